@@ -0,0 +1,132 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"main/internal/cache"
+	"main/internal/history"
+	"main/internal/segment"
+	"main/internal/user"
+)
+
+const Usage = `usage: segctl [flags] <command> [arguments]
+
+commands:
+  segment create [-ttl P30D | -rule RULE] [-group GROUP] [-description D] [-owner TEAM]
+                 [-tags A,B] [-status draft|active|paused|archived] [-parent PARENT] SLUG
+                                             create a segment, optionally with its default ttl
+                                             or as a dynamic one with the rule over the user attributes,
+                                             in an exclusion group and as a child of the parent segment
+  segment group (SLUG GROUP | -clear SLUG)   move a segment to an exclusion group or remove it from its group
+  segment update [-description D] [-owner TEAM] [-tags A,B] [-status STATUS] [-parent PARENT] SLUG
+                                             change the metadata, the status or the parent of a segment,
+                                             an empty value clears the description, the owner, the tags
+                                             or the parent
+  segment rename SLUG NEW_SLUG               rename a segment, the old slug stays as a deprecated alias
+  segment delete SLUG                        delete a segment
+  segment list [-tag TAG] [-owner TEAM] [-status STATUS]
+                                             list the segments
+  user add -segments A,B [-ttl PT12H | -ttl-days N | -expires-at RFC3339] [-swap] (-id N | -csv FILE)
+                                             add users to segments, -swap removes them from the other
+                                             segments of the exclusion groups instead of failing
+  user remove -segments A,B (-id N | -csv FILE)
+                                             remove users from segments
+  ttl-cleanup                                delete the expired memberships once
+  rule-sync                                  sync the members of the dynamic segments with their rules once
+  report -date "2006-01-02 15:04" [-o FILE]  write the history report since the date to stdout or a file
+  cache rebuild                              cache the active segments of all users again
+
+The flags before the command are the same as the flags of the web app, see segctl -h.
+A csv file of users has the user ids in its first column and may start with a header.`
+
+// ErrUsage is returned when the command or its arguments are wrong.
+var ErrUsage = errors.New("invalid usage")
+
+// Deps are the repositories the commands work with and the output for their results.
+type Deps struct {
+	Users    user.Repository
+	Segments segment.Repository
+	History  history.Repository
+	Cache    cache.Repository
+	Out      io.Writer
+}
+
+// Run runs the command from args, e.g. ["segment", "create", "AVITO_VOICE_MESSAGES"].
+func Run(ctx context.Context, d *Deps, args []string) error {
+	if len(args) == 0 {
+		return ErrUsage
+	}
+
+	switch args[0] {
+	case "segment":
+		return runSegment(ctx, d, args[1:])
+	case "user":
+		return runUser(ctx, d, args[1:])
+	case "ttl-cleanup":
+		if len(args) != 1 {
+			return ErrUsage
+		}
+		return ttlCleanup(ctx, d)
+	case "rule-sync":
+		if len(args) != 1 {
+			return ErrUsage
+		}
+		return ruleSync(ctx, d)
+	case "report":
+		return report(ctx, d, args[1:])
+	case "cache":
+		if len(args) != 2 || args[1] != "rebuild" {
+			return ErrUsage
+		}
+		return rebuildCache(ctx, d)
+	}
+	return ErrUsage
+}
+
+// newFlagSet creates a flag set of a command which reports errors instead of printing them.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return fs
+}
+
+// parse parses the flags of a command and checks the number of positional arguments.
+func parse(fs *flag.FlagSet, args []string, nargs int) error {
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("%w: %s", ErrUsage, err)
+	}
+	if fs.NArg() != nargs {
+		return ErrUsage
+	}
+	return nil
+}
+
+func ttlCleanup(ctx context.Context, d *Deps) error {
+	n, err := d.Users.DeleteExpired(ctx, d.History)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(d.Out, "deleted %d expired memberships\n", n)
+	return nil
+}
+
+func ruleSync(ctx context.Context, d *Deps) error {
+	n, err := d.Users.SyncRuleSegments(ctx, d.History)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(d.Out, "changed %d memberships in dynamic segments\n", n)
+	return nil
+}
+
+func rebuildCache(ctx context.Context, d *Deps) error {
+	n, err := d.Cache.RefreshCache(ctx, d.Users)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(d.Out, "cached segments of %d users\n", n)
+	return nil
+}
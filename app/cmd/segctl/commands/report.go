@@ -0,0 +1,46 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"main/internal/reportcsv"
+	"os"
+	"time"
+)
+
+func report(ctx context.Context, d *Deps, args []string) error {
+	fs := newFlagSet("report")
+	date := fs.String("date", "", `start of the report, "2006-01-02 15:04"`)
+	out := fs.String("o", "", "file to write the report to instead of stdout")
+	if err := parse(fs, args, 0); err != nil {
+		return err
+	}
+
+	from, err := time.Parse("2006-01-02 15:04", *date)
+	if err != nil {
+		return fmt.Errorf("%w: invalid date %q", ErrUsage, *date)
+	}
+
+	story, err := d.History.GetFromDate(ctx, from)
+	if err != nil {
+		return err
+	}
+
+	if *out == "" {
+		return reportcsv.WriteReport(d.Out, story)
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err = reportcsv.WriteReport(f, story); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(d.Out, "written %d records to %s\n", len(story), *out)
+	return nil
+}
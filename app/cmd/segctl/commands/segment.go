@@ -0,0 +1,207 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"main/internal/cache"
+	"main/internal/segment"
+	"strings"
+	"text/tabwriter"
+)
+
+func runSegment(ctx context.Context, d *Deps, args []string) error {
+	if len(args) == 0 {
+		return ErrUsage
+	}
+
+	switch args[0] {
+	case "create":
+		fs := newFlagSet("segment create")
+		ttl := fs.String("ttl", "", "default ttl of the memberships, ISO-8601 duration")
+		rule := fs.String("rule", "", "rule of a dynamic segment over the user attributes")
+		group := fs.String("group", "", "exclusion group of the segment")
+		description := fs.String("description", "", "description of the segment")
+		owner := fs.String("owner", "", "team owning the segment")
+		tags := fs.String("tags", "", "comma separated tags of the segment")
+		status := fs.String("status", "", "draft, active, paused or archived, active by default")
+		parent := fs.String("parent", "", "parent segment, its members include the members of the segment")
+		if err := parse(fs, args[1:], 1); err != nil {
+			return err
+		}
+		dto := segment.SegmentDto{Slug: fs.Arg(0)}
+		if *ttl != "" {
+			dto.DefaultTtl = ttl
+		}
+		if *rule != "" {
+			dto.Rule = rule
+		}
+		if *group != "" {
+			dto.ExclusionGroup = group
+		}
+		if *parent != "" {
+			dto.Parent = parent
+		}
+		if *description != "" {
+			dto.Description = description
+		}
+		if *owner != "" {
+			dto.Owner = owner
+		}
+		if *tags != "" {
+			dto.Tags = splitTags(*tags)
+		}
+		dto.Status = *status
+		if !dto.Valid() {
+			return fmt.Errorf("%w: segment not valid", ErrUsage)
+		}
+		if err := d.Segments.Create(ctx, segment.NewSegment(&dto)); err != nil {
+			return err
+		}
+		fmt.Fprintf(d.Out, "created segment %s\n", dto.Slug)
+	case "group":
+		fs := newFlagSet("segment group")
+		clear := fs.Bool("clear", false, "remove the segment from its exclusion group")
+		if err := fs.Parse(args[1:]); err != nil {
+			return fmt.Errorf("%w: %s", ErrUsage, err)
+		}
+		dto := segment.SegmentPatchDto{Slug: fs.Arg(0), ClearExclusionGroup: *clear}
+		if fs.NArg() == 2 {
+			group := fs.Arg(1)
+			dto.ExclusionGroup = &group
+		}
+		if fs.NArg() > 2 || (dto.ExclusionGroup == nil && !*clear) || !dto.Valid() {
+			return ErrUsage
+		}
+		if _, err := d.Segments.Update(ctx, dto.Slug, dto.Patch()); err != nil {
+			return err
+		}
+		if dto.ExclusionGroup != nil {
+			fmt.Fprintf(d.Out, "moved segment %s to exclusion group %s\n", dto.Slug, *dto.ExclusionGroup)
+		} else {
+			fmt.Fprintf(d.Out, "removed segment %s from its exclusion group\n", dto.Slug)
+		}
+	case "update":
+		fs := newFlagSet("segment update")
+		ttl := fs.String("ttl", "", "default ttl of the new memberships, ISO-8601 duration, empty to clear it")
+		description := fs.String("description", "", "description of the segment, empty to clear it")
+		owner := fs.String("owner", "", "team owning the segment, empty to clear it")
+		tags := fs.String("tags", "", "comma separated tags replacing the current ones, empty to clear them")
+		status := fs.String("status", "", "draft, active, paused or archived")
+		parent := fs.String("parent", "", "parent segment, empty to make the segment a root")
+		if err := parse(fs, args[1:], 1); err != nil {
+			return err
+		}
+		// Only the flags which are set change the segment
+		dto := segment.SegmentPatchDto{Slug: fs.Arg(0)}
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "ttl":
+				if *ttl == "" {
+					dto.ClearDefaultTtl = true
+				} else {
+					dto.DefaultTtl = ttl
+				}
+			case "description":
+				dto.Description = description
+			case "owner":
+				dto.Owner = owner
+			case "tags":
+				dto.Tags = splitTags(*tags)
+			case "status":
+				dto.Status = status
+			case "parent":
+				dto.Parent = parent
+			}
+		})
+		if !dto.Valid() {
+			return fmt.Errorf("%w: segment update not valid", ErrUsage)
+		}
+		s, err := d.Segments.Update(ctx, dto.Slug, dto.Patch())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(d.Out, "updated segment %s, status %s\n", s.Slug, s.Status)
+		if dto.Status != nil {
+			if err = cache.DropSegmentMembers(ctx, d.Cache, d.Segments, s.Id); err != nil {
+				fmt.Fprintf(d.Out, "failed to drop cached segments of members: %s\n", err)
+			}
+		}
+	case "rename":
+		if len(args) != 3 || args[1] == "" || args[2] == "" {
+			return ErrUsage
+		}
+		s, err := d.Segments.Rename(ctx, args[1], args[2])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(d.Out, "renamed segment %s to %s, the old slug stays as a deprecated alias\n", args[1], s.Slug)
+		if err = cache.DropSegmentMembers(ctx, d.Cache, d.Segments, s.Id); err != nil {
+			fmt.Fprintf(d.Out, "failed to drop cached segments of members: %s\n", err)
+		}
+	case "delete":
+		if len(args) != 2 || args[1] == "" {
+			return ErrUsage
+		}
+		if err := d.Segments.Delete(ctx, args[1]); err != nil {
+			return err
+		}
+		fmt.Fprintf(d.Out, "deleted segment %s\n", args[1])
+	case "list":
+		fs := newFlagSet("segment list")
+		tag := fs.String("tag", "", "list only the segments with the tag")
+		owner := fs.String("owner", "", "list only the segments of the team")
+		status := fs.String("status", "", "list only the segments with the status")
+		if err := parse(fs, args[1:], 0); err != nil {
+			return err
+		}
+		if *status != "" && !segment.ValidStatus(*status) {
+			return fmt.Errorf("%w: status not valid", ErrUsage)
+		}
+		segments, err := d.Segments.FindAll(ctx, segment.Filter{Tag: *tag, Owner: *owner, Status: *status})
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(d.Out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tSLUG\tSTATUS\tOWNER\tTAGS\tDEFAULT TTL\tGROUP\tPARENT\tRULE")
+		for _, s := range segments {
+			owner := "-"
+			if s.Owner != nil {
+				owner = *s.Owner
+			}
+			tags := "-"
+			if len(s.Tags) > 0 {
+				tags = strings.Join(s.Tags, ",")
+			}
+			ttl := "-"
+			if s.DefaultTtl != nil {
+				ttl = *s.DefaultTtl
+			}
+			group := "-"
+			if s.ExclusionGroup != nil {
+				group = *s.ExclusionGroup
+			}
+			parent := "-"
+			if s.Parent != nil {
+				parent = *s.Parent
+			}
+			rule := "-"
+			if s.Rule != nil {
+				rule = *s.Rule
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", s.Id, s.Slug, s.Status, owner, tags, ttl, group, parent, rule)
+		}
+		return w.Flush()
+	default:
+		return ErrUsage
+	}
+	return nil
+}
+
+// splitTags splits the comma separated tags, an empty string is no tags.
+func splitTags(tags string) []string {
+	if tags == "" {
+		return []string{}
+	}
+	return strings.Split(tags, ",")
+}
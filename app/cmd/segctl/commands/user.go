@@ -0,0 +1,160 @@
+package commands
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"main/internal/cache"
+	"main/internal/user"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func runUser(ctx context.Context, d *Deps, args []string) error {
+	if len(args) == 0 || (args[0] != "add" && args[0] != "remove") {
+		return ErrUsage
+	}
+	add := args[0] == "add"
+
+	fs := newFlagSet("user " + args[0])
+	segments := fs.String("segments", "", "comma separated slugs of the segments")
+	id := fs.Int("id", 0, "id of the user")
+	csvPath := fs.String("csv", "", "csv file with the ids of the users in the first column")
+	var ttl, ttlDays, expiresAt *string
+	var swap *bool
+	if add {
+		swap = fs.Bool("swap", false, "remove the users from the other segments of the exclusion groups")
+		ttl = fs.String("ttl", "", "lifetime of the memberships, ISO-8601 duration")
+		ttlDays = fs.String("ttl-days", "", "lifetime of the memberships in days")
+		expiresAt = fs.String("expires-at", "", "moment the memberships expire at, RFC 3339")
+	}
+	if err := parse(fs, args[1:], 0); err != nil {
+		return err
+	}
+	if *segments == "" || (*id == 0) == (*csvPath == "") {
+		return ErrUsage
+	}
+
+	dto := user.SegmentsAddDelDto{SegmentsAdd: []user.SegmentAdd{}, SegmentsDel: []string{}}
+	for _, slug := range strings.Split(*segments, ",") {
+		slug = strings.TrimSpace(slug)
+		if add {
+			dto.SegmentsAdd = append(dto.SegmentsAdd, user.SegmentAdd{Slug: slug})
+		} else {
+			dto.SegmentsDel = append(dto.SegmentsDel, slug)
+		}
+	}
+	if add {
+		if err := setExpiry(&dto, *ttl, *ttlDays, *expiresAt); err != nil {
+			return err
+		}
+		if *swap {
+			dto.OnConflict = user.OnConflictSwap
+		}
+	}
+
+	ids := []int{*id}
+	if *csvPath != "" {
+		var err error
+		if ids, err = readUserIds(*csvPath); err != nil {
+			return err
+		}
+	}
+
+	return applyToUsers(ctx, d, dto, ids)
+}
+
+// setExpiry sets the lifetime of the added memberships from the flags which are not empty.
+func setExpiry(dto *user.SegmentsAddDelDto, ttl, ttlDays, expiresAt string) error {
+	if ttl != "" {
+		dto.Ttl = &ttl
+	}
+	if ttlDays != "" {
+		days, err := strconv.Atoi(ttlDays)
+		if err != nil {
+			return fmt.Errorf("%w: invalid ttl-days %q", ErrUsage, ttlDays)
+		}
+		dto.TtlDays = &days
+	}
+	if expiresAt != "" {
+		t, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return fmt.Errorf("%w: invalid expires-at %q", ErrUsage, expiresAt)
+		}
+		dto.ExpiresAt = &t
+	}
+	return nil
+}
+
+// readUserIds reads the ids of the users from the first column of the csv file.
+// The first row is skipped if it is not a number, so that the file may have a header.
+func readUserIds(path string) ([]int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	ids := make([]int, 0)
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		value := strings.TrimSpace(record[0])
+		if value == "" {
+			continue
+		}
+		id, err := strconv.Atoi(value)
+		if err != nil && line == 1 {
+			continue
+		}
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("%s:%d: invalid user id %q", path, line, value)
+		}
+		ids = append(ids, id)
+	}
+
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("%s: no user ids", path)
+	}
+	return ids, nil
+}
+
+// applyToUsers adds or removes each of the users the same way as the API does.
+// A failure of one user does not stop the others, the failed users are listed in the output.
+// The cached segments of the changed users are dropped, so that the changes are visible immediately.
+func applyToUsers(ctx context.Context, d *Deps, dto user.SegmentsAddDelDto, ids []int) error {
+	failed := 0
+	for _, id := range ids {
+		dto.UserId = id
+		if !dto.Valid() {
+			return fmt.Errorf("%w: request not valid", ErrUsage)
+		}
+
+		if err := d.Users.AddDelSegments(ctx, &dto, d.History); err != nil {
+			failed++
+			fmt.Fprintf(d.Out, "user %d: %s\n", id, err)
+			continue
+		}
+		if err := d.Cache.Del(ctx, cache.UserSegmentsKey(id)); err != nil {
+			fmt.Fprintf(d.Out, "user %d: failed to drop cached segments: %s\n", id, err)
+		}
+	}
+
+	fmt.Fprintf(d.Out, "updated %d of %d users\n", len(ids)-failed, len(ids))
+	if failed > 0 {
+		return fmt.Errorf("failed to update %d users", failed)
+	}
+	return nil
+}
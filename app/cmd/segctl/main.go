@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"main/cmd/segctl/commands"
+	"main/internal/cache"
+	"main/internal/config"
+	"main/internal/history"
+	"main/internal/segment"
+	"main/internal/user"
+	"main/pkg"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// segctl is the administrative CLI, it works with the same database and cache as the web app
+// and is configured the same way.
+func main() {
+	os.Exit(run())
+}
+
+// run runs the command and returns the exit code of the process.
+func run() int {
+	cfg, args, err := config.Parse(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Println(commands.Usage)
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, commands.Usage)
+		return 2
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	psqlClient, err := pkg.NewPsqlClient(ctx, cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to create db client:", err)
+		return 1
+	}
+	defer psqlClient.Close()
+
+	redisClient, err := pkg.NewRedisClient(ctx, cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to create redis client:", err)
+		return 1
+	}
+	defer redisClient.Close()
+
+	d := &commands.Deps{
+		Users:    user.NewRepo(psqlClient),
+		Segments: segment.NewRepo(psqlClient),
+		History:  history.NewRepo(psqlClient),
+		Cache:    cache.NewRepo(redisClient, cfg.CacheCfg.UserSegmentsTtl),
+		Out:      os.Stdout,
+	}
+
+	err = commands.Run(ctx, d, args)
+	if errors.Is(err, commands.ErrUsage) {
+		fmt.Fprintf(os.Stderr, "%s\n\n%s\n", err, commands.Usage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
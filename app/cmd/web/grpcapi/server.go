@@ -0,0 +1,117 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"log/slog"
+	"main/cmd/web/handlers"
+	"main/internal/e"
+	"main/internal/logger"
+	"main/internal/metrics"
+	"main/pkg/pb"
+	"time"
+)
+
+// NewGrpcServer creates the gRPC server with the segment service, the health service and,
+// if enabled, the reflection service. The segment service shares the rate limits with the REST routes.
+func NewGrpcServer(s *Server, limits *handlers.RateLimits, withReflection bool) (*grpc.Server, *health.Server) {
+	limiter := limits.NewLimiter()
+	srv := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(
+			otelgrpc.UnaryServerInterceptor(),
+			func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, next grpc.UnaryHandler) (interface{}, error) {
+				if !isSegmentService(info.FullMethod) {
+					return next(ctx, req)
+				}
+				start := time.Now()
+				ctx = logger.WithRequestId(ctx, handlers.UniqueKey())
+				if !limiter.Allow() {
+					metrics.RateLimited.Inc()
+					return nil, status.Error(codes.ResourceExhausted, "rate limit exceeded")
+				}
+				resp, err := next(ctx, req)
+				logCall(ctx, info.FullMethod, start, err)
+				return resp, err
+			},
+		),
+		grpc.ChainStreamInterceptor(
+			otelgrpc.StreamServerInterceptor(),
+			func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, next grpc.StreamHandler) error {
+				if !isSegmentService(info.FullMethod) {
+					return next(srv, ss)
+				}
+				start := time.Now()
+				if !limiter.Allow() {
+					metrics.RateLimited.Inc()
+					return status.Error(codes.ResourceExhausted, "rate limit exceeded")
+				}
+				err := next(srv, ss)
+				logCall(ss.Context(), info.FullMethod, start, err)
+				return err
+			},
+		),
+	)
+
+	pb.RegisterSegmentServiceServer(srv, s)
+
+	healthSrv := health.NewServer()
+	healthSrv.SetServingStatus(pb.SegmentService_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(srv, healthSrv)
+
+	if withReflection {
+		reflection.Register(srv)
+	}
+	return srv, healthSrv
+}
+
+func isSegmentService(method string) bool {
+	prefix := "/" + pb.SegmentService_ServiceDesc.ServiceName + "/"
+	return len(method) > len(prefix) && method[:len(prefix)] == prefix
+}
+
+// logCall writes the access log line of the call.
+func logCall(ctx context.Context, method string, start time.Time, err error) {
+	slog.InfoContext(ctx, "grpc call handled",
+		"method", method,
+		"code", status.Code(err).String(),
+		"duration", time.Since(start),
+	)
+}
+
+// toStatus converts the error of a repository into the status of the call.
+// Unexpected errors are logged and hidden from the client.
+func toStatus(ctx context.Context, err error) error {
+	var dse *e.DuplicateSegmentError
+	var notFound *e.SegmentsNotFoundError
+	var parentNotFound *e.ParentNotFoundError
+	var membership *e.MembershipNotFoundError
+	var ruleSegment *e.RuleSegmentError
+	var inExperiment *e.SegmentInExperimentError
+	var exclusionConflict *e.ExclusionConflictError
+	var archived *e.ArchivedSegmentError
+	var hasChildren *e.SegmentHasChildrenError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &dse):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.As(err, &notFound), errors.As(err, &parentNotFound):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.As(err, &membership):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.As(err, &ruleSegment), errors.As(err, &inExperiment), errors.As(err, &exclusionConflict),
+		errors.As(err, &archived), errors.As(err, &hasChildren):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	}
+	slog.ErrorContext(ctx, "failed to handle grpc call", "err", err)
+	return status.Error(codes.Internal, "internal error")
+}
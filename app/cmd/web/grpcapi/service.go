@@ -0,0 +1,282 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"io"
+	"main/cmd/web/handlers"
+	"main/internal/cache"
+	"main/internal/config"
+	"main/internal/history"
+	"main/internal/segment"
+	"main/internal/user"
+	"main/pkg/pb"
+	"math"
+	"time"
+)
+
+// Server implements the segment service with the same repositories as the REST handlers.
+type Server struct {
+	pb.UnimplementedSegmentServiceServer
+
+	segmentRepo segment.Repository
+	userRepo    user.Repository
+	historyRepo history.Repository
+	rdb         cache.Repository
+	cfg         *config.Config
+}
+
+func NewServer(segmentRepo segment.Repository, userRepo user.Repository, historyRepo history.Repository, rdb cache.Repository, cfg *config.Config) *Server {
+	return &Server{
+		segmentRepo: segmentRepo,
+		userRepo:    userRepo,
+		historyRepo: historyRepo,
+		rdb:         rdb,
+		cfg:         cfg,
+	}
+}
+
+func (s *Server) CreateSegment(ctx context.Context, req *pb.CreateSegmentRequest) (*emptypb.Empty, error) {
+	dto := segment.SegmentDto{Slug: req.Slug}
+	if req.DefaultTtl != "" {
+		dto.DefaultTtl = &req.DefaultTtl
+	}
+	if req.Rule != "" {
+		dto.Rule = &req.Rule
+	}
+	if req.ExclusionGroup != "" {
+		dto.ExclusionGroup = &req.ExclusionGroup
+	}
+	if req.Parent != "" {
+		dto.Parent = &req.Parent
+	}
+	if req.Description != "" {
+		dto.Description = &req.Description
+	}
+	if req.Owner != "" {
+		dto.Owner = &req.Owner
+	}
+	dto.Tags, dto.Status = req.Tags, req.Status
+	if !dto.Valid() {
+		return nil, status.Error(codes.InvalidArgument, "segment not valid")
+	}
+
+	if err := s.segmentRepo.Create(ctx, segment.NewSegment(&dto)); err != nil {
+		return nil, toStatus(ctx, err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (s *Server) DeleteSegment(ctx context.Context, req *pb.DeleteSegmentRequest) (*emptypb.Empty, error) {
+	if req.Slug == "" {
+		return nil, status.Error(codes.InvalidArgument, "segment not valid")
+	}
+	if err := s.segmentRepo.Delete(ctx, req.Slug); err != nil {
+		return nil, toStatus(ctx, err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (s *Server) ListSegments(ctx context.Context, req *pb.ListSegmentsRequest) (*pb.ListSegmentsResponse, error) {
+	if req.Status != "" && !segment.ValidStatus(req.Status) {
+		return nil, status.Error(codes.InvalidArgument, "status not valid")
+	}
+	segments, err := s.segmentRepo.FindAll(ctx, segment.Filter{Tag: req.Tag, Owner: req.Owner, Status: req.Status})
+	if err != nil {
+		return nil, toStatus(ctx, err)
+	}
+
+	resp := &pb.ListSegmentsResponse{Segments: make([]*pb.Segment, 0, len(segments))}
+	for _, seg := range segments {
+		ps := &pb.Segment{
+			Slug:      seg.Slug,
+			Tags:      seg.Tags,
+			Status:    seg.Status,
+			CreatedAt: timestamppb.New(seg.CreatedAt),
+			UpdatedAt: timestamppb.New(seg.UpdatedAt),
+		}
+		if seg.DefaultTtl != nil {
+			ps.DefaultTtl = *seg.DefaultTtl
+		}
+		if seg.Rule != nil {
+			ps.Rule = *seg.Rule
+		}
+		if seg.ExclusionGroup != nil {
+			ps.ExclusionGroup = *seg.ExclusionGroup
+		}
+		if seg.Parent != nil {
+			ps.Parent = *seg.Parent
+		}
+		if seg.Description != nil {
+			ps.Description = *seg.Description
+		}
+		if seg.Owner != nil {
+			ps.Owner = *seg.Owner
+		}
+		resp.Segments = append(resp.Segments, ps)
+	}
+	return resp, nil
+}
+
+func (s *Server) GetUserSegments(ctx context.Context, req *pb.GetUserSegmentsRequest) (*pb.UserSegments, error) {
+	id, ok := userId(req.UserId)
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "user id not valid")
+	}
+
+	us, err := handlers.ActiveSegments(ctx, s.rdb, s.userRepo, id)
+	if err == nil && us != nil && req.Effective {
+		err = handlers.AddInherited(ctx, s.userRepo, us)
+	}
+	if err != nil {
+		return nil, toStatus(ctx, err)
+	}
+
+	resp := &pb.UserSegments{UserId: req.UserId, Segments: make([]*pb.UserSegment, 0)}
+	if us == nil {
+		return resp, nil
+	}
+	for _, seg := range us.Segments {
+		ps := &pb.UserSegment{Slug: seg.Slug}
+		if seg.AddedAt != nil {
+			ps.AddedAt = timestamppb.New(*seg.AddedAt)
+		}
+		if seg.AliveUntil != nil {
+			ps.AliveUntil = timestamppb.New(*seg.AliveUntil)
+		}
+		if seg.InheritedFrom != nil {
+			ps.InheritedFrom = *seg.InheritedFrom
+		}
+		resp.Segments = append(resp.Segments, ps)
+	}
+	return resp, nil
+}
+
+func (s *Server) ModifyUserSegments(ctx context.Context, req *pb.ModifyUserSegmentsRequest) (*emptypb.Empty, error) {
+	if err := s.modify(ctx, req); err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (s *Server) BulkModifyUserSegments(stream pb.SegmentService_BulkModifyUserSegmentsServer) error {
+	ctx := stream.Context()
+	resp := &pb.BulkModifyUserSegmentsResponse{}
+	for i := int32(0); ; i++ {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return stream.SendAndClose(resp)
+		}
+		if err != nil {
+			return err
+		}
+
+		if err = s.modify(ctx, req); err != nil {
+			st := status.Convert(err)
+			resp.Failures = append(resp.Failures, &pb.BulkModifyUserSegmentsResponse_Failure{
+				Index:   i,
+				UserId:  req.UserId,
+				Code:    st.Code().String(),
+				Message: st.Message(),
+			})
+			continue
+		}
+		resp.Modified++
+	}
+}
+
+// modify adds and removes the segments of the user the same way as the REST API does.
+func (s *Server) modify(ctx context.Context, req *pb.ModifyUserSegmentsRequest) error {
+	id, ok := userId(req.UserId)
+	if !ok {
+		return status.Error(codes.InvalidArgument, "user id not valid")
+	}
+
+	dto := &user.SegmentsAddDelDto{
+		UserId:      id,
+		SegmentsAdd: make([]user.SegmentAdd, 0, len(req.Add)),
+		SegmentsDel: make([]string, 0, len(req.Del)),
+	}
+	dto.ExpiresAt, dto.Ttl, dto.TtlDays = expiry(req.Expiry)
+	for _, add := range req.Add {
+		a := user.SegmentAdd{Slug: add.Slug}
+		a.ExpiresAt, a.Ttl, a.TtlDays = expiry(add.Expiry)
+		dto.SegmentsAdd = append(dto.SegmentsAdd, a)
+	}
+	dto.SegmentsDel = append(dto.SegmentsDel, req.Del...)
+	if req.Swap {
+		dto.OnConflict = user.OnConflictSwap
+	}
+	if !dto.Valid() {
+		return status.Error(codes.InvalidArgument, "request not valid")
+	}
+
+	return toStatus(ctx, s.userRepo.AddDelSegments(ctx, dto, s.historyRepo))
+}
+
+func (s *Server) StartReport(ctx context.Context, req *pb.StartReportRequest) (*pb.Report, error) {
+	if req.From == nil || !req.From.IsValid() {
+		return nil, status.Error(codes.InvalidArgument, "from not valid")
+	}
+
+	// The REST API takes the date with minute precision in UTC, so does this one
+	from := req.From.AsTime().UTC().Truncate(time.Minute)
+	taskId, err := handlers.StartReport(ctx, s.rdb, s.historyRepo, s.cfg, from)
+	if err != nil {
+		return nil, toStatus(ctx, err)
+	}
+	return &pb.Report{TaskId: taskId, Status: pb.Report_STATUS_PROGRESS}, nil
+}
+
+func (s *Server) GetReport(ctx context.Context, req *pb.GetReportRequest) (*pb.Report, error) {
+	if req.TaskId == "" {
+		return nil, status.Error(codes.InvalidArgument, "task id not valid")
+	}
+
+	report, err := handlers.GetReport(ctx, s.rdb, req.TaskId)
+	if errors.Is(err, redis.Nil) {
+		return nil, status.Error(codes.NotFound, "report not found")
+	}
+	if err != nil {
+		return nil, toStatus(ctx, err)
+	}
+
+	resp := &pb.Report{TaskId: req.TaskId, LinkToFile: report.LinkToFile}
+	switch report.Status {
+	case "progress":
+		resp.Status = pb.Report_STATUS_PROGRESS
+	case "success":
+		resp.Status = pb.Report_STATUS_SUCCESS
+	case "fail":
+		resp.Status = pb.Report_STATUS_FAIL
+	}
+	return resp, nil
+}
+
+// userId converts the id of the user from the request, it is not valid unless positive.
+func userId(id int64) (int, bool) {
+	if id <= 0 || id > math.MaxInt32 {
+		return 0, false
+	}
+	return int(id), true
+}
+
+// expiry converts the lifetime from the request into the fields of the DTOs, all of them are nil if it is not set.
+func expiry(ex *pb.Expiry) (expiresAt *time.Time, ttl *string, ttlDays *int) {
+	switch v := ex.GetValue().(type) {
+	case *pb.Expiry_ExpiresAt:
+		t := v.ExpiresAt.AsTime()
+		expiresAt = &t
+	case *pb.Expiry_Ttl:
+		ttl = &v.Ttl
+	case *pb.Expiry_TtlDays:
+		days := int(v.TtlDays)
+		ttlDays = &days
+	}
+	return expiresAt, ttl, ttlDays
+}
@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"log/slog"
+	"main/internal/e"
+	"main/internal/job"
+	"main/internal/user"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	DefaultJobRunsLimit = 50
+	MaxJobRunsLimit     = 500
+
+	DefaultDryRunLimit = 1000
+	MaxDryRunLimit     = 10000
+)
+
+// AdminToken is a middleware which lets through only the requests carrying the token
+// in the "Authorization: Bearer <token>" header. An empty token disables the routes, they respond with 403.
+func AdminToken(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token == "" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// getLimitQuery extracts the optional "limit" query parameter.
+// It returns def if the parameter is absent and an error if it is not in the range [1, max].
+func getLimitQuery(r *http.Request, def, max int) (int, error) {
+	l, ok := r.URL.Query()["limit"]
+	if !ok {
+		return def, nil
+	}
+	if len(l) != 1 {
+		return 0, errors.New("bad request")
+	}
+	limit, err := strconv.Atoi(l[0])
+	if err != nil || limit <= 0 || limit > max {
+		return 0, errors.New("bad request")
+	}
+	return limit, nil
+}
+
+// writeJson marshals v and writes it to the response.
+func writeJson(w http.ResponseWriter, r *http.Request, v interface{}) {
+	writeJsonStatus(w, r, http.StatusOK, v)
+}
+
+// writeJsonStatus marshals v and writes it to the response with the status. The status is written
+// only after v has been marshalled, so that a failure can still respond with 500.
+func writeJsonStatus(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to marshal response", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err = w.Write(data); err != nil {
+		slog.ErrorContext(r.Context(), "failed to write response", "err", err)
+	}
+}
+
+// checkJobErrors is a utility function that responds with the status code matching the scheduler error.
+// It returns false if there is no error.
+func checkJobErrors(w http.ResponseWriter, r *http.Request, err error) bool {
+	var notFound *e.JobNotFoundError
+	var running *e.JobRunningError
+	if errors.As(err, &notFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return true
+	} else if errors.As(err, &running) {
+		w.WriteHeader(http.StatusConflict)
+		return true
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "failed to handle job request", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return true
+	}
+	return false
+}
+
+// getJobRuns is a handler function responsible for retrieving the latest runs of the background jobs.
+// The runs can be filtered by the job name with the "job" query parameter.
+func getJobRuns(w http.ResponseWriter, r *http.Request, jobRepo job.Repository) {
+	name := r.URL.Query().Get("job")
+	limit, err := getLimitQuery(r, DefaultJobRunsLimit, MaxJobRunsLimit)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	runs, err := jobRepo.FindRuns(ctx, name, limit)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to get job runs", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp := job.RunsDto{Runs: make([]job.RunDto, 0, len(runs))}
+	for _, run := range runs {
+		resp.Runs = append(resp.Runs, job.NewRunDto(run))
+	}
+	writeJson(w, r, resp)
+}
+
+// Jobs is a handler function that returns the history of the background job runs.
+func Jobs(jobRepo job.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		getJobRuns(w, r, jobRepo)
+	}
+}
+
+// JobInfo is a handler function that returns the schedule and the state of the job from the "name" path variable.
+func JobInfo(scheduler *job.Scheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		info, err := scheduler.Info(r.Context(), mux.Vars(r)["name"])
+		if checkJobErrors(w, r, err) {
+			return
+		}
+		writeJson(w, r, job.NewInfoDto(info))
+	}
+}
+
+// TriggerJob is a handler function that runs the job from the "name" path variable immediately
+// and returns the finished run. If the job is being run at the moment, it responds with 409.
+func TriggerJob(scheduler *job.Scheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The run must not be interrupted if the client disconnects
+		run, err := scheduler.Trigger(context.WithoutCancel(r.Context()), mux.Vars(r)["name"])
+		if checkJobErrors(w, r, err) {
+			return
+		}
+		writeJson(w, r, job.NewRunDto(run))
+	}
+}
+
+// PauseJob is a handler function that pauses (paused = true) or resumes the scheduled runs
+// of the job from the "name" path variable on all instances.
+func PauseJob(scheduler *job.Scheduler, paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := scheduler.SetPaused(r.Context(), mux.Vars(r)["name"], paused)
+		checkJobErrors(w, r, err)
+	}
+}
+
+// DryRunTtlCleanup is a handler function that reports which memberships the TTL cleanup would delete
+// without deleting them. The optional "until" query parameter (RFC3339) sets the moment of the
+// imaginary run, by default it is now.
+func DryRunTtlCleanup(userRepo user.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		until := time.Now().UTC()
+		if u := r.URL.Query().Get("until"); u != "" {
+			t, err := time.Parse(time.RFC3339, u)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			until = t.UTC()
+		}
+		limit, err := getLimitQuery(r, DefaultDryRunLimit, MaxDryRunLimit)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		memberships, err := userRepo.FindExpired(r.Context(), until, limit)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to find expired memberships", "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		resp := user.ExpiringDto{
+			Until:       until,
+			Memberships: make([]user.MembershipDto, 0, len(memberships)),
+		}
+		for _, m := range memberships {
+			resp.Memberships = append(resp.Memberships, user.NewMembershipDto(m))
+		}
+		writeJson(w, r, resp)
+	}
+}
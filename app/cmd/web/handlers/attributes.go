@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"main/internal/cache"
+	"main/internal/e"
+	"main/internal/history"
+	"main/internal/user"
+	"net/http"
+	"strconv"
+)
+
+// getAttributes is a handler function responsible for retrieving the attributes of the user from the "id" query parameter.
+func getAttributes(w http.ResponseWriter, r *http.Request, userRepo user.Repository) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil || id <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	attrs, err := userRepo.FindAttributes(r.Context(), id)
+	var notFound *e.UserNotFoundError
+	if errors.As(err, &notFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to get user attributes", "user_id", id, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, r, user.AttributesDto{UserId: id, Attributes: attrs})
+}
+
+// updateAttributes is a handler function responsible for merging the attributes into the ones of the user.
+// The memberships of the user in the dynamic segments follow the new attributes,
+// so the cached segments of the user are dropped.
+func updateAttributes(w http.ResponseWriter, r *http.Request, userRepo user.Repository, rdb cache.Repository, historyRepo history.Repository) {
+	ctx := r.Context()
+
+	var dto user.AttributesDto
+	if err := json.NewDecoder(r.Body).Decode(&dto); err != nil || !dto.Valid() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	attrs, err := userRepo.UpsertAttributes(ctx, dto.UserId, dto.Attributes, historyRepo)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to update user attributes", "user_id", dto.UserId, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err = rdb.Del(ctx, cache.UserSegmentsKey(dto.UserId)); err != nil {
+		slog.ErrorContext(ctx, "failed to drop cached user segments", "user_id", dto.UserId, "err", err)
+	}
+	writeJson(w, r, user.AttributesDto{UserId: dto.UserId, Attributes: attrs})
+}
+
+// UserAttributes is a handler function that returns (GET) or updates (PATCH) the attributes of a user.
+func UserAttributes(userRepo user.Repository, rdb cache.Repository, historyRepo history.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			getAttributes(w, r, userRepo)
+		} else if r.Method == "PATCH" {
+			updateAttributes(w, r, userRepo, rdb, historyRepo)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"main/internal/cache"
+	"main/internal/e"
+	"main/internal/experiment"
+	"main/internal/history"
+	"main/internal/metrics"
+	"net/http"
+)
+
+// checkExperimentErrors is a utility function that responds with the status code matching the experiment error.
+// It returns false if there is no error.
+func checkExperimentErrors(w http.ResponseWriter, r *http.Request, err error) bool {
+	var experimentNotFound *e.ExperimentNotFoundError
+	var userNotFound *e.UserNotFoundError
+	var duplicateExperiment *e.DuplicateExperimentError
+	var duplicateSegment *e.DuplicateSegmentError
+	var inactive *e.InactiveExperimentError
+	var archived *e.ArchivedSegmentError
+	switch {
+	case err == nil:
+		return false
+	case errors.As(err, &experimentNotFound), errors.As(err, &userNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.As(err, &duplicateExperiment), errors.As(err, &duplicateSegment), errors.As(err, &inactive),
+		errors.As(err, &archived):
+		w.WriteHeader(http.StatusConflict)
+	default:
+		slog.ErrorContext(r.Context(), "failed to handle experiment request", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	return true
+}
+
+// createExperiment is a handler function responsible for creating an experiment with the segments of its variants.
+func createExperiment(w http.ResponseWriter, r *http.Request, experimentRepo experiment.Repository) {
+	var dto experiment.ExperimentDto
+	if err := json.NewDecoder(r.Body).Decode(&dto); err != nil || !dto.Valid() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ex := experiment.NewExperiment(&dto)
+	if checkExperimentErrors(w, r, experimentRepo.Create(r.Context(), ex)) {
+		return
+	}
+	writeJsonStatus(w, r, http.StatusCreated, experiment.NewExperimentDto(ex))
+}
+
+// getExperiments is a handler function responsible for listing the experiments.
+func getExperiments(w http.ResponseWriter, r *http.Request, experimentRepo experiment.Repository) {
+	experiments, err := experimentRepo.FindAll(r.Context())
+	if checkExperimentErrors(w, r, err) {
+		return
+	}
+
+	resp := experiment.ExperimentsDto{Experiments: make([]experiment.ExperimentDto, 0, len(experiments))}
+	for _, ex := range experiments {
+		resp.Experiments = append(resp.Experiments, experiment.NewExperimentDto(ex))
+	}
+	writeJson(w, r, resp)
+}
+
+// deleteExperiment is a handler function responsible for deleting the experiment from the "slug" query parameter.
+func deleteExperiment(w http.ResponseWriter, r *http.Request, experimentRepo experiment.Repository) {
+	slug := r.URL.Query().Get("slug")
+	if slug == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if checkExperimentErrors(w, r, experimentRepo.Delete(r.Context(), slug)) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Experiments is a handler function that creates (POST), lists (GET) or deletes (DELETE) the experiments.
+func Experiments(experimentRepo experiment.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			createExperiment(w, r, experimentRepo)
+		} else if r.Method == "GET" {
+			getExperiments(w, r, experimentRepo)
+		} else if r.Method == "DELETE" {
+			deleteExperiment(w, r, experimentRepo)
+		}
+	}
+}
+
+// Allocate is a handler function that returns the variant of the user in the experiment.
+// On the first exposure the user is added to the segment of the variant, so the cached segments of the user are dropped.
+func Allocate(experimentRepo experiment.Repository, rdb cache.Repository, historyRepo history.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		var dto experiment.AllocateDto
+		if err := json.NewDecoder(r.Body).Decode(&dto); err != nil || !dto.Valid() {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		allocation, err := experimentRepo.Allocate(ctx, dto.Experiment, dto.UserId, historyRepo)
+		if checkExperimentErrors(w, r, err) {
+			return
+		}
+
+		if allocation.FirstExposure {
+			metrics.ExperimentExposures.WithLabelValues(allocation.Experiment, allocation.Variant).Inc()
+			if err = rdb.Del(ctx, cache.UserSegmentsKey(dto.UserId)); err != nil {
+				slog.ErrorContext(ctx, "failed to drop cached user segments", "user_id", dto.UserId, "err", err)
+			}
+		}
+		writeJson(w, r, experiment.NewAllocationDto(allocation))
+	}
+}
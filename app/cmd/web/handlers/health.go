@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"context"
+	"main/internal/health"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Liveness is a handler function that reports that the process is alive.
+func Liveness() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, r, health.Report{Status: health.StatusOk, Checks: map[string]health.CheckResult{}})
+	}
+}
+
+// Readiness is a handler function that reports the status of every dependency of the application.
+// It responds with 503 while the application is starting or if any of the checks fails.
+func Readiness(checker *health.Checker, timeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		status := http.StatusOK
+		report := checker.Check(ctx)
+		if !report.Ok() {
+			status = http.StatusServiceUnavailable
+		}
+		writeJsonStatus(w, r, status, report)
+	}
+}
+
+// Deferred is an http.Handler which responds with 503 until the actual handler is set.
+// It allows the web server to answer health checks while the application is still starting.
+type Deferred struct {
+	handler atomic.Pointer[http.Handler]
+}
+
+// Set sets the handler serving the requests from now on.
+func (d *Deferred) Set(h http.Handler) {
+	d.handler.Store(&h)
+}
+
+func (d *Deferred) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h := d.handler.Load()
+	if h == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	(*h).ServeHTTP(w, r)
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"log/slog"
+	"main/internal/logger"
+	"net/http"
+	"time"
+	"unicode"
+)
+
+const (
+	RequestIdHeader = "X-Request-ID"
+	maxRequestIdLen = 128
+)
+
+// validRequestId reports whether the request ID sent by the client can be written to the logs as is.
+func validRequestId(id string) bool {
+	if id == "" || len(id) > maxRequestIdLen {
+		return false
+	}
+	for _, r := range id {
+		if r > unicode.MaxASCII || !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// RequestId is a middleware function that takes the request ID from the X-Request-ID header
+// or generates a new one, echoes it in the response and attaches it to the logs of the request.
+// When the request is handled, it is logged with its status and duration.
+func RequestId(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIdHeader)
+		if !validRequestId(id) {
+			id = UniqueKey()
+		}
+		w.Header().Set(RequestIdHeader, id)
+
+		ctx := logger.WithRequestId(r.Context(), id)
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		// Probes come every few seconds and would flood the logs
+		level := slog.LevelInfo
+		switch r.URL.Path {
+		case "/healthz", "/readyz", "/metrics":
+			level = slog.LevelDebug
+		}
+		slog.Log(ctx, level, "request handled",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"duration", time.Since(start),
+		)
+	})
+}
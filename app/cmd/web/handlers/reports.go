@@ -5,15 +5,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"main/internal/cache"
 	"main/internal/config"
 	"main/internal/history"
+	"main/internal/metrics"
 	"main/internal/reportcsv"
+	"main/internal/tracing"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -21,6 +24,25 @@ var (
 	TaskPrefix = "report_task_"
 )
 
+// reports tracks the report generations running in the background, so they can be waited for on shutdown.
+var reports sync.WaitGroup
+
+// WaitReports waits until all running report generations finish or ctx is done.
+func WaitReports(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		reports.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 type Report struct {
 	Status     string `json:"status"`
 	LinkToFile string `json:"link_to_file"`
@@ -41,16 +63,10 @@ func genReport(ctx context.Context, historyRepo history.Repository, date time.Ti
 	return nil
 }
 
-// launchGenReport is an HTTP handler function that initiates the process of generating a report.
-// Upon receiving the request, the function starts a new goroutine to generate the report.
+// StartReport creates the task of the report since the date and starts generating the report
+// in a new goroutine. It returns the id of the task.
 // When the report generation is complete, the task status is updated to "success" in the redis.
-func launchGenReport(w http.ResponseWriter, r *http.Request, rdb cache.Repository, historyRepo history.Repository, cfg *config.Config) {
-	date, err := GetDateQuery(r.URL.Query())
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
+func StartReport(ctx context.Context, rdb cache.Repository, historyRepo history.Repository, cfg *config.Config, date time.Time) (string, error) {
 	// Create task and set "progress" status
 	taskId := UniqueKey()
 	ttl := 5 * time.Hour
@@ -58,39 +74,48 @@ func launchGenReport(w http.ResponseWriter, r *http.Request, rdb cache.Repositor
 	report := Report{Status: "progress"}
 	b, err := json.Marshal(report)
 	if err != nil {
-		log.Println("Error marshal report:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return "", err
 	}
 
-	res := rdb.Set(context.Background(), taskKey, b, ttl)
+	res := rdb.Set(ctx, taskKey, b, ttl)
 	if res != nil && res.Err() != nil {
-		log.Println("Error to set task in redis:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return "", fmt.Errorf("set report task %s: %w", taskId, res.Err())
 	}
 
+	reports.Add(1)
 	go func() {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer reports.Done()
+
+		// The report is generated after the response is sent, so the request must not cancel it
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Minute)
 		defer cancel()
+		ctx, span := tracing.Tracer.Start(ctx, "generate report")
+		defer span.End()
+
+		start := time.Now()
+		if err := genReport(ctx, historyRepo, date, taskId); err != nil {
+			metrics.ReportGenerations.WithLabelValues(metrics.OutcomeFail).Inc()
+			metrics.ReportGenerationDuration.WithLabelValues(metrics.OutcomeFail).Observe(time.Since(start).Seconds())
 
-		if err = genReport(ctx, historyRepo, date, taskId); err != nil {
 			// If we could not get data from the database, then set the status to "fail"
-			log.Println("error to get history:", err)
+			slog.ErrorContext(ctx, "failed to generate report", "task_id", taskId, "err", err)
 			reportBytes, err := json.Marshal(Report{Status: "fail"})
 			if err != nil {
-				log.Println("Error to marshal data:", err)
+				slog.ErrorContext(ctx, "failed to marshal report", "err", err)
 				return
 			}
 
-			res = rdb.Set(ctx, taskKey, reportBytes, ttl)
+			res := rdb.Set(ctx, taskKey, reportBytes, ttl)
 			if res != nil && res.Err() != nil {
-				log.Println("Error to set task in redis:", err)
+				slog.ErrorContext(ctx, "failed to set report task", "task_id", taskId, "err", res.Err())
 				return
 			}
 			return
 		}
 
+		metrics.ReportGenerations.WithLabelValues(metrics.OutcomeSuccess).Inc()
+		metrics.ReportGenerationDuration.WithLabelValues(metrics.OutcomeSuccess).Observe(time.Since(start).Seconds())
+
 		linkToFile := fmt.Sprintf(
 			"%s://%s:%s/download?id=%s",
 			cfg.AppCfg.Scheme,
@@ -99,42 +124,69 @@ func launchGenReport(w http.ResponseWriter, r *http.Request, rdb cache.Repositor
 			taskId,
 		)
 
-		report = Report{
+		reportBytes, err := json.Marshal(Report{
 			Status:     "success",
 			LinkToFile: linkToFile,
-		}
-		reportBytes, err := json.Marshal(report)
+		})
 		if err != nil {
-			log.Println("Error to marshal data:", err)
+			slog.ErrorContext(ctx, "failed to marshal report", "err", err)
 			return
 		}
 
-		res = rdb.Set(ctx, taskKey, reportBytes, ttl)
+		res := rdb.Set(ctx, taskKey, reportBytes, ttl)
 		if res != nil && res.Err() != nil {
-			log.Println("error to set result in redis:", err)
+			slog.ErrorContext(ctx, "failed to set report result", "task_id", taskId, "err", res.Err())
 			return
 		}
+		slog.InfoContext(ctx, "report generated", "task_id", taskId, "duration", time.Since(start))
 	}()
 
+	return taskId, nil
+}
+
+// GetReport returns the state of the report task.
+// The report can be in one of three stages: "progress" "success" or "fail"
+func GetReport(ctx context.Context, rdb cache.Repository, taskId string) (*Report, error) {
+	var report Report
+	if err := rdb.Get(ctx, TaskPrefix+taskId, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// launchGenReport is an HTTP handler function that initiates the process of generating a report.
+func launchGenReport(w http.ResponseWriter, r *http.Request, rdb cache.Repository, historyRepo history.Repository, cfg *config.Config) {
+	date, err := GetDateQuery(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	taskId, err := StartReport(r.Context(), rdb, historyRepo, cfg, date)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to start report", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
 	resp := make(map[string]string)
 	resp["task_id"] = taskId
 	data, err := json.Marshal(resp)
 	if err != nil {
-		log.Println("Error marshal data:", err)
+		slog.ErrorContext(r.Context(), "failed to marshal response", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if _, err = w.Write(data); err != nil {
-		log.Println("Error write data:", err)
+		slog.ErrorContext(r.Context(), "failed to write response", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 }
 
 // checkReport is an HTTP handler function that allows checking the readiness of a report.
-// The report can be in one of three stages: "progress" "success" or "fail"
 func checkReport(w http.ResponseWriter, r *http.Request, rdb cache.Repository) {
 	id, ok := r.URL.Query()["task_id"]
 	if !ok || len(id) != 1 {
@@ -143,18 +195,17 @@ func checkReport(w http.ResponseWriter, r *http.Request, rdb cache.Repository) {
 	}
 	taskId := id[0]
 
-	ctx := context.Background()
-	var report Report
-	err := rdb.Get(ctx, TaskPrefix+taskId, &report)
+	ctx := r.Context()
+	report, err := GetReport(ctx, rdb, taskId)
 	if err != nil {
-		log.Println("Error get data from redis:", err)
+		slog.ErrorContext(ctx, "failed to get report task", "task_id", taskId, "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	data, err := json.Marshal(report)
 	if err != nil {
-		log.Println("Error marshal data:", err)
+		slog.ErrorContext(r.Context(), "failed to marshal response", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -162,7 +213,7 @@ func checkReport(w http.ResponseWriter, r *http.Request, rdb cache.Repository) {
 	w.Header().Set("Content-Type", "application/json")
 
 	if _, err = w.Write(data); err != nil {
-		log.Println("Error write data:", err)
+		slog.ErrorContext(r.Context(), "failed to write response", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -180,7 +231,7 @@ func DownloadFile() http.HandlerFunc {
 		fileURL := reportcsv.CSVDir + id[0] + ".csv"
 		file, err := os.Open(fileURL)
 		if err != nil {
-			log.Println("Failed to open file:", err)
+			slog.WarnContext(r.Context(), "failed to open report file", "err", err)
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
@@ -190,7 +241,7 @@ func DownloadFile() http.HandlerFunc {
 		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", fileName))
 
 		if _, err = io.Copy(w, file); err != nil {
-			log.Println("Failed to write file to response:", err)
+			slog.ErrorContext(r.Context(), "failed to write report file", "err", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
@@ -1,9 +1,11 @@
 package handlers
 
 import (
-	"context"
-	"log"
+	"encoding/json"
+	"errors"
+	"log/slog"
 	"main/internal/cache"
+	"main/internal/e"
 	"main/internal/history"
 	"main/internal/segment"
 	"net/http"
@@ -17,14 +19,19 @@ func createSegment(w http.ResponseWriter, r *http.Request, repo interface{}, his
 		return
 	}
 
-	ctx := context.Background()
+	ctx := r.Context()
 	s, err := unmarshalSegment(w, r)
 	if err != nil {
 		return
 	}
 
-	err = segmentRepo.Create(ctx, &segment.Segment{Slug: s.Slug})
-	checkErrors(w, err)
+	err = segmentRepo.Create(ctx, segment.NewSegment(s))
+	var parentNotFound *e.ParentNotFoundError
+	if errors.As(err, &parentNotFound) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	checkErrors(w, r, err)
 }
 
 // deleteSegment is a handler function responsible for deleting a segment.
@@ -35,26 +42,141 @@ func deleteSegment(w http.ResponseWriter, r *http.Request, repo interface{}, his
 		return
 	}
 
-	ctx := context.Background()
+	ctx := r.Context()
 	s, err := unmarshalSegment(w, r)
 	if err != nil {
 		return
 	}
 
-	if err = segmentRepo.Delete(ctx, s.Slug); err != nil {
-		log.Println("error to delete segment:", err)
+	err = segmentRepo.Delete(ctx, s.Slug)
+	var inExperiment *e.SegmentInExperimentError
+	var hasChildren *e.SegmentHasChildrenError
+	if errors.As(err, &inExperiment) || errors.As(err, &hasChildren) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to delete segment", "slug", s.Slug, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// getSegments is a handler function responsible for listing the segments.
+// The segments can be filtered by the "tag", "owner" and "status" query parameters.
+func getSegments(w http.ResponseWriter, r *http.Request, segmentRepo segment.Repository) {
+	query := r.URL.Query()
+	filter := segment.Filter{Tag: query.Get("tag"), Owner: query.Get("owner"), Status: query.Get("status")}
+	if filter.Status != "" && !segment.ValidStatus(filter.Status) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	segments, err := segmentRepo.FindAll(r.Context(), filter)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to find segments", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+
+	resp := segment.SegmentsDto{Segments: make([]segment.SegmentDto, 0, len(segments))}
+	for _, s := range segments {
+		resp.Segments = append(resp.Segments, segment.NewSegmentDto(s))
+	}
+	writeJson(w, r, resp)
+}
+
+// patchSegment is a handler function responsible for changing the default TTL, the metadata, the status,
+// the exclusion group or the parent of a segment. It responds with the changed segment. A change of the status drops the cached
+// segments of the members, so that the segment appears or disappears among their active segments immediately.
+func patchSegment(w http.ResponseWriter, r *http.Request, segmentRepo segment.Repository, rdb cache.Repository) {
+	ctx := r.Context()
+	var s segment.SegmentPatchDto
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil || !s.Valid() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	updated, err := segmentRepo.Update(ctx, s.Slug, s.Patch())
+	var notFound *e.SegmentsNotFoundError
+	var ruleSegment *e.RuleSegmentError
+	var inExperiment *e.SegmentInExperimentError
+	var conflict *e.ExclusionConflictError
+	var parentNotFound *e.ParentNotFoundError
+	var cycle *e.SegmentCycleError
+	switch {
+	case errors.As(err, &notFound):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.As(err, &ruleSegment), errors.As(err, &parentNotFound):
+		w.WriteHeader(http.StatusBadRequest)
+	case errors.As(err, &inExperiment), errors.As(err, &conflict), errors.As(err, &cycle):
+		w.WriteHeader(http.StatusConflict)
+	case err != nil:
+		slog.ErrorContext(ctx, "failed to patch segment", "slug", s.Slug, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	default:
+		if s.Status != nil {
+			if err = cache.DropSegmentMembers(ctx, rdb, segmentRepo, updated.Id); err != nil {
+				slog.ErrorContext(ctx, "failed to drop cached segments of members", "slug", updated.Slug, "err", err)
+			}
+		}
+		if updated.Slug != s.Slug {
+			setDeprecation(w, map[string]string{s.Slug: updated.Slug})
+		}
+		writeJson(w, r, segment.NewSegmentDto(updated))
+	}
+}
+
+// renameSegment is a handler function responsible for renaming a segment. The old slug keeps working
+// as a deprecated alias, so the clients can move to the new one gradually. It responds with the renamed segment.
+// The cached segments of the members are dropped, as they hold the old slug.
+func renameSegment(w http.ResponseWriter, r *http.Request, segmentRepo segment.Repository, rdb cache.Repository) {
+	ctx := r.Context()
+	var s segment.SegmentRenameDto
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil || !s.Valid() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	renamed, err := segmentRepo.Rename(ctx, s.Slug, s.NewSlug)
+	var notFound *e.SegmentsNotFoundError
+	var duplicate *e.DuplicateSegmentError
+	switch {
+	case errors.As(err, &notFound):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.As(err, &duplicate):
+		w.WriteHeader(http.StatusConflict)
+	case err != nil:
+		slog.ErrorContext(ctx, "failed to rename segment", "slug", s.Slug, "new_slug", s.NewSlug, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	default:
+		if err = cache.DropSegmentMembers(ctx, rdb, segmentRepo, renamed.Id); err != nil {
+			slog.ErrorContext(ctx, "failed to drop cached segments of members", "slug", renamed.Slug, "err", err)
+		}
+		writeJson(w, r, segment.NewSegmentDto(renamed))
+	}
+}
+
+// RenameSegment is a handler function that renames a segment, the request has to be idempotent.
+func RenameSegment(segmentRepo segment.Repository, rdb cache.Repository) http.HandlerFunc {
+	return IdempotentKeyMiddleware(rdb, func(w http.ResponseWriter, r *http.Request, repo interface{}, historyRepo history.Repository) {
+		renameSegment(w, r, segmentRepo, rdb)
+	}, segmentRepo, nil)
 }
 
 // Segments is a handler function that checks the request method and calls the appropriate handler.
 func Segments(segmentRepo segment.Repository, rdb cache.Repository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "POST" {
+		if r.Method == "GET" {
+			getSegments(w, r, segmentRepo)
+		} else if r.Method == "POST" {
 			IdempotentKeyMiddleware(rdb, createSegment, segmentRepo, nil)(w, r)
 		} else if r.Method == "DELETE" {
 			IdempotentKeyMiddleware(rdb, deleteSegment, segmentRepo, nil)(w, r)
+		} else if r.Method == "PATCH" {
+			IdempotentKeyMiddleware(rdb, func(w http.ResponseWriter, r *http.Request, repo interface{}, historyRepo history.Repository) {
+				patchSegment(w, r, segmentRepo, rdb)
+			}, segmentRepo, nil)(w, r)
 		}
 	}
 }
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"main/internal/e"
+	"main/internal/outbox"
+	"main/internal/segment"
+	"main/internal/user"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// streamHeartbeat is how often a comment is sent to keep idle connections open through proxies.
+const streamHeartbeat = 15 * time.Second
+
+// writeEvent writes a Server-Sent Event and flushes it to the client.
+func writeEvent(rc *http.ResponseController, w http.ResponseWriter, id, event string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		if _, err = fmt.Fprintf(w, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+	if _, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
+
+// visible reports whether the event changes the active segments of the user. The memberships of the segments
+// which are not active are hidden, they are shown or hidden all at once by the events of the status changes.
+// The events of the deleted segments are passed.
+func visible(ctx context.Context, segmentRepo segment.Repository, ev outbox.Event) (bool, error) {
+	if ev.Reason == outbox.ReasonStatus {
+		return true, nil
+	}
+	status, err := segmentRepo.FindStatus(ctx, ev.Slug)
+	var notFound *e.SegmentsNotFoundError
+	if errors.As(err, &notFound) {
+		return true, nil
+	}
+	return status == segment.StatusActive, err
+}
+
+// UserSegmentsStream is a handler function that streams the changes of the segments of a user as Server-Sent Events.
+// The full list of the active segments is sent on connect as a "segments" event, followed by a "change" event
+// per change of the active segments. The stream ends when the hub closes the subscription, the client reconnects then.
+func UserSegmentsStream(userRepo user.Repository, segmentRepo segment.Repository, hub *outbox.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId, ok := r.URL.Query()["id"]
+		if !ok || len(userId) != 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		id, err := strconv.Atoi(userId[0])
+		if err != nil || id <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// Subscribe before reading the segments, so that no change is lost in between
+		events, unsubscribe := hub.Subscribe(id)
+		defer unsubscribe()
+
+		// The cache may lag behind the changes, so the list is read from the database
+		ctx := r.Context()
+		usDto := &user.SegmentsDto{UserId: id}
+		us, err := userRepo.FindByUserId(ctx, id)
+		var notFound *e.UserNotFoundError
+		if err != nil && !errors.As(err, &notFound) {
+			slog.ErrorContext(ctx, "failed to get user segments", "user_id", id, "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if err == nil {
+			usDto = segmentsDto(id, us, time.Now())
+		}
+		if usDto.Segments == nil {
+			usDto.Segments = []segment.SegmentDto{}
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+
+		rc := http.NewResponseController(w)
+		if err = writeEvent(rc, w, "", "segments", usDto); err != nil {
+			slog.ErrorContext(ctx, "failed to write event", "user_id", id, "err", err)
+			return
+		}
+
+		heartbeat := time.NewTicker(streamHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev, ok := <-events:
+				if !ok {
+					return
+				}
+				var show bool
+				if show, err = visible(ctx, segmentRepo, ev); err != nil {
+					slog.ErrorContext(ctx, "failed to get segment status", "slug", ev.Slug, "err", err)
+					return
+				}
+				if show {
+					err = writeEvent(rc, w, strconv.FormatInt(ev.Seq, 10), "change", ev)
+				}
+			case <-heartbeat.C:
+				if _, err = fmt.Fprint(w, ": ping\n\n"); err == nil {
+					err = rc.Flush()
+				}
+			}
+			if err != nil {
+				slog.DebugContext(ctx, "failed to write event", "user_id", id, "err", err)
+				return
+			}
+		}
+	}
+}
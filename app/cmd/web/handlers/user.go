@@ -4,73 +4,168 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"main/internal/cache"
 	"main/internal/e"
 	"main/internal/history"
+	"main/internal/metrics"
 	"main/internal/segment"
 	"main/internal/user"
 	"net/http"
 	"strconv"
+	"time"
 )
 
-// getActiveSegments is a handler function responsible for retrieving the active segments of a user.
+// ActiveSegments returns the active segments of the user, nil if there are none.
 // The function checks the data in redis.
 // If there is no necessary data or an error has occurred, then it makes a request to the database.
-func getActiveSegments(w http.ResponseWriter, r *http.Request, rdb cache.Repository, userRepo user.Repository) {
-	userId, ok := r.URL.Query()["id"]
-	if !ok || len(userId) != 1 {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	id, err := strconv.Atoi(userId[0])
-	if err != nil || id <= 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	ctx := context.Background()
+func ActiveSegments(ctx context.Context, rdb cache.Repository, userRepo user.Repository, id int) (*user.SegmentsDto, error) {
 	var us user.Segments
-	redisKey := fmt.Sprintf("avito_user_%d", id)
-	if err = rdb.Get(ctx, redisKey, &us); err != nil {
-		log.Println("error to retrive cache:", err)
+	if err := rdb.Get(ctx, cache.UserSegmentsKey(id), &us); err != nil {
+		metrics.CacheLookups.WithLabelValues("miss").Inc()
+		slog.DebugContext(ctx, "user segments not found in cache", "user_id", id, "err", err)
 		u, err := userRepo.FindByUserId(ctx, id)
 		if err != nil {
 			var notFound *e.UserNotFoundError
 			if errors.As(err, &notFound) {
-				w.WriteHeader(http.StatusNoContent)
-				return
+				return nil, nil
 			}
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+			return nil, err
 		}
 		us = *u
+	} else {
+		metrics.CacheLookups.WithLabelValues("hit").Inc()
 	}
 	if us.UserId == 0 {
-		w.WriteHeader(http.StatusNoContent)
-		return
+		return nil, nil
 	}
 
+	// The cache may still hold memberships which have expired since it was filled
+	usDto := segmentsDto(id, &us, time.Now())
+	if len(usDto.Segments) == 0 {
+		return nil, nil
+	}
+	return usDto, nil
+}
+
+// segmentsDto converts the memberships of the user which are active at now.
+func segmentsDto(id int, us *user.Segments, now time.Time) *user.SegmentsDto {
 	usDto := user.SegmentsDto{
 		UserId:   id,
 		Segments: make([]segment.SegmentDto, 0, len(us.Segments)),
 	}
 	for _, dto := range us.Segments {
-		usDto.Segments = append(usDto.Segments, segment.SegmentDto{Slug: dto.Slug})
+		if dto.Expired(now) {
+			continue
+		}
+		s := segment.SegmentDto{Slug: dto.Slug, AliveUntil: dto.AliveUntil}
+		if !dto.AddedAt.IsZero() {
+			addedAt := dto.AddedAt
+			s.AddedAt = &addedAt
+		}
+		usDto.Segments = append(usDto.Segments, s)
+	}
+	return &usDto
+}
+
+// AddInherited adds the inherited memberships to the direct ones of the user. The user is an inherited member
+// of the active ancestors of the segments, unless the user is a direct member of them. A membership inherited
+// from several segments lasts as long as the longest of them, InheritedFrom is the first of them.
+func AddInherited(ctx context.Context, userRepo user.Repository, us *user.SegmentsDto) error {
+	slugs := make([]string, 0, len(us.Segments))
+	direct := make(map[string]bool, len(us.Segments))
+	for _, s := range us.Segments {
+		slugs = append(slugs, s.Slug)
+		direct[s.Slug] = true
+	}
+	ancestors, err := userRepo.FindAncestors(ctx, slugs)
+	if err != nil {
+		return err
+	}
+
+	inherited := make(map[string]int)
+	for i, n := 0, len(us.Segments); i < n; i++ {
+		s := us.Segments[i]
+		for _, ancestor := range ancestors[s.Slug] {
+			if direct[ancestor] {
+				continue
+			}
+			if j, ok := inherited[ancestor]; ok {
+				us.Segments[j].AliveUntil = later(us.Segments[j].AliveUntil, s.AliveUntil)
+				continue
+			}
+			from := s.Slug
+			inherited[ancestor] = len(us.Segments)
+			us.Segments = append(us.Segments, segment.SegmentDto{
+				Slug:          ancestor,
+				AddedAt:       s.AddedAt,
+				AliveUntil:    s.AliveUntil,
+				InheritedFrom: &from,
+			})
+		}
+	}
+	return nil
+}
+
+// later returns the later of the moments, nil is the moment which never comes.
+func later(a, b *time.Time) *time.Time {
+	if a == nil || b == nil {
+		return nil
+	}
+	if b.After(*a) {
+		return b
+	}
+	return a
+}
+
+// getActiveSegments is a handler function responsible for retrieving the active segments of a user.
+// With effective=true the inherited memberships follow the direct ones.
+func getActiveSegments(w http.ResponseWriter, r *http.Request, rdb cache.Repository, userRepo user.Repository) {
+	query := r.URL.Query()
+	userId, ok := query["id"]
+	if !ok || len(userId) != 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.Atoi(userId[0])
+	if err != nil || id <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	effective := false
+	if value := query.Get("effective"); value != "" {
+		if effective, err = strconv.ParseBool(value); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx := r.Context()
+	usDto, err := ActiveSegments(ctx, rdb, userRepo, id)
+	if err == nil && usDto != nil && effective {
+		err = AddInherited(ctx, userRepo, usDto)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to get user segments", "user_id", id, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if usDto == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
 	}
 
 	data, err := json.Marshal(usDto)
 	if err != nil {
-		log.Println("Error marshal data:", err)
+		slog.ErrorContext(ctx, "failed to marshal response", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	_, err = w.Write(data)
 	if err != nil {
-		log.Println("Error write data:", err)
+		slog.ErrorContext(ctx, "failed to write response", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -84,7 +179,7 @@ func addDelSegment(w http.ResponseWriter, r *http.Request, repo interface{}, his
 		return
 	}
 
-	ctx := context.Background()
+	ctx := r.Context()
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -104,12 +199,59 @@ func addDelSegment(w http.ResponseWriter, r *http.Request, repo interface{}, his
 	}
 
 	err = userRepo.AddDelSegments(ctx, seg, historyRepo)
+	setDeprecation(w, seg.Renamed)
 	var segmentsNotFoundError *e.SegmentsNotFoundError
-	if errors.As(err, &segmentsNotFoundError) {
+	var ruleSegmentError *e.RuleSegmentError
+	if errors.As(err, &segmentsNotFoundError) || errors.As(err, &ruleSegmentError) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var exclusionConflictError *e.ExclusionConflictError
+	var archivedSegmentError *e.ArchivedSegmentError
+	if errors.As(err, &exclusionConflictError) || errors.As(err, &archivedSegmentError) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	checkErrors(w, r, err)
+}
+
+// updateSegmentTtl is a handler function responsible for changing the lifetime of an existing user membership.
+// The cached segments of the user are dropped, so that the new lifetime is visible immediately.
+func updateSegmentTtl(w http.ResponseWriter, r *http.Request, userRepo user.Repository, rdb cache.Repository) {
+	ctx := r.Context()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer r.Body.Close()
+
+	var seg *user.SegmentTtlDto
+	if err = json.Unmarshal(body, &seg); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !seg.Valid() {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	checkErrors(w, err)
+
+	err = userRepo.UpdateAliveUntil(ctx, seg.UserId, seg.Slug, seg.AliveUntil(time.Now()))
+	var notFound *e.MembershipNotFoundError
+	if errors.As(err, &notFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to update segment ttl", "user_id", seg.UserId, "slug", seg.Slug, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err = rdb.Del(ctx, cache.UserSegmentsKey(seg.UserId)); err != nil {
+		slog.ErrorContext(ctx, "failed to drop cached user segments", "user_id", seg.UserId, "err", err)
+	}
 }
 
 // Users is a handler function that checks the request method and calls the appropriate handler.
@@ -119,6 +261,10 @@ func Users(userRepo user.Repository, rdb cache.Repository, historyRepo history.R
 			getActiveSegments(w, r, rdb, userRepo)
 		} else if r.Method == "POST" {
 			IdempotentKeyMiddleware(rdb, addDelSegment, userRepo, historyRepo)(w, r)
+		} else if r.Method == "PATCH" {
+			IdempotentKeyMiddleware(rdb, func(w http.ResponseWriter, r *http.Request, repo interface{}, historyRepo history.Repository) {
+				updateSegmentTtl(w, r, userRepo, rdb)
+			}, userRepo, historyRepo)(w, r)
 		}
 	}
 }
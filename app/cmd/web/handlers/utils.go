@@ -1,58 +1,120 @@
 package handlers
 
 import (
-	"context"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"golang.org/x/time/rate"
 	"io"
-	"log"
+	"log/slog"
 	"main/internal/cache"
 	"main/internal/e"
 	"main/internal/history"
+	"main/internal/metrics"
 	"main/internal/segment"
 	"net/http"
 	"net/url"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
 type NextHandler func(w http.ResponseWriter, r *http.Request, repo interface{}, historyRepo history.Repository)
 
+// idempotencyReplayedHeader marks the response replayed to a repeated Idempotency-Key.
+const idempotencyReplayedHeader = "Idempotency-Replayed"
+
+// idempotentResponse is the response to a request with an Idempotency-Key, it is replayed to the repeated requests.
+type idempotentResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+}
+
+// responseRecorder keeps a copy of the response written through it.
+type responseRecorder struct {
+	statusRecorder
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.statusRecorder.Write(b)
+}
+
+// replay writes the response again. The headers set before the handler, e.g. X-Request-ID, are kept.
+func (resp *idempotentResponse) replay(w http.ResponseWriter) {
+	for name, values := range resp.Header {
+		if w.Header().Get(name) == "" {
+			w.Header()[name] = values
+		}
+	}
+	w.Header().Set(idempotencyReplayedHeader, "true")
+	w.WriteHeader(resp.Status)
+	w.Write(resp.Body)
+}
+
 // IdempotentKeyMiddleware is a middleware function that checks the idempotency key in Redis
-// before invoking the next handler function.
+// before invoking the next handler function. The response is kept under the key, so the repeated requests
+// get it again. While the first request is being handled they get 409. The key of a request which has failed
+// with 5xx is released, as nothing has been changed, so its retry is handled anew.
 func IdempotentKeyMiddleware(rdb cache.Repository, next NextHandler, repo interface{}, historyRepo history.Repository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		idempotentKey := r.Header.Get("Idempotency-Key")
 		if idempotentKey == "" {
-			log.Println("Idempotency-Key not found in request headers")
+			slog.WarnContext(r.Context(), "Idempotency-Key not found in request headers")
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		ctx := context.Background()
+		ctx := r.Context()
 		val, err := rdb.Exists(ctx, idempotentKey)
 		if err != nil {
-			log.Println("error check idempotent key:", err)
+			slog.ErrorContext(ctx, "failed to check Idempotency-Key", "err", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
 		if val > 0 {
-			log.Println("Idempotency-Key already processed")
+			// The key holds a marker until the response is kept
+			var resp idempotentResponse
+			if err = rdb.Get(ctx, idempotentKey, &resp); err == nil && resp.Status != 0 {
+				slog.InfoContext(ctx, "Idempotency-Key already processed, replaying the response", "key", idempotentKey)
+				resp.replay(w)
+				return
+			}
+			metrics.IdempotencyConflicts.Inc()
+			slog.WarnContext(ctx, "Idempotency-Key is being processed", "key", idempotentKey)
 			w.WriteHeader(http.StatusConflict)
 			return
 		}
 
 		res := rdb.Set(ctx, idempotentKey, true, 60*time.Minute)
 		if res != nil && res.Err() != nil {
-			log.Println("can't set idempotency key in redis")
+			slog.ErrorContext(ctx, "failed to set Idempotency-Key", "err", res.Err())
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		next(w, r, repo, historyRepo)
+		rec := &responseRecorder{statusRecorder: statusRecorder{ResponseWriter: w}}
+		next(rec, r, repo, historyRepo)
+
+		if rec.status >= http.StatusInternalServerError {
+			if err = rdb.Del(ctx, idempotentKey); err != nil {
+				slog.ErrorContext(ctx, "failed to release Idempotency-Key", "err", err)
+			}
+			return
+		}
+		resp := idempotentResponse{Status: rec.status, Header: w.Header().Clone(), Body: rec.body.Bytes()}
+		if resp.Status == 0 {
+			resp.Status = http.StatusOK
+		}
+		if err = rdb.AddToCache(ctx, idempotentKey, resp, 60*time.Minute); err != nil {
+			slog.ErrorContext(ctx, "failed to keep the response of Idempotency-Key", "err", err)
+		}
 	}
 }
 
@@ -79,23 +141,75 @@ func unmarshalSegment(w http.ResponseWriter, r *http.Request) (*segment.SegmentD
 }
 
 // checkErrors is a utility function that checks for errors and responds with appropriate status codes.
-func checkErrors(w http.ResponseWriter, err error) {
+func checkErrors(w http.ResponseWriter, r *http.Request, err error) {
 	var dse *e.DuplicateSegmentError
 	if errors.As(err, &dse) {
 		w.WriteHeader(http.StatusConflict)
 		return
 	} else if err != nil {
-		log.Println(err)
+		slog.ErrorContext(r.Context(), "failed to handle request", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 }
 
+// setDeprecation marks the response as the one to a request which used the deprecated slugs of the renamed
+// segments. The X-Segment-Renamed header lists them as OLD=NEW pairs. It has to be called before the status is written.
+func setDeprecation(w http.ResponseWriter, renamed map[string]string) {
+	if len(renamed) == 0 {
+		return
+	}
+	pairs := make([]string, 0, len(renamed))
+	for old, slug := range renamed {
+		pairs = append(pairs, old+"="+slug)
+	}
+	sort.Strings(pairs)
+	w.Header().Set("Deprecation", "true")
+	w.Header().Set("X-Segment-Renamed", strings.Join(pairs, ","))
+}
+
+// RateLimits are the limits of the requests per route. All the routes share the settings,
+// which can be changed while the app is running, but each route has its own limiter.
+type RateLimits struct {
+	mu       sync.Mutex
+	limit    rate.Limit
+	burst    int
+	limiters []*rate.Limiter
+}
+
+// NewRateLimits creates limits of rps requests per second with bursts of up to burst requests.
+func NewRateLimits(rps float64, burst int) *RateLimits {
+	return &RateLimits{limit: rate.Limit(rps), burst: burst}
+}
+
+// NewLimiter creates a limiter of a route which follows the changes of the limits.
+func (l *RateLimits) NewLimiter() *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limiter := rate.NewLimiter(l.limit, l.burst)
+	l.limiters = append(l.limiters, limiter)
+	return limiter
+}
+
+// Set changes the limits of all the routes.
+func (l *RateLimits) Set(rps float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limit, l.burst = rate.Limit(rps), burst
+	for _, limiter := range l.limiters {
+		limiter.SetLimit(l.limit)
+		limiter.SetBurst(l.burst)
+	}
+}
+
 // RateLimiter is a middleware function that acts as a rate limiter for incoming requests.
-func RateLimiter(next http.HandlerFunc) http.HandlerFunc {
-	limiter := rate.NewLimiter(10, 10)
+func RateLimiter(limits *RateLimits, next http.HandlerFunc) http.HandlerFunc {
+	limiter := limits.NewLimiter()
 	return func(w http.ResponseWriter, r *http.Request) {
 		if !limiter.Allow() {
+			metrics.RateLimited.Inc()
 			w.WriteHeader(http.StatusTooManyRequests)
 			return
 		} else {
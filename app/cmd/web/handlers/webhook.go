@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"log/slog"
+	"main/internal/e"
+	"main/internal/webhook"
+	"net/http"
+	"strconv"
+)
+
+var (
+	DefaultDeliveriesLimit = 50
+	MaxDeliveriesLimit     = 500
+)
+
+// checkWebhookErrors is a utility function that responds with the status code matching the webhook error.
+// It returns false if there is no error.
+func checkWebhookErrors(w http.ResponseWriter, r *http.Request, err error) bool {
+	var webhookNotFound *e.WebhookNotFoundError
+	var deadLetterNotFound *e.DeadLetterNotFoundError
+	if errors.As(err, &webhookNotFound) || errors.As(err, &deadLetterNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return true
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "failed to handle webhook request", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return true
+	}
+	return false
+}
+
+// createWebhook is a handler function responsible for registering a webhook.
+func createWebhook(w http.ResponseWriter, r *http.Request, webhookRepo webhook.Repository) {
+	var dto webhook.WebhookDto
+	if err := json.NewDecoder(r.Body).Decode(&dto); err != nil || !dto.Valid() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	wh := webhook.NewWebhook(&dto)
+	if checkWebhookErrors(w, r, webhookRepo.Create(r.Context(), wh)) {
+		return
+	}
+	writeJsonStatus(w, r, http.StatusCreated, webhook.NewInfoDto(wh))
+}
+
+// getWebhooks is a handler function responsible for listing the registered webhooks.
+func getWebhooks(w http.ResponseWriter, r *http.Request, webhookRepo webhook.Repository) {
+	webhooks, err := webhookRepo.FindAll(r.Context())
+	if checkWebhookErrors(w, r, err) {
+		return
+	}
+
+	resp := webhook.InfosDto{Webhooks: make([]webhook.InfoDto, 0, len(webhooks))}
+	for _, wh := range webhooks {
+		resp.Webhooks = append(resp.Webhooks, webhook.NewInfoDto(wh))
+	}
+	writeJson(w, r, resp)
+}
+
+// Webhooks is a handler function that registers (POST) or lists (GET) the webhooks.
+func Webhooks(webhookRepo webhook.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			createWebhook(w, r, webhookRepo)
+		} else if r.Method == "GET" {
+			getWebhooks(w, r, webhookRepo)
+		}
+	}
+}
+
+// DeleteWebhook is a handler function that deletes the webhook from the "id" path variable with its deliveries.
+func DeleteWebhook(webhookRepo webhook.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if checkWebhookErrors(w, r, webhookRepo.Delete(r.Context(), id)) {
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// WebhookDeliveries is a handler function that returns the delivery log of the webhook from the "id" path variable,
+// newest first. The deliveries can be filtered by the "status" query parameter.
+func WebhookDeliveries(webhookRepo webhook.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		status := r.URL.Query().Get("status")
+		if status != "" && status != webhook.StatusPending && status != webhook.StatusDelivered && status != webhook.StatusDead {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		limit, err := getLimitQuery(r, DefaultDeliveriesLimit, MaxDeliveriesLimit)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		deliveries, err := webhookRepo.FindDeliveries(r.Context(), id, status, limit)
+		if checkWebhookErrors(w, r, err) {
+			return
+		}
+
+		resp := webhook.DeliveriesDto{Deliveries: make([]webhook.DeliveryDto, 0, len(deliveries))}
+		for _, d := range deliveries {
+			resp.Deliveries = append(resp.Deliveries, webhook.NewDeliveryDto(d))
+		}
+		writeJson(w, r, resp)
+	}
+}
+
+// DeadLetters is a handler function that returns the deliveries of all the webhooks which have run out of attempts.
+func DeadLetters(webhookRepo webhook.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, err := getLimitQuery(r, DefaultDeliveriesLimit, MaxDeliveriesLimit)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		letters, err := webhookRepo.FindDeadLetters(r.Context(), limit)
+		if checkWebhookErrors(w, r, err) {
+			return
+		}
+
+		resp := webhook.DeadLettersDto{DeadLetters: make([]webhook.DeadLetterDto, 0, len(letters))}
+		for _, l := range letters {
+			resp.DeadLetters = append(resp.DeadLetters, webhook.NewDeadLetterDto(l))
+		}
+		writeJson(w, r, resp)
+	}
+}
+
+// RetryDeadLetter is a handler function that returns the dead delivery from the "id" path variable to the queue.
+func RetryDeadLetter(webhookRepo webhook.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if checkWebhookErrors(w, r, webhookRepo.RetryDeadLetter(r.Context(), id)) {
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -2,79 +2,445 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/gorilla/mux"
-	"log"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/extra/redisotel/v9"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
+	"google.golang.org/grpc"
+	grpchealth "google.golang.org/grpc/health"
+	"log/slog"
+	"main/cmd/web/grpcapi"
 	"main/cmd/web/handlers"
 	"main/internal/cache"
 	"main/internal/config"
+	"main/internal/experiment"
+	"main/internal/health"
 	"main/internal/history"
+	"main/internal/job"
+	"main/internal/logger"
+	"main/internal/metrics"
+	"main/internal/migrate"
+	"main/internal/outbox"
+	"main/internal/reportcsv"
 	"main/internal/segment"
+	"main/internal/tracing"
 	"main/internal/user"
+	"main/internal/webhook"
 	"main/pkg"
-	"main/pkg/utils"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 )
 
 var cfg *config.Config
 
-func init() {
-	cfg = utils.LoadConfig("./config/app.yaml")
-}
-
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(migrateCommand(os.Args[2:]))
+	}
+
+	var err error
+	cfg, err = config.Load(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	var logLevel slog.LevelVar
+	l, err := logger.New(cfg.LogCfg, &logLevel, os.Stdout)
+	if err != nil {
+		fatal("failed to init logger", err)
+	}
+	slog.SetDefault(l)
+
+	tracer, err := tracing.NewProvider(context.Background(), cfg.TracingCfg)
+	if err != nil {
+		fatal("failed to init tracing", err)
+	}
+
+	// Launch the web server first, so that health checks are answered while connecting to dependencies.
+	// Until the API is set, its requests are answered with 503.
+	checker := health.NewChecker()
+	api := &handlers.Deferred{}
+
+	root := mux.NewRouter()
+	root.Use(handlers.RequestId)
+	root.HandleFunc("/healthz", handlers.Liveness()).Methods("GET")
+	root.HandleFunc("/readyz", handlers.Readiness(checker, cfg.HealthCfg.Timeout)).Methods("GET")
+	root.Handle("/metrics", promhttp.Handler()).Methods("GET")
+	root.PathPrefix("/").Handler(api)
+
+	srv := &http.Server{
+		Addr:    fmt.Sprintf("%s:%s", cfg.AppCfg.Host, cfg.AppCfg.Port),
+		Handler: root,
+	}
+
+	// Both the web and the gRPC server report their failures here
+	serveErr := make(chan error, 2)
+	go func() {
+		serveErr <- srv.ListenAndServe()
+	}()
+
 	// Create postgres client
 	psqlClient, err := pkg.NewPsqlClient(context.Background(), cfg)
 	if err != nil {
-		log.Fatalln("Error create db client:", err)
+		fatal("failed to create db client", err)
+	}
+	db := tracing.NewDB(psqlClient)
+
+	migrator, err := migrate.NewMigrator(db)
+	if err != nil {
+		fatal("failed to read migrations", err)
+	}
+	if cfg.PostgresCfg.MigrateOnStart {
+		applied, err := migrator.Up(context.Background())
+		for _, m := range applied {
+			slog.Info("migration applied", "version", m.Version, "name", m.Name)
+		}
+		if err != nil {
+			fatal("failed to migrate database", err)
+		}
 	}
 
 	// Create redis client
 	redisClient, err := pkg.NewRedisClient(context.Background(), cfg)
 	if err != nil {
-		log.Fatalln("Error create redis client:", err)
+		fatal("failed to create redis client", err)
+	}
+	if err = redisotel.InstrumentTracing(redisClient); err != nil {
+		fatal("failed to instrument redis client", err)
 	}
 
 	// Init repositories
-	userRepo := user.NewRepo(psqlClient)
-	segmentRepo := segment.NewRepo(psqlClient)
-	cacheRepo := cache.NewRepo(redisClient)
-	historyRepo := history.NewRepo(psqlClient)
+	userRepo := user.NewRepo(db)
+	segmentRepo := segment.NewRepo(db)
+	cacheRepo := cache.NewRepo(redisClient, cfg.CacheCfg.UserSegmentsTtl)
+	historyRepo := history.NewRepo(db)
+	webhookRepo := webhook.NewRepo(db)
+	experimentRepo := experiment.NewRepo(db)
 
-	// Launch cache update
+	jobRepo := job.NewRepo(db)
+
+	// Launch background jobs. Each run is executed by only one of the app instances.
 	ctx := context.Background()
-	cacheRepo.UpdateCache(ctx, userRepo)
+	instance := job.InstanceId()
+	locker := job.NewRedisLocker(redisClient, instance, cfg.JobsCfg.LockLease, cfg.JobsCfg.LockHold)
+	scheduler := job.NewScheduler(jobRepo, locker, instance)
+
+	// Cache update
+	err = scheduler.Cron(ctx, job.CacheRefresh, cfg.JobsCfg.CacheRefresh.Cron, func(ctx context.Context) (int, error) {
+		return cacheRepo.RefreshCache(ctx, userRepo)
+	})
+	if err != nil {
+		fatal("failed to schedule cache refresh", err)
+	}
+
+	// Delete expired user segments (ttl)
+	err = scheduler.Cron(ctx, job.TtlCleanup, cfg.JobsCfg.TtlCleanup.Cron, func(ctx context.Context) (int, error) {
+		return userRepo.DeleteExpired(ctx, historyRepo)
+	})
+	if err != nil {
+		fatal("failed to schedule ttl cleanup", err)
+	}
+
+	// Sync the members of the dynamic segments with their rules, e.g. after a segment has been created
+	err = scheduler.Cron(ctx, job.RuleSegments, cfg.JobsCfg.RuleSegments.Cron, func(ctx context.Context) (int, error) {
+		return userRepo.SyncRuleSegments(ctx, historyRepo)
+	})
+	if err != nil {
+		fatal("failed to schedule rule segments sync", err)
+	}
 
-	// Launch delete user segments (ttl)
-	userRepo.DeleteSegmentsEveryDay(ctx, historyRepo)
+	// Delete old job runs
+	err = scheduler.Cron(ctx, job.JobRunsCleanup, cfg.JobsCfg.JobRunsCleanup.Cron, func(ctx context.Context) (int, error) {
+		return jobRepo.DeleteRunsBefore(ctx, time.Now().AddDate(0, 0, -cfg.JobsCfg.KeepRunsDays))
+	})
+	if err != nil {
+		fatal("failed to schedule job runs cleanup", err)
+	}
+
+	scheduler.Start()
+
+	prometheus.MustRegister(metrics.NewPgxPoolCollector(psqlClient))
 
 	// Init routes
+	limits := handlers.NewRateLimits(cfg.RateLimitCfg.Rps, cfg.RateLimitCfg.Burst)
 	r := mux.NewRouter()
+	r.Use(otelmux.Middleware(tracing.ServiceName), handlers.Metrics)
 
-	r.HandleFunc("/segment", handlers.RateLimiter(
+	r.HandleFunc("/segment", handlers.RateLimiter(limits,
 		handlers.Segments(segmentRepo, cacheRepo)),
-	).Methods("POST", "DELETE")
+	).Methods("GET", "POST", "DELETE", "PATCH")
+
+	r.HandleFunc("/segment/rename", handlers.RateLimiter(limits,
+		handlers.RenameSegment(segmentRepo, cacheRepo)),
+	).Methods("POST")
 
-	r.HandleFunc("/segment/user", handlers.RateLimiter(
+	// The streams receive the published membership events of all the instances
+	hub := outbox.NewHub(redisClient, cfg.OutboxCfg.Stream)
+	srv.RegisterOnShutdown(hub.Close)
+	r.HandleFunc("/segment/user/stream", handlers.RateLimiter(limits,
+		handlers.UserSegmentsStream(userRepo, segmentRepo, hub)),
+	).Methods("GET")
+
+	r.HandleFunc("/segment/user", handlers.RateLimiter(limits,
 		handlers.Users(userRepo, cacheRepo, historyRepo)),
-	).Methods("POST", "GET")
+	).Methods("POST", "GET", "PATCH")
 
-	r.HandleFunc("/report", handlers.RateLimiter(
+	r.HandleFunc("/user/attributes", handlers.RateLimiter(limits,
+		handlers.UserAttributes(userRepo, cacheRepo, historyRepo)),
+	).Methods("GET", "PATCH")
+
+	r.HandleFunc("/experiment", handlers.RateLimiter(limits,
+		handlers.Experiments(experimentRepo)),
+	).Methods("POST", "GET", "DELETE")
+
+	r.HandleFunc("/experiment/allocate", handlers.RateLimiter(limits,
+		handlers.Allocate(experimentRepo, cacheRepo, historyRepo)),
+	).Methods("POST")
+
+	r.HandleFunc("/report", handlers.RateLimiter(limits,
 		handlers.Reports(historyRepo, cacheRepo, cfg)),
 	).Methods("GET")
 
-	r.HandleFunc("/report_check", handlers.RateLimiter(
+	r.HandleFunc("/report_check", handlers.RateLimiter(limits,
 		handlers.ReportCheck(cacheRepo)),
 	).Methods("GET")
 
-	r.HandleFunc("/download", handlers.RateLimiter(
+	r.HandleFunc("/download", handlers.RateLimiter(limits,
 		handlers.DownloadFile()),
 	).Methods("GET")
 
-	http.Handle("/", r)
+	// The admin routes require the token, they are disabled without it
+	if cfg.AdminCfg.Token == "" {
+		slog.Warn("admin token is not set, the admin routes are disabled")
+	}
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(handlers.AdminToken(cfg.AdminCfg.Token))
+
+	admin.HandleFunc("/webhooks", handlers.RateLimiter(limits,
+		handlers.Webhooks(webhookRepo)),
+	).Methods("POST", "GET")
+
+	admin.HandleFunc("/webhooks/{id:[0-9]+}", handlers.RateLimiter(limits,
+		handlers.DeleteWebhook(webhookRepo)),
+	).Methods("DELETE")
+
+	admin.HandleFunc("/webhooks/{id:[0-9]+}/deliveries", handlers.RateLimiter(limits,
+		handlers.WebhookDeliveries(webhookRepo)),
+	).Methods("GET")
+
+	admin.HandleFunc("/webhooks/dead_letters", handlers.RateLimiter(limits,
+		handlers.DeadLetters(webhookRepo)),
+	).Methods("GET")
+
+	admin.HandleFunc("/webhooks/dead_letters/{id:[0-9]+}/retry", handlers.RateLimiter(limits,
+		handlers.RetryDeadLetter(webhookRepo)),
+	).Methods("POST")
+
+	admin.HandleFunc("/jobs", handlers.RateLimiter(limits,
+		handlers.Jobs(jobRepo)),
+	).Methods("GET")
+
+	admin.HandleFunc("/jobs/ttl_cleanup/dry_run", handlers.RateLimiter(limits,
+		handlers.DryRunTtlCleanup(userRepo)),
+	).Methods("GET")
+
+	admin.HandleFunc("/jobs/{name}", handlers.RateLimiter(limits,
+		handlers.JobInfo(scheduler)),
+	).Methods("GET")
+
+	admin.HandleFunc("/jobs/{name}/run", handlers.RateLimiter(limits,
+		handlers.TriggerJob(scheduler)),
+	).Methods("POST")
+
+	admin.HandleFunc("/jobs/{name}/pause", handlers.RateLimiter(limits,
+		handlers.PauseJob(scheduler, true)),
+	).Methods("POST")
+
+	admin.HandleFunc("/jobs/{name}/resume", handlers.RateLimiter(limits,
+		handlers.PauseJob(scheduler, false)),
+	).Methods("POST")
+
+	api.Set(r)
+
+	// Launch the gRPC server, it serves the same repositories as the routes
+	grpcSrv, grpcHealth := grpcapi.NewGrpcServer(
+		grpcapi.NewServer(segmentRepo, userRepo, historyRepo, cacheRepo, cfg),
+		limits,
+		cfg.GrpcCfg.Reflection,
+	)
+	lis, err := net.Listen("tcp", net.JoinHostPort(cfg.AppCfg.Host, cfg.GrpcCfg.Port))
+	if err != nil {
+		fatal("failed to listen for grpc", err)
+	}
+	go func() {
+		serveErr <- grpcSrv.Serve(lis)
+	}()
+
+	// Readiness checks
+	checker.Add("postgres", psqlClient.Ping)
+	checker.Add("migrations", migrator.CheckPending)
+	checker.Add("redis", func(ctx context.Context) error {
+		return redisClient.Ping(ctx).Err()
+	})
+	checker.Add("report_storage", health.DiskSpace(reportcsv.CSVDir, cfg.HealthCfg.MinFreeDiskMb<<20))
+	checker.Add("scheduler", func(ctx context.Context) error {
+		if !scheduler.Running() {
+			return errors.New("scheduler is not running")
+		}
+		return nil
+	})
+	checker.SetStarted()
 
-	addr := fmt.Sprintf("%s:%s", cfg.AppCfg.Host, cfg.AppCfg.Port)
-	if err = http.ListenAndServe(addr, r); err != nil {
-		log.Fatalln("Error launch web server:", err)
+	// Wait for a termination signal or a failure of the web server
+	stop, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	// Reload the runtime-tunable settings on SIGHUP or a change of the config file
+	reloader := config.NewReloader(cfg, func() (*config.Config, error) {
+		return config.Load(os.Args[1:], os.LookupEnv)
+	})
+	reloader.Subscribe(func(c *config.Config) error {
+		limits.Set(c.RateLimitCfg.Rps, c.RateLimitCfg.Burst)
+		return nil
+	})
+	reloader.Subscribe(func(c *config.Config) error {
+		cacheRepo.SetUserSegmentsTtl(c.CacheCfg.UserSegmentsTtl)
+		return nil
+	})
+	reloader.Subscribe(func(c *config.Config) error {
+		return logger.SetLevel(&logLevel, c.LogCfg.Level)
+	})
+	reloader.Subscribe(func(c *config.Config) error {
+		return errors.Join(
+			scheduler.Reschedule(job.CacheRefresh, c.JobsCfg.CacheRefresh.Cron),
+			scheduler.Reschedule(job.TtlCleanup, c.JobsCfg.TtlCleanup.Cron),
+			scheduler.Reschedule(job.JobRunsCleanup, c.JobsCfg.JobRunsCleanup.Cron),
+			scheduler.Reschedule(job.RuleSegments, c.JobsCfg.RuleSegments.Cron),
+		)
+	})
+	go reloader.Watch(stop, cfg.AppCfg.ReloadInterval)
+
+	// Publish the events and deliver them to the webhooks. The relay and the dispatcher poll the tables,
+	// so their queries are not traced.
+	untracedWebhookRepo := webhook.NewRepo(psqlClient)
+	sink := outbox.Sinks{
+		outbox.NewRedisStreamSink(redisClient, cfg.OutboxCfg.Stream, cfg.OutboxCfg.MaxLen),
+		webhook.NewSink(untracedWebhookRepo),
 	}
+	relay := outbox.NewRelay(psqlClient, sink, cfg.OutboxCfg.BatchSize)
+	dispatcher := webhook.NewDispatcher(
+		untracedWebhookRepo,
+		&http.Client{Timeout: cfg.WebhookCfg.Timeout},
+		webhook.Backoff{
+			MaxAttempts: cfg.WebhookCfg.MaxAttempts,
+			Min:         cfg.WebhookCfg.MinBackoff,
+			Max:         cfg.WebhookCfg.MaxBackoff,
+		},
+		cfg.WebhookCfg.BatchSize,
+	)
+	var workers sync.WaitGroup
+	workers.Add(2)
+	go func() {
+		defer workers.Done()
+		relay.Run(stop, cfg.OutboxCfg.Interval)
+	}()
+	go func() {
+		defer workers.Done()
+		dispatcher.Run(stop, cfg.WebhookCfg.Interval)
+	}()
+	workersDone := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(workersDone)
+	}()
+	go hub.Run(stop)
+
+	select {
+	case err = <-serveErr:
+		slog.Error("failed to launch web server", "err", err)
+	case <-stop.Done():
+		slog.Info("shutting down")
+	}
+	// Stop the relay, the dispatcher and the config watcher also if the server has failed
+	cancel()
+
+	shutdown(srv, grpcSrv, grpcHealth, scheduler, workersDone, psqlClient, redisClient, tracer)
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// shutdown stops the application in the order its parts depend on each other.
+// It stops accepting requests and calls and waits for in-flight ones, waits for the report generations,
+// the running background jobs, the outbox relay and the webhook dispatcher, and only then closes the Postgres and Redis clients
+// and flushes the remaining spans.
+// Waiting for requests and reports is limited by the shutdown timeout from the config.
+func shutdown(srv *http.Server, grpcSrv *grpc.Server, grpcHealth *grpchealth.Server, scheduler *job.Scheduler, workersDone <-chan struct{}, psqlClient *pgxpool.Pool, redisClient *redis.Client, tracer *tracing.Provider) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.AppCfg.ShutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Error("failed to shut down web server", "err", err)
+	}
+
+	// The health service reports NOT_SERVING while the calls are drained
+	grpcHealth.Shutdown()
+	stopped := make(chan struct{})
+	go func() {
+		grpcSrv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		slog.Error("failed to shut down grpc server", "err", ctx.Err())
+		grpcSrv.Stop()
+	}
+
+	if err := handlers.WaitReports(ctx); err != nil {
+		slog.Error("failed to wait for reports", "err", err)
+	}
+
+	scheduler.Stop()
+
+	// The relay and the dispatcher stop with the termination signal. An interrupted batch is published
+	// again on the next start, an interrupted delivery is sent again after its lease.
+	select {
+	case <-workersDone:
+	case <-ctx.Done():
+		slog.Error("failed to wait for outbox relay and webhook dispatcher", "err", ctx.Err())
+	}
+
+	psqlClient.Close()
+
+	if err := redisClient.Close(); err != nil {
+		slog.Error("failed to close redis client", "err", err)
+	}
+
+	if err := tracer.Shutdown(ctx); err != nil {
+		slog.Error("failed to flush traces", "err", err)
+	}
+
+	slog.Info("stopped")
+}
+
+// fatal logs the error which prevents the app from starting and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
 }
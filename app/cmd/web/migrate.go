@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"main/internal/config"
+	"main/internal/migrate"
+	"main/pkg"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+const migrateUsage = `usage: web migrate [flags] up | down [steps] | status
+
+  up      apply all pending migrations
+  down    revert the last applied migration, or the last steps ones
+  status  list the migrations and when they have been applied
+
+The flags are the same as the flags of the app, see web -h.`
+
+// migrateCommand runs the migrate subcommand and returns the exit code of the process.
+func migrateCommand(args []string) int {
+	cfg, rest, err := config.Parse(args, os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Println(migrateUsage)
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if len(rest) == 0 || len(rest) > 2 || (len(rest) == 2 && rest[0] != "down") {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+
+	steps := 1
+	if len(rest) == 2 {
+		steps, err = strconv.Atoi(rest[1])
+		if err != nil || steps <= 0 {
+			fmt.Fprintf(os.Stderr, "invalid number of steps %q\n", rest[1])
+			return 2
+		}
+	}
+
+	ctx := context.Background()
+	psqlClient, err := pkg.NewPsqlClient(ctx, cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to create db client:", err)
+		return 1
+	}
+	defer psqlClient.Close()
+
+	migrator, err := migrate.NewMigrator(psqlClient)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to read migrations:", err)
+		return 1
+	}
+
+	switch rest[0] {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		for _, m := range applied {
+			fmt.Printf("applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if len(applied) == 0 {
+			fmt.Println("no pending migrations")
+		}
+	case "down":
+		reverted, err := migrator.Down(ctx, steps)
+		for _, m := range reverted {
+			fmt.Printf("reverted %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if len(reverted) == 0 {
+			fmt.Println("no applied migrations")
+		}
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, s := range statuses {
+			appliedAt := "pending"
+			if s.AppliedAt != nil {
+				appliedAt = s.AppliedAt.UTC().Format(time.RFC3339)
+			}
+			if s.Unknown {
+				appliedAt += " (unknown to this binary)"
+			}
+			fmt.Fprintf(w, "%04d\t%s\t%s\n", s.Version, s.Name, appliedAt)
+		}
+		w.Flush()
+	default:
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+	return 0
+}
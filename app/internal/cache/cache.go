@@ -3,16 +3,26 @@ package cache
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/go-co-op/gocron"
 	"github.com/redis/go-redis/v9"
-	"log"
+	"log/slog"
+	"main/internal/e"
+	"main/internal/segment"
 	"main/internal/user"
+	"sync/atomic"
 	"time"
 )
 
 type repository struct {
 	client *redis.Client
+	// userSegmentsTtl is a time.Duration, it can be changed while the cache is refreshed
+	userSegmentsTtl atomic.Int64
+}
+
+// UserSegmentsKey returns the key under which the active segments of the user are cached.
+func UserSegmentsKey(userId int) string {
+	return fmt.Sprintf("avito_user_%d", userId)
 }
 
 // AddToCache adds data to the Redis cache with the specified key and expiration time.
@@ -48,51 +58,83 @@ func (r *repository) Get(ctx context.Context, key string, data interface{}) erro
 	return nil
 }
 
-// UpdateCache periodically updates the Redis cache with user data.
-// It uses the provided Redis client and user repository to refresh the cache.
-// The cache is refreshed every minute.
-func (r *repository) UpdateCache(ctx context.Context, userRepo user.Repository) {
-	s := gocron.NewScheduler(time.UTC)
+// RefreshCache updates the Redis cache with the active segments of every user who has them.
+// It returns the number of users whose segments have been cached.
+func (r *repository) RefreshCache(ctx context.Context, userRepo user.Repository) (int, error) {
+	users, err := userRepo.FindAll(ctx)
+	if err != nil {
+		return 0, err
+	}
 
-	_, err := s.Every(1).Minutes().Do(func() error {
-		users, err := userRepo.FindAll(ctx)
+	n := 0
+	for _, u := range users {
+		us, err := userRepo.FindByUserId(ctx, u.Id)
+		var notFound *e.UserNotFoundError
+		if errors.As(err, &notFound) {
+			// The memberships have expired or their segments have been deactivated since FindAll
+			if err = r.Del(ctx, UserSegmentsKey(u.Id)); err != nil {
+				slog.ErrorContext(ctx, "failed to drop cached user segments", "user_id", u.Id, "err", err)
+			}
+			continue
+		}
 		if err != nil {
-			log.Println("error to get users:", err)
-			return err
+			slog.ErrorContext(ctx, "failed to find active user segments", "user_id", u.Id, "err", err)
+			continue
 		}
-
-		for _, u := range users {
-			us, err := userRepo.FindByUserId(ctx, u.Id)
-			if err != nil {
-				log.Println("error to find active users segments:", err)
-				continue
-			}
-			key := fmt.Sprintf("avito_user_%d", us.UserId)
-			err = r.AddToCache(ctx, key, us, 5*time.Minute)
-			if err != nil {
-				log.Println("error to add cache in redis:", err)
-				continue
-			}
+		err = r.AddToCache(ctx, UserSegmentsKey(us.UserId), us, time.Duration(r.userSegmentsTtl.Load()))
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to cache user segments", "user_id", us.UserId, "err", err)
+			continue
 		}
-		return nil
-	})
+		n++
+	}
+	return n, nil
+}
 
+// delBatch is the number of keys dropped by a single DEL.
+const delBatch = 1000
+
+// DropSegmentMembers drops the cached segments of the members of the segment, so that a change of the segment
+// which the cached segments depend on, such as its status, is visible immediately.
+func DropSegmentMembers(ctx context.Context, rdb Repository, segmentRepo segment.Repository, segmentId int) error {
+	userIds, err := segmentRepo.FindMembers(ctx, segmentId)
 	if err != nil {
-		log.Println("error update cache:", err)
+		return err
+	}
+
+	keys := make([]string, 0, delBatch)
+	for i, userId := range userIds {
+		keys = append(keys, UserSegmentsKey(userId))
+		if len(keys) == delBatch || i == len(userIds)-1 {
+			if err = rdb.Del(ctx, keys...); err != nil {
+				return err
+			}
+			keys = keys[:0]
+		}
 	}
-	s.StartAsync()
+	return nil
 }
 
 func (r *repository) Exists(ctx context.Context, keys ...string) (int64, error) {
 	return r.client.Exists(ctx, keys...).Result()
 }
 
+func (r *repository) Del(ctx context.Context, keys ...string) error {
+	return r.client.Del(ctx, keys...).Err()
+}
+
 func (r *repository) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
 	return r.client.Set(ctx, key, value, expiration)
 }
 
-func NewRepo(client *redis.Client) Repository {
-	return &repository{
-		client: client,
-	}
+// NewRepo creates a cache repository. userSegmentsTtl is the lifetime of the cached active segments of a user.
+func NewRepo(client *redis.Client, userSegmentsTtl time.Duration) Repository {
+	r := &repository{client: client}
+	r.SetUserSegmentsTtl(userSegmentsTtl)
+	return r
+}
+
+// SetUserSegmentsTtl changes the lifetime of the active segments cached from now on.
+func (r *repository) SetUserSegmentsTtl(ttl time.Duration) {
+	r.userSegmentsTtl.Store(int64(ttl))
 }
@@ -51,6 +51,25 @@ func (mr *MockRepositoryMockRecorder) AddToCache(ctx, key, data, exp interface{}
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddToCache", reflect.TypeOf((*MockRepository)(nil).AddToCache), ctx, key, data, exp)
 }
 
+// Del mocks base method.
+func (m *MockRepository) Del(ctx context.Context, keys ...string) error {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{ctx}
+	for _, a := range keys {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "Del", varargs...)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Del indicates an expected call of Del.
+func (mr *MockRepositoryMockRecorder) Del(ctx interface{}, keys ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]interface{}{ctx}, keys...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Del", reflect.TypeOf((*MockRepository)(nil).Del), varargs...)
+}
+
 // Exists mocks base method.
 func (m *MockRepository) Exists(ctx context.Context, keys ...string) (int64, error) {
 	m.ctrl.T.Helper()
@@ -85,6 +104,21 @@ func (mr *MockRepositoryMockRecorder) Get(ctx, key, data interface{}) *gomock.Ca
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockRepository)(nil).Get), ctx, key, data)
 }
 
+// RefreshCache mocks base method.
+func (m *MockRepository) RefreshCache(ctx context.Context, userRepo user.Repository) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RefreshCache", ctx, userRepo)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RefreshCache indicates an expected call of RefreshCache.
+func (mr *MockRepositoryMockRecorder) RefreshCache(ctx, userRepo interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RefreshCache", reflect.TypeOf((*MockRepository)(nil).RefreshCache), ctx, userRepo)
+}
+
 // Set mocks base method.
 func (m *MockRepository) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
 	m.ctrl.T.Helper()
@@ -99,14 +133,14 @@ func (mr *MockRepositoryMockRecorder) Set(ctx, key, value, expiration interface{
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Set", reflect.TypeOf((*MockRepository)(nil).Set), ctx, key, value, expiration)
 }
 
-// UpdateCache mocks base method.
-func (m *MockRepository) UpdateCache(ctx context.Context, userRepo user.Repository) {
+// SetUserSegmentsTtl mocks base method.
+func (m *MockRepository) SetUserSegmentsTtl(ttl time.Duration) {
 	m.ctrl.T.Helper()
-	m.ctrl.Call(m, "UpdateCache", ctx, userRepo)
+	m.ctrl.Call(m, "SetUserSegmentsTtl", ttl)
 }
 
-// UpdateCache indicates an expected call of UpdateCache.
-func (mr *MockRepositoryMockRecorder) UpdateCache(ctx, userRepo interface{}) *gomock.Call {
+// SetUserSegmentsTtl indicates an expected call of SetUserSegmentsTtl.
+func (mr *MockRepositoryMockRecorder) SetUserSegmentsTtl(ttl interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateCache", reflect.TypeOf((*MockRepository)(nil).UpdateCache), ctx, userRepo)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetUserSegmentsTtl", reflect.TypeOf((*MockRepository)(nil).SetUserSegmentsTtl), ttl)
 }
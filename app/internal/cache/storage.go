@@ -11,7 +11,9 @@ import (
 type Repository interface {
 	AddToCache(ctx context.Context, key string, data interface{}, exp time.Duration) error
 	Get(ctx context.Context, key string, data interface{}) error
-	UpdateCache(ctx context.Context, userRepo user.Repository)
+	RefreshCache(ctx context.Context, userRepo user.Repository) (int, error)
 	Exists(ctx context.Context, keys ...string) (int64, error)
+	Del(ctx context.Context, keys ...string) error
 	Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd
+	SetUserSegmentsTtl(ttl time.Duration)
 }
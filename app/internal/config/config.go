@@ -1,11 +1,17 @@
 package config
 
+import "time"
+
 type PostgresConfig struct {
 	Password string `yaml:"password"`
-	User     string `yaml:"user"`
-	DbName   string `yaml:"name"`
-	Host     string `yaml:"host"`
-	Port     string `yaml:"port"`
+	// PasswordFile is the file the password is read from, e.g. a Docker secret
+	PasswordFile string `yaml:"password_file"`
+	User         string `yaml:"user"`
+	DbName       string `yaml:"name"`
+	Host         string `yaml:"host"`
+	Port         string `yaml:"port"`
+	// MigrateOnStart applies the pending migrations when the app starts
+	MigrateOnStart bool `yaml:"migrate_on_start"`
 }
 
 type RedisConfig struct {
@@ -18,18 +24,181 @@ type AppConfig struct {
 	Port   string `yaml:"port"`
 	Scheme string `yaml:"scheme"`
 	Domain string `yaml:"domain"`
+	// ShutdownTimeout limits how long in-flight requests and reports are waited for on shutdown
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// ReloadInterval is how often the config file is checked for changes, 0 disables the check
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+type AdminConfig struct {
+	// Token is the bearer token of the /admin routes, they are disabled if it is empty
+	Token string `yaml:"token"`
+	// TokenFile is the file the token is read from, e.g. a Docker secret
+	TokenFile string `yaml:"token_file"`
 }
 
+type GrpcConfig struct {
+	// Port is the port of the gRPC server, it listens on the host of the app
+	Port string `yaml:"port"`
+	// Reflection lets tools like grpcurl discover the services
+	Reflection bool `yaml:"reflection"`
+}
+
+type RateLimitConfig struct {
+	// Rps is the number of requests per second allowed on each route
+	Rps float64 `yaml:"rps"`
+	// Burst is the number of requests allowed at once
+	Burst int `yaml:"burst"`
+}
+
+type CacheConfig struct {
+	// UserSegmentsTtl is the lifetime of the cached active segments of a user
+	UserSegmentsTtl time.Duration `yaml:"user_segments_ttl"`
+}
+
+type JobConfig struct {
+	// Cron is the schedule of the job in the five-field cron format, in UTC
+	Cron string `yaml:"cron"`
+}
+
+type JobsConfig struct {
+	TtlCleanup     JobConfig `yaml:"ttl_cleanup"`
+	CacheRefresh   JobConfig `yaml:"cache_refresh"`
+	JobRunsCleanup JobConfig `yaml:"job_runs_cleanup"`
+	RuleSegments   JobConfig `yaml:"rule_segments"`
+	// LockLease is how long the instance running a job holds the lock if it dies during the run
+	LockLease time.Duration `yaml:"lock_lease"`
+	// LockHold is the minimum time the lock is held, so that other instances skip the same run
+	LockHold time.Duration `yaml:"lock_hold"`
+	// KeepRunsDays is how many days job runs are kept in the history
+	KeepRunsDays int `yaml:"keep_runs_days"`
+}
+
+type OutboxConfig struct {
+	// Stream is the Redis Stream the membership events are published to
+	Stream string `yaml:"stream"`
+	// MaxLen is the approximate number of entries the stream is trimmed to, 0 keeps all of them
+	MaxLen int64 `yaml:"max_len"`
+	// Interval is how often the relay publishes the new events
+	Interval time.Duration `yaml:"interval"`
+	// BatchSize is the maximum number of events published at once
+	BatchSize int `yaml:"batch_size"`
+}
+
+type WebhookConfig struct {
+	// Interval is how often the dispatcher sends the due deliveries
+	Interval time.Duration `yaml:"interval"`
+	// Timeout limits a single delivery request
+	Timeout time.Duration `yaml:"timeout"`
+	// MaxAttempts is the number of attempts after which a delivery goes to the dead letters
+	MaxAttempts int `yaml:"max_attempts"`
+	// MinBackoff is the delay after the first failed attempt, it doubles after each next one up to MaxBackoff
+	MinBackoff time.Duration `yaml:"min_backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+	// BatchSize is the maximum number of deliveries sent at once
+	BatchSize int `yaml:"batch_size"`
+}
+
+type HealthConfig struct {
+	// Timeout limits the time of all readiness checks
+	Timeout time.Duration `yaml:"timeout"`
+	// MinFreeDiskMb is the free space in the report storage below which the app is not ready
+	MinFreeDiskMb uint64 `yaml:"min_free_disk_mb"`
+}
+
+type TracingConfig struct {
+	// Exporter is where spans are sent: "none", "otlp" or "stdout"
+	Exporter string `yaml:"exporter"`
+	// Endpoint is the host:port of the OTLP/HTTP collector
+	Endpoint string `yaml:"endpoint"`
+	Insecure bool   `yaml:"insecure"`
+	// File is where the stdout exporter writes spans, the standard output if empty
+	File string `yaml:"file"`
+	// SampleRatio is the share of traces which are recorded, from 0 to 1
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+type LogConfig struct {
+	// Level is the minimum level of logged records: "debug", "info", "warn" or "error"
+	Level string `yaml:"level"`
+	// Format is "json" or "text"
+	Format string `yaml:"format"`
+}
+
+// Config is the configuration of the app. The rate limits, the cache TTL, the log level
+// and the schedules of the jobs are reloaded at runtime, other settings require a restart.
 type Config struct {
-	AppCfg      AppConfig      `yaml:"app"`
-	PostgresCfg PostgresConfig `yaml:"db"`
-	RedisCfg    RedisConfig    `yaml:"redis"`
+	// Path is the YAML file the config has been loaded from
+	Path string `yaml:"-"`
+
+	AppCfg       AppConfig       `yaml:"app"`
+	AdminCfg     AdminConfig     `yaml:"admin"`
+	GrpcCfg      GrpcConfig      `yaml:"grpc"`
+	RateLimitCfg RateLimitConfig `yaml:"rate_limit"`
+	PostgresCfg  PostgresConfig  `yaml:"db"`
+	RedisCfg     RedisConfig     `yaml:"redis"`
+	CacheCfg     CacheConfig     `yaml:"cache"`
+	JobsCfg      JobsConfig      `yaml:"jobs"`
+	OutboxCfg    OutboxConfig    `yaml:"outbox"`
+	WebhookCfg   WebhookConfig   `yaml:"webhook"`
+	HealthCfg    HealthConfig    `yaml:"health"`
+	TracingCfg   TracingConfig   `yaml:"tracing"`
+	LogCfg       LogConfig       `yaml:"log"`
 }
 
 func NewConfig() *Config {
 	return &Config{
-		AppCfg:      AppConfig{},
+		AppCfg: AppConfig{
+			ShutdownTimeout: 30 * time.Second,
+			ReloadInterval:  5 * time.Second,
+		},
+		GrpcCfg: GrpcConfig{
+			Port:       "50051",
+			Reflection: true,
+		},
+		RateLimitCfg: RateLimitConfig{
+			Rps:   10,
+			Burst: 10,
+		},
 		PostgresCfg: PostgresConfig{},
 		RedisCfg:    RedisConfig{},
+		CacheCfg: CacheConfig{
+			UserSegmentsTtl: 5 * time.Minute,
+		},
+		JobsCfg: JobsConfig{
+			TtlCleanup:     JobConfig{Cron: "* * * * *"},
+			CacheRefresh:   JobConfig{Cron: "* * * * *"},
+			JobRunsCleanup: JobConfig{Cron: "0 0 * * *"},
+			RuleSegments:   JobConfig{Cron: "* * * * *"},
+			LockLease:      10 * time.Minute,
+			LockHold:       30 * time.Second,
+			KeepRunsDays:   7,
+		},
+		OutboxCfg: OutboxConfig{
+			Stream:    "segment_events",
+			MaxLen:    1000000,
+			Interval:  time.Second,
+			BatchSize: 500,
+		},
+		WebhookCfg: WebhookConfig{
+			Interval:    time.Second,
+			Timeout:     10 * time.Second,
+			MaxAttempts: 10,
+			MinBackoff:  10 * time.Second,
+			MaxBackoff:  time.Hour,
+			BatchSize:   50,
+		},
+		HealthCfg: HealthConfig{
+			Timeout:       2 * time.Second,
+			MinFreeDiskMb: 100,
+		},
+		TracingCfg: TracingConfig{
+			Exporter:    "none",
+			SampleRatio: 1,
+		},
+		LogCfg: LogConfig{
+			Level:  "info",
+			Format: "json",
+		},
 	}
 }
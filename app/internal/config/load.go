@@ -0,0 +1,188 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	DefaultPath = "./config/app.yaml"
+	PathEnv     = "CONFIG_PATH"
+)
+
+// envVars maps the environment variables to the flags which they set.
+// The Postgres ones are the same as the variables of the postgres image in docker-compose.yaml.
+var envVars = []struct {
+	env  string
+	flag string
+}{
+	{"APP_HOST", "app-host"},
+	{"APP_PORT", "app-port"},
+	{"APP_SCHEME", "app-scheme"},
+	{"APP_DOMAIN", "app-domain"},
+	{"APP_SHUTDOWN_TIMEOUT", "app-shutdown-timeout"},
+	{"APP_RELOAD_INTERVAL", "app-reload-interval"},
+	{"ADMIN_TOKEN", "admin-token"},
+	{"ADMIN_TOKEN_FILE", "admin-token-file"},
+	{"GRPC_PORT", "grpc-port"},
+	{"GRPC_REFLECTION", "grpc-reflection"},
+	{"RATE_LIMIT_RPS", "rate-limit-rps"},
+	{"RATE_LIMIT_BURST", "rate-limit-burst"},
+	{"POSTGRES_HOST", "db-host"},
+	{"POSTGRES_PORT", "db-port"},
+	{"POSTGRES_DB", "db-name"},
+	{"POSTGRES_USER", "db-user"},
+	{"POSTGRES_PASSWORD", "db-password"},
+	{"POSTGRES_PASSWORD_FILE", "db-password-file"},
+	{"MIGRATE_ON_START", "db-migrate-on-start"},
+	{"REDIS_HOST", "redis-host"},
+	{"REDIS_PORT", "redis-port"},
+	{"CACHE_USER_SEGMENTS_TTL", "cache-user-segments-ttl"},
+	{"OUTBOX_STREAM", "outbox-stream"},
+	{"OUTBOX_INTERVAL", "outbox-interval"},
+	{"WEBHOOK_TIMEOUT", "webhook-timeout"},
+	{"WEBHOOK_MAX_ATTEMPTS", "webhook-max-attempts"},
+	{"LOG_LEVEL", "log-level"},
+	{"LOG_FORMAT", "log-format"},
+	{"TRACING_EXPORTER", "tracing-exporter"},
+	{"TRACING_ENDPOINT", "tracing-endpoint"},
+	{"TRACING_SAMPLE_RATIO", "tracing-sample-ratio"},
+}
+
+// newFlagSet defines the flags which override the settings of cfg.
+func newFlagSet(cfg *Config) *flag.FlagSet {
+	fs := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+	fs.StringVar(&cfg.AppCfg.Host, "app-host", cfg.AppCfg.Host, "host the web server listens on")
+	fs.StringVar(&cfg.AppCfg.Port, "app-port", cfg.AppCfg.Port, "port the web server listens on")
+	fs.StringVar(&cfg.AppCfg.Scheme, "app-scheme", cfg.AppCfg.Scheme, "scheme of the links to reports")
+	fs.StringVar(&cfg.AppCfg.Domain, "app-domain", cfg.AppCfg.Domain, "domain of the links to reports")
+	fs.DurationVar(&cfg.AppCfg.ShutdownTimeout, "app-shutdown-timeout", cfg.AppCfg.ShutdownTimeout, "how long to wait for requests and reports on shutdown")
+	fs.DurationVar(&cfg.AppCfg.ReloadInterval, "app-reload-interval", cfg.AppCfg.ReloadInterval, "how often the config file is checked for changes, 0 to disable")
+	fs.StringVar(&cfg.AdminCfg.Token, "admin-token", cfg.AdminCfg.Token, "bearer token of the admin routes, they are disabled if empty")
+	fs.StringVar(&cfg.AdminCfg.TokenFile, "admin-token-file", cfg.AdminCfg.TokenFile, "file with the admin token, takes precedence over the token")
+	fs.StringVar(&cfg.GrpcCfg.Port, "grpc-port", cfg.GrpcCfg.Port, "port the gRPC server listens on")
+	fs.BoolVar(&cfg.GrpcCfg.Reflection, "grpc-reflection", cfg.GrpcCfg.Reflection, "enable the gRPC reflection service")
+	fs.Float64Var(&cfg.RateLimitCfg.Rps, "rate-limit-rps", cfg.RateLimitCfg.Rps, "requests per second allowed on each route")
+	fs.IntVar(&cfg.RateLimitCfg.Burst, "rate-limit-burst", cfg.RateLimitCfg.Burst, "requests allowed at once on each route")
+	fs.StringVar(&cfg.PostgresCfg.Host, "db-host", cfg.PostgresCfg.Host, "Postgres host")
+	fs.StringVar(&cfg.PostgresCfg.Port, "db-port", cfg.PostgresCfg.Port, "Postgres port")
+	fs.StringVar(&cfg.PostgresCfg.DbName, "db-name", cfg.PostgresCfg.DbName, "Postgres database")
+	fs.StringVar(&cfg.PostgresCfg.User, "db-user", cfg.PostgresCfg.User, "Postgres user")
+	fs.StringVar(&cfg.PostgresCfg.Password, "db-password", cfg.PostgresCfg.Password, "Postgres password")
+	fs.StringVar(&cfg.PostgresCfg.PasswordFile, "db-password-file", cfg.PostgresCfg.PasswordFile, "file with the Postgres password, takes precedence over the password")
+	fs.BoolVar(&cfg.PostgresCfg.MigrateOnStart, "db-migrate-on-start", cfg.PostgresCfg.MigrateOnStart, "apply pending migrations on start")
+	fs.StringVar(&cfg.RedisCfg.Host, "redis-host", cfg.RedisCfg.Host, "Redis host")
+	fs.StringVar(&cfg.RedisCfg.Port, "redis-port", cfg.RedisCfg.Port, "Redis port")
+	fs.DurationVar(&cfg.CacheCfg.UserSegmentsTtl, "cache-user-segments-ttl", cfg.CacheCfg.UserSegmentsTtl, "lifetime of the cached user segments")
+	fs.StringVar(&cfg.OutboxCfg.Stream, "outbox-stream", cfg.OutboxCfg.Stream, "Redis Stream of the membership events")
+	fs.DurationVar(&cfg.OutboxCfg.Interval, "outbox-interval", cfg.OutboxCfg.Interval, "how often the membership events are published")
+	fs.DurationVar(&cfg.WebhookCfg.Timeout, "webhook-timeout", cfg.WebhookCfg.Timeout, "timeout of a webhook delivery request")
+	fs.IntVar(&cfg.WebhookCfg.MaxAttempts, "webhook-max-attempts", cfg.WebhookCfg.MaxAttempts, "attempts of a webhook delivery before it goes to the dead letters")
+	fs.StringVar(&cfg.LogCfg.Level, "log-level", cfg.LogCfg.Level, "log level: debug, info, warn or error")
+	fs.StringVar(&cfg.LogCfg.Format, "log-format", cfg.LogCfg.Format, "log format: json or text")
+	fs.StringVar(&cfg.TracingCfg.Exporter, "tracing-exporter", cfg.TracingCfg.Exporter, "tracing exporter: none, otlp or stdout")
+	fs.StringVar(&cfg.TracingCfg.Endpoint, "tracing-endpoint", cfg.TracingCfg.Endpoint, "host:port of the OTLP/HTTP collector")
+	fs.Float64Var(&cfg.TracingCfg.SampleRatio, "tracing-sample-ratio", cfg.TracingCfg.SampleRatio, "share of recorded traces from 0 to 1")
+	return fs
+}
+
+// Load builds the config from the layers, each of which overrides the previous one:
+// the defaults, the YAML file, the environment variables and the command line flags.
+// The YAML file is taken from the -config flag, the CONFIG_PATH variable or DefaultPath.
+// The resulting config is validated.
+func Load(args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	cfg, rest, err := Parse(args, lookupEnv)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(rest, " "))
+	}
+	return cfg, nil
+}
+
+// Parse is Load for subcommands, it also returns the arguments left after the flags.
+func Parse(args []string, lookupEnv func(string) (string, bool)) (*Config, []string, error) {
+	// The flags are parsed first to find the YAML file, but they are applied last
+	flags := newFlagSet(NewConfig())
+	path := flags.String("config", DefaultPath, "path to the YAML config file")
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	if v, ok := lookupEnv(PathEnv); ok && !isSet(flags, "config") {
+		*path = v
+	}
+
+	cfg, err := LoadFile(*path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	layer := newFlagSet(cfg)
+	for _, v := range envVars {
+		value, ok := lookupEnv(v.env)
+		if !ok {
+			continue
+		}
+		if err = layer.Set(v.flag, value); err != nil {
+			return nil, nil, fmt.Errorf("invalid value %q of %s: %w", value, v.env, err)
+		}
+	}
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name != "config" && err == nil {
+			err = layer.Set(f.Name, f.Value.String())
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if cfg.PostgresCfg.PasswordFile != "" {
+		password, err := os.ReadFile(cfg.PostgresCfg.PasswordFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("read postgres password file: %w", err)
+		}
+		cfg.PostgresCfg.Password = strings.TrimRight(string(password), "\r\n")
+	}
+	if cfg.AdminCfg.TokenFile != "" {
+		token, err := os.ReadFile(cfg.AdminCfg.TokenFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("read admin token file: %w", err)
+		}
+		cfg.AdminCfg.Token = strings.TrimRight(string(token), "\r\n")
+	}
+
+	if err = cfg.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("invalid config:\n%w", err)
+	}
+	return cfg, flags.Args(), nil
+}
+
+// LoadFile reads the YAML file over the defaults, without validation.
+func LoadFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config file: %w", err)
+	}
+
+	cfg := NewConfig()
+	if err = yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parse config file %s: %w", path, err)
+	}
+	cfg.Path = path
+	return cfg, nil
+}
+
+func isSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
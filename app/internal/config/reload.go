@@ -0,0 +1,142 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Reloader keeps the current config and reloads its runtime-tunable settings
+// on SIGHUP or when the config file changes. The components of the app subscribe to the reloads.
+type Reloader struct {
+	mu      sync.Mutex
+	current *Config
+	load    func() (*Config, error)
+	subs    []func(cfg *Config) error
+}
+
+// NewReloader creates a reloader of cfg. load builds a new validated config,
+// the same way the current one has been built.
+func NewReloader(cfg *Config, load func() (*Config, error)) *Reloader {
+	current := *cfg
+	return &Reloader{current: &current, load: load}
+}
+
+// Subscribe registers fn which applies the reloaded config. It is not called for the current config.
+func (r *Reloader) Subscribe(fn func(cfg *Config) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subs = append(r.subs, fn)
+}
+
+// Current returns a copy of the current config.
+func (r *Reloader) Current() Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return *r.current
+}
+
+// tunable copies the settings which can be changed at runtime from src to dst.
+func tunable(dst, src *Config) {
+	dst.RateLimitCfg = src.RateLimitCfg
+	dst.CacheCfg.UserSegmentsTtl = src.CacheCfg.UserSegmentsTtl
+	dst.LogCfg.Level = src.LogCfg.Level
+	dst.JobsCfg.TtlCleanup.Cron = src.JobsCfg.TtlCleanup.Cron
+	dst.JobsCfg.CacheRefresh.Cron = src.JobsCfg.CacheRefresh.Cron
+	dst.JobsCfg.JobRunsCleanup.Cron = src.JobsCfg.JobRunsCleanup.Cron
+	dst.JobsCfg.RuleSegments.Cron = src.JobsCfg.RuleSegments.Cron
+}
+
+// Reload loads the config and applies its runtime-tunable settings. If the config is invalid,
+// it is rejected and the current one is kept. If a subscriber fails to apply it, the current one is kept as well,
+// so that the next reload retries it. The subscribers have to tolerate the same config applied again. Changes of other settings are ignored until restart.
+func (r *Reloader) Reload() error {
+	loaded, err := r.load()
+	if err != nil {
+		return fmt.Errorf("config rejected, the current one is kept: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Compare the settings which can't be reloaded
+	restart := *loaded
+	tunable(&restart, r.current)
+	if !reflect.DeepEqual(&restart, r.current) {
+		slog.Warn("config changes other than rate limits, cache ttl, log level and job schedules require a restart")
+	}
+
+	next := *r.current
+	tunable(&next, loaded)
+	if reflect.DeepEqual(&next, r.current) {
+		return nil
+	}
+
+	var errs []error
+	for _, fn := range r.subs {
+		if err = fn(&next); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	// The config is not committed unless all the subscribers have applied it, so the next reload applies it again
+	if len(errs) > 0 {
+		return fmt.Errorf("apply reloaded config: %w", errors.Join(errs...))
+	}
+	r.current = &next
+	return nil
+}
+
+// Watch reloads the config on SIGHUP and, if interval is positive, when the modification time
+// of the config file changes. It blocks until ctx is done.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	path := r.Current().Path
+	modTime := fileModTime(path)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			r.reload("signal")
+		case <-tick:
+			// The file is stat'ed and not watched, so that replacing a mounted file or its symlink is noticed too
+			if t := fileModTime(path); !t.Equal(modTime) {
+				modTime = t
+				r.reload("file change")
+			}
+		}
+	}
+}
+
+func (r *Reloader) reload(reason string) {
+	if err := r.Reload(); err != nil {
+		slog.Error("failed to reload config", "reason", reason, "err", err)
+		return
+	}
+	slog.Info("config reloaded", "reason", reason)
+}
+
+func fileModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,96 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"github.com/robfig/cron/v3"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Validate checks the config and returns all the problems found, one per line.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, field string, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+		}
+	}
+	port := func(field, value string) {
+		p, err := strconv.Atoi(value)
+		check(err == nil && p > 0 && p <= 65535, field, "must be a port number, got %q", value)
+	}
+	positive := func(field string, d time.Duration) {
+		check(d > 0, field, "must be a positive duration, got %s", d)
+	}
+	oneOf := func(field, value string, allowed ...string) {
+		for _, a := range allowed {
+			if value == a {
+				return
+			}
+		}
+		check(false, field, "must be one of %s, got %q", strings.Join(allowed, ", "), value)
+	}
+	schedule := func(field, expr string) {
+		_, err := cron.ParseStandard(expr)
+		check(err == nil, field, "must be a five-field cron expression, got %q", expr)
+	}
+
+	port("app.port", c.AppCfg.Port)
+	oneOf("app.scheme", c.AppCfg.Scheme, "http", "https")
+	check(c.AppCfg.Domain != "", "app.domain", "must not be empty")
+	positive("app.shutdown_timeout", c.AppCfg.ShutdownTimeout)
+	check(c.AppCfg.ReloadInterval >= 0, "app.reload_interval", "must not be negative, got %s", c.AppCfg.ReloadInterval)
+
+	check(c.AdminCfg.Token == "" || len(c.AdminCfg.Token) >= 16, "admin.token", "must be at least 16 characters")
+
+	port("grpc.port", c.GrpcCfg.Port)
+	check(c.GrpcCfg.Port != c.AppCfg.Port, "grpc.port", "must differ from app.port")
+
+	check(c.RateLimitCfg.Rps > 0, "rate_limit.rps", "must be positive, got %v", c.RateLimitCfg.Rps)
+	check(c.RateLimitCfg.Burst > 0, "rate_limit.burst", "must be positive, got %d", c.RateLimitCfg.Burst)
+
+	check(c.PostgresCfg.Host != "", "db.host", "must not be empty")
+	port("db.port", c.PostgresCfg.Port)
+	check(c.PostgresCfg.DbName != "", "db.name", "must not be empty")
+	check(c.PostgresCfg.User != "", "db.user", "must not be empty")
+
+	check(c.RedisCfg.Host != "", "redis.host", "must not be empty")
+	port("redis.port", c.RedisCfg.Port)
+
+	positive("cache.user_segments_ttl", c.CacheCfg.UserSegmentsTtl)
+
+	schedule("jobs.ttl_cleanup.cron", c.JobsCfg.TtlCleanup.Cron)
+	schedule("jobs.cache_refresh.cron", c.JobsCfg.CacheRefresh.Cron)
+	schedule("jobs.job_runs_cleanup.cron", c.JobsCfg.JobRunsCleanup.Cron)
+	schedule("jobs.rule_segments.cron", c.JobsCfg.RuleSegments.Cron)
+	positive("jobs.lock_lease", c.JobsCfg.LockLease)
+	check(c.JobsCfg.LockHold >= 0, "jobs.lock_hold", "must not be negative, got %s", c.JobsCfg.LockHold)
+	check(c.JobsCfg.KeepRunsDays > 0, "jobs.keep_runs_days", "must be positive, got %d", c.JobsCfg.KeepRunsDays)
+
+	check(c.OutboxCfg.Stream != "", "outbox.stream", "must not be empty")
+	check(c.OutboxCfg.MaxLen >= 0, "outbox.max_len", "must not be negative, got %d", c.OutboxCfg.MaxLen)
+	positive("outbox.interval", c.OutboxCfg.Interval)
+	check(c.OutboxCfg.BatchSize > 0, "outbox.batch_size", "must be positive, got %d", c.OutboxCfg.BatchSize)
+
+	positive("webhook.interval", c.WebhookCfg.Interval)
+	positive("webhook.timeout", c.WebhookCfg.Timeout)
+	check(c.WebhookCfg.MaxAttempts > 0, "webhook.max_attempts", "must be positive, got %d", c.WebhookCfg.MaxAttempts)
+	positive("webhook.min_backoff", c.WebhookCfg.MinBackoff)
+	check(c.WebhookCfg.MaxBackoff >= c.WebhookCfg.MinBackoff, "webhook.max_backoff", "must not be less than webhook.min_backoff, got %s", c.WebhookCfg.MaxBackoff)
+	check(c.WebhookCfg.BatchSize > 0, "webhook.batch_size", "must be positive, got %d", c.WebhookCfg.BatchSize)
+
+	positive("health.timeout", c.HealthCfg.Timeout)
+
+	oneOf("tracing.exporter", c.TracingCfg.Exporter, "none", "otlp", "stdout")
+	if c.TracingCfg.Exporter == "otlp" {
+		check(c.TracingCfg.Endpoint != "", "tracing.endpoint", "must not be empty for the otlp exporter")
+	}
+	check(c.TracingCfg.SampleRatio >= 0 && c.TracingCfg.SampleRatio <= 1, "tracing.sample_ratio", "must be from 0 to 1, got %v", c.TracingCfg.SampleRatio)
+
+	oneOf("log.level", c.LogCfg.Level, "debug", "info", "warn", "error")
+	oneOf("log.format", c.LogCfg.Format, "json", "text")
+
+	return errors.Join(errs...)
+}
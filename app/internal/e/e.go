@@ -35,3 +35,139 @@ type SegmentsNotFoundError struct {
 func (e *SegmentsNotFoundError) Error() string {
 	return fmt.Sprintf("segments not found: %s", e.Slugs)
 }
+
+type MembershipNotFoundError struct {
+	UserId int
+	Slug   string
+}
+
+func (e *MembershipNotFoundError) Error() string {
+	return fmt.Sprintf("user with id '%d' is not in segment '%s'", e.UserId, e.Slug)
+}
+
+type JobNotFoundError struct {
+	Name string
+}
+
+func (e *JobNotFoundError) Error() string {
+	return fmt.Sprintf("job '%s' not found", e.Name)
+}
+
+type JobRunningError struct {
+	Name string
+}
+
+func (e *JobRunningError) Error() string {
+	return fmt.Sprintf("job '%s' is already running", e.Name)
+}
+
+type WebhookNotFoundError struct {
+	Id int
+}
+
+func (e *WebhookNotFoundError) Error() string {
+	return fmt.Sprintf("webhook with id '%d' not found", e.Id)
+}
+
+type DeadLetterNotFoundError struct {
+	DeliveryId int64
+}
+
+func (e *DeadLetterNotFoundError) Error() string {
+	return fmt.Sprintf("dead letter of delivery '%d' not found", e.DeliveryId)
+}
+
+// RuleSegmentError is returned when the members of dynamic segments are changed directly,
+// they are managed by the rules of the segments.
+type RuleSegmentError struct {
+	Slugs []string
+}
+
+func (e *RuleSegmentError) Error() string {
+	return fmt.Sprintf("segments are managed by their rules: %s", e.Slugs)
+}
+
+type ExperimentNotFoundError struct {
+	Slug string
+}
+
+func (e *ExperimentNotFoundError) Error() string {
+	return fmt.Sprintf("experiment '%s' not found", e.Slug)
+}
+
+type DuplicateExperimentError struct {
+	Slug string
+}
+
+func (e *DuplicateExperimentError) Error() string {
+	return fmt.Sprintf("experiment '%s' already exists", e.Slug)
+}
+
+// InactiveExperimentError is returned when a user is allocated in an experiment none of whose variants is active.
+type InactiveExperimentError struct {
+	Slug string
+}
+
+func (e *InactiveExperimentError) Error() string {
+	return fmt.Sprintf("experiment '%s' has no active variants", e.Slug)
+}
+
+// SegmentInExperimentError is returned when the segment of a variant is deleted while its experiment exists.
+type SegmentInExperimentError struct {
+	Slug       string
+	Experiment string
+}
+
+func (e *SegmentInExperimentError) Error() string {
+	return fmt.Sprintf("segment '%s' is a variant of experiment '%s'", e.Slug, e.Experiment)
+}
+
+// ExclusionConflictError is returned when a user would be a member of several segments of an exclusion group.
+type ExclusionConflictError struct {
+	Group string
+	Slugs []string
+}
+
+func (e *ExclusionConflictError) Error() string {
+	return fmt.Sprintf("segments %s of exclusion group '%s' are mutually exclusive", e.Slugs, e.Group)
+}
+
+// ArchivedSegmentError is returned when users are added to archived segments, the archived segments keep
+// their members but do not accept new ones.
+type ArchivedSegmentError struct {
+	Slugs []string
+}
+
+func (e *ArchivedSegmentError) Error() string {
+	return fmt.Sprintf("segments are archived: %s", e.Slugs)
+}
+
+// ParentNotFoundError is returned when the parent given to a segment does not exist.
+type ParentNotFoundError struct {
+	Slug string
+}
+
+func (e *ParentNotFoundError) Error() string {
+	return fmt.Sprintf("parent segment '%s' not found", e.Slug)
+}
+
+// SegmentCycleError is returned when the parent of a segment is the segment itself or one of its descendants.
+type SegmentCycleError struct {
+	Slug   string
+	Parent string
+}
+
+func (e *SegmentCycleError) Error() string {
+	return fmt.Sprintf("segment '%s' cannot be a child of '%s', the hierarchy would have a cycle", e.Slug, e.Parent)
+}
+
+// SegmentHasChildrenError is returned when a segment with children is deleted,
+// the children have to be moved to another parent or deleted first.
+type SegmentHasChildrenError struct {
+	Slug     string
+	Children []string
+}
+
+func (e *SegmentHasChildrenError) Error() string {
+	return fmt.Sprintf("segment '%s' is the parent of segments %s", e.Slug, e.Children)
+}
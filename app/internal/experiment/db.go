@@ -0,0 +1,277 @@
+package experiment
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"main/internal/e"
+	"main/internal/history"
+	"main/internal/outbox"
+	"main/internal/segment"
+	"main/pkg"
+	"main/pkg/utils"
+	"sort"
+	"time"
+)
+
+type repository struct {
+	client pkg.DBClient
+}
+
+// Create saves the experiment and creates the segments of its variants, their creation is written to the outbox.
+// It sets the IDs of the experiment and the segments and the creation time.
+func (r *repository) Create(ctx context.Context, experiment *Experiment) (err error) {
+	tx, err := r.client.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback(ctx)
+			panic(p)
+		} else if err != nil {
+			tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	q := `INSERT INTO experiments (slug) VALUES ($1) RETURNING experiment_id, created_at;`
+	err = tx.QueryRow(ctx, q, experiment.Slug).Scan(&experiment.Id, &experiment.CreatedAt)
+	if e.IsDuplicateError(err) {
+		return &e.DuplicateExperimentError{Slug: experiment.Slug}
+	}
+	if err != nil {
+		return err
+	}
+
+	slugs := make([]string, 0, len(experiment.Variants))
+	for _, v := range experiment.Variants {
+		slugs = append(slugs, v.Segment)
+	}
+	if err = segment.ReserveSlugs(ctx, tx, slugs...); err != nil {
+		return err
+	}
+
+	events := make([]outbox.Event, 0, len(experiment.Variants))
+	for i, v := range experiment.Variants {
+		q = `INSERT INTO segments (slug) VALUES ($1) RETURNING segment_id;`
+		err = tx.QueryRow(ctx, q, v.Segment).Scan(&v.SegmentId)
+		if e.IsDuplicateError(err) {
+			return &e.DuplicateSegmentError{SegmentName: v.Segment}
+		}
+		if err != nil {
+			return err
+		}
+
+		q = `INSERT INTO experiment_variants (experiment_id, position, name, segment_id, weight) VALUES ($1, $2, $3, $4, $5);`
+		if _, err = tx.Exec(ctx, q, experiment.Id, i, v.Name, v.SegmentId, v.Weight); err != nil {
+			return err
+		}
+		events = append(events, outbox.Event{Slug: v.Segment, Type: outbox.SegmentCreated, Reason: outbox.ReasonRequest})
+	}
+	return outbox.Write(ctx, tx, events...)
+}
+
+// Delete deletes the experiment. The segments of its variants stay with their members as ordinary segments.
+func (r *repository) Delete(ctx context.Context, slug string) error {
+	tag, err := r.client.Exec(ctx, `DELETE FROM experiments WHERE slug = $1;`, slug)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return &e.ExperimentNotFoundError{Slug: slug}
+	}
+	return nil
+}
+
+// FindAll returns all the experiments ordered by slug with their variants in the order of the assignment.
+func (r *repository) FindAll(ctx context.Context) ([]*Experiment, error) {
+	q := `
+		SELECT e.experiment_id, e.slug, e.created_at, v.name, s.slug, v.segment_id, v.weight
+		FROM experiments e
+		JOIN experiment_variants v ON v.experiment_id = e.experiment_id
+		JOIN segments s ON s.segment_id = v.segment_id
+		ORDER BY e.slug, v.position;
+	`
+	rows, err := r.client.Query(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	experiments := make([]*Experiment, 0)
+	var last *Experiment
+	for rows.Next() {
+		var ex Experiment
+		var v Variant
+		if err = rows.Scan(&ex.Id, &ex.Slug, &ex.CreatedAt, &v.Name, &v.Segment, &v.SegmentId, &v.Weight); err != nil {
+			return nil, err
+		}
+		if last == nil || last.Id != ex.Id {
+			last = &ex
+			experiments = append(experiments, last)
+		}
+		last.Variants = append(last.Variants, &v)
+	}
+	return experiments, rows.Err()
+}
+
+// findBySlug returns the experiment with its variants. The experiment is locked, so that it is not deleted
+// while the user is being assigned to it.
+func findBySlug(ctx context.Context, tx pgx.Tx, slug string) (*Experiment, error) {
+	ex := Experiment{Slug: slug}
+	q := `SELECT experiment_id, created_at FROM experiments WHERE slug = $1 FOR SHARE;`
+	err := tx.QueryRow(ctx, q, slug).Scan(&ex.Id, &ex.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, &e.ExperimentNotFoundError{Slug: slug}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	q = `
+		SELECT v.name, s.slug, v.segment_id, v.weight, s.default_ttl, s.status
+		FROM experiment_variants v JOIN segments s ON s.segment_id = v.segment_id
+		WHERE v.experiment_id = $1
+		ORDER BY v.position;
+	`
+	rows, err := tx.Query(ctx, q, ex.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var v Variant
+		if err = rows.Scan(&v.Name, &v.Segment, &v.SegmentId, &v.Weight, &v.DefaultTtl, &v.Status); err != nil {
+			return nil, err
+		}
+		ex.Variants = append(ex.Variants, &v)
+	}
+	return &ex, rows.Err()
+}
+
+// Allocate returns the variant of the user in the experiment. Only the variants with active segments count,
+// the segments which are not active are hidden from their members and do not take new ones. The variant is sticky:
+// if the user is already in the segment of one of them, e.g. added there explicitly, that variant is returned.
+// Otherwise the user is assigned to a variant by Experiment.Assign and added to its segment for the default TTL
+// of the segment, the membership is written to the history and the outbox.
+func (r *repository) Allocate(ctx context.Context, slug string, userId int, historyRepo history.Repository) (allocation *Allocation, err error) {
+	tx, err := r.client.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback(ctx)
+			panic(p)
+		} else if err != nil {
+			tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	ex, err := findBySlug(ctx, tx, slug)
+	if err != nil {
+		return nil, err
+	}
+	active := ex.Active()
+	if len(active.Variants) == 0 {
+		return nil, inactiveError(ex)
+	}
+
+	// The user is locked, so that the concurrent first exposures assign the user once
+	var found int
+	err = tx.QueryRow(ctx, `SELECT 1 FROM users WHERE user_id = $1 FOR UPDATE;`, userId).Scan(&found)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, &e.UserNotFoundError{UserId: userId}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	segmentIds := make([]int, 0, len(active.Variants))
+	for _, v := range active.Variants {
+		segmentIds = append(segmentIds, v.SegmentId)
+	}
+	q := `
+		SELECT segment_id FROM user_segments
+		WHERE user_id = $1 AND segment_id = ANY($2) AND (alive_until IS NULL OR alive_until > now())
+		ORDER BY added_at
+		LIMIT 1;
+	`
+	var segmentId int
+	err = tx.QueryRow(ctx, q, userId, segmentIds).Scan(&segmentId)
+	if err == nil {
+		v := active.Variant(segmentId)
+		return &Allocation{Experiment: slug, UserId: userId, Variant: v.Name, Segment: v.Segment}, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, err
+	}
+
+	v := active.Assign(userId)
+	// The membership lasts for the default TTL of the segment, as if the user was added to it by a request
+	var aliveUntil *time.Time
+	if v.DefaultTtl != nil {
+		d, err := utils.ParseISODuration(*v.DefaultTtl)
+		if err != nil {
+			return nil, err
+		}
+		t := d.AddTo(time.Now()).UTC()
+		aliveUntil = &t
+	}
+	// An expired membership which has not been cleaned up yet is renewed
+	q = `
+		INSERT INTO user_segments (user_id, segment_id, alive_until) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, segment_id) DO UPDATE SET added_at = now(), alive_until = EXCLUDED.alive_until;
+	`
+	if _, err = tx.Exec(ctx, q, userId, v.SegmentId, aliveUntil); err != nil {
+		return nil, err
+	}
+
+	h := history.History{
+		UserId:     userId,
+		SegmentIds: []int{v.SegmentId},
+		Operation:  "added",
+		Date:       time.Now(),
+	}
+	if err = historyRepo.Create(ctx, &h, tx); err != nil {
+		return nil, err
+	}
+	err = outbox.Write(ctx, tx, outbox.Event{
+		UserId:     userId,
+		Slug:       v.Segment,
+		Type:       outbox.Entered,
+		Reason:     outbox.ReasonExperiment,
+		AliveUntil: aliveUntil,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Allocation{Experiment: slug, UserId: userId, Variant: v.Name, Segment: v.Segment, FirstExposure: true}, nil
+}
+
+// inactiveError explains why the experiment without active variants takes no users.
+// The archived variants are reported, as the users cannot be added to them anymore.
+func inactiveError(ex *Experiment) error {
+	slugs := make([]string, 0)
+	for _, v := range ex.Variants {
+		if v.Status == segment.StatusArchived {
+			slugs = append(slugs, v.Segment)
+		}
+	}
+	if len(slugs) > 0 {
+		sort.Strings(slugs)
+		return &e.ArchivedSegmentError{Slugs: slugs}
+	}
+	return &e.InactiveExperimentError{Slug: ex.Slug}
+}
+
+func NewRepo(client pkg.DBClient) Repository {
+	return &repository{
+		client: client,
+	}
+}
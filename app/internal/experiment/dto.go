@@ -0,0 +1,99 @@
+package experiment
+
+import (
+	"strings"
+	"time"
+)
+
+// VariantDto describes a variant. The segment of the variant is created with the experiment,
+// its slug defaults to the experiment slug and the upper-cased variant name, e.g. AVITO_CHECKOUT_CONTROL.
+type VariantDto struct {
+	Name    string `json:"name"`
+	Segment string `json:"segment,omitempty"`
+	Weight  int    `json:"weight"`
+}
+
+type ExperimentDto struct {
+	Slug      string       `json:"slug"`
+	Variants  []VariantDto `json:"variants"`
+	CreatedAt *time.Time   `json:"created_at,omitempty"`
+}
+
+// Valid checks that the experiment has at least two variants with unique names and segments and positive weights.
+func (e *ExperimentDto) Valid() bool {
+	if e.Slug == "" || len(e.Variants) < 2 {
+		return false
+	}
+	names := make(map[string]bool, len(e.Variants))
+	segments := make(map[string]bool, len(e.Variants))
+	for _, v := range e.Variants {
+		segment := variantSegment(e.Slug, &v)
+		if v.Name == "" || v.Weight <= 0 || names[v.Name] || segments[segment] {
+			return false
+		}
+		names[v.Name] = true
+		segments[segment] = true
+	}
+	return true
+}
+
+func variantSegment(slug string, v *VariantDto) string {
+	if v.Segment != "" {
+		return v.Segment
+	}
+	return slug + "_" + strings.ToUpper(v.Name)
+}
+
+// NewExperiment converts the request, the segments of the variants get their default slugs.
+func NewExperiment(e *ExperimentDto) *Experiment {
+	experiment := &Experiment{Slug: e.Slug, Variants: make([]*Variant, 0, len(e.Variants))}
+	for _, v := range e.Variants {
+		experiment.Variants = append(experiment.Variants, &Variant{
+			Name:    v.Name,
+			Segment: variantSegment(e.Slug, &v),
+			Weight:  v.Weight,
+		})
+	}
+	return experiment
+}
+
+func NewExperimentDto(e *Experiment) ExperimentDto {
+	createdAt := e.CreatedAt
+	dto := ExperimentDto{Slug: e.Slug, Variants: make([]VariantDto, 0, len(e.Variants)), CreatedAt: &createdAt}
+	for _, v := range e.Variants {
+		dto.Variants = append(dto.Variants, VariantDto{Name: v.Name, Segment: v.Segment, Weight: v.Weight})
+	}
+	return dto
+}
+
+type ExperimentsDto struct {
+	Experiments []ExperimentDto `json:"experiments"`
+}
+
+// AllocateDto is the request for the variant of the user in the experiment.
+type AllocateDto struct {
+	Experiment string `json:"experiment"`
+	UserId     int    `json:"user_id"`
+}
+
+func (a *AllocateDto) Valid() bool {
+	return a.Experiment != "" && a.UserId > 0
+}
+
+type AllocationDto struct {
+	Experiment    string `json:"experiment"`
+	UserId        int    `json:"user_id"`
+	Variant       string `json:"variant"`
+	Segment       string `json:"segment"`
+	FirstExposure bool   `json:"first_exposure"`
+}
+
+func NewAllocationDto(a *Allocation) AllocationDto {
+	return AllocationDto{
+		Experiment:    a.Experiment,
+		UserId:        a.UserId,
+		Variant:       a.Variant,
+		Segment:       a.Segment,
+		FirstExposure: a.FirstExposure,
+	}
+}
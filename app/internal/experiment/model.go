@@ -0,0 +1,88 @@
+package experiment
+
+import (
+	"hash/fnv"
+	"main/internal/segment"
+	"strconv"
+	"time"
+)
+
+// Experiment is an A/B experiment. Each variant is a segment, a user exposed to the experiment
+// becomes a member of the segment of the variant assigned to the user.
+type Experiment struct {
+	Id        int
+	Slug      string
+	Variants  []*Variant
+	CreatedAt time.Time
+}
+
+// Variant is a variant of the experiment. The users are assigned to it in proportion to its weight.
+type Variant struct {
+	Name      string
+	Segment   string
+	SegmentId int
+	Weight    int
+	// DefaultTtl is the default TTL of the segment, the lifetime of the memberships created by the allocation
+	DefaultTtl *string
+	// Status is the status of the segment, only the variants with active segments take users
+	Status string
+}
+
+// Active returns the experiment restricted to the variants whose segments are active.
+func (e *Experiment) Active() *Experiment {
+	active := *e
+	active.Variants = make([]*Variant, 0, len(e.Variants))
+	for _, v := range e.Variants {
+		if v.Status == segment.StatusActive {
+			active.Variants = append(active.Variants, v)
+		}
+	}
+	return &active
+}
+
+// Assign returns the variant of the user. The assignment is deterministic: the FNV-1a hash of
+// the experiment slug and the user id modulo the total weight picks the variant, so the same user
+// always gets the same variant as long as the variants and their weights stay the same.
+func (e *Experiment) Assign(userId int) *Variant {
+	total := 0
+	for _, v := range e.Variants {
+		total += v.Weight
+	}
+	if total <= 0 {
+		return nil
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(e.Slug))
+	h.Write([]byte(":"))
+	h.Write([]byte(strconv.Itoa(userId)))
+	point := int(h.Sum64() % uint64(total))
+
+	for _, v := range e.Variants {
+		if point < v.Weight {
+			return v
+		}
+		point -= v.Weight
+	}
+	return nil
+}
+
+// Variant returns the variant whose segment has the id, nil if there is none.
+func (e *Experiment) Variant(segmentId int) *Variant {
+	for _, v := range e.Variants {
+		if v.SegmentId == segmentId {
+			return v
+		}
+	}
+	return nil
+}
+
+// Allocation is the variant of the user in the experiment.
+type Allocation struct {
+	Experiment string
+	UserId     int
+	Variant    string
+	Segment    string
+	// FirstExposure is true if the user has been added to the segment of the variant by this allocation
+	FirstExposure bool
+}
@@ -0,0 +1,14 @@
+package experiment
+
+import (
+	"context"
+	"main/internal/history"
+)
+
+//go:generate mockgen -source=storage.go -destination=mocks/mock.go
+type Repository interface {
+	Create(ctx context.Context, experiment *Experiment) error
+	Delete(ctx context.Context, slug string) error
+	FindAll(ctx context.Context) ([]*Experiment, error)
+	Allocate(ctx context.Context, slug string, userId int, historyRepo history.Repository) (*Allocation, error)
+}
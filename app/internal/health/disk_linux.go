@@ -0,0 +1,23 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+)
+
+// DiskSpace returns a check that fails if there are less than minFree bytes available in the directory.
+func DiskSpace(dir string, minFree uint64) CheckFunc {
+	return func(ctx context.Context) error {
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(dir, &stat); err != nil {
+			return err
+		}
+
+		free := stat.Bavail * uint64(stat.Bsize)
+		if free < minFree {
+			return fmt.Errorf("%d bytes free in %s, at least %d required", free, dir, minFree)
+		}
+		return nil
+	}
+}
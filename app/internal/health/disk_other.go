@@ -0,0 +1,16 @@
+//go:build !linux
+
+package health
+
+import (
+	"context"
+	"os"
+)
+
+// DiskSpace returns a check that the directory exists. Free space is only checked on Linux.
+func DiskSpace(dir string, minFree uint64) CheckFunc {
+	return func(ctx context.Context) error {
+		_, err := os.Stat(dir)
+		return err
+	}
+}
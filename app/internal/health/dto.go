@@ -0,0 +1,16 @@
+package health
+
+type CheckResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Report struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// Ok reports whether the application is ready to serve requests.
+func (r *Report) Ok() bool {
+	return r.Status == StatusOk
+}
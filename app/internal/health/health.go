@@ -0,0 +1,89 @@
+package health
+
+import (
+	"context"
+	"sync"
+)
+
+const (
+	StatusOk       = "ok"
+	StatusFail     = "fail"
+	StatusStarting = "starting"
+)
+
+// CheckFunc checks a dependency of the application. It returns nil if the dependency is usable.
+type CheckFunc func(ctx context.Context) error
+
+type check struct {
+	name string
+	fn   CheckFunc
+}
+
+// Checker checks the readiness of the application: it is not ready until it has started,
+// i.e. until the connections to all dependencies have been established, and after that
+// it is ready as long as all registered checks pass.
+type Checker struct {
+	mu      sync.RWMutex
+	started bool
+	checks  []check
+}
+
+func NewChecker() *Checker {
+	return &Checker{}
+}
+
+// Add registers a check of the dependency with the given name.
+func (c *Checker) Add(name string, fn CheckFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, check{name: name, fn: fn})
+}
+
+// SetStarted marks the end of the application startup.
+func (c *Checker) SetStarted() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.started = true
+}
+
+// Check runs all registered checks concurrently and returns the report.
+// The report is ok only if the application has started and every check passed.
+func (c *Checker) Check(ctx context.Context) *Report {
+	c.mu.RLock()
+	started := c.started
+	checks := c.checks
+	c.mu.RUnlock()
+
+	report := &Report{
+		Status: StatusOk,
+		Checks: make(map[string]CheckResult, len(checks)),
+	}
+	if !started {
+		report.Status = StatusStarting
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, ch := range checks {
+		wg.Add(1)
+		go func(ch check) {
+			defer wg.Done()
+
+			res := CheckResult{Status: StatusOk}
+			if err := ch.fn(ctx); err != nil {
+				res.Status = StatusFail
+				res.Error = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[ch.name] = res
+			if res.Status != StatusOk && report.Status == StatusOk {
+				report.Status = StatusFail
+			}
+		}(ch)
+	}
+	wg.Wait()
+
+	return report
+}
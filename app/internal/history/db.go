@@ -2,10 +2,9 @@ package history
 
 import (
 	"context"
-	"fmt"
+	"github.com/jackc/pgtype"
 	"github.com/jackc/pgx/v4"
 	"main/pkg"
-	"strings"
 	"time"
 )
 
@@ -13,27 +12,24 @@ type repository struct {
 	client pkg.DBClient
 }
 
-// Create is a method that adds a new segment to the segments table.
+// Create is a method that writes the operation with the segments of the user to the history.
+// The slugs are written as well, so that the history outlives the segments.
 func (r *repository) Create(ctx context.Context, history *History, tx pgx.Tx) error {
 	if len(history.SegmentIds) == 0 {
 		return nil
 	}
 
-	q := `INSERT INTO history (user_id, segment_id, operation, date) VALUES `
-
-	values := make([]interface{}, 0, len(history.SegmentIds))
-	date := history.Date.Format("2006-01-02 15:04:05")
-	for _, segmentId := range history.SegmentIds {
-		values = append(values, history.UserId, segmentId, history.Operation, date)
-	}
-	placeholders := make([]string, 0, len(values)/4)
-	for i := 0; i < len(values)/4; i++ {
-		placeholder := fmt.Sprintf("($%d, $%d, $%d, $%d)", i*4+1, i*4+2, i*4+3, i*4+4)
-		placeholders = append(placeholders, placeholder)
+	var segmentIds pgtype.Int4Array
+	if err := segmentIds.Set(history.SegmentIds); err != nil {
+		return err
 	}
 
-	resQuery := fmt.Sprintf("%s %s", q, strings.Join(placeholders, ", "))
-	_, err := tx.Exec(ctx, resQuery, values...)
+	q := `
+		INSERT INTO history (user_id, segment_id, slug, operation, date)
+		SELECT $1::int, segment_id, slug, $2::varchar, $3::timestamp FROM segments WHERE segment_id = ANY($4);
+	`
+	date := history.Date.Format("2006-01-02 15:04:05")
+	_, err := tx.Exec(ctx, q, history.UserId, history.Operation, date, &segmentIds)
 	if err != nil {
 		return err
 	}
@@ -42,9 +38,12 @@ func (r *repository) Create(ctx context.Context, history *History, tx pgx.Tx) er
 }
 
 func (r *repository) GetFromDate(ctx context.Context, date time.Time) ([]HistoryDto, error) {
-	q := `SELECT user_id, slug, operation, date
-		  FROM history JOIN segments s on s.segment_id = history.segment_id
-          WHERE date >= $1;`
+	// The renamed segments are reported under the current slug, so their history stays in one piece
+	q := `
+		SELECT h.user_id, COALESCE(s.slug, h.slug), h.operation, h.date
+		FROM history h LEFT JOIN segments s ON s.segment_id = h.segment_id
+		WHERE h.date >= $1;
+	`
 
 	rows, err := r.client.Query(ctx, q, date.Format("2006-01-02 15:04:05"))
 	if err != nil {
@@ -0,0 +1,100 @@
+package job
+
+import (
+	"context"
+	"main/pkg"
+	"time"
+)
+
+type repository struct {
+	client pkg.DBClient
+}
+
+// CreateRun saves the start of a job run and sets its ID.
+func (r *repository) CreateRun(ctx context.Context, run *Run) error {
+	q := `INSERT INTO job_runs (job, instance, started_at) VALUES ($1, $2, $3) RETURNING run_id;`
+	return r.client.QueryRow(ctx, q, run.Job, run.Instance, run.StartedAt).Scan(&run.Id)
+}
+
+// FinishRun saves the end of a job run together with its result.
+func (r *repository) FinishRun(ctx context.Context, run *Run) error {
+	q := `UPDATE job_runs SET finished_at = $2, rows_affected = $3, error = $4 WHERE run_id = $1;`
+	_, err := r.client.Exec(ctx, q, run.Id, run.FinishedAt, run.RowsAffected, run.Error)
+	return err
+}
+
+// FindRuns returns the latest runs, newest first. If name is not empty, only runs of the job with this name are returned.
+func (r *repository) FindRuns(ctx context.Context, name string, limit int) ([]*Run, error) {
+	q := `
+		SELECT run_id, job, instance, started_at, finished_at, rows_affected, error
+		FROM job_runs
+		WHERE $1 = '' OR job = $1
+		ORDER BY started_at DESC, run_id DESC
+		LIMIT $2;
+	`
+	rows, err := r.client.Query(ctx, q, name, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := make([]*Run, 0)
+	for rows.Next() {
+		var run Run
+		err = rows.Scan(
+			&run.Id,
+			&run.Job,
+			&run.Instance,
+			&run.StartedAt,
+			&run.FinishedAt,
+			&run.RowsAffected,
+			&run.Error,
+		)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, &run)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return runs, nil
+}
+
+// DeleteRunsBefore deletes the runs started before the given date and returns their number.
+func (r *repository) DeleteRunsBefore(ctx context.Context, date time.Time) (int, error) {
+	q := `DELETE FROM job_runs WHERE started_at < $1;`
+	tag, err := r.client.Exec(ctx, q, date)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// SetPaused pauses or resumes the scheduled runs of the job on all instances.
+func (r *repository) SetPaused(ctx context.Context, name string, paused bool) error {
+	q := `
+		INSERT INTO job_states (job, paused) VALUES ($1, $2)
+		ON CONFLICT (job) DO UPDATE SET paused = excluded.paused;
+	`
+	_, err := r.client.Exec(ctx, q, name, paused)
+	return err
+}
+
+// IsPaused reports whether the scheduled runs of the job are paused.
+func (r *repository) IsPaused(ctx context.Context, name string) (bool, error) {
+	var paused bool
+	q := `SELECT EXISTS (SELECT 1 FROM job_states WHERE job = $1 AND paused);`
+	err := r.client.QueryRow(ctx, q, name).Scan(&paused)
+	if err != nil {
+		return false, err
+	}
+	return paused, nil
+}
+
+func NewRepo(client pkg.DBClient) Repository {
+	return &repository{
+		client: client,
+	}
+}
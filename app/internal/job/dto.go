@@ -0,0 +1,45 @@
+package job
+
+import "time"
+
+type RunDto struct {
+	Id           int        `json:"run_id"`
+	Job          string     `json:"job"`
+	Instance     string     `json:"instance"`
+	StartedAt    time.Time  `json:"started_at"`
+	FinishedAt   *time.Time `json:"finished_at"`
+	RowsAffected *int       `json:"rows_affected"`
+	Error        *string    `json:"error"`
+}
+
+type RunsDto struct {
+	Runs []RunDto `json:"runs"`
+}
+
+func NewRunDto(r *Run) RunDto {
+	return RunDto{
+		Id:           r.Id,
+		Job:          r.Job,
+		Instance:     r.Instance,
+		StartedAt:    r.StartedAt,
+		FinishedAt:   r.FinishedAt,
+		RowsAffected: r.RowsAffected,
+		Error:        r.Error,
+	}
+}
+
+type InfoDto struct {
+	Name    string    `json:"job"`
+	Cron    string    `json:"cron"`
+	Paused  bool      `json:"paused"`
+	NextRun time.Time `json:"next_run"`
+}
+
+func NewInfoDto(i *Info) InfoDto {
+	return InfoDto{
+		Name:    i.Name,
+		Cron:    i.Cron,
+		Paused:  i.Paused,
+		NextRun: i.NextRun,
+	}
+}
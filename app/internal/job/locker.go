@@ -0,0 +1,84 @@
+package job
+
+import (
+	"context"
+	"github.com/go-co-op/gocron"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+var (
+	LockPrefix = "job_lock_"
+)
+
+// unlockScript releases the lease only if it still belongs to the holder.
+// If ARGV[2] is positive, the lease is not deleted but kept for that many milliseconds.
+var unlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+if tonumber(ARGV[2]) > 0 then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return redis.call("DEL", KEYS[1])
+`)
+
+// redisLocker is a gocron.Locker which elects the instance running a job with a lease in Redis.
+// The instance which managed to set the lease key runs the job, the others skip this run.
+type redisLocker struct {
+	client   *redis.Client
+	instance string
+	lease    time.Duration
+	hold     time.Duration
+}
+
+type redisLock struct {
+	locker   *redisLocker
+	key      string
+	token    string
+	acquired time.Time
+}
+
+// NewRedisLocker creates a locker whose leases expire after lease in case the holder dies.
+// A released lease is still kept until hold has passed since it was taken, so that instances
+// whose clocks are slightly behind do not run the same scheduled job once again.
+func NewRedisLocker(client *redis.Client, instance string, lease, hold time.Duration) gocron.Locker {
+	return &redisLocker{
+		client:   client,
+		instance: instance,
+		lease:    lease,
+		hold:     hold,
+	}
+}
+
+func (l *redisLocker) Lock(ctx context.Context, key string) (gocron.Lock, error) {
+	token := l.instance + "/" + uuid.New().String()
+	ok, err := l.client.SetNX(ctx, LockPrefix+key, token, l.lease).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, gocron.ErrFailedToObtainLock
+	}
+
+	return &redisLock{
+		locker:   l,
+		key:      LockPrefix + key,
+		token:    token,
+		acquired: time.Now(),
+	}, nil
+}
+
+func (l *redisLock) Unlock(ctx context.Context) error {
+	keep := l.locker.hold - time.Since(l.acquired)
+	if keep < 0 {
+		keep = 0
+	}
+
+	err := unlockScript.Run(ctx, l.locker.client, []string{l.key}, l.token, keep.Milliseconds()).Err()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	return nil
+}
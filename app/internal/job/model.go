@@ -0,0 +1,33 @@
+package job
+
+import "time"
+
+// Run is a single execution of a scheduled job.
+type Run struct {
+	Id           int
+	Job          string
+	Instance     string
+	StartedAt    time.Time
+	FinishedAt   *time.Time
+	RowsAffected *int
+	Error        *string
+}
+
+// Info describes a job registered in the scheduler.
+type Info struct {
+	Name    string
+	Cron    string
+	Paused  bool
+	NextRun time.Time
+}
+
+// finish records the result of the run.
+func (r *Run) finish(rowsAffected int, err error) {
+	now := time.Now()
+	r.FinishedAt = &now
+	r.RowsAffected = &rowsAffected
+	if err != nil {
+		msg := err.Error()
+		r.Error = &msg
+	}
+}
@@ -0,0 +1,249 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-co-op/gocron"
+	"github.com/google/uuid"
+	"github.com/robfig/cron/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"main/internal/e"
+	"main/internal/metrics"
+	"main/internal/tracing"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Names of the background jobs.
+const (
+	TtlCleanup     = "ttl_cleanup"
+	CacheRefresh   = "cache_refresh"
+	JobRunsCleanup = "job_runs_cleanup"
+	RuleSegments   = "rule_segments"
+)
+
+// Func is the body of a scheduled job. It returns the number of rows the run has affected.
+type Func func(ctx context.Context) (int, error)
+
+type scheduledJob struct {
+	cron string
+	fn   Func
+	job  *gocron.Job
+}
+
+// Scheduler runs named jobs on a schedule. When several instances of the application
+// share the same locker, each scheduled run of a job is executed by only one of them.
+// Every executed run is recorded in the job repository.
+type Scheduler struct {
+	// mu guards the schedules of the jobs
+	mu        sync.RWMutex
+	scheduler *gocron.Scheduler
+	locker    gocron.Locker
+	repo      Repository
+	instance  string
+	jobs      map[string]*scheduledJob
+}
+
+func NewScheduler(repo Repository, locker gocron.Locker, instance string) *Scheduler {
+	s := gocron.NewScheduler(time.UTC)
+	s.WithDistributedLocker(locker)
+
+	return &Scheduler{
+		scheduler: s,
+		locker:    locker,
+		repo:      repo,
+		instance:  instance,
+		jobs:      make(map[string]*scheduledJob),
+	}
+}
+
+// InstanceId returns an identifier of the running application instance.
+func InstanceId() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%s", host, uuid.New().String()[:8])
+}
+
+// Cron schedules the job with the given name according to the five-field cron expression.
+// The name is also the key of the lock that elects the instance running the job.
+// Scheduled runs are skipped while the job is paused.
+func (s *Scheduler) Cron(ctx context.Context, name string, expr string, fn Func) error {
+	j, err := s.scheduler.Cron(expr).Name(name).Do(func() {
+		paused, err := s.repo.IsPaused(ctx, name)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to check if job is paused", "job", name, "err", err)
+		}
+		if paused {
+			return
+		}
+		s.run(ctx, name, fn)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.jobs[name] = &scheduledJob{cron: expr, fn: fn, job: j}
+	return nil
+}
+
+// run executes the job and records the run.
+func (s *Scheduler) run(ctx context.Context, name string, fn Func) *Run {
+	ctx, span := tracing.Tracer.Start(ctx, "job "+name, trace.WithAttributes(
+		attribute.String("job.name", name),
+		attribute.String("job.instance", s.instance),
+	))
+	defer span.End()
+
+	run := &Run{
+		Job:       name,
+		Instance:  s.instance,
+		StartedAt: time.Now(),
+	}
+	if err := s.repo.CreateRun(ctx, run); err != nil {
+		slog.ErrorContext(ctx, "failed to create job run", "job", name, "err", err)
+	}
+
+	n, err := fn(ctx)
+	outcome := metrics.OutcomeSuccess
+	if err != nil {
+		outcome = metrics.OutcomeFail
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		slog.ErrorContext(ctx, "job run failed", "job", name, "err", err)
+	}
+	span.SetAttributes(attribute.Int("job.rows_affected", n))
+	if err == nil {
+		// Most runs have nothing to do, they would flood the logs
+		level := slog.LevelDebug
+		if n > 0 {
+			level = slog.LevelInfo
+		}
+		slog.Log(ctx, level, "job run finished", "job", name, "rows_affected", n, "duration", time.Since(run.StartedAt))
+	}
+	run.finish(n, err)
+
+	metrics.JobRuns.WithLabelValues(name, outcome).Inc()
+	metrics.JobRunDuration.WithLabelValues(name).Observe(run.FinishedAt.Sub(run.StartedAt).Seconds())
+	metrics.JobRowsAffected.WithLabelValues(name).Add(float64(n))
+
+	if run.Id == 0 {
+		return run
+	}
+	if err = s.repo.FinishRun(ctx, run); err != nil {
+		slog.ErrorContext(ctx, "failed to finish job run", "job", name, "run_id", run.Id, "err", err)
+	}
+	return run
+}
+
+// Trigger runs the job immediately and waits for the run to finish, even if the job is paused.
+// The run takes the same lock as the scheduled ones, so it fails with JobRunningError
+// if the job is being run by any instance at the moment.
+func (s *Scheduler) Trigger(ctx context.Context, name string) (*Run, error) {
+	j, ok := s.jobs[name]
+	if !ok {
+		return nil, &e.JobNotFoundError{Name: name}
+	}
+
+	lock, err := s.locker.Lock(ctx, name)
+	if errors.Is(err, gocron.ErrFailedToObtainLock) {
+		return nil, &e.JobRunningError{Name: name}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := lock.Unlock(ctx); err != nil {
+			slog.ErrorContext(ctx, "failed to unlock job", "job", name, "err", err)
+		}
+	}()
+
+	return s.run(ctx, name, j.fn), nil
+}
+
+// Reschedule changes the cron expression of the job. A run in progress is not interrupted.
+func (s *Scheduler) Reschedule(name string, expr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[name]
+	if !ok {
+		return &e.JobNotFoundError{Name: name}
+	}
+	if j.cron == expr {
+		return nil
+	}
+	// gocron removes the job if the new expression is invalid, so it is checked beforehand
+	if _, err := cron.ParseStandard(expr); err != nil {
+		return fmt.Errorf("invalid cron expression %q of job %s: %w", expr, name, err)
+	}
+
+	updated, err := s.scheduler.Job(j.job).Cron(expr).Update()
+	if err != nil {
+		return err
+	}
+	j.job, j.cron = updated, expr
+	return nil
+}
+
+// SetPaused pauses or resumes the scheduled runs of the job on all instances.
+func (s *Scheduler) SetPaused(ctx context.Context, name string, paused bool) error {
+	if _, ok := s.jobs[name]; !ok {
+		return &e.JobNotFoundError{Name: name}
+	}
+	return s.repo.SetPaused(ctx, name, paused)
+}
+
+// Info returns the schedule and the state of the job.
+func (s *Scheduler) Info(ctx context.Context, name string) (*Info, error) {
+	j, ok := s.jobs[name]
+	if !ok {
+		return nil, &e.JobNotFoundError{Name: name}
+	}
+
+	paused, err := s.repo.IsPaused(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return &Info{
+		Name:    name,
+		Cron:    j.cron,
+		Paused:  paused,
+		NextRun: j.job.NextRun(),
+	}, nil
+}
+
+// Names returns the names of the registered jobs in alphabetical order.
+func (s *Scheduler) Names() []string {
+	names := make([]string, 0, len(s.jobs))
+	for name := range s.jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Running reports whether the scheduler has been started and not stopped.
+func (s *Scheduler) Running() bool {
+	return s.scheduler.IsRunning()
+}
+
+// Start starts the scheduler without blocking.
+func (s *Scheduler) Start() {
+	s.scheduler.StartAsync()
+}
+
+// Stop stops the scheduler and waits for running jobs to finish.
+func (s *Scheduler) Stop() {
+	s.scheduler.Stop()
+}
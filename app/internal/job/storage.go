@@ -0,0 +1,16 @@
+package job
+
+import (
+	"context"
+	"time"
+)
+
+//go:generate mockgen -source=storage.go -destination=mocks/mock.go
+type Repository interface {
+	CreateRun(ctx context.Context, run *Run) error
+	FinishRun(ctx context.Context, run *Run) error
+	FindRuns(ctx context.Context, name string, limit int) ([]*Run, error)
+	DeleteRunsBefore(ctx context.Context, date time.Time) (int, error)
+	SetPaused(ctx context.Context, name string, paused bool) error
+	IsPaused(ctx context.Context, name string) (bool, error)
+}
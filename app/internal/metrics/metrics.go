@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "avito"
+
+// Outcomes of report generations and job runs.
+const (
+	OutcomeSuccess = "success"
+	OutcomeFail    = "fail"
+)
+
+var (
+	HttpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of handled HTTP requests by route, method and status.",
+	}, []string{"route", "method", "status"})
+
+	HttpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests by route, method and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	RateLimited = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limiter_rejections_total",
+		Help:      "Number of requests rejected by the rate limiter.",
+	})
+
+	IdempotencyConflicts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "idempotency_conflicts_total",
+		Help:      "Number of requests rejected because their Idempotency-Key was still being processed.",
+	})
+
+	CacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_lookups_total",
+		Help:      "Number of lookups of the active user segments in the cache by result (hit or miss).",
+	}, []string{"result"})
+
+	ReportGenerations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "report_generations_total",
+		Help:      "Number of finished report generations by outcome.",
+	}, []string{"outcome"})
+
+	ReportGenerationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "report_generation_duration_seconds",
+		Help:      "Duration of report generations by outcome.",
+		Buckets:   []float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300},
+	}, []string{"outcome"})
+
+	JobRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "job_runs_total",
+		Help:      "Number of background job runs executed by this instance by job and outcome.",
+	}, []string{"job", "outcome"})
+
+	JobRunDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "job_run_duration_seconds",
+		Help:      "Duration of background job runs by job.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"job"})
+
+	JobRowsAffected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "job_rows_affected_total",
+		Help:      "Number of rows affected by background jobs, e.g. memberships deleted by ttl_cleanup.",
+	}, []string{"job"})
+
+	OutboxPublished = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "outbox_published_events_total",
+		Help:      "Number of membership events published by the outbox relay.",
+	})
+
+	OutboxPublishFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "outbox_publish_failures_total",
+		Help:      "Number of failed attempts to publish a batch of membership events.",
+	})
+
+	WebhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhook_delivery_attempts_total",
+		Help:      "Number of attempts to deliver events to webhooks by event and result (delivered, retry or dead).",
+	}, []string{"event", "result"})
+
+	ExperimentExposures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "experiment_exposures_total",
+		Help:      "Number of first exposures of users to experiments by experiment and variant.",
+	}, []string{"experiment", "variant"})
+)
@@ -0,0 +1,265 @@
+package migrate
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"main/pkg"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var embedded embed.FS
+
+// Migration is a numbered change of the schema with the SQL to apply and to revert it.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status is the state of a migration in the database. AppliedAt is nil for a pending migration.
+// Unknown is set for a migration applied to the database but missing in the binary.
+type Status struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+	Unknown   bool
+}
+
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Parse reads the migrations from the files named "<version>_<name>.up.sql" and "<version>_<name>.down.sql"
+// in the root of fsys and returns them ordered by version. Every migration must have both files.
+func Parse(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		m := fileName.FindStringSubmatch(entry.Name())
+		if m == nil {
+			return nil, fmt.Errorf("unexpected migration file %s", entry.Name())
+		}
+		version, _ := strconv.Atoi(m[1])
+		data, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = migration
+		} else if migration.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, migration.Name, m[2])
+		}
+		if m[3] == "up" {
+			migration.Up = string(data)
+		} else {
+			migration.Down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s must have both up and down files", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Migrator applies and reverts the migrations embedded in the binary.
+// Each migration runs in its own transaction under an advisory lock,
+// so several instances of the app can migrate the same database at once.
+type Migrator struct {
+	client     pkg.DBClient
+	migrations []Migration
+}
+
+func NewMigrator(client pkg.DBClient) (*Migrator, error) {
+	sub, err := fs.Sub(embedded, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := Parse(sub)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{client: client, migrations: migrations}, nil
+}
+
+func (m *Migrator) init(ctx context.Context) error {
+	q := `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INT PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+	`
+	_, err := m.client.Exec(ctx, q)
+	return err
+}
+
+// applied returns the applied versions with the moments they were applied.
+func (m *Migrator) applied(ctx context.Context) (map[int]Status, error) {
+	rows, err := m.client.Query(ctx, `SELECT version, name, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make(map[int]Status)
+	for rows.Next() {
+		var s Status
+		var appliedAt time.Time
+		if err = rows.Scan(&s.Version, &s.Name, &appliedAt); err != nil {
+			return nil, err
+		}
+		s.AppliedAt = &appliedAt
+		res[s.Version] = s
+	}
+	return res, rows.Err()
+}
+
+// step applies or reverts one migration unless another instance has already done it.
+// It returns false if there was nothing to do.
+func (m *Migrator) step(ctx context.Context, migration Migration, up bool) (done bool, err error) {
+	tx, err := m.client.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err = tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('schema_migrations'))`); err != nil {
+		return false, err
+	}
+
+	var applied bool
+	q := `SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`
+	if err = tx.QueryRow(ctx, q, migration.Version).Scan(&applied); err != nil {
+		return false, err
+	}
+	if applied == up {
+		return false, nil
+	}
+
+	if up {
+		if _, err = tx.Exec(ctx, migration.Up); err != nil {
+			return false, fmt.Errorf("apply migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+		q = `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`
+		_, err = tx.Exec(ctx, q, migration.Version, migration.Name)
+	} else {
+		if _, err = tx.Exec(ctx, migration.Down); err != nil {
+			return false, fmt.Errorf("revert migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+		_, err = tx.Exec(ctx, `DELETE FROM schema_migrations WHERE version = $1`, migration.Version)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+// Up applies all pending migrations in order and returns the applied ones.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	if err := m.init(ctx); err != nil {
+		return nil, err
+	}
+
+	var res []Migration
+	for _, migration := range m.migrations {
+		done, err := m.step(ctx, migration, true)
+		if err != nil {
+			return res, err
+		}
+		if done {
+			res = append(res, migration)
+		}
+	}
+	return res, nil
+}
+
+// Down reverts the last steps applied migrations and returns the reverted ones.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	if err := m.init(ctx); err != nil {
+		return nil, err
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []Migration
+	for i := len(m.migrations) - 1; i >= 0 && len(res) < steps; i-- {
+		migration := m.migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		done, err := m.step(ctx, migration, false)
+		if err != nil {
+			return res, err
+		}
+		if done {
+			res = append(res, migration)
+		}
+	}
+	return res, nil
+}
+
+// Status returns the state of every known migration and of the unknown applied ones, ordered by version.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	if err := m.init(ctx); err != nil {
+		return nil, err
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]Status, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		s := Status{Version: migration.Version, Name: migration.Name}
+		if a, ok := applied[migration.Version]; ok {
+			s.AppliedAt = a.AppliedAt
+			delete(applied, migration.Version)
+		}
+		res = append(res, s)
+	}
+	for _, a := range applied {
+		a.Unknown = true
+		res = append(res, a)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Version < res[j].Version
+	})
+	return res, nil
+}
+
+// CheckPending returns an error if some of the migrations have not been applied yet.
+// It is used as a readiness check.
+func (m *Migrator) CheckPending(ctx context.Context) error {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; !ok {
+			return fmt.Errorf("migration %d_%s is pending", migration.Version, migration.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS job_states;
+DROP TABLE IF EXISTS job_runs;
+ALTER TABLE user_segments ALTER COLUMN alive_until TYPE TIMESTAMP;
+ALTER TABLE user_segments DROP COLUMN IF EXISTS added_at;
+ALTER TABLE segments DROP COLUMN IF EXISTS default_ttl;
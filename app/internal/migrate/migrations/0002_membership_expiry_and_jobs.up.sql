@@ -0,0 +1,22 @@
+-- The default TTL of the segments, the moments the users are added to the segments, the exact expiry
+-- of the memberships and the runs and the pause states of the scheduled jobs.
+-- The expiry moments written as local timestamps are read in the time zone of the session.
+ALTER TABLE segments ADD COLUMN IF NOT EXISTS default_ttl varchar(64) NULL;
+ALTER TABLE user_segments ADD COLUMN IF NOT EXISTS added_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE user_segments ALTER COLUMN alive_until TYPE TIMESTAMPTZ;
+
+CREATE TABLE IF NOT EXISTS job_runs (
+    run_id serial PRIMARY KEY,
+    job VARCHAR(100) NOT NULL,
+    instance VARCHAR(255) NOT NULL,
+    started_at TIMESTAMPTZ NOT NULL,
+    finished_at TIMESTAMPTZ NULL,
+    rows_affected INT NULL,
+    error TEXT NULL
+);
+CREATE INDEX IF NOT EXISTS job_runs_started_at_idx ON job_runs (started_at);
+
+CREATE TABLE IF NOT EXISTS job_states (
+    job VARCHAR(100) PRIMARY KEY,
+    paused BOOLEAN NOT NULL DEFAULT false
+);
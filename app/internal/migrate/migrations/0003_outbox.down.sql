@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS outbox_state;
+DROP TABLE IF EXISTS outbox;
+
+DELETE FROM history WHERE segment_id IS NULL;
+ALTER TABLE history DROP CONSTRAINT history_segment_id_fkey;
+ALTER TABLE history ADD CONSTRAINT history_segment_id_fkey
+    FOREIGN KEY (segment_id) REFERENCES segments(segment_id);
+ALTER TABLE history DROP COLUMN slug;
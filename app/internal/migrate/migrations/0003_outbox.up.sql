@@ -0,0 +1,28 @@
+-- A segment can be deleted together with its memberships, so the history keeps the slug
+-- of the segment instead of depending on it.
+ALTER TABLE history ADD COLUMN slug varchar(255);
+UPDATE history h SET slug = s.slug FROM segments s WHERE s.segment_id = h.segment_id;
+ALTER TABLE history DROP CONSTRAINT history_segment_id_fkey;
+ALTER TABLE history ADD CONSTRAINT history_segment_id_fkey
+    FOREIGN KEY (segment_id) REFERENCES segments(segment_id) ON DELETE SET NULL;
+
+-- The membership events written in the same transactions as the memberships.
+-- seq is assigned by the relay in the order the events become visible.
+CREATE TABLE outbox (
+    id bigserial PRIMARY KEY,
+    seq bigint NULL UNIQUE,
+    user_id INT NOT NULL,
+    slug varchar(255) NOT NULL,
+    event varchar(16) NOT NULL,
+    reason varchar(32) NOT NULL,
+    alive_until TIMESTAMPTZ NULL,
+    occurred_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX outbox_unsequenced_idx ON outbox (id) WHERE seq IS NULL;
+
+-- The last assigned sequence number, it is kept in a table so that the numbers have no gaps.
+CREATE TABLE outbox_state (
+    id BOOLEAN PRIMARY KEY DEFAULT true CHECK (id),
+    last_seq bigint NOT NULL
+);
+INSERT INTO outbox_state (last_seq) VALUES (0);
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS webhook_dead_letters;
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhooks;
+
+DELETE FROM outbox WHERE user_id IS NULL;
+ALTER TABLE outbox ALTER COLUMN user_id SET NOT NULL;
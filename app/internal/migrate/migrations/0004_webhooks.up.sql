@@ -0,0 +1,42 @@
+-- The creations and deletions of the segments are written to the outbox too, they have no user.
+ALTER TABLE outbox ALTER COLUMN user_id DROP NOT NULL;
+
+-- The subscriptions to the events. An empty list of segments or events means all of them.
+CREATE TABLE webhooks (
+    id serial PRIMARY KEY,
+    url text NOT NULL,
+    secret text NOT NULL,
+    segments varchar(255)[] NOT NULL DEFAULT '{}',
+    events varchar(32)[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- A delivery of an event to a webhook, it is both the queue of the dispatcher and the delivery log.
+-- An event published again by the relay has the same seq, so it is not delivered twice.
+CREATE TABLE webhook_deliveries (
+    id bigserial PRIMARY KEY,
+    webhook_id INT NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+    event_seq bigint NOT NULL,
+    event varchar(32) NOT NULL,
+    payload jsonb NOT NULL,
+    status varchar(16) NOT NULL DEFAULT 'pending',
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_status_code INT NULL,
+    last_error text NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    finished_at TIMESTAMPTZ NULL,
+    UNIQUE (webhook_id, event_seq)
+);
+CREATE INDEX webhook_deliveries_pending_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+
+-- The deliveries which have run out of attempts, kept until they are retried.
+CREATE TABLE webhook_dead_letters (
+    delivery_id bigint PRIMARY KEY REFERENCES webhook_deliveries(id) ON DELETE CASCADE,
+    webhook_id INT NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+    event varchar(32) NOT NULL,
+    payload jsonb NOT NULL,
+    attempts INT NOT NULL,
+    last_error text NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
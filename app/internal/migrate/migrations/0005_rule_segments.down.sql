@@ -0,0 +1,2 @@
+ALTER TABLE segments DROP COLUMN IF EXISTS rule;
+ALTER TABLE users DROP COLUMN IF EXISTS attributes;
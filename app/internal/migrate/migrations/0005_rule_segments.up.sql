@@ -0,0 +1,5 @@
+-- The attributes of the users, e.g. {"city": "Moscow", "platform": "ios"}.
+ALTER TABLE users ADD COLUMN attributes jsonb NOT NULL DEFAULT '{}';
+
+-- The rule of a dynamic segment, its members are the users whose attributes match the rule.
+ALTER TABLE segments ADD COLUMN rule text NULL;
@@ -0,0 +1,18 @@
+-- The A/B experiments. The users are assigned to the variants by the hash of the experiment slug and the user id.
+CREATE TABLE experiments (
+    experiment_id serial PRIMARY KEY,
+    slug varchar(255) NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- The variants of an experiment in the order of the assignment, each of them is a segment.
+-- A segment of a variant cannot be deleted while the experiment exists.
+CREATE TABLE experiment_variants (
+    experiment_id INT NOT NULL REFERENCES experiments(experiment_id) ON DELETE CASCADE,
+    position INT NOT NULL,
+    name varchar(100) NOT NULL,
+    segment_id INT NOT NULL UNIQUE REFERENCES segments(segment_id),
+    weight INT NOT NULL CHECK (weight > 0),
+    PRIMARY KEY (experiment_id, position),
+    UNIQUE (experiment_id, name)
+);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS segments_exclusion_group_idx;
+ALTER TABLE segments DROP COLUMN IF EXISTS exclusion_group;
@@ -0,0 +1,3 @@
+-- The mutually exclusive segments share an exclusion group, a user is a member of at most one segment of a group.
+ALTER TABLE segments ADD COLUMN exclusion_group varchar(255) NULL;
+CREATE INDEX segments_exclusion_group_idx ON segments (exclusion_group) WHERE exclusion_group IS NOT NULL;
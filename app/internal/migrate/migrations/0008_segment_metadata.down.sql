@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS segments_tags_idx;
+DROP INDEX IF EXISTS segments_owner_idx;
+ALTER TABLE segments
+    DROP COLUMN IF EXISTS updated_at,
+    DROP COLUMN IF EXISTS created_at,
+    DROP COLUMN IF EXISTS status,
+    DROP COLUMN IF EXISTS tags,
+    DROP COLUMN IF EXISTS owner,
+    DROP COLUMN IF EXISTS description;
@@ -0,0 +1,11 @@
+-- The descriptive metadata of the segments. The segments which existed before are active.
+-- Only the active segments are returned among the segments of a user, the memberships in the others are kept.
+ALTER TABLE segments
+    ADD COLUMN description text NULL,
+    ADD COLUMN owner varchar(255) NULL,
+    ADD COLUMN tags text[] NOT NULL DEFAULT '{}',
+    ADD COLUMN status varchar(16) NOT NULL DEFAULT 'active' CHECK (status IN ('draft', 'active', 'paused', 'archived')),
+    ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    ADD COLUMN updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+CREATE INDEX segments_owner_idx ON segments (owner) WHERE owner IS NOT NULL;
+CREATE INDEX segments_tags_idx ON segments USING gin (tags);
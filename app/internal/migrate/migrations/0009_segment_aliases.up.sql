@@ -0,0 +1,8 @@
+-- The previous slugs of the renamed segments. They are deprecated, but still resolve to the segments,
+-- and are deleted together with the segments.
+CREATE TABLE segment_aliases (
+    slug varchar(255) PRIMARY KEY,
+    segment_id INT NOT NULL REFERENCES segments(segment_id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX segment_aliases_segment_id_idx ON segment_aliases (segment_id);
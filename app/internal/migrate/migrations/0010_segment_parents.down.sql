@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS segments_parent_id_idx;
+ALTER TABLE segments DROP COLUMN IF EXISTS parent_id;
@@ -0,0 +1,4 @@
+-- A member of a segment is also an inherited member of its parent and of the ancestors of the parent.
+-- A segment with children cannot be deleted, the children have to be moved or deleted first.
+ALTER TABLE segments ADD COLUMN parent_id INT NULL REFERENCES segments(segment_id);
+CREATE INDEX segments_parent_id_idx ON segments (parent_id) WHERE parent_id IS NOT NULL;
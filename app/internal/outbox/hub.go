@@ -0,0 +1,153 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// subscriberBuffer is the number of events a subscriber may lag behind before it is dropped.
+const subscriberBuffer = 64
+
+// Hub reads the published events from the Redis Stream and passes them to the subscribers
+// of this app instance, so that they receive the changes made by any instance.
+type Hub struct {
+	client redis.Cmdable
+	stream string
+
+	mu     sync.Mutex
+	subs   map[int]map[chan Event]struct{}
+	closed bool
+}
+
+func NewHub(client redis.Cmdable, stream string) *Hub {
+	return &Hub{client: client, stream: stream, subs: make(map[int]map[chan Event]struct{})}
+}
+
+// Subscribe returns the channel of the events of the user and the function which cancels the subscription.
+// The channel is closed if the subscriber falls behind or the hub is closed.
+func (h *Hub) Subscribe(userId int) (<-chan Event, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := make(chan Event, subscriberBuffer)
+	if h.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if h.subs[userId] == nil {
+		h.subs[userId] = make(map[chan Event]struct{})
+	}
+	h.subs[userId][ch] = struct{}{}
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.remove(userId, ch)
+	}
+}
+
+// remove closes the channel of the subscriber unless it has been removed already. h.mu must be held.
+func (h *Hub) remove(userId int, ch chan Event) {
+	if _, ok := h.subs[userId][ch]; !ok {
+		return
+	}
+	delete(h.subs[userId], ch)
+	if len(h.subs[userId]) == 0 {
+		delete(h.subs, userId)
+	}
+	close(ch)
+}
+
+// Close closes the channels of all the subscribers, e.g. on shutdown.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for userId, chans := range h.subs {
+		for ch := range chans {
+			h.remove(userId, ch)
+		}
+	}
+}
+
+// Dispatch passes the event to the subscribers of its user.
+func (h *Hub) Dispatch(ev Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subs[ev.UserId] {
+		select {
+		case ch <- ev:
+		default:
+			slog.Warn("dropping slow event subscriber", "user_id", ev.UserId)
+			h.remove(ev.UserId, ch)
+		}
+	}
+}
+
+// Run reads the stream from its end until ctx is done. The end is resolved to the ID of the last entry once,
+// then the stream is always read after the last seen entry, so that no entry added in between two reads is missed.
+func (h *Hub) Run(ctx context.Context) {
+	last, err := h.end(ctx)
+	for err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		slog.ErrorContext(ctx, "failed to read event stream", "stream", h.stream, "err", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+		last, err = h.end(ctx)
+	}
+
+	for ctx.Err() == nil {
+		streams, err := h.client.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{h.stream, last},
+			Block:   5 * time.Second,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.ErrorContext(ctx, "failed to read event stream", "stream", h.stream, "err", err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Second):
+				}
+			}
+			continue
+		}
+
+		for _, stream := range streams {
+			for _, msg := range stream.Messages {
+				last = msg.ID
+				ev, err := parseStreamValues(msg.Values)
+				if err != nil {
+					slog.ErrorContext(ctx, "failed to parse event", "stream", h.stream, "id", msg.ID, "err", err)
+					continue
+				}
+				h.Dispatch(ev)
+			}
+		}
+	}
+}
+
+// end returns the ID of the last entry of the stream, or "0-0" if it is empty.
+func (h *Hub) end(ctx context.Context) (string, error) {
+	msgs, err := h.client.XRevRangeN(ctx, h.stream, "+", "-", 1).Result()
+	if err != nil {
+		return "", err
+	}
+	if len(msgs) == 0 {
+		return "0-0", nil
+	}
+	return msgs[0].ID, nil
+}
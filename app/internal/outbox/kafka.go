@@ -0,0 +1,54 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+)
+
+// KafkaMessage is a message of a Kafka topic.
+type KafkaMessage struct {
+	Topic   string
+	Key     []byte
+	Value   []byte
+	Headers map[string]string
+}
+
+// KafkaProducer is the part of a Kafka client the sink needs. WriteMessages must return
+// only when all the messages are acknowledged, in the order they are given within a partition.
+type KafkaProducer interface {
+	WriteMessages(ctx context.Context, msgs ...KafkaMessage) error
+}
+
+// KafkaSink publishes the events to a Kafka topic as JSON. The key is the user id,
+// so the events of a user go to the same partition and keep their order.
+// The events of the segments themselves are keyed by the slug.
+type KafkaSink struct {
+	producer KafkaProducer
+	topic    string
+}
+
+func NewKafkaSink(producer KafkaProducer, topic string) *KafkaSink {
+	return &KafkaSink{producer: producer, topic: topic}
+}
+
+func (s *KafkaSink) Publish(ctx context.Context, events []Event) error {
+	msgs := make([]KafkaMessage, 0, len(events))
+	for _, ev := range events {
+		value, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		key := ev.Slug
+		if ev.UserId != 0 {
+			key = strconv.Itoa(ev.UserId)
+		}
+		msgs = append(msgs, KafkaMessage{
+			Topic:   s.topic,
+			Key:     []byte(key),
+			Value:   value,
+			Headers: map[string]string{"seq": strconv.FormatInt(ev.Seq, 10)},
+		})
+	}
+	return s.producer.WriteMessages(ctx, msgs...)
+}
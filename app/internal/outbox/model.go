@@ -0,0 +1,43 @@
+package outbox
+
+import "time"
+
+// The types of the events.
+const (
+	Entered = "entered"
+	Left    = "left"
+	// SegmentCreated and SegmentDeleted are the events of the segment itself, they have no user
+	SegmentCreated = "segment_created"
+	SegmentDeleted = "segment_deleted"
+)
+
+// The reasons of the events.
+const (
+	// ReasonRequest is a change requested through the API or the CLI
+	ReasonRequest = "request"
+	// ReasonTtl is the expiration of the membership deleted by the TTL cleanup
+	ReasonTtl = "ttl"
+	// ReasonSegmentDeleted is the deletion of the segment with all its memberships
+	ReasonSegmentDeleted = "segment_deleted"
+	// ReasonRule is a change of the attributes of the user which match the rule of a dynamic segment
+	ReasonRule = "rule"
+	// ReasonExperiment is the first exposure of the user to an experiment, which assigns the user to a variant
+	ReasonExperiment = "experiment"
+	// ReasonExclusion is the addition of the user to another segment of the same exclusion group
+	ReasonExclusion = "exclusion"
+	// ReasonStatus is the change of the status of the segment, which shows it to its members or hides it from them
+	ReasonStatus = "status"
+)
+
+// Event is the change of a membership of a user in a segment, or the creation or deletion of a segment.
+// Seq is assigned by the relay and grows by one with every published event, so consumers
+// can skip the events they have already seen: an event may be delivered more than once.
+type Event struct {
+	Seq        int64      `json:"seq"`
+	UserId     int        `json:"user_id,omitempty"`
+	Slug       string     `json:"segment"`
+	Type       string     `json:"type"`
+	Reason     string     `json:"reason"`
+	AliveUntil *time.Time `json:"alive_until,omitempty"`
+	OccurredAt time.Time  `json:"occurred_at"`
+}
@@ -0,0 +1,50 @@
+package outbox
+
+import (
+	"context"
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+// Write adds the events to the outbox within the transaction which changes the memberships or the segment,
+// so that the events are published if and only if the transaction is committed.
+func Write(ctx context.Context, tx pgx.Tx, events ...Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	// The events are passed as arrays, so that any number of them fits into a single statement
+	userIds := make([]*int, 0, len(events))
+	slugs := make([]string, 0, len(events))
+	types := make([]string, 0, len(events))
+	reasons := make([]string, 0, len(events))
+	aliveUntil := make([]*time.Time, 0, len(events))
+	for _, ev := range events {
+		var userId *int
+		if ev.UserId != 0 {
+			userId = &ev.UserId
+		}
+		userIds = append(userIds, userId)
+		slugs = append(slugs, ev.Slug)
+		types = append(types, ev.Type)
+		reasons = append(reasons, ev.Reason)
+		aliveUntil = append(aliveUntil, ev.AliveUntil)
+	}
+
+	var userIdsArr pgtype.Int4Array
+	var aliveUntilArr pgtype.TimestamptzArray
+	if err := userIdsArr.Set(userIds); err != nil {
+		return err
+	}
+	if err := aliveUntilArr.Set(aliveUntil); err != nil {
+		return err
+	}
+
+	q := `
+		INSERT INTO outbox (user_id, slug, event, reason, alive_until)
+		SELECT * FROM unnest($1::int[], $2::varchar[], $3::varchar[], $4::varchar[], $5::timestamptz[]);
+	`
+	_, err := tx.Exec(ctx, q, &userIdsArr, slugs, types, reasons, &aliveUntilArr)
+	return err
+}
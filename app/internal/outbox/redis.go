@@ -0,0 +1,85 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+	"time"
+)
+
+// RedisStreamSink publishes the events to a Redis Stream, an entry per event.
+// The entries published again after a failure are added to the stream once more, with the same seq field.
+type RedisStreamSink struct {
+	client redis.Cmdable
+	stream string
+	// maxLen is the approximate number of entries the stream is trimmed to, 0 keeps all of them
+	maxLen int64
+}
+
+func NewRedisStreamSink(client redis.Cmdable, stream string, maxLen int64) *RedisStreamSink {
+	return &RedisStreamSink{client: client, stream: stream, maxLen: maxLen}
+}
+
+func (s *RedisStreamSink) Publish(ctx context.Context, events []Event) error {
+	_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, ev := range events {
+			pipe.XAdd(ctx, &redis.XAddArgs{
+				Stream: s.stream,
+				MaxLen: s.maxLen,
+				Approx: s.maxLen > 0,
+				Values: streamValues(ev),
+			})
+		}
+		return nil
+	})
+	return err
+}
+
+func streamValues(ev Event) map[string]interface{} {
+	values := map[string]interface{}{
+		"seq":         strconv.FormatInt(ev.Seq, 10),
+		"segment":     ev.Slug,
+		"type":        ev.Type,
+		"reason":      ev.Reason,
+		"occurred_at": ev.OccurredAt.UTC().Format(time.RFC3339Nano),
+	}
+	if ev.UserId != 0 {
+		values["user_id"] = strconv.Itoa(ev.UserId)
+	}
+	if ev.AliveUntil != nil {
+		values["alive_until"] = ev.AliveUntil.UTC().Format(time.RFC3339Nano)
+	}
+	return values
+}
+
+// parseStreamValues converts an entry of the stream back into the event.
+func parseStreamValues(values map[string]interface{}) (Event, error) {
+	str := func(key string) string {
+		s, _ := values[key].(string)
+		return s
+	}
+
+	var ev Event
+	var err error
+	if ev.Seq, err = strconv.ParseInt(str("seq"), 10, 64); err != nil {
+		return Event{}, fmt.Errorf("invalid seq: %w", err)
+	}
+	if s := str("user_id"); s != "" {
+		if ev.UserId, err = strconv.Atoi(s); err != nil {
+			return Event{}, fmt.Errorf("invalid user_id: %w", err)
+		}
+	}
+	if ev.OccurredAt, err = time.Parse(time.RFC3339Nano, str("occurred_at")); err != nil {
+		return Event{}, fmt.Errorf("invalid occurred_at: %w", err)
+	}
+	if s := str("alive_until"); s != "" {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return Event{}, fmt.Errorf("invalid alive_until: %w", err)
+		}
+		ev.AliveUntil = &t
+	}
+	ev.Slug, ev.Type, ev.Reason = str("segment"), str("type"), str("reason")
+	return ev, nil
+}
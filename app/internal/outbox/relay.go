@@ -0,0 +1,206 @@
+package outbox
+
+import (
+	"context"
+	"github.com/jackc/pgx/v4"
+	"log/slog"
+	"main/internal/metrics"
+	"main/pkg"
+	"time"
+)
+
+// Sink is where the relay publishes the events to. Publish must either deliver all the events
+// in the given order or return an error, then they are published again with the same numbers.
+type Sink interface {
+	Publish(ctx context.Context, events []Event) error
+}
+
+// Sinks publishes the events to each of the sinks in turn. If one of them fails, the events are published
+// again to all of them, so each sink must tolerate the repeated events.
+type Sinks []Sink
+
+func (s Sinks) Publish(ctx context.Context, events []Event) error {
+	for _, sink := range s {
+		if err := sink.Publish(ctx, events); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Relay publishes the events from the outbox to the sink at least once and in the order of their numbers.
+// Any number of app instances may run it, the events are published by one of them at a time.
+type Relay struct {
+	client    pkg.DBClient
+	sink      Sink
+	batchSize int
+}
+
+func NewRelay(client pkg.DBClient, sink Sink, batchSize int) *Relay {
+	return &Relay{client: client, sink: sink, batchSize: batchSize}
+}
+
+// Run relays the events every interval until ctx is done.
+func (r *Relay) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		// Drain the outbox, a full batch means that there may be more events
+		for {
+			n, err := r.RelayOnce(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.ErrorContext(ctx, "failed to relay outbox events", "err", err)
+				}
+				break
+			}
+			if n < r.batchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// RelayOnce numbers and publishes a batch of events and returns the number of published ones.
+//
+// The events are numbered and published in separate transactions: if publishing fails
+// or its transaction is not committed, the events are published again with the same numbers.
+func (r *Relay) RelayOnce(ctx context.Context) (int, error) {
+	if err := r.sequence(ctx); err != nil {
+		return 0, err
+	}
+	n, err := r.publish(ctx)
+	if err != nil {
+		metrics.OutboxPublishFailures.Inc()
+		return 0, err
+	}
+	metrics.OutboxPublished.Add(float64(n))
+	return n, nil
+}
+
+// sequence numbers a batch of the events which have no number yet in the order they have been written.
+// The events of transactions which are committed later get the later numbers.
+func (r *Relay) sequence(ctx context.Context) (err error) {
+	tx, err := r.client.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback(ctx)
+			panic(p)
+		} else if err != nil {
+			tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	// The row lock serializes the numbering between the instances
+	var last int64
+	if err = tx.QueryRow(ctx, `SELECT last_seq FROM outbox_state FOR UPDATE;`).Scan(&last); err != nil {
+		return err
+	}
+
+	ids, err := queryIds(ctx, tx, `SELECT id FROM outbox WHERE seq IS NULL ORDER BY id LIMIT $1;`, r.batchSize)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+
+	q := `
+		UPDATE outbox o SET seq = $1 + v.n
+		FROM unnest($2::bigint[]) WITH ORDINALITY AS v(id, n)
+		WHERE o.id = v.id;
+	`
+	if _, err = tx.Exec(ctx, q, last, ids); err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `UPDATE outbox_state SET last_seq = $1;`, last+int64(len(ids)))
+	return err
+}
+
+func queryIds(ctx context.Context, tx pgx.Tx, q string, args ...interface{}) ([]int64, error) {
+	rows, err := tx.Query(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// publish sends the numbered events to the sink and deletes them from the outbox.
+func (r *Relay) publish(ctx context.Context) (n int, err error) {
+	tx, err := r.client.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback(ctx)
+			panic(p)
+		} else if err != nil {
+			tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	// Only one instance publishes at a time, otherwise the sink could get the batches out of order
+	if _, err = tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('outbox_relay'));`); err != nil {
+		return 0, err
+	}
+
+	q := `
+		SELECT seq, COALESCE(user_id, 0), slug, event, reason, alive_until, occurred_at
+		FROM outbox WHERE seq IS NOT NULL
+		ORDER BY seq
+		LIMIT $1;
+	`
+	rows, err := tx.Query(ctx, q, r.batchSize)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	events := make([]Event, 0)
+	seqs := make([]int64, 0)
+	for rows.Next() {
+		var ev Event
+		if err = rows.Scan(&ev.Seq, &ev.UserId, &ev.Slug, &ev.Type, &ev.Reason, &ev.AliveUntil, &ev.OccurredAt); err != nil {
+			return 0, err
+		}
+		events = append(events, ev)
+		seqs = append(seqs, ev.Seq)
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	if err = r.sink.Publish(ctx, events); err != nil {
+		return 0, err
+	}
+
+	if _, err = tx.Exec(ctx, `DELETE FROM outbox WHERE seq = ANY($1);`, seqs); err != nil {
+		return 0, err
+	}
+	return len(events), nil
+}
@@ -2,6 +2,7 @@ package reportcsv
 
 import (
 	"encoding/csv"
+	"io"
 	"main/internal/history"
 	"os"
 	"strconv"
@@ -20,11 +21,15 @@ func CreateReport(story []history.HistoryDto, fileName string) error {
 	}
 	defer file.Close()
 
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
+	return WriteReport(file, story)
+}
+
+// WriteReport writes the history as a csv report to w.
+func WriteReport(w io.Writer, story []history.HistoryDto) error {
+	writer := csv.NewWriter(w)
 
 	headers := []string{"user", "segment", "operation", "date"}
-	if err = writer.Write(headers); err != nil {
+	if err := writer.Write(headers); err != nil {
 		return err
 	}
 
@@ -35,10 +40,11 @@ func CreateReport(story []history.HistoryDto, fileName string) error {
 			row.Operation,
 			row.Date,
 		}
-		if err = writer.Write(csvRow); err != nil {
+		if err := writer.Write(csvRow); err != nil {
 			return err
 		}
 	}
 
-	return nil
+	writer.Flush()
+	return writer.Error()
 }
@@ -0,0 +1,469 @@
+// Package rule implements the expressions which define the members of dynamic segments, e.g.
+//
+//	city == "Moscow" && platform in ["ios", "android"] && registered_at >= "2023-01-01"
+//
+// An expression is evaluated against the attributes of a user. The identifiers are the attributes,
+// nested ones are separated by dots (device.os), a missing attribute is null. The literals are
+// strings in double quotes, numbers, true, false, null and lists in square brackets.
+//
+// The operators from the lowest precedence: ||, &&, ! and the comparisons ==, !=, <, <=, >, >=, in, not in.
+// Values of different types are never equal, < and the like compare only two numbers or two strings,
+// so the dates in the ISO format can be compared as strings. An identifier alone is true if the attribute is true.
+package rule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Rule is a parsed expression.
+type Rule struct {
+	src  string
+	root node
+}
+
+// Parse parses the expression.
+func Parse(src string) (*Rule, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %s at %d", t, t.pos)
+	}
+	return &Rule{src: src, root: root}, nil
+}
+
+// Match reports whether the attributes satisfy the rule.
+func (r *Rule) Match(attrs map[string]interface{}) bool {
+	return truthy(r.root.eval(attrs))
+}
+
+func (r *Rule) String() string {
+	return r.src
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of rule"
+	}
+	return strconv.Quote(t.text)
+}
+
+// operators are sorted so that the longer ones are matched first.
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", ","}
+
+func lex(src string) ([]token, error) {
+	tokens := make([]token, 0)
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"':
+			// The string ends with the first quote which is not escaped
+			j := i + 1
+			for ; j < len(src) && src[j] != '"'; j++ {
+				if src[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			s, err := strconv.Unquote(src[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at %d", i)
+			}
+			tokens = append(tokens, token{kind: tokenString, text: s, pos: i})
+			i = j + 1
+		case c == '-' || c == '.' || unicode.IsDigit(c):
+			j := i + 1
+			for j < len(src) && (src[j] == '.' || unicode.IsDigit(rune(src[j]))) {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: src[i:j], pos: i})
+			i = j
+		case c == '_' || unicode.IsLetter(c):
+			j := i + 1
+			for j < len(src) && (src[j] == '_' || src[j] == '.' || unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j]))) {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: src[i:j], pos: i})
+			i = j
+		default:
+			op := ""
+			for _, o := range operators {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+			tokens = append(tokens, token{kind: tokenOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(src)}), nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it is the operator or the keyword.
+func (p *parser) accept(text string) bool {
+	t := p.peek()
+	if (t.kind == tokenOp || t.kind == tokenIdent) && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(op string) error {
+	if !p.accept(op) {
+		t := p.peek()
+		return fmt.Errorf("expected %q, got %s at %d", op, t, t.pos)
+	}
+	return nil
+}
+
+func (p *parser) or() (node, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) and() (node, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) not() (node, error) {
+	if p.accept("!") {
+		n, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{n}, nil
+	}
+	return p.comparison()
+}
+
+func (p *parser) comparison() (node, error) {
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	switch {
+	case t.kind == tokenOp && (t.text == "==" || t.text == "!=" || t.text == "<" || t.text == "<=" || t.text == ">" || t.text == ">="):
+		p.next()
+		right, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		return compareNode{op: t.text, left: left, right: right}, nil
+	case t.kind == tokenIdent && t.text == "in":
+		p.next()
+		right, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		return inNode{left: left, right: right}, nil
+	case t.kind == tokenIdent && t.text == "not":
+		p.next()
+		if err = p.expect("in"); err != nil {
+			return nil, err
+		}
+		right, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{inNode{left: left, right: right}}, nil
+	}
+	return left, nil
+}
+
+func (p *parser) operand() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenString:
+		return literal{t.text}, nil
+	case tokenNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s at %d", t, t.pos)
+		}
+		return literal{f}, nil
+	case tokenIdent:
+		switch t.text {
+		case "true":
+			return literal{true}, nil
+		case "false":
+			return literal{false}, nil
+		case "null":
+			return literal{nil}, nil
+		case "in", "not":
+			return nil, fmt.Errorf("unexpected %s at %d", t, t.pos)
+		}
+		return attribute(strings.Split(t.text, ".")), nil
+	case tokenOp:
+		switch t.text {
+		case "(":
+			n, err := p.or()
+			if err != nil {
+				return nil, err
+			}
+			return n, p.expect(")")
+		case "[":
+			items := make(listNode, 0)
+			if p.accept("]") {
+				return items, nil
+			}
+			for {
+				item, err := p.operand()
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, item)
+				if p.accept("]") {
+					return items, nil
+				}
+				if err = p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("unexpected %s at %d", t, t.pos)
+}
+
+// node is a node of the expression tree. eval returns nil, bool, float64, string or []interface{}.
+type node interface {
+	eval(attrs map[string]interface{}) interface{}
+}
+
+type literal struct {
+	v interface{}
+}
+
+func (n literal) eval(map[string]interface{}) interface{} {
+	return n.v
+}
+
+type attribute []string
+
+func (n attribute) eval(attrs map[string]interface{}) interface{} {
+	var v interface{} = attrs
+	for _, key := range n {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+	return normalize(v)
+}
+
+// normalize converts the numbers of the other types, which appear if the attributes are not decoded from JSON.
+func normalize(v interface{}) interface{} {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case float32:
+		return float64(n)
+	}
+	return v
+}
+
+type listNode []node
+
+func (n listNode) eval(attrs map[string]interface{}) interface{} {
+	items := make([]interface{}, 0, len(n))
+	for _, item := range n {
+		items = append(items, item.eval(attrs))
+	}
+	return items
+}
+
+type andNode struct {
+	left, right node
+}
+
+func (n andNode) eval(attrs map[string]interface{}) interface{} {
+	return truthy(n.left.eval(attrs)) && truthy(n.right.eval(attrs))
+}
+
+type orNode struct {
+	left, right node
+}
+
+func (n orNode) eval(attrs map[string]interface{}) interface{} {
+	return truthy(n.left.eval(attrs)) || truthy(n.right.eval(attrs))
+}
+
+type notNode struct {
+	n node
+}
+
+func (n notNode) eval(attrs map[string]interface{}) interface{} {
+	return !truthy(n.n.eval(attrs))
+}
+
+type compareNode struct {
+	op          string
+	left, right node
+}
+
+func (n compareNode) eval(attrs map[string]interface{}) interface{} {
+	l, r := n.left.eval(attrs), n.right.eval(attrs)
+	switch n.op {
+	case "==":
+		return equal(l, r)
+	case "!=":
+		return !equal(l, r)
+	}
+
+	var c int
+	switch lv := l.(type) {
+	case float64:
+		rv, ok := r.(float64)
+		if !ok {
+			return false
+		}
+		c = compareFloats(lv, rv)
+	case string:
+		rv, ok := r.(string)
+		if !ok {
+			return false
+		}
+		c = strings.Compare(lv, rv)
+	default:
+		return false
+	}
+
+	switch n.op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	default:
+		return c >= 0
+	}
+}
+
+type inNode struct {
+	left, right node
+}
+
+func (n inNode) eval(attrs map[string]interface{}) interface{} {
+	items, ok := n.right.eval(attrs).([]interface{})
+	if !ok {
+		return false
+	}
+	v := n.left.eval(attrs)
+	for _, item := range items {
+		if equal(v, normalize(item)) {
+			return true
+		}
+	}
+	return false
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func equal(a, b interface{}) bool {
+	switch av := a.(type) {
+	case nil:
+		return b == nil
+	case bool:
+		bv, ok := b.(bool)
+		return ok && av == bv
+	case float64:
+		bv, ok := b.(float64)
+		return ok && av == bv
+	case string:
+		bv, ok := b.(string)
+		return ok && av == bv
+	}
+	return false
+}
+
+func truthy(v interface{}) bool {
+	b, ok := v.(bool)
+	return ok && b
+}
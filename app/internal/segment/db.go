@@ -2,31 +2,606 @@ package segment
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
 	"main/internal/e"
+	"main/internal/outbox"
 	"main/pkg"
+	"sort"
+	"strings"
+	"time"
 )
 
 type repository struct {
 	client pkg.DBClient
 }
 
+// columns are the columns of a segment in the order of scanSegment, the parent is selected by its slug.
+const columns = `segment_id, slug, default_ttl, rule, exclusion_group,
+	(SELECT p.slug FROM segments p WHERE p.segment_id = segments.parent_id),
+	description, owner, tags, status, created_at, updated_at`
+
+func scanSegment(row pgx.Row, s *Segment) error {
+	return row.Scan(&s.Id, &s.Slug, &s.DefaultTtl, &s.Rule, &s.ExclusionGroup, &s.Parent,
+		&s.Description, &s.Owner, &s.Tags, &s.Status, &s.CreatedAt, &s.UpdatedAt)
+}
+
+// bySlug is the condition which finds a segment by its slug $1 or by a deprecated alias of it.
+const bySlug = `(slug = $1 OR segment_id = (SELECT segment_id FROM segment_aliases WHERE slug = $1))`
+
+// slugLocks is the first key of the advisory locks of the slugs, it keeps them apart from the other advisory locks.
+const slugLocks = 1
+
+// lockSlugs locks the slugs until the end of the transaction. The segments table keeps the current slugs unique,
+// the locks keep them apart from the aliases while the segments are created and renamed.
+func lockSlugs(ctx context.Context, tx pgx.Tx, slugs ...string) error {
+	sorted := append(make([]string, 0, len(slugs)), slugs...)
+	sort.Strings(sorted)
+	for _, slug := range sorted {
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1, hashtext($2));`, slugLocks, slug); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hierarchyLock is the key of the advisory lock of the segment hierarchy. The parents are changed one at a time,
+// so that the concurrent changes cannot make a cycle together.
+const hierarchyLock = 2
+
+// lockHierarchy locks the hierarchy until the end of the transaction. It has to be locked before any segment
+// row, otherwise two transactions setting the parents of each other's segments could deadlock.
+func lockHierarchy(ctx context.Context, tx pgx.Tx) error {
+	_, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1, 0);`, hierarchyLock)
+	return err
+}
+
+// findParent returns the id and the current slug of the parent found by its slug or an alias, the hierarchy
+// has to be locked already. The parent is locked, so that it is not deleted meanwhile.
+func findParent(ctx context.Context, tx pgx.Tx, slug string) (int, string, error) {
+	var parentId int
+	q := `SELECT segment_id, slug FROM segments WHERE ` + bySlug + ` FOR SHARE;`
+	err := tx.QueryRow(ctx, q, slug).Scan(&parentId, &slug)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, "", &e.ParentNotFoundError{Slug: slug}
+	}
+	return parentId, slug, err
+}
+
+// checkCycle checks that the parent is neither the segment itself nor one of its descendants.
+func checkCycle(ctx context.Context, tx pgx.Tx, segmentId int, slug string, parentId int, parent string) error {
+	q := `
+		WITH RECURSIVE ancestors (segment_id) AS (
+			SELECT $1::int
+			UNION
+			SELECT s.parent_id FROM segments s JOIN ancestors a ON a.segment_id = s.segment_id
+			WHERE s.parent_id IS NOT NULL
+		)
+		SELECT EXISTS (SELECT 1 FROM ancestors WHERE segment_id = $2);
+	`
+	var cycle bool
+	if err := tx.QueryRow(ctx, q, parentId, segmentId).Scan(&cycle); err != nil {
+		return err
+	}
+	if cycle {
+		return &e.SegmentCycleError{Slug: slug, Parent: parent}
+	}
+	return nil
+}
+
+// ReserveSlugs locks the slugs of new segments until the end of the transaction and checks that none of them
+// is an alias of a renamed segment.
+func ReserveSlugs(ctx context.Context, tx pgx.Tx, slugs ...string) error {
+	if err := lockSlugs(ctx, tx, slugs...); err != nil {
+		return err
+	}
+	var alias string
+	q := `SELECT slug FROM segment_aliases WHERE slug = ANY($1) ORDER BY slug LIMIT 1;`
+	err := tx.QueryRow(ctx, q, slugs).Scan(&alias)
+	if err == nil {
+		return &e.DuplicateSegmentError{SegmentName: alias}
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	return err
+}
+
+// FindAliases returns the current slugs of the renamed segments whose deprecated aliases are among the slugs,
+// keyed by the alias.
+func FindAliases(ctx context.Context, client pkg.DBClient, slugs []string) (map[string]string, error) {
+	q := `
+		SELECT a.slug, s.slug FROM segment_aliases a JOIN segments s ON s.segment_id = a.segment_id
+		WHERE a.slug = ANY($1);
+	`
+	rows, err := client.Query(ctx, q, slugs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	aliases := make(map[string]string)
+	for rows.Next() {
+		var alias, slug string
+		if err = rows.Scan(&alias, &slug); err != nil {
+			return nil, err
+		}
+		aliases[alias] = slug
+	}
+	return aliases, rows.Err()
+}
+
 // Create is a method that adds a new segment to the segments table.
-func (r *repository) Create(ctx context.Context, segment *Segment) error {
-	q := `INSERT INTO segments (slug) VALUES ($1) RETURNING segment_id`
-	_, err := r.client.Exec(ctx, q, segment.Slug)
+// The creation is written to the outbox in the same transaction. The members of a segment with a rule
+// are added by the rule_segments job. A segment without a status is active. The parent may be given by an alias,
+// the segment gets its current slug.
+func (r *repository) Create(ctx context.Context, segment *Segment) (err error) {
+	tx, err := r.client.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback(ctx)
+			panic(p)
+		} else if err != nil {
+			tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	if segment.Status == "" {
+		segment.Status = StatusActive
+	}
+	if segment.Tags == nil {
+		segment.Tags = make([]string, 0)
+	}
+	// The parent is locked before the slug, in the same order as Rename locks the segment and the slugs
+	var parentId *int
+	if segment.Parent != nil {
+		if err = lockHierarchy(ctx, tx); err != nil {
+			return err
+		}
+		id, parent, err := findParent(ctx, tx, *segment.Parent)
+		if err != nil {
+			return err
+		}
+		parentId, segment.Parent = &id, &parent
+	}
+	if err = ReserveSlugs(ctx, tx, segment.Slug); err != nil {
+		return err
+	}
+	q := `
+		INSERT INTO segments (slug, default_ttl, rule, exclusion_group, parent_id, description, owner, tags, status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING segment_id, created_at, updated_at
+	`
+	err = tx.QueryRow(ctx, q, segment.Slug, segment.DefaultTtl, segment.Rule, segment.ExclusionGroup, parentId,
+		segment.Description, segment.Owner, segment.Tags, segment.Status).Scan(&segment.Id, &segment.CreatedAt, &segment.UpdatedAt)
 	if e.IsDuplicateError(err) {
 		return &e.DuplicateSegmentError{SegmentName: segment.Slug}
 	}
-	return err
+	if err != nil {
+		return err
+	}
+	return outbox.Write(ctx, tx, outbox.Event{Slug: segment.Slug, Type: outbox.SegmentCreated, Reason: outbox.ReasonRequest})
 }
 
 // Delete is a method that deletes a segment from the segments table based on the provided slug.
-func (r *repository) Delete(ctx context.Context, slug string) error {
-	q := `DELETE FROM segments WHERE slug = $1`
-	_, err := r.client.Exec(ctx, q, slug)
+// The users leave the segment: their memberships are deleted and written to the history and the outbox,
+// followed by the deletion of the segment itself together with its aliases.
+// The segment of a variant of an experiment cannot be deleted, nor can a segment with children.
+func (r *repository) Delete(ctx context.Context, slug string) (err error) {
+	tx, err := r.client.Begin(ctx)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback(ctx)
+			panic(p)
+		} else if err != nil {
+			tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	// The segment may be found by an alias, the history and the events get the current slug
+	var segmentId int
+	q := `SELECT segment_id, slug FROM segments WHERE ` + bySlug + ` FOR UPDATE;`
+	err = tx.QueryRow(ctx, q, slug).Scan(&segmentId, &slug)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var experiment string
+	q = `
+		SELECT e.slug FROM experiment_variants v JOIN experiments e ON e.experiment_id = v.experiment_id
+		WHERE v.segment_id = $1;
+	`
+	err = tx.QueryRow(ctx, q, segmentId).Scan(&experiment)
+	if err == nil {
+		return &e.SegmentInExperimentError{Slug: slug, Experiment: experiment}
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+
+	// The inherited memberships would silently disappear, so the children have to be moved or deleted first
+	children, err := findChildren(ctx, tx, segmentId)
+	if err != nil {
+		return err
+	}
+	if len(children) > 0 {
+		return &e.SegmentHasChildrenError{Slug: slug, Children: children}
+	}
+
+	// The deletions are written to the history in the same statement, a segment may have many users
+	q = `
+		WITH deleted AS (DELETE FROM user_segments WHERE segment_id = $1 RETURNING user_id)
+		INSERT INTO history (user_id, segment_id, slug, operation, date)
+		SELECT user_id, $1, $2::varchar, 'deleted', $3::timestamp FROM deleted
+		RETURNING user_id;
+	`
+	rows, err := tx.Query(ctx, q, segmentId, slug, time.Now().Format("2006-01-02 15:04:05"))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	events := make([]outbox.Event, 0)
+	for rows.Next() {
+		var userId int
+		if err = rows.Scan(&userId); err != nil {
+			return err
+		}
+		events = append(events, outbox.Event{UserId: userId, Slug: slug, Type: outbox.Left, Reason: outbox.ReasonSegmentDeleted})
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	events = append(events, outbox.Event{Slug: slug, Type: outbox.SegmentDeleted, Reason: outbox.ReasonRequest})
+	if err = outbox.Write(ctx, tx, events...); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM segments WHERE segment_id = $1;`, segmentId)
+	return err
+}
+
+// FindAll returns the segments matching the filter ordered by slug.
+func (r *repository) FindAll(ctx context.Context, filter Filter) ([]*Segment, error) {
+	q := `
+		SELECT ` + columns + ` FROM segments
+		WHERE ($1 = '' OR $1 = ANY(tags)) AND ($2 = '' OR owner = $2) AND ($3 = '' OR status = $3)
+		ORDER BY slug
+	`
+	rows, err := r.client.Query(ctx, q, filter.Tag, filter.Owner, filter.Status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	segments := make([]*Segment, 0)
+	for rows.Next() {
+		var s Segment
+		if err = scanSegment(rows, &s); err != nil {
+			return nil, err
+		}
+		segments = append(segments, &s)
+	}
+	return segments, rows.Err()
+}
+
+// Update applies the patch to the segment found by its slug or an alias and returns the changed segment.
+func (r *repository) Update(ctx context.Context, slug string, patch *Patch) (segment *Segment, err error) {
+	tx, err := r.client.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback(ctx)
+			panic(p)
+		} else if err != nil {
+			tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	// The hierarchy is locked before the segment, see lockHierarchy
+	setsParent := patch.Parent != nil && *patch.Parent != ""
+	if setsParent {
+		if err = lockHierarchy(ctx, tx); err != nil {
+			return nil, err
+		}
+	}
+	var segmentId int
+	var rule *string
+	var status string
+	q := `SELECT segment_id, slug, rule, status FROM segments WHERE ` + bySlug + ` FOR UPDATE;`
+	err = tx.QueryRow(ctx, q, slug).Scan(&segmentId, &slug, &rule, &status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, &e.SegmentsNotFoundError{Slugs: []string{slug}}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sets := []string{"updated_at = now()"}
+	args := []interface{}{segmentId}
+	set := func(column string, value interface{}) {
+		args = append(args, value)
+		sets = append(sets, fmt.Sprintf("%s = $%d", column, len(args)))
+	}
+	if patch.DefaultTtl != nil {
+		// The members of a dynamic segment do not expire
+		if rule != nil {
+			return nil, &e.RuleSegmentError{Slugs: []string{slug}}
+		}
+		set("default_ttl", *patch.DefaultTtl)
+	} else if patch.ClearDefaultTtl {
+		set("default_ttl", nil)
+	}
+	if patch.Description != nil {
+		set("description", nullIfEmpty(*patch.Description))
+	}
+	if patch.Owner != nil {
+		set("owner", nullIfEmpty(*patch.Owner))
+	}
+	if patch.Tags != nil {
+		set("tags", patch.Tags)
+	}
+	if patch.Status != nil {
+		set("status", *patch.Status)
+	}
+	if patch.ExclusionGroup != nil {
+		if err = checkExclusionGroup(ctx, tx, segmentId, slug, rule, *patch.ExclusionGroup); err != nil {
+			return nil, err
+		}
+		set("exclusion_group", *patch.ExclusionGroup)
+	} else if patch.ClearExclusionGroup {
+		set("exclusion_group", nil)
+	}
+	if patch.Parent != nil && *patch.Parent == "" {
+		set("parent_id", nil)
+	} else if setsParent {
+		parentId, parent, err := findParent(ctx, tx, *patch.Parent)
+		if err != nil {
+			return nil, err
+		}
+		if err = checkCycle(ctx, tx, segmentId, slug, parentId, parent); err != nil {
+			return nil, err
+		}
+		set("parent_id", parentId)
+	}
+
+	segment = &Segment{}
+	q = `UPDATE segments SET ` + strings.Join(sets, ", ") + ` WHERE segment_id = $1 RETURNING ` + columns
+	if err = scanSegment(tx.QueryRow(ctx, q, args...), segment); err != nil {
+		return nil, err
+	}
+	if (status == StatusActive) != (segment.Status == StatusActive) {
+		if err = writeStatusEvents(ctx, tx, segment); err != nil {
+			return nil, err
+		}
+	}
+	return segment, nil
+}
+
+// writeStatusEvents writes the events of the members of the segment which has been shown to them or hidden
+// from them by the change of its status, so that the consumers of the events see the same segments
+// as GET /segment/user. The inherited memberships have no events, as everywhere else.
+func writeStatusEvents(ctx context.Context, tx pgx.Tx, segment *Segment) error {
+	q := `
+		SELECT user_id, alive_until FROM user_segments
+		WHERE segment_id = $1 AND (alive_until IS NULL OR alive_until > now())
+		ORDER BY user_id;
+	`
+	rows, err := tx.Query(ctx, q, segment.Id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	events := make([]outbox.Event, 0)
+	for rows.Next() {
+		ev := outbox.Event{Slug: segment.Slug, Type: outbox.Left, Reason: outbox.ReasonStatus}
+		if err = rows.Scan(&ev.UserId, &ev.AliveUntil); err != nil {
+			return err
+		}
+		if segment.Status == StatusActive {
+			ev.Type = outbox.Entered
+		} else {
+			ev.AliveUntil = nil
+		}
+		events = append(events, ev)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	return outbox.Write(ctx, tx, events...)
+}
+
+// FindStatus returns the status of the segment found by its slug or an alias.
+func (r *repository) FindStatus(ctx context.Context, slug string) (string, error) {
+	var status string
+	err := r.client.QueryRow(ctx, `SELECT status FROM segments WHERE `+bySlug+`;`, slug).Scan(&status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", &e.SegmentsNotFoundError{Slugs: []string{slug}}
+	}
+	return status, err
+}
+
+// Rename changes the slug of the segment found by its slug or an alias and returns the renamed segment.
+// The previous slug becomes a deprecated alias of the segment, renaming the segment back to an alias
+// of its own turns the alias into the slug again. The slugs and the aliases of the other segments cannot be taken.
+func (r *repository) Rename(ctx context.Context, slug, newSlug string) (segment *Segment, err error) {
+	tx, err := r.client.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback(ctx)
+			panic(p)
+		} else if err != nil {
+			tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	var segmentId int
+	q := `SELECT segment_id, slug FROM segments WHERE ` + bySlug + ` FOR UPDATE;`
+	err = tx.QueryRow(ctx, q, slug).Scan(&segmentId, &slug)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, &e.SegmentsNotFoundError{Slugs: []string{slug}}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	segment = &Segment{}
+	if newSlug == slug {
+		q = `SELECT ` + columns + ` FROM segments WHERE segment_id = $1;`
+		if err = scanSegment(tx.QueryRow(ctx, q, segmentId), segment); err != nil {
+			return nil, err
+		}
+		return segment, nil
+	}
+
+	if err = lockSlugs(ctx, tx, slug, newSlug); err != nil {
+		return nil, err
+	}
+	var aliasOf int
+	err = tx.QueryRow(ctx, `SELECT segment_id FROM segment_aliases WHERE slug = $1;`, newSlug).Scan(&aliasOf)
+	if err == nil && aliasOf != segmentId {
+		return nil, &e.DuplicateSegmentError{SegmentName: newSlug}
+	}
+	if err == nil {
+		if _, err = tx.Exec(ctx, `DELETE FROM segment_aliases WHERE slug = $1;`, newSlug); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, err
+	}
+
+	q = `UPDATE segments SET slug = $2, updated_at = now() WHERE segment_id = $1 RETURNING ` + columns
+	err = scanSegment(tx.QueryRow(ctx, q, segmentId, newSlug), segment)
+	if e.IsDuplicateError(err) {
+		return nil, &e.DuplicateSegmentError{SegmentName: newSlug}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	q = `INSERT INTO segment_aliases (slug, segment_id) VALUES ($1, $2);`
+	if _, err = tx.Exec(ctx, q, slug, segmentId); err != nil {
+		return nil, err
+	}
+	return segment, nil
+}
+
+// FindMembers returns the ids of the direct members of the segment, including the expired memberships
+// which have not been deleted yet.
+func (r *repository) FindMembers(ctx context.Context, segmentId int) ([]int, error) {
+	rows, err := r.client.Query(ctx, `SELECT user_id FROM user_segments WHERE segment_id = $1 ORDER BY user_id;`, segmentId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	userIds := make([]int, 0)
+	for rows.Next() {
+		var userId int
+		if err = rows.Scan(&userId); err != nil {
+			return nil, err
+		}
+		userIds = append(userIds, userId)
+	}
+	return userIds, rows.Err()
+}
+
+// findChildren returns the slugs of the children of the segment.
+func findChildren(ctx context.Context, tx pgx.Tx, segmentId int) ([]string, error) {
+	rows, err := tx.Query(ctx, `SELECT slug FROM segments WHERE parent_id = $1 ORDER BY slug;`, segmentId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	children := make([]string, 0)
+	for rows.Next() {
+		var child string
+		if err = rows.Scan(&child); err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+	return children, rows.Err()
+}
+
+func nullIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// checkExclusionGroup checks that the segment can join the exclusion group: its members must not be members
+// of another segment of the group. The members of dynamic segments and of the variants of experiments are assigned
+// without the groups, so they cannot join one.
+func checkExclusionGroup(ctx context.Context, tx pgx.Tx, segmentId int, slug string, rule *string, group string) error {
+	if rule != nil {
+		return &e.RuleSegmentError{Slugs: []string{slug}}
+	}
+
+	var experiment string
+	q := `
+		SELECT e.slug FROM experiment_variants v JOIN experiments e ON e.experiment_id = v.experiment_id
+		WHERE v.segment_id = $1;
+	`
+	err := tx.QueryRow(ctx, q, segmentId).Scan(&experiment)
+	if err == nil {
+		return &e.SegmentInExperimentError{Slug: slug, Experiment: experiment}
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+
+	// The other segments of the group are locked, so that no user joins them meanwhile
+	q = `SELECT segment_id FROM segments WHERE exclusion_group = $1 ORDER BY segment_id FOR UPDATE;`
+	if _, err = tx.Exec(ctx, q, group); err != nil {
+		return err
+	}
+
+	q = `
+		SELECT s.slug FROM segments s
+		WHERE s.exclusion_group = $2 AND s.segment_id <> $1 AND EXISTS (
+			SELECT 1 FROM user_segments a JOIN user_segments b ON b.user_id = a.user_id
+			WHERE a.segment_id = $1 AND b.segment_id = s.segment_id
+			  AND (a.alive_until IS NULL OR a.alive_until > now())
+			  AND (b.alive_until IS NULL OR b.alive_until > now())
+		)
+		ORDER BY s.slug
+		LIMIT 1;
+	`
+	var conflicting string
+	err = tx.QueryRow(ctx, q, segmentId, group).Scan(&conflicting)
+	if err == nil {
+		return &e.ExclusionConflictError{Group: group, Slugs: []string{conflicting, slug}}
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
 	return nil
 }
 
@@ -1,9 +1,175 @@
 package segment
 
+import (
+	"main/internal/rule"
+	"main/pkg/utils"
+	"time"
+)
+
+// SegmentDto describes a segment in requests and, in the user segments response, the membership of the user in it.
 type SegmentDto struct {
-	Slug string `json:"slug"`
+	Slug       string  `json:"slug"`
+	DefaultTtl *string `json:"default_ttl,omitempty"`
+	// Rule makes the segment dynamic, see package rule. Its members do not expire, so it has no default TTL
+	Rule *string `json:"rule,omitempty"`
+	// ExclusionGroup is the group of the mutually exclusive segments, the rules cannot keep its members apart,
+	// so a dynamic segment is in none
+	ExclusionGroup *string `json:"exclusion_group,omitempty"`
+	// Parent is the parent segment, the members of the segment are inherited members of it
+	Parent *string `json:"parent,omitempty"`
+	// Description, Owner, Tags, Status, CreatedAt and UpdatedAt describe the segment in the listing
+	Description *string    `json:"description,omitempty"`
+	Owner       *string    `json:"owner,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	Status      string     `json:"status,omitempty"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+	UpdatedAt   *time.Time `json:"updated_at,omitempty"`
+	// AddedAt is when the user was added, AliveUntil until when the user stays there,
+	// it is missing if the membership does not expire
+	AddedAt    *time.Time `json:"added_at,omitempty"`
+	AliveUntil *time.Time `json:"alive_until,omitempty"`
+	// InheritedFrom is, among the effective segments of a user, the direct segment of the user which
+	// the inherited membership comes from, it is not set for the direct ones
+	InheritedFrom *string `json:"inherited_from,omitempty"`
 }
 
 func (s *SegmentDto) Valid() bool {
-	return s.Slug != ""
+	if s.Slug == "" {
+		return false
+	}
+	if s.DefaultTtl != nil {
+		d, err := utils.ParseISODuration(*s.DefaultTtl)
+		if err != nil || d.IsZero() {
+			return false
+		}
+	}
+	if s.Rule != nil {
+		if _, err := rule.Parse(*s.Rule); err != nil || s.DefaultTtl != nil || s.ExclusionGroup != nil {
+			return false
+		}
+	}
+	if s.ExclusionGroup != nil && *s.ExclusionGroup == "" {
+		return false
+	}
+	if s.Parent != nil && (*s.Parent == "" || *s.Parent == s.Slug) {
+		return false
+	}
+	return (s.Status == "" || ValidStatus(s.Status)) && validTags(s.Tags)
+}
+
+// NewSegment creates the segment described by the dto.
+func NewSegment(s *SegmentDto) *Segment {
+	return &Segment{
+		Slug:           s.Slug,
+		DefaultTtl:     s.DefaultTtl,
+		Rule:           s.Rule,
+		ExclusionGroup: s.ExclusionGroup,
+		Parent:         s.Parent,
+		Description:    s.Description,
+		Owner:          s.Owner,
+		Tags:           s.Tags,
+		Status:         s.Status,
+	}
+}
+
+// NewSegmentDto describes the segment in the listing.
+func NewSegmentDto(s *Segment) SegmentDto {
+	createdAt, updatedAt := s.CreatedAt, s.UpdatedAt
+	return SegmentDto{
+		Slug:           s.Slug,
+		DefaultTtl:     s.DefaultTtl,
+		Rule:           s.Rule,
+		ExclusionGroup: s.ExclusionGroup,
+		Parent:         s.Parent,
+		Description:    s.Description,
+		Owner:          s.Owner,
+		Tags:           s.Tags,
+		Status:         s.Status,
+		CreatedAt:      &createdAt,
+		UpdatedAt:      &updatedAt,
+	}
+}
+
+// SegmentsDto is the listing of the segments.
+type SegmentsDto struct {
+	Segments []SegmentDto `json:"segments"`
+}
+
+// validTags reports whether the tags are not empty and not repeated.
+func validTags(tags []string) bool {
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		if tag == "" || seen[tag] {
+			return false
+		}
+		seen[tag] = true
+	}
+	return true
+}
+
+// SegmentPatchDto changes the segment, the missing fields are not changed. An empty description, owner or parent
+// clears it, the tags replace the current ones. At most one of ExclusionGroup and ClearExclusionGroup
+// and of DefaultTtl and ClearDefaultTtl can be set, and at least one change is required.
+type SegmentPatchDto struct {
+	Slug                string   `json:"slug"`
+	DefaultTtl          *string  `json:"default_ttl,omitempty"`
+	ClearDefaultTtl     bool     `json:"clear_default_ttl,omitempty"`
+	Description         *string  `json:"description,omitempty"`
+	Owner               *string  `json:"owner,omitempty"`
+	Tags                []string `json:"tags"`
+	Status              *string  `json:"status,omitempty"`
+	ExclusionGroup      *string  `json:"exclusion_group,omitempty"`
+	ClearExclusionGroup bool     `json:"clear_exclusion_group,omitempty"`
+	Parent              *string  `json:"parent,omitempty"`
+}
+
+func (s *SegmentPatchDto) Valid() bool {
+	if s.Slug == "" || (s.ExclusionGroup != nil && *s.ExclusionGroup == "") {
+		return false
+	}
+	if s.ExclusionGroup != nil && s.ClearExclusionGroup {
+		return false
+	}
+	if s.DefaultTtl != nil {
+		d, err := utils.ParseISODuration(*s.DefaultTtl)
+		if err != nil || d.IsZero() || s.ClearDefaultTtl {
+			return false
+		}
+	}
+	if s.Status != nil && !ValidStatus(*s.Status) {
+		return false
+	}
+	if !validTags(s.Tags) {
+		return false
+	}
+	if s.Parent != nil && *s.Parent == s.Slug {
+		return false
+	}
+	return s.DefaultTtl != nil || s.ClearDefaultTtl || s.Description != nil || s.Owner != nil || s.Tags != nil ||
+		s.Status != nil || s.ExclusionGroup != nil || s.ClearExclusionGroup || s.Parent != nil
+}
+
+// Patch returns the change of the segment requested by the dto.
+func (s *SegmentPatchDto) Patch() *Patch {
+	return &Patch{
+		DefaultTtl:          s.DefaultTtl,
+		ClearDefaultTtl:     s.ClearDefaultTtl,
+		Description:         s.Description,
+		Owner:               s.Owner,
+		Tags:                s.Tags,
+		Status:              s.Status,
+		ExclusionGroup:      s.ExclusionGroup,
+		ClearExclusionGroup: s.ClearExclusionGroup,
+		Parent:              s.Parent,
+	}
+}
+
+// SegmentRenameDto renames the segment. The old slug stays as a deprecated alias of the segment.
+type SegmentRenameDto struct {
+	Slug    string `json:"slug"`
+	NewSlug string `json:"new_slug"`
+}
+
+func (s *SegmentRenameDto) Valid() bool {
+	return s.Slug != "" && s.NewSlug != ""
 }
@@ -62,3 +62,78 @@ func (mr *MockRepositoryMockRecorder) Delete(ctx, slug interface{}) *gomock.Call
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockRepository)(nil).Delete), ctx, slug)
 }
+
+// FindAll mocks base method.
+func (m *MockRepository) FindAll(ctx context.Context, filter segment.Filter) ([]*segment.Segment, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FindAll", ctx, filter)
+	ret0, _ := ret[0].([]*segment.Segment)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FindAll indicates an expected call of FindAll.
+func (mr *MockRepositoryMockRecorder) FindAll(ctx, filter interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindAll", reflect.TypeOf((*MockRepository)(nil).FindAll), ctx, filter)
+}
+
+// FindMembers mocks base method.
+func (m *MockRepository) FindMembers(ctx context.Context, segmentId int) ([]int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FindMembers", ctx, segmentId)
+	ret0, _ := ret[0].([]int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FindMembers indicates an expected call of FindMembers.
+func (mr *MockRepositoryMockRecorder) FindMembers(ctx, segmentId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindMembers", reflect.TypeOf((*MockRepository)(nil).FindMembers), ctx, segmentId)
+}
+
+// FindStatus mocks base method.
+func (m *MockRepository) FindStatus(ctx context.Context, slug string) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FindStatus", ctx, slug)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FindStatus indicates an expected call of FindStatus.
+func (mr *MockRepositoryMockRecorder) FindStatus(ctx, slug interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindStatus", reflect.TypeOf((*MockRepository)(nil).FindStatus), ctx, slug)
+}
+
+// Rename mocks base method.
+func (m *MockRepository) Rename(ctx context.Context, slug, newSlug string) (*segment.Segment, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Rename", ctx, slug, newSlug)
+	ret0, _ := ret[0].(*segment.Segment)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Rename indicates an expected call of Rename.
+func (mr *MockRepositoryMockRecorder) Rename(ctx, slug, newSlug interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Rename", reflect.TypeOf((*MockRepository)(nil).Rename), ctx, slug, newSlug)
+}
+
+// Update mocks base method.
+func (m *MockRepository) Update(ctx context.Context, slug string, patch *segment.Patch) (*segment.Segment, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Update", ctx, slug, patch)
+	ret0, _ := ret[0].(*segment.Segment)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Update indicates an expected call of Update.
+func (mr *MockRepositoryMockRecorder) Update(ctx, slug, patch interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Update", reflect.TypeOf((*MockRepository)(nil).Update), ctx, slug, patch)
+}
@@ -1,6 +1,71 @@
 package segment
 
+import "time"
+
+// Segment is a segment, optionally with the membership of a particular user in it, as cached with the user segments.
 type Segment struct {
-	Id   int
-	Slug string
+	Id         int     `json:"id"`
+	Slug       string  `json:"slug"`
+	DefaultTtl *string `json:"default_ttl,omitempty"`
+	// Rule makes the segment dynamic: its members are the users whose attributes match the rule
+	Rule *string `json:"rule,omitempty"`
+	// ExclusionGroup is the group of the mutually exclusive segments, a user is a member of at most one of them.
+	// It is nil if the segment is in none
+	ExclusionGroup *string `json:"exclusion_group,omitempty"`
+	// Parent is the slug of the parent segment, nil if the segment is a root. The members of the segment
+	// are inherited members of the parent and of the ancestors of the parent
+	Parent      *string  `json:"parent,omitempty"`
+	Description *string  `json:"description,omitempty"`
+	Owner       *string  `json:"owner,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	// Status is one of the statuses below, only the active segments are returned among the segments of a user
+	Status string `json:"status,omitempty"`
+	// AddedAt and AliveUntil are the membership of the user, AliveUntil is nil if the membership does not expire
+	AddedAt    time.Time  `json:"added_at"`
+	AliveUntil *time.Time `json:"alive_until"`
+	// CreatedAt and UpdatedAt are not cached with the user segments
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+}
+
+const (
+	// StatusDraft is a segment which is being prepared, its members do not see it yet
+	StatusDraft = "draft"
+	// StatusActive is the default status, the members of the segment see it
+	StatusActive = "active"
+	// StatusPaused hides the segment from its members, the memberships are kept
+	StatusPaused = "paused"
+	// StatusArchived hides the segment from its members, it does not accept new ones
+	StatusArchived = "archived"
+)
+
+// ValidStatus reports whether the status is one of the statuses of a segment.
+func ValidStatus(status string) bool {
+	return status == StatusDraft || status == StatusActive || status == StatusPaused || status == StatusArchived
+}
+
+// Filter selects the segments in the listing, the empty fields match any segment.
+type Filter struct {
+	Tag    string
+	Owner  string
+	Status string
+}
+
+// Patch is a partial change of a segment, the nil fields are not changed. An empty Description, Owner or Parent
+// clears it, ClearExclusionGroup removes the segment from its exclusion group and ClearDefaultTtl its default TTL.
+type Patch struct {
+	DefaultTtl          *string
+	ClearDefaultTtl     bool
+	Description         *string
+	Owner               *string
+	Tags                []string
+	Status              *string
+	ExclusionGroup      *string
+	ClearExclusionGroup bool
+	Parent              *string
+}
+
+// Expired reports whether the user's membership in the segment has ended by the moment now.
+func (s *Segment) Expired(now time.Time) bool {
+	return s.AliveUntil != nil && !s.AliveUntil.After(now)
 }
@@ -6,4 +6,9 @@ import "context"
 type Repository interface {
 	Create(ctx context.Context, segment *Segment) error
 	Delete(ctx context.Context, slug string) error
+	FindAll(ctx context.Context, filter Filter) ([]*Segment, error)
+	Update(ctx context.Context, slug string, patch *Patch) (*Segment, error)
+	Rename(ctx context.Context, slug, newSlug string) (*Segment, error)
+	FindMembers(ctx context.Context, segmentId int) ([]int, error)
+	FindStatus(ctx context.Context, slug string) (string, error)
 }
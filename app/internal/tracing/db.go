@@ -0,0 +1,166 @@
+package tracing
+
+import (
+	"context"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"main/pkg"
+	"strings"
+)
+
+// db wraps the client of the database and records a span for every query.
+type db struct {
+	client pkg.DBClient
+}
+
+// NewDB instruments the client of the database, pgx v4 has no tracing hooks of its own.
+func NewDB(client pkg.DBClient) pkg.DBClient {
+	return &db{client: client}
+}
+
+func startQuery(ctx context.Context, sql string) (context.Context, trace.Span) {
+	return Tracer.Start(ctx, queryName(sql),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemPostgreSQL,
+			semconv.DBStatement(sql),
+		),
+	)
+}
+
+// queryName names the span after the operation of the query, e.g. "SELECT".
+func queryName(sql string) string {
+	fields := strings.Fields(sql)
+	if len(fields) == 0 {
+		return "postgres"
+	}
+	return "postgres " + strings.ToUpper(fields[0])
+}
+
+func finish(span trace.Span, err error) {
+	if err != nil && err != pgx.ErrNoRows {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func exec(ctx context.Context, client pkg.DBClient, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	ctx, span := startQuery(ctx, sql)
+	tag, err := client.Exec(ctx, sql, args...)
+	if err == nil {
+		span.SetAttributes(attribute.Int64("db.rows_affected", tag.RowsAffected()))
+	}
+	finish(span, err)
+	return tag, err
+}
+
+func query(ctx context.Context, client pkg.DBClient, sql string, args ...interface{}) (pgx.Rows, error) {
+	ctx, span := startQuery(ctx, sql)
+	rows, err := client.Query(ctx, sql, args...)
+	if err != nil {
+		finish(span, err)
+		return nil, err
+	}
+	return &tracedRows{Rows: rows, span: span}, nil
+}
+
+func queryRow(ctx context.Context, client pkg.DBClient, sql string, args ...interface{}) pgx.Row {
+	ctx, span := startQuery(ctx, sql)
+	return &tracedRow{row: client.QueryRow(ctx, sql, args...), span: span}
+}
+
+func (d *db) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	return exec(ctx, d.client, sql, args...)
+}
+
+func (d *db) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	return query(ctx, d.client, sql, args...)
+}
+
+func (d *db) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	return queryRow(ctx, d.client, sql, args...)
+}
+
+func (d *db) Begin(ctx context.Context) (pgx.Tx, error) {
+	ctx, span := Tracer.Start(ctx, "postgres transaction", trace.WithAttributes(semconv.DBSystemPostgreSQL))
+	t, err := d.client.Begin(ctx)
+	if err != nil {
+		finish(span, err)
+		return nil, err
+	}
+	return &tx{Tx: t, span: span}, nil
+}
+
+// tx records the queries of the transaction as children of the span of the transaction.
+// The span ends on commit or rollback.
+type tx struct {
+	pgx.Tx
+	span  trace.Span
+	ended bool
+}
+
+func (t *tx) ctx(ctx context.Context) context.Context {
+	return trace.ContextWithSpan(ctx, t.span)
+}
+
+func (t *tx) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	return exec(t.ctx(ctx), t.Tx, sql, args...)
+}
+
+func (t *tx) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	return query(t.ctx(ctx), t.Tx, sql, args...)
+}
+
+func (t *tx) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	return queryRow(t.ctx(ctx), t.Tx, sql, args...)
+}
+
+func (t *tx) Commit(ctx context.Context) error {
+	err := t.Tx.Commit(ctx)
+	t.end(err)
+	return err
+}
+
+func (t *tx) Rollback(ctx context.Context) error {
+	err := t.Tx.Rollback(ctx)
+	if err == pgx.ErrTxClosed {
+		// The deferred rollback after a successful commit
+		return err
+	}
+	t.end(err)
+	return err
+}
+
+func (t *tx) end(err error) {
+	if t.ended {
+		return
+	}
+	t.ended = true
+	finish(t.span, err)
+}
+
+type tracedRows struct {
+	pgx.Rows
+	span trace.Span
+}
+
+func (r *tracedRows) Close() {
+	r.Rows.Close()
+	finish(r.span, r.Rows.Err())
+}
+
+type tracedRow struct {
+	row  pgx.Row
+	span trace.Span
+}
+
+func (r *tracedRow) Scan(dest ...interface{}) error {
+	err := r.row.Scan(dest...)
+	finish(r.span, err)
+	return err
+}
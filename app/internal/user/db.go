@@ -2,16 +2,19 @@ package user
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"github.com/go-co-op/gocron"
 	"github.com/jackc/pgtype"
 	"github.com/jackc/pgx/v4"
-	"github.com/lib/pq"
-	"log"
+	"log/slog"
 	"main/internal/e"
 	"main/internal/history"
+	"main/internal/outbox"
+	"main/internal/rule"
 	"main/internal/segment"
 	"main/pkg"
+	"main/pkg/utils"
+	"sort"
 	"strings"
 	"time"
 )
@@ -22,8 +25,13 @@ type repository struct {
 
 // FindAll retrieves all user IDs from the user_segments table in the repository.
 // It executes a query to select all user IDs and returns a slice of User pointers.
+// Memberships whose lifetime has already ended are not taken into account.
 func (r *repository) FindAll(ctx context.Context) ([]*User, error) {
-	q := `SELECT user_id FROM user_segments;`
+	q := `
+		SELECT DISTINCT user_id
+		FROM segments JOIN user_segments us ON segments.segment_id = us.segment_id
+		WHERE (alive_until IS NULL OR alive_until > now()) AND status = 'active';
+	`
 	rows, err := r.client.Query(ctx, q)
 	if err != nil {
 		return nil, err
@@ -48,11 +56,14 @@ func (r *repository) FindAll(ctx context.Context) ([]*User, error) {
 }
 
 // FindByUserId is a method that retrieves segments associated with a user based on the provided user ID.
+// Expired memberships are filtered out even if the sweeper has not deleted them yet,
+// as are the memberships in the segments which are not active.
 func (r *repository) FindByUserId(ctx context.Context, userId int) (*Segments, error) {
 	q := `
-		SELECT us.segment_id, slug 
+		SELECT us.segment_id, slug, added_at, alive_until
 		FROM segments JOIN user_segments us ON segments.segment_id = us.segment_id 
-		WHERE user_id = $1;
+		WHERE user_id = $1 AND (alive_until IS NULL OR alive_until > now()) AND status = 'active'
+		ORDER BY added_at, slug;
 	`
 
 	rows, err := r.client.Query(ctx, q, userId)
@@ -64,7 +75,7 @@ func (r *repository) FindByUserId(ctx context.Context, userId int) (*Segments, e
 	segments := make([]*segment.Segment, 0)
 	for rows.Next() {
 		var s segment.Segment
-		err = rows.Scan(&s.Id, &s.Slug)
+		err = rows.Scan(&s.Id, &s.Slug, &s.AddedAt, &s.AliveUntil)
 		if err != nil {
 			return nil, err
 		}
@@ -85,9 +96,76 @@ func (r *repository) FindByUserId(ctx context.Context, userId int) (*Segments, e
 	return us, nil
 }
 
-// getSegmentIdsBySlugs is a function that retrieves segment IDs based on the provided segment slugs.
-func getSegmentIdsBySlugs(ctx context.Context, tx pgx.Tx, slugs []string) ([]int, error) {
-	q := `SELECT segment_id FROM segments WHERE slug = ANY($1);`
+// FindAncestors returns the active ancestors of each of the segments, the nearest first. The segments inherit
+// from the ancestors above the inactive ones as well, the inactive ancestors are just not returned.
+func (r *repository) FindAncestors(ctx context.Context, slugs []string) (map[string][]string, error) {
+	// UNION stops at the segments which have already been visited
+	q := `
+		WITH RECURSIVE tree (segment_id, slug, parent_id, status) AS (
+			SELECT segment_id, slug, parent_id, status FROM segments WHERE slug = ANY($1)
+			UNION
+			SELECT p.segment_id, p.slug, p.parent_id, p.status FROM tree t JOIN segments p ON p.segment_id = t.parent_id
+		)
+		SELECT segment_id, slug, parent_id, status FROM tree;
+	`
+	rows, err := r.client.Query(ctx, q, slugs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type node struct {
+		slug     string
+		parentId *int
+		status   string
+	}
+	nodes := make(map[int]*node)
+	ids := make(map[string]int)
+	for rows.Next() {
+		var id int
+		var n node
+		if err = rows.Scan(&id, &n.slug, &n.parentId, &n.status); err != nil {
+			return nil, err
+		}
+		nodes[id] = &n
+		ids[n.slug] = id
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	ancestors := make(map[string][]string, len(slugs))
+	for _, slug := range slugs {
+		id, ok := ids[slug]
+		if !ok {
+			continue
+		}
+		visited := map[int]bool{id: true}
+		for parentId := nodes[id].parentId; parentId != nil && !visited[*parentId]; {
+			visited[*parentId] = true
+			parent, ok := nodes[*parentId]
+			if !ok {
+				break
+			}
+			if parent.status == segment.StatusActive {
+				ancestors[slug] = append(ancestors[slug], parent.slug)
+			}
+			parentId = parent.parentId
+		}
+	}
+	return ancestors, nil
+}
+
+// getSegmentsBySlugs is a function that retrieves segments based on the provided segment slugs.
+// The result maps every found slug to its segment. The segments are locked,
+// so that their exclusion groups do not change until the memberships are changed.
+func getSegmentsBySlugs(ctx context.Context, tx pgx.Tx, slugs []string) (map[string]*segment.Segment, error) {
+	q := `
+		SELECT segment_id, slug, default_ttl, rule, exclusion_group, status FROM segments
+		WHERE slug = ANY($1)
+		ORDER BY segment_id
+		FOR SHARE;
+	`
 	slugsArr := pgtype.TextArray{}
 	if err := slugsArr.Set(slugs); err != nil {
 		return nil, err
@@ -99,59 +177,204 @@ func getSegmentIdsBySlugs(ctx context.Context, tx pgx.Tx, slugs []string) ([]int
 	}
 	defer rows.Close()
 
-	segmentIds := make([]int, 0)
+	segments := make(map[string]*segment.Segment)
 	for rows.Next() {
-		var segmentId int
-		err = rows.Scan(&segmentId)
+		var s segment.Segment
+		err = rows.Scan(&s.Id, &s.Slug, &s.DefaultTtl, &s.Rule, &s.ExclusionGroup, &s.Status)
 		if err != nil {
 			return nil, err
 		}
-		segmentIds = append(segmentIds, segmentId)
+		segments[s.Slug] = &s
 	}
-	return segmentIds, nil
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return segments, nil
 }
 
-// addSegments is a function that adds the user to the specified segments.
-func addSegments(ctx context.Context, userId int, slugs []string, ttlDays *int, historyRepo history.Repository, tx pgx.Tx) error {
-	segmentIds, err := getSegmentIdsBySlugs(ctx, tx, slugs)
-	if err != nil {
+// checkNoRules returns an error if some of the segments are dynamic, their members cannot be changed directly.
+func checkNoRules(segments map[string]*segment.Segment) error {
+	slugs := make([]string, 0)
+	for slug, s := range segments {
+		if s.Rule != nil {
+			slugs = append(slugs, slug)
+		}
+	}
+	if len(slugs) > 0 {
+		sort.Strings(slugs)
+		return &e.RuleSegmentError{Slugs: slugs}
+	}
+	return nil
+}
+
+// checkNotArchived returns an error if some of the segments are archived, they do not accept new members.
+func checkNotArchived(segments map[string]*segment.Segment) error {
+	slugs := make([]string, 0)
+	for slug, s := range segments {
+		if s.Status == segment.StatusArchived {
+			slugs = append(slugs, slug)
+		}
+	}
+	if len(slugs) > 0 {
+		sort.Strings(slugs)
+		return &e.ArchivedSegmentError{Slugs: slugs}
+	}
+	return nil
+}
+
+// resolveExclusions checks that the user does not become a member of several segments of an exclusion group.
+// The segments the user is deleted from by the same request do not count. If swap is true, the user leaves
+// the conflicting segments, this is written to the history and the outbox, otherwise an error is returned.
+func resolveExclusions(ctx context.Context, tx pgx.Tx, userId int, segments map[string]*segment.Segment, deleting []string, swap bool, historyRepo history.Repository) error {
+	// key: group, value: the added slugs of the group
+	groups := make(map[string][]string)
+	for slug, s := range segments {
+		if s.ExclusionGroup != nil {
+			groups[*s.ExclusionGroup] = append(groups[*s.ExclusionGroup], slug)
+		}
+	}
+	if len(groups) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(groups))
+	for group, slugs := range groups {
+		if len(slugs) > 1 {
+			sort.Strings(slugs)
+			return &e.ExclusionConflictError{Group: group, Slugs: slugs}
+		}
+		names = append(names, group)
+	}
+
+	// The user is locked, so that concurrent requests do not add the user to different segments of a group
+	if _, err := tx.Exec(ctx, `SELECT 1 FROM users WHERE user_id = $1 FOR UPDATE;`, userId); err != nil {
 		return err
 	}
-	if len(segmentIds) == 0 {
-		return &e.SegmentsNotFoundError{Slugs: slugs}
+
+	skipped := append(make([]string, 0, len(segments)+len(deleting)), deleting...)
+	for slug := range segments {
+		skipped = append(skipped, slug)
+	}
+	q := `
+		SELECT s.segment_id, s.slug, s.exclusion_group
+		FROM user_segments us JOIN segments s ON s.segment_id = us.segment_id
+		WHERE us.user_id = $1 AND s.exclusion_group = ANY($2) AND NOT s.slug = ANY($3)
+		  AND (us.alive_until IS NULL OR us.alive_until > now())
+		ORDER BY s.slug;
+	`
+	rows, err := tx.Query(ctx, q, userId, names, skipped)
+	if err != nil {
+		return err
 	}
+	defer rows.Close()
 
-	var aliveUntil pq.NullTime
-	if ttlDays != nil {
-		aliveUntil.Time = time.Now().AddDate(0, 0, *ttlDays)
-		aliveUntil.Valid = true
+	ids := make([]int, 0)
+	events := make([]outbox.Event, 0)
+	for rows.Next() {
+		var id int
+		var slug, group string
+		if err = rows.Scan(&id, &slug, &group); err != nil {
+			return err
+		}
+		if !swap {
+			return &e.ExclusionConflictError{Group: group, Slugs: []string{slug, groups[group][0]}}
+		}
+		ids = append(ids, id)
+		events = append(events, outbox.Event{UserId: userId, Slug: slug, Type: outbox.Left, Reason: outbox.ReasonExclusion})
+	}
+	if err = rows.Err(); err != nil || len(ids) == 0 {
+		return err
 	}
 
-	aliveUntilStr := "NULL"
-	if aliveUntil.Valid {
-		aliveUntilStr = fmt.Sprintf("'%s'", aliveUntil.Time.Format("2006-01-02"))
+	q = `DELETE FROM user_segments WHERE user_id = $1 AND segment_id = ANY($2);`
+	if _, err = tx.Exec(ctx, q, userId, ids); err != nil {
+		return err
 	}
 
-	q := `INSERT INTO user_segments (user_id, segment_id, alive_until) VALUES `
+	h := history.History{
+		UserId:     userId,
+		SegmentIds: ids,
+		Operation:  "deleted",
+		Date:       time.Now(),
+	}
+	if err = historyRepo.Create(ctx, &h, tx); err != nil {
+		return err
+	}
+	return outbox.Write(ctx, tx, events...)
+}
 
-	values := make([]string, 0, len(segmentIds))
-	for _, segmentId := range segmentIds {
-		value := fmt.Sprintf("(%d, %d, %s)", userId, segmentId, aliveUntilStr)
-		values = append(values, value)
+// addSegments is a function that adds the user to the specified segments.
+// aliveUntil maps the slug of every segment to the moment the user leaves it.
+// If the moment is nil, the default TTL of the segment is used, if the segment has one.
+// The conflicts with the exclusion groups of the segments are resolved by resolveExclusions.
+func addSegments(ctx context.Context, userId int, aliveUntil map[string]*time.Time, deleting []string, swap bool, historyRepo history.Repository, tx pgx.Tx) error {
+	slugs := make([]string, 0, len(aliveUntil))
+	for slug := range aliveUntil {
+		slugs = append(slugs, slug)
 	}
 
-	resQuery := fmt.Sprintf("%s %s;", q, strings.Join(values, ", "))
-	_, err = tx.Exec(ctx, resQuery)
-	if e.IsDuplicateError(err) {
-		return &e.DuplicateSegmentError{}
+	segments, err := getSegmentsBySlugs(ctx, tx, slugs)
+	if err != nil {
+		return err
+	}
+	if len(segments) == 0 {
+		return &e.SegmentsNotFoundError{Slugs: slugs}
 	}
+	if err = checkNoRules(segments); err != nil {
+		return err
+	}
+	if err = checkNotArchived(segments); err != nil {
+		return err
+	}
+	if err = resolveExclusions(ctx, tx, userId, segments, deleting, swap, historyRepo); err != nil {
+		return err
+	}
+
+	q := `INSERT INTO user_segments (user_id, segment_id, alive_until) VALUES `
+
+	now := time.Now()
+	ids := make([]int, 0, len(segments))
+	events := make([]outbox.Event, 0, len(segments))
+	values := make([]interface{}, 0, len(segments)*3)
+	placeholders := make([]string, 0, len(segments))
+	for slug, s := range segments {
+		until := aliveUntil[slug]
+		if until == nil && s.DefaultTtl != nil {
+			d, err := utils.ParseISODuration(*s.DefaultTtl)
+			if err != nil {
+				return err
+			}
+			t := d.AddTo(now).UTC()
+			until = &t
+		}
+
+		i := len(values)
+		placeholders = append(placeholders, fmt.Sprintf("($%d, $%d, $%d)", i+1, i+2, i+3))
+		values = append(values, userId, s.Id, until)
+		ids = append(ids, s.Id)
+		events = append(events, outbox.Event{
+			UserId:     userId,
+			Slug:       slug,
+			Type:       outbox.Entered,
+			Reason:     outbox.ReasonRequest,
+			AliveUntil: until,
+		})
+	}
+
+	// An expired membership which has not been cleaned up yet is renewed, a live one is a duplicate
+	resQuery := fmt.Sprintf(`%s %s
+		ON CONFLICT (user_id, segment_id) DO UPDATE SET added_at = now(), alive_until = EXCLUDED.alive_until
+		WHERE user_segments.alive_until <= now();`, q, strings.Join(placeholders, ", "))
+	tag, err := tx.Exec(ctx, resQuery, values...)
 	if err != nil {
 		return err
 	}
+	if int(tag.RowsAffected()) < len(placeholders) {
+		return &e.DuplicateSegmentError{}
+	}
 
 	h := history.History{
 		UserId:     userId,
-		SegmentIds: segmentIds,
+		SegmentIds: ids,
 		Operation:  "added",
 		Date:       time.Now(),
 	}
@@ -160,21 +383,31 @@ func addSegments(ctx context.Context, userId int, slugs []string, ttlDays *int,
 		return err
 	}
 
-	return nil
+	return outbox.Write(ctx, tx, events...)
 }
 
 // delSegments is a function that deletes the specified segments from the user.
 func delSegments(ctx context.Context, userId int, slugs []string, historyRepo history.Repository, tx pgx.Tx) error {
-	segmentIds, err := getSegmentIdsBySlugs(ctx, tx, slugs)
+	segments, err := getSegmentsBySlugs(ctx, tx, slugs)
 	if err != nil {
 		return err
 	}
-	if len(segmentIds) == 0 {
+	if len(segments) == 0 {
 		return nil
 	}
+	if err = checkNoRules(segments); err != nil {
+		return err
+	}
+
+	ids := make([]int, 0, len(segments))
+	slugsById := make(map[int]string, len(segments))
+	for slug, s := range segments {
+		ids = append(ids, s.Id)
+		slugsById[s.Id] = slug
+	}
 
 	var segmentIdsArray pgtype.Int4Array
-	err = segmentIdsArray.Set(segmentIds)
+	err = segmentIdsArray.Set(ids)
 	if err != nil {
 		return err
 	}
@@ -186,12 +419,19 @@ func delSegments(ctx context.Context, userId int, slugs []string, historyRepo hi
 	}
 	defer rows.Close()
 	deletedSegmentIds := make([]int, 0)
+	events := make([]outbox.Event, 0)
 	for rows.Next() {
 		var deletedId int
 		if err = rows.Scan(&deletedId); err != nil {
 			return err
 		}
 		deletedSegmentIds = append(deletedSegmentIds, deletedId)
+		events = append(events, outbox.Event{
+			UserId: userId,
+			Slug:   slugsById[deletedId],
+			Type:   outbox.Left,
+			Reason: outbox.ReasonRequest,
+		})
 	}
 	if err = rows.Err(); err != nil {
 		return err
@@ -208,13 +448,14 @@ func delSegments(ctx context.Context, userId int, slugs []string, historyRepo hi
 		return err
 	}
 
-	return nil
+	return outbox.Write(ctx, tx, events...)
 }
 
 // AddDelSegments is a method of the repository that adds and deletes segments for a user within a single transaction.
 // This function calls the functions to add and delete segments for the user in a single transaction.
 // If an error occurs during the process, a rollback will be triggered.
-func (r *repository) AddDelSegments(ctx context.Context, s *SegmentsAddDelDto, historyRepo history.Repository) error {
+// The deprecated slugs of the renamed segments used in the request are reported in s.Renamed.
+func (r *repository) AddDelSegments(ctx context.Context, s *SegmentsAddDelDto, historyRepo history.Repository) (err error) {
 	tx, err := r.client.Begin(ctx)
 	if err != nil {
 		return err
@@ -230,19 +471,66 @@ func (r *repository) AddDelSegments(ctx context.Context, s *SegmentsAddDelDto, h
 		}
 	}()
 
+	// The deprecated slugs of the renamed segments are replaced with the current ones
+	slugs := append(make([]string, 0, len(s.SegmentsAdd)+len(s.SegmentsDel)), s.SegmentsDel...)
+	for _, add := range s.SegmentsAdd {
+		slugs = append(slugs, add.Slug)
+	}
+	if s.Renamed, err = segment.FindAliases(ctx, tx, slugs); err != nil {
+		return err
+	}
+	current := func(slug string) string {
+		if renamed, ok := s.Renamed[slug]; ok {
+			return renamed
+		}
+		return slug
+	}
+	deleting := make([]string, 0, len(s.SegmentsDel))
+	for _, slug := range s.SegmentsDel {
+		deleting = append(deleting, current(slug))
+	}
+
 	if len(s.SegmentsAdd) > 0 {
-		if err = addSegments(ctx, s.UserId, s.SegmentsAdd, s.TtlDays, historyRepo, tx); err != nil {
+		aliveUntil := make(map[string]*time.Time, len(s.SegmentsAdd))
+		for slug, until := range s.AliveUntil(time.Now()) {
+			aliveUntil[current(slug)] = until
+		}
+		swap := s.OnConflict == OnConflictSwap
+		if err = addSegments(ctx, s.UserId, aliveUntil, deleting, swap, historyRepo, tx); err != nil {
 			return err
 		}
 	}
-	if len(s.SegmentsDel) > 0 {
-		if err = delSegments(ctx, s.UserId, s.SegmentsDel, historyRepo, tx); err != nil {
+	if len(deleting) > 0 {
+		if err = delSegments(ctx, s.UserId, deleting, historyRepo, tx); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// UpdateAliveUntil sets a new lifetime for an existing membership of the user in the segment.
+// A nil aliveUntil removes the lifetime, so the user stays in the segment forever.
+// Memberships which have already expired cannot be prolonged, they have to be added again.
+// The members of dynamic segments do not expire, so their memberships are not found either.
+// The deprecated slug of a renamed segment is accepted as well.
+func (r *repository) UpdateAliveUntil(ctx context.Context, userId int, slug string, aliveUntil *time.Time) error {
+	q := `
+		UPDATE user_segments us SET alive_until = $3
+		FROM segments s
+		WHERE s.segment_id = us.segment_id AND us.user_id = $1 AND s.rule IS NULL
+		  AND (s.slug = $2 OR s.segment_id = (SELECT segment_id FROM segment_aliases WHERE slug = $2))
+		  AND (us.alive_until IS NULL OR us.alive_until > now());
+	`
+	tag, err := r.client.Exec(ctx, q, userId, slug, aliveUntil)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return &e.MembershipNotFoundError{UserId: userId, Slug: slug}
+	}
+	return nil
+}
+
 // CreateUser creates a new user record in the "users" table within the repository and returns the ID of the newly created row.
 func (r *repository) CreateUser(ctx context.Context) (int, error) {
 	maxId, err := r.GetMaxId(ctx)
@@ -274,79 +562,363 @@ func (r *repository) GetMaxId(ctx context.Context) (int, error) {
 // This function is primarily intended for testing purposes, providing the ability to remove a user by their unique identifier.
 func (r *repository) DelUser(ctx context.Context, userId int) error {
 	q := `DELETE FROM users WHERE user_id = ($1);`
-	_, err := r.client.Query(ctx, q, userId)
+	_, err := r.client.Exec(ctx, q, userId)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// DeleteSegmentsEveryDay deletes users from segments when the current date
+// FindExpired returns at most limit memberships whose lifetime ends by the moment until,
+// i.e. the ones the TTL cleanup would delete if it ran at that moment.
+func (r *repository) FindExpired(ctx context.Context, until time.Time, limit int) ([]*Membership, error) {
+	q := `
+		SELECT user_id, slug, added_at, alive_until
+		FROM user_segments us JOIN segments s ON s.segment_id = us.segment_id
+		WHERE alive_until <= $1
+		ORDER BY alive_until, user_id, slug
+		LIMIT $2;
+	`
+	rows, err := r.client.Query(ctx, q, until, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	memberships := make([]*Membership, 0)
+	for rows.Next() {
+		var m Membership
+		if err = rows.Scan(&m.UserId, &m.Slug, &m.AddedAt, &m.AliveUntil); err != nil {
+			return nil, err
+		}
+		memberships = append(memberships, &m)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return memberships, nil
+}
+
+// DeleteExpired deletes users from segments when the current time
 // become greater than or equal to the user's lifetime (alive_until column)
-// within the segment.
-// The function is triggered every day at 03:00 AM in the Moscow time zone
-// when server load is at its lowest
-func (r *repository) DeleteSegmentsEveryDay(ctx context.Context, historyRepo history.Repository) {
-	s := gocron.NewScheduler(time.UTC)
-	_, err := s.Every(1).Day().At("00:00").Do(func() error {
-		tx, err := r.client.Begin(ctx)
-		if err != nil {
-			return err
+// within the segment and writes the deletions to the history.
+// It returns the number of deleted memberships.
+func (r *repository) DeleteExpired(ctx context.Context, historyRepo history.Repository) (n int, err error) {
+	tx, err := r.client.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback(ctx)
+			panic(p)
+		} else if err != nil {
+			tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
 		}
-		defer func() {
-			if p := recover(); p != nil {
-				tx.Rollback(ctx)
-				panic(p)
-			} else if err != nil {
-				tx.Rollback(ctx)
-			} else {
-				err = tx.Commit(ctx)
-			}
-		}()
+	}()
 
-		// key: userId, value: slice of segment ids witch deleted
-		h := make(map[int][]int)
+	// Serialize concurrent cleanups (e.g. a scheduled and a manual one) so that
+	// the same memberships are not written to the history twice
+	if _, err = tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('ttl_cleanup'));`); err != nil {
+		return 0, err
+	}
 
-		q := `DELETE FROM user_segments WHERE alive_until <= $1 RETURNING user_id, segment_id;`
-		rows, err := tx.Query(ctx, q, time.Now())
-		if err != nil {
-			return err
+	// key: userId, value: slice of segment ids witch deleted
+	h := make(map[int][]int)
+	events := make([]outbox.Event, 0)
+
+	q := `
+		DELETE FROM user_segments us USING segments s
+		WHERE s.segment_id = us.segment_id AND us.alive_until <= now()
+		RETURNING us.user_id, us.segment_id, s.slug;
+	`
+	rows, err := tx.Query(ctx, q)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userId, segmentId int
+		var slug string
+		if err = rows.Scan(&userId, &segmentId, &slug); err != nil {
+			return 0, err
+		}
+		h[userId] = append(h[userId], segmentId)
+		events = append(events, outbox.Event{UserId: userId, Slug: slug, Type: outbox.Left, Reason: outbox.ReasonTtl})
+		n++
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// Add rows to history
+	now := time.Now()
+	for userId, segmentIds := range h {
+		h := history.History{
+			UserId:     userId,
+			SegmentIds: segmentIds,
+			Operation:  "deleted",
+			Date:       now,
 		}
-		defer rows.Close()
+		if err = historyRepo.Create(ctx, &h, tx); err != nil {
+			return 0, err
+		}
+	}
 
-		for rows.Next() {
-			var userId, segmentId int
-			if err = rows.Scan(&userId, &segmentId); err != nil {
-				return err
+	if err = outbox.Write(ctx, tx, events...); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// ruleSyncBatch is the number of users whose dynamic segments are synced in a single transaction.
+const ruleSyncBatch = 1000
+
+// ruleSegment is a dynamic segment with its parsed rule.
+type ruleSegment struct {
+	id   int
+	slug string
+	rule *rule.Rule
+}
+
+// getRuleSegments returns the dynamic segments and locks them, so that they are not deleted during the sync.
+// The segments whose rules cannot be parsed are skipped.
+func getRuleSegments(ctx context.Context, tx pgx.Tx) ([]*ruleSegment, error) {
+	q := `SELECT segment_id, slug, rule FROM segments WHERE rule IS NOT NULL ORDER BY segment_id FOR SHARE;`
+	rows, err := tx.Query(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	segments := make([]*ruleSegment, 0)
+	for rows.Next() {
+		var s ruleSegment
+		var src string
+		if err = rows.Scan(&s.id, &s.slug, &src); err != nil {
+			return nil, err
+		}
+		if s.rule, err = rule.Parse(src); err != nil {
+			slog.WarnContext(ctx, "skipping segment with invalid rule", "slug", s.slug, "err", err)
+			continue
+		}
+		segments = append(segments, &s)
+	}
+	return segments, rows.Err()
+}
+
+// applyRules adds the users to the dynamic segments whose rules their attributes match and removes them
+// from the other ones. The changes are written to the history and the outbox. It returns their number.
+func applyRules(ctx context.Context, tx pgx.Tx, segments []*ruleSegment, users []*Attributes, historyRepo history.Repository) (int, error) {
+	if len(segments) == 0 || len(users) == 0 {
+		return 0, nil
+	}
+
+	userIds := make([]int, 0, len(users))
+	for _, u := range users {
+		userIds = append(userIds, u.UserId)
+	}
+	segmentIds := make([]int, 0, len(segments))
+	for _, s := range segments {
+		segmentIds = append(segmentIds, s.id)
+	}
+
+	q := `SELECT user_id, segment_id FROM user_segments WHERE user_id = ANY($1) AND segment_id = ANY($2);`
+	rows, err := tx.Query(ctx, q, userIds, segmentIds)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	type membership struct{ userId, segmentId int }
+	current := make(map[membership]bool)
+	for rows.Next() {
+		var m membership
+		if err = rows.Scan(&m.userId, &m.segmentId); err != nil {
+			return 0, err
+		}
+		current[m] = true
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// key: userId, value: ids of the segments the user has entered or left
+	added := make(map[int][]int)
+	deleted := make(map[int][]int)
+	var addUsers, addSegments, delUsers, delSegments []int
+	events := make([]outbox.Event, 0)
+	for _, u := range users {
+		for _, s := range segments {
+			match := s.rule.Match(u.Attributes)
+			member := current[membership{u.UserId, s.id}]
+			if match && !member {
+				added[u.UserId] = append(added[u.UserId], s.id)
+				addUsers, addSegments = append(addUsers, u.UserId), append(addSegments, s.id)
+				events = append(events, outbox.Event{UserId: u.UserId, Slug: s.slug, Type: outbox.Entered, Reason: outbox.ReasonRule})
+			} else if !match && member {
+				deleted[u.UserId] = append(deleted[u.UserId], s.id)
+				delUsers, delSegments = append(delUsers, u.UserId), append(delSegments, s.id)
+				events = append(events, outbox.Event{UserId: u.UserId, Slug: s.slug, Type: outbox.Left, Reason: outbox.ReasonRule})
 			}
-			h[userId] = append(h[userId], segmentId)
 		}
-		if err = rows.Err(); err != nil {
-			return err
+	}
+
+	if len(addUsers) > 0 {
+		q = `INSERT INTO user_segments (user_id, segment_id) SELECT * FROM unnest($1::int[], $2::int[]);`
+		if _, err = tx.Exec(ctx, q, addUsers, addSegments); err != nil {
+			return 0, err
+		}
+	}
+	if len(delUsers) > 0 {
+		q = `
+			DELETE FROM user_segments us USING unnest($1::int[], $2::int[]) AS v(user_id, segment_id)
+			WHERE us.user_id = v.user_id AND us.segment_id = v.segment_id;
+		`
+		if _, err = tx.Exec(ctx, q, delUsers, delSegments); err != nil {
+			return 0, err
 		}
+	}
 
-		// Add rows to history
-		now := time.Now()
-		for userId, segmentIds := range h {
+	now := time.Now()
+	for operation, changes := range map[string]map[int][]int{"added": added, "deleted": deleted} {
+		for userId, ids := range changes {
 			h := history.History{
 				UserId:     userId,
-				SegmentIds: segmentIds,
-				Operation:  "deleted",
+				SegmentIds: ids,
+				Operation:  operation,
 				Date:       now,
 			}
 			if err = historyRepo.Create(ctx, &h, tx); err != nil {
-				return err
+				return 0, err
 			}
 		}
+	}
 
-		return nil
-	})
+	if err = outbox.Write(ctx, tx, events...); err != nil {
+		return 0, err
+	}
+	return len(events), nil
+}
+
+// UpsertAttributes merges the attributes into the ones of the user, creating the user if there is none,
+// and updates the memberships of the user in the dynamic segments. The merge is shallow,
+// an attribute with the null value is removed. It returns the resulting attributes.
+func (r *repository) UpsertAttributes(ctx context.Context, userId int, attrs map[string]interface{}, historyRepo history.Repository) (result map[string]interface{}, err error) {
+	tx, err := r.client.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback(ctx)
+			panic(p)
+		} else if err != nil {
+			tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	q := `
+		INSERT INTO users (user_id, attributes) VALUES ($1, jsonb_strip_nulls($2::jsonb))
+		ON CONFLICT (user_id) DO UPDATE SET attributes = jsonb_strip_nulls(users.attributes || $2::jsonb)
+		RETURNING attributes;
+	`
+	if err = tx.QueryRow(ctx, q, userId, attrs).Scan(&result); err != nil {
+		return nil, err
+	}
+
+	segments, err := getRuleSegments(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	_, err = applyRules(ctx, tx, segments, []*Attributes{{UserId: userId, Attributes: result}}, historyRepo)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// FindAttributes returns the attributes of the user.
+func (r *repository) FindAttributes(ctx context.Context, userId int) (map[string]interface{}, error) {
+	var attrs map[string]interface{}
+	err := r.client.QueryRow(ctx, `SELECT attributes FROM users WHERE user_id = $1;`, userId).Scan(&attrs)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, &e.UserNotFoundError{UserId: userId}
+	}
+	return attrs, err
+}
+
+// SyncRuleSegments evaluates the rules of the dynamic segments against the attributes of all the users
+// and updates the memberships which do not match, e.g. after a segment has been created.
+// It returns the number of the users who have entered or left the segments.
+func (r *repository) SyncRuleSegments(ctx context.Context, historyRepo history.Repository) (int, error) {
+	n, after := 0, 0
+	for {
+		changed, last, err := r.syncRuleSegmentsBatch(ctx, historyRepo, after)
+		n += changed
+		if err != nil || last == 0 {
+			return n, err
+		}
+		after = last
+	}
+}
+
+// syncRuleSegmentsBatch syncs the batch of the users after the given id. It returns the number of the changes
+// and the id of the last user of the batch, 0 if there are no more users.
+func (r *repository) syncRuleSegmentsBatch(ctx context.Context, historyRepo history.Repository, after int) (n, last int, err error) {
+	tx, err := r.client.Begin(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback(ctx)
+			panic(p)
+		} else if err != nil {
+			tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	segments, err := getRuleSegments(ctx, tx)
+	if err != nil || len(segments) == 0 {
+		return 0, 0, err
+	}
 
+	// The users are locked, so that a concurrent change of their attributes is not overwritten
+	q := `SELECT user_id, attributes FROM users WHERE user_id > $1 ORDER BY user_id LIMIT $2 FOR UPDATE;`
+	rows, err := tx.Query(ctx, q, after, ruleSyncBatch)
 	if err != nil {
-		log.Println("error delete segments every day:", err)
+		return 0, 0, err
+	}
+	defer rows.Close()
+
+	users := make([]*Attributes, 0)
+	for rows.Next() {
+		var u Attributes
+		if err = rows.Scan(&u.UserId, &u.Attributes); err != nil {
+			return 0, 0, err
+		}
+		users = append(users, &u)
+	}
+	if err = rows.Err(); err != nil {
+		return 0, 0, err
 	}
 
-	s.StartAsync()
+	if n, err = applyRules(ctx, tx, segments, users, historyRepo); err != nil {
+		return 0, 0, err
+	}
+	if len(users) == ruleSyncBatch {
+		last = users[len(users)-1].UserId
+	}
+	return n, last, nil
 }
 
 func NewRepo(client pkg.DBClient) Repository {
@@ -1,28 +1,124 @@
 package user
 
-import "main/internal/segment"
+import (
+	"encoding/json"
+	"main/internal/segment"
+	"main/pkg/utils"
+	"strings"
+	"time"
+)
 
 type SegmentsDto struct {
 	UserId   int                  `json:"user_id"`
 	Segments []segment.SegmentDto `json:"segments"`
 }
 
+// SegmentAdd is an element of the "add" list. In JSON it is either a plain slug
+// or an object that additionally sets the lifetime of the user in this segment only.
+type SegmentAdd struct {
+	Slug      string     `json:"slug"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Ttl       *string    `json:"ttl,omitempty"`
+	TtlDays   *int       `json:"ttl_days,omitempty"`
+}
+
+func (s *SegmentAdd) UnmarshalJSON(data []byte) error {
+	var slug string
+	if err := json.Unmarshal(data, &slug); err == nil {
+		*s = SegmentAdd{Slug: slug}
+		return nil
+	}
+
+	type segmentAdd SegmentAdd
+	var v segmentAdd
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*s = SegmentAdd(v)
+	return nil
+}
+
+// What to do if an added segment is in the same exclusion group as a segment the user is already in.
+const (
+	// OnConflictReject rejects the request, it is the default
+	OnConflictReject = "reject"
+	// OnConflictSwap removes the user from the other segment of the group
+	OnConflictSwap = "swap"
+)
+
 type SegmentsAddDelDto struct {
-	UserId      int      `json:"user_id"`
-	SegmentsAdd []string `json:"add"`
-	SegmentsDel []string `json:"del"`
-	TtlDays     *int     `json:"ttl_days"`
+	UserId      int          `json:"user_id"`
+	SegmentsAdd []SegmentAdd `json:"add"`
+	SegmentsDel []string     `json:"del"`
+	TtlDays     *int         `json:"ttl_days"`
+	ExpiresAt   *time.Time   `json:"expires_at"`
+	Ttl         *string      `json:"ttl"`
+	OnConflict  string       `json:"on_conflict,omitempty"`
+	// Renamed is filled by the repository with the current slugs of the deprecated aliases used in the request
+	Renamed map[string]string `json:"-"`
+}
+
+// validExpiry checks that at most one way of setting the lifetime is used
+// and that the resulting moment lies in the future.
+func validExpiry(expiresAt *time.Time, ttl *string, ttlDays *int, now time.Time) bool {
+	set := 0
+	if expiresAt != nil {
+		set++
+		if !expiresAt.After(now) {
+			return false
+		}
+	}
+	if ttl != nil {
+		set++
+		d, err := utils.ParseISODuration(*ttl)
+		if err != nil || d.IsZero() {
+			return false
+		}
+	}
+	if ttlDays != nil {
+		set++
+		if *ttlDays <= 0 {
+			return false
+		}
+	}
+	return set <= 1
+}
+
+// aliveUntil converts one of the ways of setting the lifetime into an exact moment.
+// It returns nil if none of them is set. The values must be validated beforehand.
+func aliveUntil(expiresAt *time.Time, ttl *string, ttlDays *int, now time.Time) *time.Time {
+	var t time.Time
+	switch {
+	case expiresAt != nil:
+		t = *expiresAt
+	case ttl != nil:
+		d, _ := utils.ParseISODuration(*ttl)
+		t = d.AddTo(now)
+	case ttlDays != nil:
+		t = now.AddDate(0, 0, *ttlDays)
+	default:
+		return nil
+	}
+	t = t.UTC()
+	return &t
 }
 
 func (seg *SegmentsAddDelDto) Valid() bool {
 	if seg.UserId <= 0 || seg.SegmentsAdd == nil || seg.SegmentsDel == nil {
 		return false
 	}
-	if seg.TtlDays != nil && *seg.TtlDays <= 0 {
+	if seg.OnConflict != "" && seg.OnConflict != OnConflictReject && seg.OnConflict != OnConflictSwap {
+		return false
+	}
+	now := time.Now()
+	if !validExpiry(seg.ExpiresAt, seg.Ttl, seg.TtlDays, now) {
 		return false
 	}
 	for _, s := range seg.SegmentsAdd {
-		if s == "" {
+		if s.Slug == "" {
+			return false
+		}
+		if !validExpiry(s.ExpiresAt, s.Ttl, s.TtlDays, now) {
 			return false
 		}
 	}
@@ -33,3 +129,90 @@ func (seg *SegmentsAddDelDto) Valid() bool {
 	}
 	return true
 }
+
+// AliveUntil returns the moment until which the user stays in each of the added segments.
+// The lifetime set for a particular slug takes precedence over the one set for the whole request.
+// A nil value means that the lifetime is not set in the request, so the default TTL of the segment applies.
+func (seg *SegmentsAddDelDto) AliveUntil(now time.Time) map[string]*time.Time {
+	common := aliveUntil(seg.ExpiresAt, seg.Ttl, seg.TtlDays, now)
+
+	res := make(map[string]*time.Time, len(seg.SegmentsAdd))
+	for _, s := range seg.SegmentsAdd {
+		if t := aliveUntil(s.ExpiresAt, s.Ttl, s.TtlDays, now); t != nil {
+			res[s.Slug] = t
+		} else {
+			res[s.Slug] = common
+		}
+	}
+	return res
+}
+
+// SegmentTtlDto changes the lifetime of an existing membership of the user in the segment.
+// Exactly one of ExpiresAt, Ttl, TtlDays and Clear must be set. Ttl and TtlDays are counted from now,
+// Clear removes the lifetime so that the user stays in the segment forever.
+type SegmentTtlDto struct {
+	UserId    int        `json:"user_id"`
+	Slug      string     `json:"slug"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	Ttl       *string    `json:"ttl"`
+	TtlDays   *int       `json:"ttl_days"`
+	Clear     bool       `json:"clear"`
+}
+
+func (seg *SegmentTtlDto) Valid() bool {
+	if seg.UserId <= 0 || seg.Slug == "" {
+		return false
+	}
+	if !validExpiry(seg.ExpiresAt, seg.Ttl, seg.TtlDays, time.Now()) {
+		return false
+	}
+	set := seg.ExpiresAt != nil || seg.Ttl != nil || seg.TtlDays != nil
+	return set != seg.Clear
+}
+
+// AliveUntil returns the new lifetime of the membership, nil if it has to be cleared.
+func (seg *SegmentTtlDto) AliveUntil(now time.Time) *time.Time {
+	return aliveUntil(seg.ExpiresAt, seg.Ttl, seg.TtlDays, now)
+}
+
+type MembershipDto struct {
+	UserId     int        `json:"user_id"`
+	Slug       string     `json:"slug"`
+	AddedAt    time.Time  `json:"added_at"`
+	AliveUntil *time.Time `json:"alive_until"`
+}
+
+// ExpiringDto lists the memberships which expire by the moment Until.
+type ExpiringDto struct {
+	Until       time.Time       `json:"until"`
+	Memberships []MembershipDto `json:"memberships"`
+}
+
+func NewMembershipDto(m *Membership) MembershipDto {
+	return MembershipDto{
+		UserId:     m.UserId,
+		Slug:       m.Slug,
+		AddedAt:    m.AddedAt,
+		AliveUntil: m.AliveUntil,
+	}
+}
+
+// AttributesDto sets the attributes of the user. The attributes are merged into the stored ones,
+// an attribute with the null value is removed.
+type AttributesDto struct {
+	UserId     int                    `json:"user_id"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+func (a *AttributesDto) Valid() bool {
+	if a.UserId <= 0 || a.Attributes == nil {
+		return false
+	}
+	for key := range a.Attributes {
+		// A dot separates the keys of the nested attributes in the rules
+		if key == "" || strings.Contains(key, ".") {
+			return false
+		}
+	}
+	return true
+}
@@ -9,6 +9,7 @@ import (
 	history "main/internal/history"
 	user "main/internal/user"
 	reflect "reflect"
+	time "time"
 
 	gomock "github.com/golang/mock/gomock"
 )
@@ -79,16 +80,19 @@ func (mr *MockRepositoryMockRecorder) DelUser(ctx, userId interface{}) *gomock.C
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DelUser", reflect.TypeOf((*MockRepository)(nil).DelUser), ctx, userId)
 }
 
-// DeleteSegmentsEveryDay mocks base method.
-func (m *MockRepository) DeleteSegmentsEveryDay(ctx context.Context, historyRepo history.Repository) {
+// DeleteExpired mocks base method.
+func (m *MockRepository) DeleteExpired(ctx context.Context, historyRepo history.Repository) (int, error) {
 	m.ctrl.T.Helper()
-	m.ctrl.Call(m, "DeleteSegmentsEveryDay", ctx, historyRepo)
+	ret := m.ctrl.Call(m, "DeleteExpired", ctx, historyRepo)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
 }
 
-// DeleteSegmentsEveryDay indicates an expected call of DeleteSegmentsEveryDay.
-func (mr *MockRepositoryMockRecorder) DeleteSegmentsEveryDay(ctx, historyRepo interface{}) *gomock.Call {
+// DeleteExpired indicates an expected call of DeleteExpired.
+func (mr *MockRepositoryMockRecorder) DeleteExpired(ctx, historyRepo interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteSegmentsEveryDay", reflect.TypeOf((*MockRepository)(nil).DeleteSegmentsEveryDay), ctx, historyRepo)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteExpired", reflect.TypeOf((*MockRepository)(nil).DeleteExpired), ctx, historyRepo)
 }
 
 // FindAll mocks base method.
@@ -106,6 +110,36 @@ func (mr *MockRepositoryMockRecorder) FindAll(ctx interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindAll", reflect.TypeOf((*MockRepository)(nil).FindAll), ctx)
 }
 
+// FindAncestors mocks base method.
+func (m *MockRepository) FindAncestors(ctx context.Context, slugs []string) (map[string][]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FindAncestors", ctx, slugs)
+	ret0, _ := ret[0].(map[string][]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FindAncestors indicates an expected call of FindAncestors.
+func (mr *MockRepositoryMockRecorder) FindAncestors(ctx, slugs interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindAncestors", reflect.TypeOf((*MockRepository)(nil).FindAncestors), ctx, slugs)
+}
+
+// FindAttributes mocks base method.
+func (m *MockRepository) FindAttributes(ctx context.Context, userId int) (map[string]interface{}, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FindAttributes", ctx, userId)
+	ret0, _ := ret[0].(map[string]interface{})
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FindAttributes indicates an expected call of FindAttributes.
+func (mr *MockRepositoryMockRecorder) FindAttributes(ctx, userId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindAttributes", reflect.TypeOf((*MockRepository)(nil).FindAttributes), ctx, userId)
+}
+
 // FindByUserId mocks base method.
 func (m *MockRepository) FindByUserId(ctx context.Context, userId int) (*user.Segments, error) {
 	m.ctrl.T.Helper()
@@ -121,6 +155,21 @@ func (mr *MockRepositoryMockRecorder) FindByUserId(ctx, userId interface{}) *gom
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindByUserId", reflect.TypeOf((*MockRepository)(nil).FindByUserId), ctx, userId)
 }
 
+// FindExpired mocks base method.
+func (m *MockRepository) FindExpired(ctx context.Context, until time.Time, limit int) ([]*user.Membership, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FindExpired", ctx, until, limit)
+	ret0, _ := ret[0].([]*user.Membership)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FindExpired indicates an expected call of FindExpired.
+func (mr *MockRepositoryMockRecorder) FindExpired(ctx, until, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindExpired", reflect.TypeOf((*MockRepository)(nil).FindExpired), ctx, until, limit)
+}
+
 // GetMaxId mocks base method.
 func (m *MockRepository) GetMaxId(ctx context.Context) (int, error) {
 	m.ctrl.T.Helper()
@@ -135,3 +184,47 @@ func (mr *MockRepositoryMockRecorder) GetMaxId(ctx interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMaxId", reflect.TypeOf((*MockRepository)(nil).GetMaxId), ctx)
 }
+
+// SyncRuleSegments mocks base method.
+func (m *MockRepository) SyncRuleSegments(ctx context.Context, historyRepo history.Repository) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SyncRuleSegments", ctx, historyRepo)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SyncRuleSegments indicates an expected call of SyncRuleSegments.
+func (mr *MockRepositoryMockRecorder) SyncRuleSegments(ctx, historyRepo interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SyncRuleSegments", reflect.TypeOf((*MockRepository)(nil).SyncRuleSegments), ctx, historyRepo)
+}
+
+// UpdateAliveUntil mocks base method.
+func (m *MockRepository) UpdateAliveUntil(ctx context.Context, userId int, slug string, aliveUntil *time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateAliveUntil", ctx, userId, slug, aliveUntil)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateAliveUntil indicates an expected call of UpdateAliveUntil.
+func (mr *MockRepositoryMockRecorder) UpdateAliveUntil(ctx, userId, slug, aliveUntil interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateAliveUntil", reflect.TypeOf((*MockRepository)(nil).UpdateAliveUntil), ctx, userId, slug, aliveUntil)
+}
+
+// UpsertAttributes mocks base method.
+func (m *MockRepository) UpsertAttributes(ctx context.Context, userId int, attrs map[string]interface{}, historyRepo history.Repository) (map[string]interface{}, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpsertAttributes", ctx, userId, attrs, historyRepo)
+	ret0, _ := ret[0].(map[string]interface{})
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UpsertAttributes indicates an expected call of UpsertAttributes.
+func (mr *MockRepositoryMockRecorder) UpsertAttributes(ctx, userId, attrs, historyRepo interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpsertAttributes", reflect.TypeOf((*MockRepository)(nil).UpsertAttributes), ctx, userId, attrs, historyRepo)
+}
@@ -1,6 +1,9 @@
 package user
 
-import "main/internal/segment"
+import (
+	"main/internal/segment"
+	"time"
+)
 
 type Segments struct {
 	UserId   int                `json:"user_id"`
@@ -16,3 +19,17 @@ type SegmentsAddDel struct {
 	SegmentsAdd []string `json:"add"`
 	SegmentsDel []string `json:"delete"`
 }
+
+// Membership is the membership of a user in a segment.
+type Membership struct {
+	UserId     int
+	Slug       string
+	AddedAt    time.Time
+	AliveUntil *time.Time
+}
+
+// Attributes are the attributes of the user which the rules of the dynamic segments are evaluated against.
+type Attributes struct {
+	UserId     int
+	Attributes map[string]interface{}
+}
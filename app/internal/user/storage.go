@@ -3,15 +3,22 @@ package user
 import (
 	"context"
 	"main/internal/history"
+	"time"
 )
 
 //go:generate mockgen -source=storage.go -destination=mocks/mock.go
 type Repository interface {
 	FindAll(ctx context.Context) ([]*User, error)
 	FindByUserId(ctx context.Context, userId int) (*Segments, error)
+	FindAncestors(ctx context.Context, slugs []string) (map[string][]string, error)
 	AddDelSegments(ctx context.Context, s *SegmentsAddDelDto, historyRepo history.Repository) error
+	UpdateAliveUntil(ctx context.Context, userId int, slug string, aliveUntil *time.Time) error
 	CreateUser(ctx context.Context) (int, error)
 	DelUser(ctx context.Context, userId int) error
 	GetMaxId(ctx context.Context) (int, error)
-	DeleteSegmentsEveryDay(ctx context.Context, historyRepo history.Repository)
+	FindExpired(ctx context.Context, until time.Time, limit int) ([]*Membership, error)
+	DeleteExpired(ctx context.Context, historyRepo history.Repository) (int, error)
+	UpsertAttributes(ctx context.Context, userId int, attrs map[string]interface{}, historyRepo history.Repository) (map[string]interface{}, error)
+	FindAttributes(ctx context.Context, userId int) (map[string]interface{}, error)
+	SyncRuleSegments(ctx context.Context, historyRepo history.Repository) (int, error)
 }
@@ -0,0 +1,303 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"main/internal/e"
+	"main/internal/outbox"
+	"main/pkg"
+	"time"
+)
+
+type repository struct {
+	client pkg.DBClient
+}
+
+// Create saves the webhook and sets its ID and creation time.
+func (r *repository) Create(ctx context.Context, webhook *Webhook) error {
+	q := `INSERT INTO webhooks (url, secret, segments, events) VALUES ($1, $2, $3, $4) RETURNING id, created_at;`
+	return r.client.QueryRow(ctx, q, webhook.Url, webhook.Secret, webhook.Segments, webhook.Events).
+		Scan(&webhook.Id, &webhook.CreatedAt)
+}
+
+// Delete deletes the webhook together with its deliveries.
+func (r *repository) Delete(ctx context.Context, id int) error {
+	tag, err := r.client.Exec(ctx, `DELETE FROM webhooks WHERE id = $1;`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return &e.WebhookNotFoundError{Id: id}
+	}
+	return nil
+}
+
+// FindAll returns all the webhooks ordered by ID.
+func (r *repository) FindAll(ctx context.Context) ([]*Webhook, error) {
+	q := `SELECT id, url, secret, segments, events, created_at FROM webhooks ORDER BY id;`
+	rows, err := r.client.Query(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := make([]*Webhook, 0)
+	for rows.Next() {
+		var w Webhook
+		if err = rows.Scan(&w.Id, &w.Url, &w.Secret, &w.Segments, &w.Events, &w.CreatedAt); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, &w)
+	}
+	return webhooks, rows.Err()
+}
+
+// FindDeliveries returns the latest deliveries to the webhook, newest first.
+// If status is not empty, only the deliveries with this status are returned.
+func (r *repository) FindDeliveries(ctx context.Context, webhookId int, status string, limit int) ([]*Delivery, error) {
+	var exists bool
+	if err := r.client.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM webhooks WHERE id = $1);`, webhookId).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, &e.WebhookNotFoundError{Id: webhookId}
+	}
+
+	q := `
+		SELECT id, webhook_id, event_seq, event, payload, status, attempts, next_attempt_at,
+			last_status_code, last_error, created_at, finished_at
+		FROM webhook_deliveries
+		WHERE webhook_id = $1 AND ($2 = '' OR status = $2)
+		ORDER BY id DESC
+		LIMIT $3;
+	`
+	rows, err := r.client.Query(ctx, q, webhookId, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := make([]*Delivery, 0)
+	for rows.Next() {
+		var d Delivery
+		err = rows.Scan(
+			&d.Id,
+			&d.WebhookId,
+			&d.EventSeq,
+			&d.Event,
+			&d.Payload,
+			&d.Status,
+			&d.Attempts,
+			&d.NextAttemptAt,
+			&d.LastStatusCode,
+			&d.LastError,
+			&d.CreatedAt,
+			&d.FinishedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, &d)
+	}
+	return deliveries, rows.Err()
+}
+
+// FindDeadLetters returns the latest dead letters of all the webhooks, newest first.
+func (r *repository) FindDeadLetters(ctx context.Context, limit int) ([]*DeadLetter, error) {
+	q := `
+		SELECT delivery_id, webhook_id, event, payload, attempts, last_error, created_at
+		FROM webhook_dead_letters
+		ORDER BY created_at DESC, delivery_id DESC
+		LIMIT $1;
+	`
+	rows, err := r.client.Query(ctx, q, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	letters := make([]*DeadLetter, 0)
+	for rows.Next() {
+		var l DeadLetter
+		if err = rows.Scan(&l.DeliveryId, &l.WebhookId, &l.Event, &l.Payload, &l.Attempts, &l.LastError, &l.CreatedAt); err != nil {
+			return nil, err
+		}
+		letters = append(letters, &l)
+	}
+	return letters, rows.Err()
+}
+
+// RetryDeadLetter removes the dead letter and returns its delivery to the queue with all the attempts.
+func (r *repository) RetryDeadLetter(ctx context.Context, deliveryId int64) (err error) {
+	tx, err := r.client.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback(ctx)
+			panic(p)
+		} else if err != nil {
+			tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	tag, err := tx.Exec(ctx, `DELETE FROM webhook_dead_letters WHERE delivery_id = $1;`, deliveryId)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return &e.DeadLetterNotFoundError{DeliveryId: deliveryId}
+	}
+
+	q := `
+		UPDATE webhook_deliveries
+		SET status = 'pending', attempts = 0, next_attempt_at = now(), finished_at = NULL
+		WHERE id = $1;
+	`
+	_, err = tx.Exec(ctx, q, deliveryId)
+	return err
+}
+
+// Enqueue adds a delivery of each event to each webhook subscribed to it and returns the number of the added ones.
+// The events which have already been enqueued are skipped. The webhooks subscribed to the old slug
+// of a renamed segment keep receiving its events.
+func (r *repository) Enqueue(ctx context.Context, events []outbox.Event) (int, error) {
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	seqs := make([]int64, 0, len(events))
+	names := make([]string, 0, len(events))
+	slugs := make([]string, 0, len(events))
+	payloads := make([]string, 0, len(events))
+	for _, ev := range events {
+		payload, err := json.Marshal(NewPayload(ev))
+		if err != nil {
+			return 0, err
+		}
+		seqs = append(seqs, ev.Seq)
+		names = append(names, EventName(ev))
+		slugs = append(slugs, ev.Slug)
+		payloads = append(payloads, string(payload))
+	}
+
+	q := `
+		INSERT INTO webhook_deliveries (webhook_id, event_seq, event, payload)
+		SELECT w.id, v.seq, v.event, v.payload::jsonb
+		FROM unnest($1::bigint[], $2::varchar[], $3::varchar[], $4::text[]) AS v(seq, event, slug, payload)
+		JOIN webhooks w ON (cardinality(w.events) = 0 OR v.event = ANY(w.events))
+			AND (cardinality(w.segments) = 0 OR v.slug = ANY(w.segments) OR EXISTS (
+				SELECT 1 FROM segment_aliases a JOIN segments s ON s.segment_id = a.segment_id
+				WHERE s.slug = v.slug AND a.slug = ANY(w.segments)
+			))
+		ON CONFLICT (webhook_id, event_seq) DO NOTHING;
+	`
+	tag, err := r.client.Exec(ctx, q, seqs, names, slugs, payloads)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// Claim returns the pending deliveries which are due and postpones their next attempt by lease,
+// so that other instances do not send them at the same time. If the instance dies while sending them,
+// they are sent again after the lease.
+func (r *repository) Claim(ctx context.Context, limit int, lease time.Duration) ([]*Delivery, error) {
+	q := `
+		UPDATE webhook_deliveries d SET next_attempt_at = now() + $2 * interval '1 millisecond'
+		FROM webhooks w
+		WHERE w.id = d.webhook_id AND d.id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = 'pending' AND next_attempt_at <= now()
+			ORDER BY next_attempt_at, id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING d.id, d.webhook_id, d.event_seq, d.event, d.payload, d.status, d.attempts, d.next_attempt_at,
+			d.last_status_code, d.last_error, d.created_at, d.finished_at, w.url, w.secret;
+	`
+	rows, err := r.client.Query(ctx, q, limit, lease.Milliseconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := make([]*Delivery, 0)
+	for rows.Next() {
+		var d Delivery
+		err = rows.Scan(
+			&d.Id,
+			&d.WebhookId,
+			&d.EventSeq,
+			&d.Event,
+			&d.Payload,
+			&d.Status,
+			&d.Attempts,
+			&d.NextAttemptAt,
+			&d.LastStatusCode,
+			&d.LastError,
+			&d.CreatedAt,
+			&d.FinishedAt,
+			&d.Url,
+			&d.Secret,
+		)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, &d)
+	}
+	return deliveries, rows.Err()
+}
+
+// Record saves the result of an attempt of the delivery. A dead delivery is copied to the dead letters.
+func (r *repository) Record(ctx context.Context, delivery *Delivery) (err error) {
+	tx, err := r.client.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback(ctx)
+			panic(p)
+		} else if err != nil {
+			tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	q := `
+		UPDATE webhook_deliveries
+		SET status = $2, attempts = $3, next_attempt_at = $4, last_status_code = $5, last_error = $6, finished_at = $7
+		WHERE id = $1;
+	`
+	_, err = tx.Exec(ctx, q,
+		delivery.Id,
+		delivery.Status,
+		delivery.Attempts,
+		delivery.NextAttemptAt,
+		delivery.LastStatusCode,
+		delivery.LastError,
+		delivery.FinishedAt,
+	)
+	if err != nil || delivery.Status != StatusDead {
+		return err
+	}
+
+	q = `
+		INSERT INTO webhook_dead_letters (delivery_id, webhook_id, event, payload, attempts, last_error)
+		SELECT id, webhook_id, event, payload, attempts, last_error FROM webhook_deliveries WHERE id = $1
+		ON CONFLICT (delivery_id) DO NOTHING;
+	`
+	_, err = tx.Exec(ctx, q, delivery.Id)
+	return err
+}
+
+func NewRepo(client pkg.DBClient) Repository {
+	return &repository{
+		client: client,
+	}
+}
@@ -0,0 +1,203 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"main/internal/metrics"
+	"main/internal/outbox"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The headers of a delivery request.
+const (
+	HeaderDelivery  = "X-Webhook-Delivery"
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+// Sign returns the signature of the delivery body sent at the unix timestamp:
+// "sha256=" followed by the hex HMAC-SHA256 of "timestamp.body" with the secret of the webhook.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sink enqueues the deliveries of the published events to the webhooks subscribed to them.
+type Sink struct {
+	repo Repository
+}
+
+func NewSink(repo Repository) *Sink {
+	return &Sink{repo: repo}
+}
+
+func (s *Sink) Publish(ctx context.Context, events []outbox.Event) error {
+	_, err := s.repo.Enqueue(ctx, events)
+	return err
+}
+
+// Backoff is the retry policy of the deliveries: the delay doubles after each failed attempt
+// from Min up to Max, and the delivery is dead after MaxAttempts attempts.
+type Backoff struct {
+	MaxAttempts int
+	Min         time.Duration
+	Max         time.Duration
+}
+
+// Delay returns the delay after the failed attempt with the number attempt, starting from 1.
+func (b Backoff) Delay(attempt int) time.Duration {
+	d := b.Min
+	for i := 1; i < attempt && d < b.Max; i++ {
+		d *= 2
+	}
+	if d > b.Max {
+		d = b.Max
+	}
+	return d
+}
+
+// Dispatcher sends the enqueued deliveries to the webhooks. Any number of app instances may run it,
+// a delivery is claimed by one of them at a time. The deliveries are sent at least once and in no particular
+// order, the receivers can use seq of the payload to skip the duplicates.
+type Dispatcher struct {
+	repo      Repository
+	client    *http.Client
+	backoff   Backoff
+	batchSize int
+}
+
+func NewDispatcher(repo Repository, client *http.Client, backoff Backoff, batchSize int) *Dispatcher {
+	return &Dispatcher{repo: repo, client: client, backoff: backoff, batchSize: batchSize}
+}
+
+// Run sends the due deliveries every interval until ctx is done.
+func (d *Dispatcher) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		for {
+			n, err := d.DispatchOnce(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.ErrorContext(ctx, "failed to dispatch webhook deliveries", "err", err)
+				}
+				break
+			}
+			if n < d.batchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// DispatchOnce sends a batch of the due deliveries at once and returns the number of the sent ones.
+func (d *Dispatcher) DispatchOnce(ctx context.Context) (int, error) {
+	// The lease covers the attempt, a delivery of a dead instance is sent again after it
+	deliveries, err := d.repo.Claim(ctx, d.batchSize, d.client.Timeout+time.Minute)
+	if err != nil {
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+	for _, delivery := range deliveries {
+		wg.Add(1)
+		go func(delivery *Delivery) {
+			defer wg.Done()
+			d.attempt(ctx, delivery)
+		}(delivery)
+	}
+	wg.Wait()
+	return len(deliveries), nil
+}
+
+// attempt sends the delivery and records the result.
+func (d *Dispatcher) attempt(ctx context.Context, delivery *Delivery) {
+	statusCode, err := d.send(ctx, delivery)
+	if ctx.Err() != nil {
+		// The attempt has been interrupted by the shutdown, it is repeated after the lease
+		return
+	}
+
+	now := time.Now()
+	delivery.Attempts++
+	delivery.LastStatusCode = nil
+	if statusCode != 0 {
+		delivery.LastStatusCode = &statusCode
+	}
+	delivery.LastError = nil
+
+	switch {
+	case err == nil:
+		delivery.Status = StatusDelivered
+		delivery.FinishedAt = &now
+	case delivery.Attempts >= d.backoff.MaxAttempts:
+		msg := err.Error()
+		delivery.LastError = &msg
+		delivery.Status = StatusDead
+		delivery.FinishedAt = &now
+	default:
+		msg := err.Error()
+		delivery.LastError = &msg
+		delivery.NextAttemptAt = now.Add(d.backoff.Delay(delivery.Attempts))
+	}
+	metrics.WebhookDeliveries.WithLabelValues(delivery.Event, deliveryResult(delivery)).Inc()
+
+	if err = d.repo.Record(ctx, delivery); err != nil {
+		slog.ErrorContext(ctx, "failed to record webhook delivery", "delivery_id", delivery.Id, "err", err)
+	}
+}
+
+func deliveryResult(delivery *Delivery) string {
+	if delivery.Status == StatusPending {
+		return "retry"
+	}
+	return delivery.Status
+}
+
+// send posts the payload of the delivery to the webhook. Any response but 2xx is a failure.
+// It returns the status code of the response, 0 if there is none.
+func (d *Dispatcher) send(ctx context.Context, delivery *Delivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.Url, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderDelivery, strconv.FormatInt(delivery.Id, 10))
+	req.Header.Set(HeaderEvent, delivery.Event)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(delivery.Secret, timestamp, delivery.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// The body is drained, so that the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
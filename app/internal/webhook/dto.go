@@ -0,0 +1,150 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/url"
+	"time"
+)
+
+// WebhookDto is the request to register a webhook. Empty segments or events subscribe to all of them.
+type WebhookDto struct {
+	Url      string   `json:"url"`
+	Secret   string   `json:"secret"`
+	Segments []string `json:"segments"`
+	Events   []string `json:"events"`
+}
+
+func (w *WebhookDto) Valid() bool {
+	u, err := url.Parse(w.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return false
+	}
+	if w.Secret == "" {
+		return false
+	}
+	for _, slug := range w.Segments {
+		if slug == "" {
+			return false
+		}
+	}
+	for _, event := range w.Events {
+		if !validEvent(event) {
+			return false
+		}
+	}
+	return true
+}
+
+func validEvent(event string) bool {
+	for _, e := range Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// NewWebhook converts the request, the missing lists become empty ones.
+func NewWebhook(w *WebhookDto) *Webhook {
+	webhook := &Webhook{
+		Url:      w.Url,
+		Secret:   w.Secret,
+		Segments: w.Segments,
+		Events:   w.Events,
+	}
+	if webhook.Segments == nil {
+		webhook.Segments = []string{}
+	}
+	if webhook.Events == nil {
+		webhook.Events = []string{}
+	}
+	return webhook
+}
+
+// InfoDto describes a registered webhook, the secret is never returned.
+type InfoDto struct {
+	Id        int       `json:"id"`
+	Url       string    `json:"url"`
+	Segments  []string  `json:"segments"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type InfosDto struct {
+	Webhooks []InfoDto `json:"webhooks"`
+}
+
+func NewInfoDto(w *Webhook) InfoDto {
+	return InfoDto{
+		Id:        w.Id,
+		Url:       w.Url,
+		Segments:  w.Segments,
+		Events:    w.Events,
+		CreatedAt: w.CreatedAt,
+	}
+}
+
+type DeliveryDto struct {
+	Id             int64           `json:"delivery_id"`
+	WebhookId      int             `json:"webhook_id"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  *time.Time      `json:"next_attempt_at"`
+	LastStatusCode *int            `json:"last_status_code"`
+	LastError      *string         `json:"last_error"`
+	CreatedAt      time.Time       `json:"created_at"`
+	FinishedAt     *time.Time      `json:"finished_at"`
+}
+
+type DeliveriesDto struct {
+	Deliveries []DeliveryDto `json:"deliveries"`
+}
+
+// NewDeliveryDto converts the delivery, the next attempt is set only for the pending ones.
+func NewDeliveryDto(d *Delivery) DeliveryDto {
+	dto := DeliveryDto{
+		Id:             d.Id,
+		WebhookId:      d.WebhookId,
+		Event:          d.Event,
+		Payload:        d.Payload,
+		Status:         d.Status,
+		Attempts:       d.Attempts,
+		LastStatusCode: d.LastStatusCode,
+		LastError:      d.LastError,
+		CreatedAt:      d.CreatedAt,
+		FinishedAt:     d.FinishedAt,
+	}
+	if d.Status == StatusPending {
+		next := d.NextAttemptAt
+		dto.NextAttemptAt = &next
+	}
+	return dto
+}
+
+type DeadLetterDto struct {
+	DeliveryId int64           `json:"delivery_id"`
+	WebhookId  int             `json:"webhook_id"`
+	Event      string          `json:"event"`
+	Payload    json.RawMessage `json:"payload"`
+	Attempts   int             `json:"attempts"`
+	LastError  *string         `json:"last_error"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+type DeadLettersDto struct {
+	DeadLetters []DeadLetterDto `json:"dead_letters"`
+}
+
+func NewDeadLetterDto(l *DeadLetter) DeadLetterDto {
+	return DeadLetterDto{
+		DeliveryId: l.DeliveryId,
+		WebhookId:  l.WebhookId,
+		Event:      l.Event,
+		Payload:    l.Payload,
+		Attempts:   l.Attempts,
+		LastError:  l.LastError,
+		CreatedAt:  l.CreatedAt,
+	}
+}
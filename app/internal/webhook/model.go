@@ -0,0 +1,108 @@
+package webhook
+
+import (
+	"main/internal/outbox"
+	"time"
+)
+
+// The events delivered to the webhooks.
+const (
+	SegmentCreated = "segment.created"
+	SegmentDeleted = "segment.deleted"
+	UserAdded      = "user.added"
+	// UserRemoved is the removal of a user from a segment by a request or together with the segment
+	UserRemoved = "user.removed"
+	// UserExpired is the removal of a user from a segment by the TTL cleanup
+	UserExpired = "user.expired"
+)
+
+// Events are all the events a webhook can subscribe to.
+var Events = []string{SegmentCreated, SegmentDeleted, UserAdded, UserRemoved, UserExpired}
+
+// The statuses of the deliveries.
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	// StatusDead is the status of a delivery which has run out of attempts, it is kept in the dead letters
+	StatusDead = "dead"
+)
+
+// Webhook is a subscription to the events. Empty Segments or Events mean all of them.
+type Webhook struct {
+	Id        int
+	Url       string
+	Secret    string
+	Segments  []string
+	Events    []string
+	CreatedAt time.Time
+}
+
+// Delivery is a delivery of an event to a webhook. Url and Secret are the ones of the webhook,
+// they are set only for the deliveries claimed by the dispatcher.
+type Delivery struct {
+	Id             int64
+	WebhookId      int
+	EventSeq       int64
+	Event          string
+	Payload        []byte
+	Status         string
+	Attempts       int
+	NextAttemptAt  time.Time
+	LastStatusCode *int
+	LastError      *string
+	CreatedAt      time.Time
+	FinishedAt     *time.Time
+	Url            string
+	Secret         string
+}
+
+// DeadLetter is a delivery which has run out of attempts.
+type DeadLetter struct {
+	DeliveryId int64
+	WebhookId  int
+	Event      string
+	Payload    []byte
+	Attempts   int
+	LastError  *string
+	CreatedAt  time.Time
+}
+
+// Payload is the body of a delivery. Seq is the number of the event in the outbox,
+// it is the same in every delivery of the event.
+type Payload struct {
+	Seq        int64      `json:"seq"`
+	Event      string     `json:"event"`
+	Segment    string     `json:"segment"`
+	UserId     int        `json:"user_id,omitempty"`
+	Reason     string     `json:"reason"`
+	AliveUntil *time.Time `json:"alive_until,omitempty"`
+	OccurredAt time.Time  `json:"occurred_at"`
+}
+
+// EventName returns the webhook event of the outbox event.
+func EventName(ev outbox.Event) string {
+	switch {
+	case ev.Type == outbox.SegmentCreated:
+		return SegmentCreated
+	case ev.Type == outbox.SegmentDeleted:
+		return SegmentDeleted
+	case ev.Type == outbox.Entered:
+		return UserAdded
+	case ev.Reason == outbox.ReasonTtl:
+		return UserExpired
+	default:
+		return UserRemoved
+	}
+}
+
+func NewPayload(ev outbox.Event) Payload {
+	return Payload{
+		Seq:        ev.Seq,
+		Event:      EventName(ev),
+		Segment:    ev.Slug,
+		UserId:     ev.UserId,
+		Reason:     ev.Reason,
+		AliveUntil: ev.AliveUntil,
+		OccurredAt: ev.OccurredAt,
+	}
+}
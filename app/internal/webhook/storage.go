@@ -0,0 +1,20 @@
+package webhook
+
+import (
+	"context"
+	"main/internal/outbox"
+	"time"
+)
+
+//go:generate mockgen -source=storage.go -destination=mocks/mock.go
+type Repository interface {
+	Create(ctx context.Context, webhook *Webhook) error
+	Delete(ctx context.Context, id int) error
+	FindAll(ctx context.Context) ([]*Webhook, error)
+	FindDeliveries(ctx context.Context, webhookId int, status string, limit int) ([]*Delivery, error)
+	FindDeadLetters(ctx context.Context, limit int) ([]*DeadLetter, error)
+	RetryDeadLetter(ctx context.Context, deliveryId int64) error
+	Enqueue(ctx context.Context, events []outbox.Event) (int, error)
+	Claim(ctx context.Context, limit int, lease time.Duration) ([]*Delivery, error)
+	Record(ctx context.Context, delivery *Delivery) error
+}
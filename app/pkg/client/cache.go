@@ -0,0 +1,81 @@
+package client
+
+import (
+	"main/internal/user"
+	"sync"
+	"time"
+)
+
+type cachedSegments struct {
+	segments  *user.SegmentsDto
+	expiresAt time.Time
+}
+
+// segmentsCache keeps the segments of the users for a while.
+type segmentsCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[int]cachedSegments
+}
+
+func newSegmentsCache(ttl time.Duration, size int) *segmentsCache {
+	return &segmentsCache{ttl: ttl, size: size, entries: make(map[int]cachedSegments)}
+}
+
+// get returns a copy of the cached segments of the user, so that the caller may change them.
+func (c *segmentsCache) get(userId int) (*user.SegmentsDto, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[userId]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expiresAt) {
+		delete(c.entries, userId)
+		return nil, false
+	}
+	return copySegments(e.segments), true
+}
+
+func (c *segmentsCache) set(userId int, s *user.SegmentsDto) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[userId]; !ok && len(c.entries) >= c.size {
+		c.evict()
+	}
+	if len(c.entries) < c.size {
+		c.entries[userId] = cachedSegments{segments: copySegments(s), expiresAt: time.Now().Add(c.ttl)}
+	}
+}
+
+func (c *segmentsCache) drop(userId int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, userId)
+}
+
+// evict frees room for an entry: it deletes the expired entries or, if there are none, an arbitrary one.
+func (c *segmentsCache) evict() {
+	now := time.Now()
+	for id, e := range c.entries {
+		if now.After(e.expiresAt) {
+			delete(c.entries, id)
+		}
+	}
+	for id := range c.entries {
+		if len(c.entries) < c.size {
+			return
+		}
+		delete(c.entries, id)
+	}
+}
+
+func copySegments(s *user.SegmentsDto) *user.SegmentsDto {
+	res := *s
+	res.Segments = append(res.Segments[:0:0], s.Segments...)
+	return &res
+}
@@ -0,0 +1,257 @@
+// Package client is a typed client of the segmentation API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotencyReplayedHeader = "Idempotency-Replayed"
+)
+
+// StatusError is returned when the API responds with an unexpected status code.
+type StatusError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	// replayed is set if the response is the one kept for the Idempotency-Key of an earlier attempt
+	replayed bool
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s %s: %d %s", e.Method, e.Path, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// IsStatus reports whether err is a StatusError with the code.
+func IsStatus(err error, code int) bool {
+	var se *StatusError
+	return errors.As(err, &se) && se.StatusCode == code
+}
+
+// Retry is the policy of repeating the requests which failed with 429, 5xx or a transport error.
+// The retries of the requests which carry an Idempotency-Key are also repeated after 409,
+// which means that an earlier attempt is still being handled. The delay before the n-th retry is MinBackoff * 2^(n-1) with jitter, capped at MaxBackoff.
+type Retry struct {
+	MaxAttempts int
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+}
+
+var DefaultRetry = Retry{MaxAttempts: 4, MinBackoff: 100 * time.Millisecond, MaxBackoff: 2 * time.Second}
+
+// backoff returns the delay before the retry following the attempt, counting from 1.
+func (r Retry) backoff(attempt int) time.Duration {
+	d := r.MinBackoff << (attempt - 1)
+	if d <= 0 || d > r.MaxBackoff {
+		d = r.MaxBackoff
+	}
+	// Full jitter in the upper half, so that the clients limited at once do not retry at once
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Client calls the API of a single service instance or a load balancer.
+// It is safe for concurrent use.
+type Client struct {
+	baseUrl      *url.URL
+	httpClient   *http.Client
+	retry        Retry
+	pollInterval time.Duration
+	cache        *segmentsCache
+	adminToken   string
+}
+
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client, http.DefaultClient by default.
+func WithHTTPClient(c *http.Client) Option {
+	return func(client *Client) {
+		client.httpClient = c
+	}
+}
+
+// WithRetry sets the retry policy, DefaultRetry by default. MaxAttempts 1 disables the retries.
+func WithRetry(r Retry) Option {
+	return func(client *Client) {
+		client.retry = r
+	}
+}
+
+// WithPollInterval sets how often WaitReport checks the report, 1 second by default.
+func WithPollInterval(d time.Duration) Option {
+	return func(client *Client) {
+		client.pollInterval = d
+	}
+}
+
+// WithCache enables the local cache of the user segments. The segments of up to size users are kept for ttl.
+// The entry of a user is dropped when the user is changed through this client,
+// but the changes made by others are visible only after the entry expires.
+func WithCache(ttl time.Duration, size int) Option {
+	return func(client *Client) {
+		client.cache = newSegmentsCache(ttl, size)
+	}
+}
+
+// WithAdminToken sets the token which the server requires on the job methods.
+func WithAdminToken(token string) Option {
+	return func(client *Client) {
+		client.adminToken = token
+	}
+}
+
+// New creates a client of the API at baseUrl, e.g. "http://localhost:8080".
+func New(baseUrl string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(strings.TrimRight(baseUrl, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid base url %q", baseUrl)
+	}
+
+	c := &Client{
+		baseUrl:      u,
+		httpClient:   http.DefaultClient,
+		retry:        DefaultRetry,
+		pollInterval: time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.retry.MaxAttempts < 1 {
+		c.retry.MaxAttempts = 1
+	}
+	return c, nil
+}
+
+// request describes a call of the API.
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	body   interface{}
+	// idempotent requests carry a generated Idempotency-Key, the same in every attempt.
+	// The server keeps the response to the key, so once an attempt has been handled, the retries
+	// get its response instead of applying the request again. The key of an attempt failed with 5xx
+	// is released, so it is safe to retry.
+	idempotent bool
+}
+
+// do sends the request, retrying it according to the policy, and decodes the JSON response into out.
+// It returns the status code of the response, which is one of 200 and 204 if there is no error.
+func (c *Client) do(ctx context.Context, req request, out interface{}) (int, error) {
+	var body []byte
+	if req.body != nil {
+		var err error
+		if body, err = json.Marshal(req.body); err != nil {
+			return 0, err
+		}
+	}
+	var key string
+	if req.idempotent {
+		key = uuid.New().String()
+	}
+
+	for attempt := 1; ; attempt++ {
+		code, err := c.send(ctx, req, body, key, out)
+		if !retryable(req, attempt, code, err) || attempt >= c.retry.MaxAttempts || ctx.Err() != nil {
+			return code, err
+		}
+
+		t := time.NewTimer(c.retry.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return code, err
+		case <-t.C:
+		}
+	}
+}
+
+// retryable reports whether the attempt of the request failed in a way which may pass on a retry.
+func retryable(req request, attempt, code int, err error) bool {
+	if err == nil {
+		return false
+	}
+	if code == 0 {
+		// Transport error
+		return true
+	}
+	if code == http.StatusTooManyRequests || code >= http.StatusInternalServerError {
+		return true
+	}
+	// An earlier attempt, e.g. the one whose response has been lost, is still being handled.
+	// The replayed 409 is the result of an earlier attempt and is returned as is.
+	var se *StatusError
+	return req.idempotent && attempt > 1 && code == http.StatusConflict && errors.As(err, &se) && !se.replayed
+}
+
+// send makes a single attempt of the request.
+func (c *Client) send(ctx context.Context, req request, body []byte, key string, out interface{}) (int, error) {
+	u := *c.baseUrl
+	u.Path += req.path
+	u.RawQuery = req.query.Encode()
+
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, u.String(), r)
+	if err != nil {
+		return 0, err
+	}
+	if body != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	if key != "" {
+		httpReq.Header.Set(idempotencyKeyHeader, key)
+	}
+	if c.adminToken != "" && strings.HasPrefix(req.path, "/admin/") {
+		httpReq.Header.Set("Authorization", "Bearer "+c.adminToken)
+	}
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNoContent:
+		return resp.StatusCode, nil
+	case resp.StatusCode != http.StatusOK:
+		// Drain the body, so that the connection is reused
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode, &StatusError{
+			Method:     req.method,
+			Path:       req.path,
+			StatusCode: resp.StatusCode,
+			replayed:   resp.Header.Get(idempotencyReplayedHeader) == "true",
+		}
+	case out == nil:
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode, nil
+	}
+
+	if w, ok := out.(io.Writer); ok {
+		_, err = io.Copy(w, resp.Body)
+	} else {
+		err = json.NewDecoder(resp.Body).Decode(out)
+	}
+	if err != nil {
+		return resp.StatusCode, fmt.Errorf("%s %s: read response: %w", req.method, req.path, err)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,49 @@
+package client
+
+import (
+	"context"
+	"main/internal/experiment"
+	"net/http"
+	"net/url"
+)
+
+// CreateExperiment creates the experiment with the segments of its variants and returns it with the segment slugs.
+// If the experiment or one of the segments already exists, a StatusError with 409 is returned.
+func (c *Client) CreateExperiment(ctx context.Context, e experiment.ExperimentDto) (*experiment.ExperimentDto, error) {
+	var res experiment.ExperimentDto
+	if _, err := c.do(ctx, request{method: http.MethodPost, path: "/experiment", body: e}, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Experiments returns all the experiments.
+func (c *Client) Experiments(ctx context.Context) ([]experiment.ExperimentDto, error) {
+	var res experiment.ExperimentsDto
+	if _, err := c.do(ctx, request{method: http.MethodGet, path: "/experiment"}, &res); err != nil {
+		return nil, err
+	}
+	return res.Experiments, nil
+}
+
+// DeleteExperiment deletes the experiment, the segments of its variants stay.
+func (c *Client) DeleteExperiment(ctx context.Context, slug string) error {
+	query := url.Values{"slug": {slug}}
+	_, err := c.do(ctx, request{method: http.MethodDelete, path: "/experiment", query: query}, nil)
+	return err
+}
+
+// Allocate returns the variant of the user in the experiment, adding the user to its segment on the first exposure.
+// If the experiment or the user is unknown, a StatusError with 404 is returned.
+func (c *Client) Allocate(ctx context.Context, slug string, userId int) (*experiment.AllocationDto, error) {
+	if c.cache != nil {
+		defer c.cache.drop(userId)
+	}
+
+	var res experiment.AllocationDto
+	body := experiment.AllocateDto{Experiment: slug, UserId: userId}
+	if _, err := c.do(ctx, request{method: http.MethodPost, path: "/experiment/allocate", body: body}, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
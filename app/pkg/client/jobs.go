@@ -0,0 +1,76 @@
+package client
+
+import (
+	"context"
+	"main/internal/job"
+	"main/internal/user"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// JobRuns returns the latest runs of the background jobs, of all of them if name is empty.
+// A limit of 0 means the default limit of the server.
+func (c *Client) JobRuns(ctx context.Context, name string, limit int) ([]job.RunDto, error) {
+	query := url.Values{}
+	if name != "" {
+		query.Set("job", name)
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	var runs job.RunsDto
+	if _, err := c.do(ctx, request{method: http.MethodGet, path: "/admin/jobs", query: query}, &runs); err != nil {
+		return nil, err
+	}
+	return runs.Runs, nil
+}
+
+// JobInfo returns the schedule and the state of the job.
+func (c *Client) JobInfo(ctx context.Context, name string) (*job.InfoDto, error) {
+	var info job.InfoDto
+	if _, err := c.do(ctx, request{method: http.MethodGet, path: "/admin/jobs/" + url.PathEscape(name)}, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// TriggerJob runs the job immediately and returns the finished run.
+// If the job is being run at the moment, a StatusError with 409 is returned.
+func (c *Client) TriggerJob(ctx context.Context, name string) (*job.RunDto, error) {
+	var run job.RunDto
+	path := "/admin/jobs/" + url.PathEscape(name) + "/run"
+	if _, err := c.do(ctx, request{method: http.MethodPost, path: path}, &run); err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+// PauseJob pauses (paused = true) or resumes the scheduled runs of the job on all instances.
+func (c *Client) PauseJob(ctx context.Context, name string, paused bool) error {
+	path := "/admin/jobs/" + url.PathEscape(name) + "/resume"
+	if paused {
+		path = "/admin/jobs/" + url.PathEscape(name) + "/pause"
+	}
+	_, err := c.do(ctx, request{method: http.MethodPost, path: path}, nil)
+	return err
+}
+
+// DryRunTtlCleanup returns the memberships the TTL cleanup run at the moment would delete.
+// A zero until means now and a limit of 0 means the default limit of the server.
+func (c *Client) DryRunTtlCleanup(ctx context.Context, until time.Time, limit int) (*user.ExpiringDto, error) {
+	query := url.Values{}
+	if !until.IsZero() {
+		query.Set("until", until.Format(time.RFC3339))
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	var resp user.ExpiringDto
+	path := "/admin/jobs/ttl_cleanup/dry_run"
+	if _, err := c.do(ctx, request{method: http.MethodGet, path: path, query: query}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
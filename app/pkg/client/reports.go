@@ -0,0 +1,93 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// The statuses of a report.
+const (
+	ReportProgress = "progress"
+	ReportSuccess  = "success"
+	ReportFail     = "fail"
+)
+
+// ErrReportFailed is returned by WaitReport when the server failed to generate the report.
+var ErrReportFailed = errors.New("report generation failed")
+
+type Report struct {
+	Status     string `json:"status"`
+	LinkToFile string `json:"link_to_file"`
+}
+
+// StartReport starts the generation of the history report since the moment and returns the id of its task.
+// The moment is sent with minute precision in the time zone of t.
+func (c *Client) StartReport(ctx context.Context, from time.Time) (string, error) {
+	query := url.Values{"date": {from.Format("2006-01-02 15:04")}}
+	var resp struct {
+		TaskId string `json:"task_id"`
+	}
+	if _, err := c.do(ctx, request{method: http.MethodGet, path: "/report", query: query}, &resp); err != nil {
+		return "", err
+	}
+	return resp.TaskId, nil
+}
+
+// ReportStatus returns the current state of the report task.
+func (c *Client) ReportStatus(ctx context.Context, taskId string) (*Report, error) {
+	query := url.Values{"task_id": {taskId}}
+	var report Report
+	if _, err := c.do(ctx, request{method: http.MethodGet, path: "/report_check", query: query}, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// WaitReport polls the report task until the report is generated or ctx is done.
+// It returns ErrReportFailed if the generation has failed.
+func (c *Client) WaitReport(ctx context.Context, taskId string) (*Report, error) {
+	t := time.NewTicker(c.pollInterval)
+	defer t.Stop()
+
+	for {
+		report, err := c.ReportStatus(ctx, taskId)
+		if err != nil {
+			return nil, err
+		}
+		switch report.Status {
+		case ReportSuccess:
+			return report, nil
+		case ReportFail:
+			return nil, ErrReportFailed
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// GenerateReport starts the generation of the report since the moment and waits for it.
+func (c *Client) GenerateReport(ctx context.Context, from time.Time) (string, *Report, error) {
+	taskId, err := c.StartReport(ctx, from)
+	if err != nil {
+		return "", nil, err
+	}
+	report, err := c.WaitReport(ctx, taskId)
+	return taskId, report, err
+}
+
+// DownloadReport writes the csv file of the generated report to w.
+// A failed download is not retried, as a part of the file may have been written already.
+func (c *Client) DownloadReport(ctx context.Context, taskId string, w io.Writer) error {
+	query := url.Values{"id": {taskId}}
+	req := request{method: http.MethodGet, path: "/download", query: query}
+	_, err := c.send(ctx, req, nil, "", w)
+	return err
+}
@@ -0,0 +1,149 @@
+package client
+
+import (
+	"context"
+	"main/internal/segment"
+	"main/internal/user"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// CreateSegment creates the segment. If it already exists, a StatusError with 409 is returned.
+func (c *Client) CreateSegment(ctx context.Context, s segment.SegmentDto) error {
+	_, err := c.do(ctx, request{method: http.MethodPost, path: "/segment", body: s, idempotent: true}, nil)
+	return err
+}
+
+// DeleteSegment deletes the segment with the slug.
+func (c *Client) DeleteSegment(ctx context.Context, slug string) error {
+	s := segment.SegmentDto{Slug: slug}
+	_, err := c.do(ctx, request{method: http.MethodDelete, path: "/segment", body: s, idempotent: true}, nil)
+	return err
+}
+
+// PatchSegment changes the metadata, the status or the exclusion group of the segment and returns the changed segment.
+// If the members of the segment would conflict with the other segments of the group, a StatusError with 409 is returned.
+func (c *Client) PatchSegment(ctx context.Context, s segment.SegmentPatchDto) (*segment.SegmentDto, error) {
+	var dto segment.SegmentDto
+	if _, err := c.do(ctx, request{method: http.MethodPatch, path: "/segment", body: s, idempotent: true}, &dto); err != nil {
+		return nil, err
+	}
+	return &dto, nil
+}
+
+// RenameSegment renames the segment, the old slug keeps working as a deprecated alias.
+func (c *Client) RenameSegment(ctx context.Context, slug, newSlug string) (*segment.SegmentDto, error) {
+	var dto segment.SegmentDto
+	body := segment.SegmentRenameDto{Slug: slug, NewSlug: newSlug}
+	if _, err := c.do(ctx, request{method: http.MethodPost, path: "/segment/rename", body: body, idempotent: true}, &dto); err != nil {
+		return nil, err
+	}
+	return &dto, nil
+}
+
+// Segments returns the segments matching the filter ordered by slug.
+func (c *Client) Segments(ctx context.Context, filter segment.Filter) ([]segment.SegmentDto, error) {
+	query := url.Values{}
+	for key, value := range map[string]string{"tag": filter.Tag, "owner": filter.Owner, "status": filter.Status} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	var s segment.SegmentsDto
+	if _, err := c.do(ctx, request{method: http.MethodGet, path: "/segment", query: query}, &s); err != nil {
+		return nil, err
+	}
+	return s.Segments, nil
+}
+
+// UserSegments returns the active segments of the user. A user without segments has an empty list.
+func (c *Client) UserSegments(ctx context.Context, userId int) (*user.SegmentsDto, error) {
+	if c.cache != nil {
+		if s, ok := c.cache.get(userId); ok {
+			return s, nil
+		}
+	}
+
+	query := url.Values{"id": {strconv.Itoa(userId)}}
+	var s user.SegmentsDto
+	code, err := c.do(ctx, request{method: http.MethodGet, path: "/segment/user", query: query}, &s)
+	if err != nil {
+		return nil, err
+	}
+	if code == http.StatusNoContent {
+		s = user.SegmentsDto{UserId: userId, Segments: []segment.SegmentDto{}}
+	}
+
+	if c.cache != nil {
+		c.cache.set(userId, &s)
+	}
+	return &s, nil
+}
+
+// EffectiveSegments returns the active segments of the user followed by the inherited ones, which have
+// InheritedFrom set. They are not cached.
+func (c *Client) EffectiveSegments(ctx context.Context, userId int) (*user.SegmentsDto, error) {
+	query := url.Values{"id": {strconv.Itoa(userId)}, "effective": {"true"}}
+	var s user.SegmentsDto
+	code, err := c.do(ctx, request{method: http.MethodGet, path: "/segment/user", query: query}, &s)
+	if err != nil {
+		return nil, err
+	}
+	if code == http.StatusNoContent {
+		s = user.SegmentsDto{UserId: userId, Segments: []segment.SegmentDto{}}
+	}
+	return &s, nil
+}
+
+// AddDelSegments adds the user to the segments from SegmentsAdd and removes it from the ones from SegmentsDel.
+// Nil lists are sent as empty ones.
+func (c *Client) AddDelSegments(ctx context.Context, s user.SegmentsAddDelDto) error {
+	if s.SegmentsAdd == nil {
+		s.SegmentsAdd = []user.SegmentAdd{}
+	}
+	if s.SegmentsDel == nil {
+		s.SegmentsDel = []string{}
+	}
+	if c.cache != nil {
+		defer c.cache.drop(s.UserId)
+	}
+
+	_, err := c.do(ctx, request{method: http.MethodPost, path: "/segment/user", body: s, idempotent: true}, nil)
+	return err
+}
+
+// UpdateSegmentTtl changes the lifetime of the membership of the user in the segment.
+// If the user is not in the segment, a StatusError with 404 is returned.
+func (c *Client) UpdateSegmentTtl(ctx context.Context, s user.SegmentTtlDto) error {
+	if c.cache != nil {
+		defer c.cache.drop(s.UserId)
+	}
+
+	_, err := c.do(ctx, request{method: http.MethodPatch, path: "/segment/user", body: s, idempotent: true}, nil)
+	return err
+}
+
+// UserAttributes returns the attributes of the user. If the user is unknown, a StatusError with 404 is returned.
+func (c *Client) UserAttributes(ctx context.Context, userId int) (*user.AttributesDto, error) {
+	query := url.Values{"id": {strconv.Itoa(userId)}}
+	var a user.AttributesDto
+	if _, err := c.do(ctx, request{method: http.MethodGet, path: "/user/attributes", query: query}, &a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// UpdateUserAttributes merges the attributes into the ones of the user, an attribute with the nil value is removed.
+// It returns the resulting attributes. The memberships of the user in the dynamic segments follow them.
+func (c *Client) UpdateUserAttributes(ctx context.Context, a user.AttributesDto) (*user.AttributesDto, error) {
+	if c.cache != nil {
+		defer c.cache.drop(a.UserId)
+	}
+
+	var res user.AttributesDto
+	if _, err := c.do(ctx, request{method: http.MethodPatch, path: "/user/attributes", body: a}, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
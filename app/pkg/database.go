@@ -2,13 +2,14 @@ package pkg
 
 import (
 	"context"
-	"fmt"
 	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	_ "github.com/lib/pq"
 	"main/internal/config"
 	"main/pkg/utils"
+	"net"
+	"net/url"
 	"time"
 )
 
@@ -20,14 +21,13 @@ type DBClient interface {
 }
 
 func NewPsqlClient(ctx context.Context, cfg *config.Config) (pool *pgxpool.Pool, err error) {
-	queryConnection := fmt.Sprintf(
-		"postgresql://%s:%s@%s:%s/%s?%s",
-		cfg.PostgresCfg.User,
-		cfg.PostgresCfg.Password,
-		cfg.PostgresCfg.Host,
-		cfg.PostgresCfg.Port,
-		cfg.PostgresCfg.DbName,
-	)
+	// The password may come from a secret, so it is escaped
+	queryConnection := (&url.URL{
+		Scheme: "postgresql",
+		User:   url.UserPassword(cfg.PostgresCfg.User, cfg.PostgresCfg.Password),
+		Host:   net.JoinHostPort(cfg.PostgresCfg.Host, cfg.PostgresCfg.Port),
+		Path:   cfg.PostgresCfg.DbName,
+	}).String()
 
 	err = utils.DoWithTries(func() error {
 
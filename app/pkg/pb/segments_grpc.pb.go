@@ -0,0 +1,422 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: segments.proto
+
+package pb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	SegmentService_CreateSegment_FullMethodName          = "/segments.v1.SegmentService/CreateSegment"
+	SegmentService_DeleteSegment_FullMethodName          = "/segments.v1.SegmentService/DeleteSegment"
+	SegmentService_ListSegments_FullMethodName           = "/segments.v1.SegmentService/ListSegments"
+	SegmentService_GetUserSegments_FullMethodName        = "/segments.v1.SegmentService/GetUserSegments"
+	SegmentService_ModifyUserSegments_FullMethodName     = "/segments.v1.SegmentService/ModifyUserSegments"
+	SegmentService_BulkModifyUserSegments_FullMethodName = "/segments.v1.SegmentService/BulkModifyUserSegments"
+	SegmentService_StartReport_FullMethodName            = "/segments.v1.SegmentService/StartReport"
+	SegmentService_GetReport_FullMethodName              = "/segments.v1.SegmentService/GetReport"
+)
+
+// SegmentServiceClient is the client API for SegmentService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type SegmentServiceClient interface {
+	// CreateSegment creates a segment, ALREADY_EXISTS if it exists.
+	CreateSegment(ctx context.Context, in *CreateSegmentRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	// DeleteSegment deletes a segment.
+	DeleteSegment(ctx context.Context, in *DeleteSegmentRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	// ListSegments returns the segments matching the filter ordered by slug.
+	ListSegments(ctx context.Context, in *ListSegmentsRequest, opts ...grpc.CallOption) (*ListSegmentsResponse, error)
+	// GetUserSegments returns the active segments of a user, an empty list if there are none.
+	GetUserSegments(ctx context.Context, in *GetUserSegmentsRequest, opts ...grpc.CallOption) (*UserSegments, error)
+	// ModifyUserSegments adds a user to segments and removes it from others at once.
+	ModifyUserSegments(ctx context.Context, in *ModifyUserSegmentsRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	// BulkModifyUserSegments applies a stream of modifications one by one. A failed modification
+	// does not stop the others, the failures are listed in the response.
+	BulkModifyUserSegments(ctx context.Context, opts ...grpc.CallOption) (SegmentService_BulkModifyUserSegmentsClient, error)
+	// StartReport starts the generation of the history report.
+	StartReport(ctx context.Context, in *StartReportRequest, opts ...grpc.CallOption) (*Report, error)
+	// GetReport returns the state of the report, NOT_FOUND if the task is unknown or expired.
+	GetReport(ctx context.Context, in *GetReportRequest, opts ...grpc.CallOption) (*Report, error)
+}
+
+type segmentServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewSegmentServiceClient(cc grpc.ClientConnInterface) SegmentServiceClient {
+	return &segmentServiceClient{cc}
+}
+
+func (c *segmentServiceClient) CreateSegment(ctx context.Context, in *CreateSegmentRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, SegmentService_CreateSegment_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *segmentServiceClient) DeleteSegment(ctx context.Context, in *DeleteSegmentRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, SegmentService_DeleteSegment_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *segmentServiceClient) ListSegments(ctx context.Context, in *ListSegmentsRequest, opts ...grpc.CallOption) (*ListSegmentsResponse, error) {
+	out := new(ListSegmentsResponse)
+	err := c.cc.Invoke(ctx, SegmentService_ListSegments_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *segmentServiceClient) GetUserSegments(ctx context.Context, in *GetUserSegmentsRequest, opts ...grpc.CallOption) (*UserSegments, error) {
+	out := new(UserSegments)
+	err := c.cc.Invoke(ctx, SegmentService_GetUserSegments_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *segmentServiceClient) ModifyUserSegments(ctx context.Context, in *ModifyUserSegmentsRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, SegmentService_ModifyUserSegments_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *segmentServiceClient) BulkModifyUserSegments(ctx context.Context, opts ...grpc.CallOption) (SegmentService_BulkModifyUserSegmentsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &SegmentService_ServiceDesc.Streams[0], SegmentService_BulkModifyUserSegments_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &segmentServiceBulkModifyUserSegmentsClient{stream}
+	return x, nil
+}
+
+type SegmentService_BulkModifyUserSegmentsClient interface {
+	Send(*ModifyUserSegmentsRequest) error
+	CloseAndRecv() (*BulkModifyUserSegmentsResponse, error)
+	grpc.ClientStream
+}
+
+type segmentServiceBulkModifyUserSegmentsClient struct {
+	grpc.ClientStream
+}
+
+func (x *segmentServiceBulkModifyUserSegmentsClient) Send(m *ModifyUserSegmentsRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *segmentServiceBulkModifyUserSegmentsClient) CloseAndRecv() (*BulkModifyUserSegmentsResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(BulkModifyUserSegmentsResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *segmentServiceClient) StartReport(ctx context.Context, in *StartReportRequest, opts ...grpc.CallOption) (*Report, error) {
+	out := new(Report)
+	err := c.cc.Invoke(ctx, SegmentService_StartReport_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *segmentServiceClient) GetReport(ctx context.Context, in *GetReportRequest, opts ...grpc.CallOption) (*Report, error) {
+	out := new(Report)
+	err := c.cc.Invoke(ctx, SegmentService_GetReport_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SegmentServiceServer is the server API for SegmentService service.
+// All implementations must embed UnimplementedSegmentServiceServer
+// for forward compatibility
+type SegmentServiceServer interface {
+	// CreateSegment creates a segment, ALREADY_EXISTS if it exists.
+	CreateSegment(context.Context, *CreateSegmentRequest) (*emptypb.Empty, error)
+	// DeleteSegment deletes a segment.
+	DeleteSegment(context.Context, *DeleteSegmentRequest) (*emptypb.Empty, error)
+	// ListSegments returns the segments matching the filter ordered by slug.
+	ListSegments(context.Context, *ListSegmentsRequest) (*ListSegmentsResponse, error)
+	// GetUserSegments returns the active segments of a user, an empty list if there are none.
+	GetUserSegments(context.Context, *GetUserSegmentsRequest) (*UserSegments, error)
+	// ModifyUserSegments adds a user to segments and removes it from others at once.
+	ModifyUserSegments(context.Context, *ModifyUserSegmentsRequest) (*emptypb.Empty, error)
+	// BulkModifyUserSegments applies a stream of modifications one by one. A failed modification
+	// does not stop the others, the failures are listed in the response.
+	BulkModifyUserSegments(SegmentService_BulkModifyUserSegmentsServer) error
+	// StartReport starts the generation of the history report.
+	StartReport(context.Context, *StartReportRequest) (*Report, error)
+	// GetReport returns the state of the report, NOT_FOUND if the task is unknown or expired.
+	GetReport(context.Context, *GetReportRequest) (*Report, error)
+	mustEmbedUnimplementedSegmentServiceServer()
+}
+
+// UnimplementedSegmentServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedSegmentServiceServer struct {
+}
+
+func (UnimplementedSegmentServiceServer) CreateSegment(context.Context, *CreateSegmentRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateSegment not implemented")
+}
+func (UnimplementedSegmentServiceServer) DeleteSegment(context.Context, *DeleteSegmentRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteSegment not implemented")
+}
+func (UnimplementedSegmentServiceServer) ListSegments(context.Context, *ListSegmentsRequest) (*ListSegmentsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListSegments not implemented")
+}
+func (UnimplementedSegmentServiceServer) GetUserSegments(context.Context, *GetUserSegmentsRequest) (*UserSegments, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUserSegments not implemented")
+}
+func (UnimplementedSegmentServiceServer) ModifyUserSegments(context.Context, *ModifyUserSegmentsRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ModifyUserSegments not implemented")
+}
+func (UnimplementedSegmentServiceServer) BulkModifyUserSegments(SegmentService_BulkModifyUserSegmentsServer) error {
+	return status.Errorf(codes.Unimplemented, "method BulkModifyUserSegments not implemented")
+}
+func (UnimplementedSegmentServiceServer) StartReport(context.Context, *StartReportRequest) (*Report, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method StartReport not implemented")
+}
+func (UnimplementedSegmentServiceServer) GetReport(context.Context, *GetReportRequest) (*Report, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetReport not implemented")
+}
+func (UnimplementedSegmentServiceServer) mustEmbedUnimplementedSegmentServiceServer() {}
+
+// UnsafeSegmentServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to SegmentServiceServer will
+// result in compilation errors.
+type UnsafeSegmentServiceServer interface {
+	mustEmbedUnimplementedSegmentServiceServer()
+}
+
+func RegisterSegmentServiceServer(s grpc.ServiceRegistrar, srv SegmentServiceServer) {
+	s.RegisterService(&SegmentService_ServiceDesc, srv)
+}
+
+func _SegmentService_CreateSegment_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateSegmentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SegmentServiceServer).CreateSegment(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SegmentService_CreateSegment_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SegmentServiceServer).CreateSegment(ctx, req.(*CreateSegmentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SegmentService_DeleteSegment_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteSegmentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SegmentServiceServer).DeleteSegment(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SegmentService_DeleteSegment_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SegmentServiceServer).DeleteSegment(ctx, req.(*DeleteSegmentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SegmentService_ListSegments_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListSegmentsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SegmentServiceServer).ListSegments(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SegmentService_ListSegments_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SegmentServiceServer).ListSegments(ctx, req.(*ListSegmentsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SegmentService_GetUserSegments_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetUserSegmentsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SegmentServiceServer).GetUserSegments(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SegmentService_GetUserSegments_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SegmentServiceServer).GetUserSegments(ctx, req.(*GetUserSegmentsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SegmentService_ModifyUserSegments_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ModifyUserSegmentsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SegmentServiceServer).ModifyUserSegments(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SegmentService_ModifyUserSegments_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SegmentServiceServer).ModifyUserSegments(ctx, req.(*ModifyUserSegmentsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SegmentService_BulkModifyUserSegments_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(SegmentServiceServer).BulkModifyUserSegments(&segmentServiceBulkModifyUserSegmentsServer{stream})
+}
+
+type SegmentService_BulkModifyUserSegmentsServer interface {
+	SendAndClose(*BulkModifyUserSegmentsResponse) error
+	Recv() (*ModifyUserSegmentsRequest, error)
+	grpc.ServerStream
+}
+
+type segmentServiceBulkModifyUserSegmentsServer struct {
+	grpc.ServerStream
+}
+
+func (x *segmentServiceBulkModifyUserSegmentsServer) SendAndClose(m *BulkModifyUserSegmentsResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *segmentServiceBulkModifyUserSegmentsServer) Recv() (*ModifyUserSegmentsRequest, error) {
+	m := new(ModifyUserSegmentsRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _SegmentService_StartReport_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StartReportRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SegmentServiceServer).StartReport(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SegmentService_StartReport_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SegmentServiceServer).StartReport(ctx, req.(*StartReportRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SegmentService_GetReport_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetReportRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SegmentServiceServer).GetReport(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SegmentService_GetReport_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SegmentServiceServer).GetReport(ctx, req.(*GetReportRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// SegmentService_ServiceDesc is the grpc.ServiceDesc for SegmentService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var SegmentService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "segments.v1.SegmentService",
+	HandlerType: (*SegmentServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "CreateSegment",
+			Handler:    _SegmentService_CreateSegment_Handler,
+		},
+		{
+			MethodName: "DeleteSegment",
+			Handler:    _SegmentService_DeleteSegment_Handler,
+		},
+		{
+			MethodName: "ListSegments",
+			Handler:    _SegmentService_ListSegments_Handler,
+		},
+		{
+			MethodName: "GetUserSegments",
+			Handler:    _SegmentService_GetUserSegments_Handler,
+		},
+		{
+			MethodName: "ModifyUserSegments",
+			Handler:    _SegmentService_ModifyUserSegments_Handler,
+		},
+		{
+			MethodName: "StartReport",
+			Handler:    _SegmentService_StartReport_Handler,
+		},
+		{
+			MethodName: "GetReport",
+			Handler:    _SegmentService_GetReport_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "BulkModifyUserSegments",
+			Handler:       _SegmentService_BulkModifyUserSegments_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "segments.proto",
+}
@@ -1,10 +1,7 @@
 package utils
 
 import (
-	"gopkg.in/yaml.v3"
-	"log"
-	"main/internal/config"
-	"os"
+	"log/slog"
 	"time"
 )
 
@@ -14,7 +11,7 @@ import (
 func DoWithTries(fn func() error, attempts int, delay time.Duration) (err error) {
 	for attempts > 0 {
 		if err = fn(); err != nil {
-			log.Println("Error to connect. Try again...")
+			slog.Warn("failed to connect, retrying", "attempts_left", attempts-1, "err", err)
 			time.Sleep(delay)
 			attempts--
 			continue
@@ -23,17 +20,3 @@ func DoWithTries(fn func() error, attempts int, delay time.Duration) (err error)
 	}
 	return err
 }
-
-func LoadConfig(path string) *config.Config {
-	confStream, err := os.ReadFile(path)
-	if err != nil {
-		log.Fatalln("Error to open read config file:", err)
-	}
-
-	conf := config.NewConfig()
-	err = yaml.Unmarshal(confStream, conf)
-	if err != nil {
-		log.Fatalln("Error to unmarshal data from config file:", err)
-	}
-	return conf
-}
@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ISODuration is a parsed ISO-8601 duration such as "P1Y2M3DT4H5M6S" or "P2W".
+// Calendar parts (years, months, days) are kept separately from the clock part,
+// so that adding "P1M" to a date moves it by a calendar month and not by 30 days.
+type ISODuration struct {
+	Years  int
+	Months int
+	Days   int
+	Clock  time.Duration
+}
+
+// ParseISODuration parses an ISO-8601 duration string.
+// Only non-negative integer values are accepted, except for seconds which may be fractional.
+// A duration whose parts do not fit into ISODuration is rejected.
+func ParseISODuration(s string) (ISODuration, error) {
+	var d ISODuration
+	if len(s) < 2 || s[0] != 'P' {
+		return d, fmt.Errorf("invalid ISO-8601 duration %q", s)
+	}
+
+	inTime := false
+	empty := true
+	rest := s[1:]
+	for len(rest) > 0 {
+		if rest[0] == 'T' {
+			if inTime {
+				return d, fmt.Errorf("invalid ISO-8601 duration %q", s)
+			}
+			inTime = true
+			rest = rest[1:]
+			if len(rest) == 0 {
+				return d, fmt.Errorf("invalid ISO-8601 duration %q", s)
+			}
+			continue
+		}
+
+		i := strings.IndexFunc(rest, func(r rune) bool {
+			return (r < '0' || r > '9') && r != '.'
+		})
+		if i <= 0 {
+			return d, fmt.Errorf("invalid ISO-8601 duration %q", s)
+		}
+		number, unit := rest[:i], rest[i]
+		rest = rest[i+1:]
+		empty = false
+
+		if unit == 'S' && inTime {
+			seconds, err := strconv.ParseFloat(number, 64)
+			if err != nil {
+				return d, fmt.Errorf("invalid ISO-8601 duration %q", s)
+			}
+			// The float comparison is conservative, math.MaxInt64 is rounded up to 2^63
+			ns := seconds * float64(time.Second)
+			if ns >= float64(math.MaxInt64-d.Clock) {
+				return d, fmt.Errorf("ISO-8601 duration %q is too long", s)
+			}
+			d.Clock += time.Duration(ns)
+			continue
+		}
+
+		n, err := strconv.Atoi(number)
+		if err != nil {
+			return d, fmt.Errorf("invalid ISO-8601 duration %q", s)
+		}
+		ok := true
+		switch {
+		case !inTime && unit == 'Y':
+			d.Years, ok = addPart(d.Years, n, 1)
+		case !inTime && unit == 'M':
+			d.Months, ok = addPart(d.Months, n, 1)
+		case !inTime && unit == 'W':
+			d.Days, ok = addPart(d.Days, n, 7)
+		case !inTime && unit == 'D':
+			d.Days, ok = addPart(d.Days, n, 1)
+		case inTime && unit == 'H':
+			d.Clock, ok = addClock(d.Clock, n, time.Hour)
+		case inTime && unit == 'M':
+			d.Clock, ok = addClock(d.Clock, n, time.Minute)
+		default:
+			return d, fmt.Errorf("invalid ISO-8601 duration %q", s)
+		}
+		if !ok {
+			return d, fmt.Errorf("ISO-8601 duration %q is too long", s)
+		}
+	}
+
+	if empty {
+		return d, fmt.Errorf("invalid ISO-8601 duration %q", s)
+	}
+	return d, nil
+}
+
+// addPart returns part + n*unit, or false if it overflows.
+func addPart(part, n, unit int) (int, bool) {
+	if n > (math.MaxInt-part)/unit {
+		return part, false
+	}
+	return part + n*unit, true
+}
+
+// addClock returns clock + n*unit, or false if it overflows.
+func addClock(clock time.Duration, n int, unit time.Duration) (time.Duration, bool) {
+	if int64(n) > int64((math.MaxInt64-clock)/unit) {
+		return clock, false
+	}
+	return clock + time.Duration(n)*unit, true
+}
+
+// IsZero reports whether the duration does not move a point in time at all.
+func (d ISODuration) IsZero() bool {
+	return d.Years == 0 && d.Months == 0 && d.Days == 0 && d.Clock == 0
+}
+
+// AddTo returns t moved forward by the duration.
+func (d ISODuration) AddTo(t time.Time) time.Time {
+	return t.AddDate(d.Years, d.Months, d.Days).Add(d.Clock)
+}
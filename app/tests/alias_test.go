@@ -0,0 +1,143 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"main/cmd/web/handlers"
+	"main/internal/cache"
+	redisRepoMock "main/internal/cache/mocks"
+	"main/internal/e"
+	historyRepoMock "main/internal/history/mocks"
+	"main/internal/segment"
+	segmentRepoMock "main/internal/segment/mocks"
+	"main/internal/user"
+	userRepoMock "main/internal/user/mocks"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRenameSegmentEndpoint(t *testing.T) {
+	ctx := context.Background()
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+
+	segmentRepo := segmentRepoMock.NewMockRepository(ctl)
+	cacheRepo := redisRepoMock.NewMockRepository(ctl)
+	handler := handlers.RenameSegment(segmentRepo, cacheRepo)
+
+	rename := func(body string) *httptest.ResponseRecorder {
+		key := handlers.UniqueKey()
+		cacheRepo.EXPECT().Exists(ctx, key).Return(int64(0), nil)
+		cacheRepo.EXPECT().Set(ctx, key, true, 60*time.Minute)
+		cacheRepo.EXPECT().AddToCache(ctx, key, gomock.Any(), 60*time.Minute)
+		req := httptest.NewRequest("POST", "/segment/rename", bytes.NewBufferString(body))
+		req.Header.Add("Idempotency-Key", key)
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	body := `{"slug": "AVITO_VOICE_MESAGES", "new_slug": "AVITO_VOICE_MESSAGES"}`
+	segmentRepo.EXPECT().Rename(ctx, "AVITO_VOICE_MESAGES", "AVITO_VOICE_MESSAGES").
+		Return(&segment.Segment{Id: 1, Slug: "AVITO_VOICE_MESSAGES", Status: segment.StatusActive}, nil)
+	// The cached segments of the members hold the old slug
+	segmentRepo.EXPECT().FindMembers(ctx, 1).Return([]int{5, 7}, nil)
+	cacheRepo.EXPECT().Del(ctx, cache.UserSegmentsKey(5), cache.UserSegmentsKey(7)).Return(nil)
+	rr := rename(body)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var resp segment.SegmentDto
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	assert.Equal(t, "AVITO_VOICE_MESSAGES", resp.Slug)
+
+	for err, code := range map[error]int{
+		&e.SegmentsNotFoundError{Slugs: []string{"AVITO_VOICE_MESAGES"}}: http.StatusNotFound,
+		&e.DuplicateSegmentError{SegmentName: "AVITO_VOICE_MESSAGES"}:    http.StatusConflict,
+	} {
+		segmentRepo.EXPECT().Rename(ctx, "AVITO_VOICE_MESAGES", "AVITO_VOICE_MESSAGES").Return(nil, err)
+		assert.Equal(t, code, rename(body).Code, err.Error())
+	}
+
+	for _, body := range []string{
+		`{"slug": "AVITO_VOICE_MESAGES"}`,
+		`{"new_slug": "AVITO_VOICE_MESSAGES"}`,
+		`{"slug": `,
+	} {
+		assert.Equal(t, http.StatusBadRequest, rename(body).Code, body)
+	}
+}
+
+func TestPatchSegmentByAliasEndpoint(t *testing.T) {
+	ctx := context.Background()
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+
+	segmentRepo := segmentRepoMock.NewMockRepository(ctl)
+	cacheRepo := redisRepoMock.NewMockRepository(ctl)
+
+	key := handlers.UniqueKey()
+	cacheRepo.EXPECT().Exists(ctx, key).Return(int64(0), nil)
+	cacheRepo.EXPECT().Set(ctx, key, true, 60*time.Minute)
+	cacheRepo.EXPECT().AddToCache(ctx, key, gomock.Any(), 60*time.Minute)
+	paused := segment.StatusPaused
+	segmentRepo.EXPECT().Update(ctx, "AVITO_VOICE_MESAGES", &segment.Patch{Status: &paused}).
+		Return(&segment.Segment{Id: 1, Slug: "AVITO_VOICE_MESSAGES", Status: paused}, nil)
+	segmentRepo.EXPECT().FindMembers(ctx, 1).Return([]int{}, nil)
+
+	req := httptest.NewRequest("PATCH", "/segment", bytes.NewBufferString(`{"slug": "AVITO_VOICE_MESAGES", "status": "paused"}`))
+	req.Header.Add("Idempotency-Key", key)
+	rr := httptest.NewRecorder()
+	handlers.Segments(segmentRepo, cacheRepo)(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "true", rr.Header().Get("Deprecation"))
+	assert.Equal(t, "AVITO_VOICE_MESAGES=AVITO_VOICE_MESSAGES", rr.Header().Get("X-Segment-Renamed"))
+}
+
+func TestAddDelByAliasEndpoint(t *testing.T) {
+	ctx := context.Background()
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+
+	userRepo := userRepoMock.NewMockRepository(ctl)
+	cacheRepo := redisRepoMock.NewMockRepository(ctl)
+	historyRepo := historyRepoMock.NewMockRepository(ctl)
+	handler := handlers.Users(userRepo, cacheRepo, historyRepo)
+
+	addDel := func(body string) *httptest.ResponseRecorder {
+		key := handlers.UniqueKey()
+		cacheRepo.EXPECT().Exists(ctx, key).Return(int64(0), nil)
+		cacheRepo.EXPECT().Set(ctx, key, true, 60*time.Minute)
+		cacheRepo.EXPECT().AddToCache(ctx, key, gomock.Any(), 60*time.Minute)
+		req := httptest.NewRequest("POST", "/segment/user", bytes.NewBufferString(body))
+		req.Header.Add("Idempotency-Key", key)
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	// The repository reports the deprecated slugs it has resolved
+	userRepo.EXPECT().AddDelSegments(ctx, gomock.Any(), historyRepo).
+		DoAndReturn(func(_ context.Context, s *user.SegmentsAddDelDto, _ interface{}) error {
+			s.Renamed = map[string]string{
+				"AVITO_VOICE_MESAGES": "AVITO_VOICE_MESSAGES",
+				"AVITO_DISCONT_30":    "AVITO_DISCOUNT_30",
+			}
+			return nil
+		})
+	rr := addDel(`{"user_id": 1, "add": ["AVITO_VOICE_MESAGES"], "del": ["AVITO_DISCONT_30"]}`)
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "true", rr.Header().Get("Deprecation"))
+	assert.Equal(t, "AVITO_DISCONT_30=AVITO_DISCOUNT_30,AVITO_VOICE_MESAGES=AVITO_VOICE_MESSAGES",
+		rr.Header().Get("X-Segment-Renamed"))
+
+	userRepo.EXPECT().AddDelSegments(ctx, gomock.Any(), historyRepo).Return(nil)
+	rr = addDel(`{"user_id": 1, "add": ["AVITO_VOICE_MESSAGES"], "del": []}`)
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Header().Get("Deprecation"))
+	assert.Empty(t, rr.Header().Get("X-Segment-Renamed"))
+}
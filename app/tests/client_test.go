@@ -0,0 +1,256 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"main/cmd/web/handlers"
+	"main/internal/cache"
+	redisRepoMock "main/internal/cache/mocks"
+	historyRepoMock "main/internal/history/mocks"
+	"main/internal/segment"
+	"main/internal/user"
+	userRepoMock "main/internal/user/mocks"
+	"main/pkg/client"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var fastRetry = client.Retry{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+func newTestClient(t *testing.T, h http.Handler, opts ...client.Option) *client.Client {
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	c, err := client.New(srv.URL, append([]client.Option{client.WithRetry(fastRetry)}, opts...)...)
+	require.NoError(t, err)
+	return c
+}
+
+func TestClientRetries(t *testing.T) {
+	ctx := context.Background()
+
+	// The attempts of a request are retried after 429 with the same Idempotency-Key
+	var keys []string
+	statuses := []int{http.StatusTooManyRequests, http.StatusTooManyRequests, http.StatusOK}
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "/segment", r.URL.Path)
+		body, _ := io.ReadAll(r.Body)
+		assert.JSONEq(t, `{"slug": "AVITO_VOICE_MESSAGES"}`, string(body))
+
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		w.WriteHeader(statuses[len(keys)-1])
+	}))
+	require.NoError(t, c.CreateSegment(ctx, segment.SegmentDto{Slug: "AVITO_VOICE_MESSAGES"}))
+	require.Len(t, keys, 3)
+	assert.NotEmpty(t, keys[0])
+	assert.Equal(t, keys[0], keys[1])
+	assert.Equal(t, keys[0], keys[2])
+
+	// The key differs between the requests
+	keys, statuses = nil, []int{http.StatusOK, http.StatusOK}
+	require.NoError(t, c.CreateSegment(ctx, segment.SegmentDto{Slug: "AVITO_VOICE_MESSAGES"}))
+	require.NoError(t, c.CreateSegment(ctx, segment.SegmentDto{Slug: "AVITO_VOICE_MESSAGES"}))
+	assert.NotEqual(t, keys[0], keys[1])
+
+	// The request with a key is retried after 5xx, the server releases the key of a failed attempt.
+	// A retry gets 409 while an earlier attempt is still being handled, and is repeated
+	keys, statuses = nil, []int{http.StatusBadGateway, http.StatusConflict, http.StatusOK}
+	require.NoError(t, c.CreateSegment(ctx, segment.SegmentDto{Slug: "AVITO_VOICE_MESSAGES"}))
+	assert.Len(t, keys, 3)
+
+	// The 409 of the first attempt is the result of the request
+	keys, statuses = nil, []int{http.StatusConflict}
+	err := c.CreateSegment(ctx, segment.SegmentDto{Slug: "AVITO_VOICE_MESSAGES"})
+	assert.True(t, client.IsStatus(err, http.StatusConflict), err)
+	assert.Len(t, keys, 1)
+
+	// The replayed response of an earlier attempt is the result of the request too
+	var attempts atomic.Int32
+	c = newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Idempotency-Replayed", "true")
+		w.WriteHeader(http.StatusConflict)
+	}))
+	err = c.CreateSegment(ctx, segment.SegmentDto{Slug: "AVITO_VOICE_MESSAGES"})
+	assert.True(t, client.IsStatus(err, http.StatusConflict), err)
+	assert.EqualValues(t, 2, attempts.Load())
+
+	// The last error is returned once the attempts are exhausted, other errors are not retried
+	attempts.Store(0)
+	c = newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		if r.URL.Path == "/segment" {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	_, err = c.UserSegments(ctx, 1)
+	assert.True(t, client.IsStatus(err, http.StatusInternalServerError), err)
+	assert.EqualValues(t, 3, attempts.Load())
+
+	attempts.Store(0)
+	err = c.CreateSegment(ctx, segment.SegmentDto{Slug: "AVITO_VOICE_MESSAGES"})
+	assert.True(t, client.IsStatus(err, http.StatusConflict), err)
+	assert.EqualValues(t, 1, attempts.Load())
+}
+
+func TestClientUserSegmentsCache(t *testing.T) {
+	ctx := context.Background()
+
+	var gets atomic.Int32
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Query().Get("id") == "1":
+			gets.Add(1)
+			w.Write([]byte(`{"user_id": 1, "segments": [{"slug": "AVITO_DISCOUNT_30"}]}`))
+		case r.Method == "GET":
+			gets.Add(1)
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == "POST":
+			var dto user.SegmentsAddDelDto
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&dto))
+			assert.True(t, dto.Valid())
+		}
+	}), client.WithCache(time.Minute, 10))
+
+	want := &user.SegmentsDto{UserId: 1, Segments: []segment.SegmentDto{{Slug: "AVITO_DISCOUNT_30"}}}
+	for i := 0; i < 2; i++ {
+		s, err := c.UserSegments(ctx, 1)
+		require.NoError(t, err)
+		assert.Equal(t, want, s)
+	}
+	assert.EqualValues(t, 1, gets.Load())
+
+	// A user without segments has an empty list
+	s, err := c.UserSegments(ctx, 2)
+	require.NoError(t, err)
+	assert.Equal(t, &user.SegmentsDto{UserId: 2, Segments: []segment.SegmentDto{}}, s)
+
+	// Changing the user through the client drops its cached segments
+	require.NoError(t, c.AddDelSegments(ctx, user.SegmentsAddDelDto{UserId: 1, SegmentsDel: []string{"AVITO_DISCOUNT_30"}}))
+	_, err = c.UserSegments(ctx, 1)
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, gets.Load())
+}
+
+func TestClientWaitReport(t *testing.T) {
+	ctx := context.Background()
+
+	var checks atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/report", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "2023-08-01 10:00", r.URL.Query().Get("date"))
+		w.Write([]byte(`{"task_id": "42"}`))
+	})
+	mux.HandleFunc("/report_check", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "42", r.URL.Query().Get("task_id"))
+		if checks.Add(1) < 3 {
+			w.Write([]byte(`{"status": "progress"}`))
+			return
+		}
+		w.Write([]byte(`{"status": "success", "link_to_file": "http://localhost:8080/download?id=42"}`))
+	})
+	mux.HandleFunc("/download", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "42", r.URL.Query().Get("id"))
+		w.Write([]byte("user,segment,operation,date\n"))
+	})
+	c := newTestClient(t, mux, client.WithPollInterval(time.Millisecond))
+
+	taskId, report, err := c.GenerateReport(ctx, time.Date(2023, 8, 1, 10, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	assert.Equal(t, "42", taskId)
+	assert.Equal(t, &client.Report{Status: client.ReportSuccess, LinkToFile: "http://localhost:8080/download?id=42"}, report)
+	assert.EqualValues(t, 3, checks.Load())
+
+	var buf bytes.Buffer
+	require.NoError(t, c.DownloadReport(ctx, taskId, &buf))
+	assert.Equal(t, "user,segment,operation,date\n", buf.String())
+
+	// A failed generation and a cancelled wait stop the polling
+	c = newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status": "fail"}`))
+	}))
+	_, err = c.WaitReport(ctx, "42")
+	assert.ErrorIs(t, err, client.ErrReportFailed)
+
+	c = newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status": "progress"}`))
+	}), client.WithPollInterval(time.Millisecond))
+	timeout, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	_, err = c.WaitReport(timeout, "42")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), err)
+}
+
+// TestClientHandlers checks the client against the real handlers.
+func TestClientHandlers(t *testing.T) {
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+
+	userRepo := userRepoMock.NewMockRepository(ctl)
+	historyRepo := historyRepoMock.NewMockRepository(ctl)
+	cacheRepo := redisRepoMock.NewMockRepository(ctl)
+
+	limits := handlers.NewRateLimits(100, 100)
+	c := newTestClient(t, handlers.RateLimiter(limits, handlers.Users(userRepo, cacheRepo, historyRepo)))
+	ctx := context.Background()
+
+	cacheRepo.EXPECT().Get(gomock.Any(), cache.UserSegmentsKey(1), gomock.Any()).Return(errors.New("redis: nil"))
+	userRepo.EXPECT().FindByUserId(gomock.Any(), 1).Return(&user.Segments{
+		UserId:   1,
+		Segments: []*segment.Segment{{Slug: "AVITO_DISCOUNT_30"}},
+	}, nil)
+	s, err := c.UserSegments(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, &user.SegmentsDto{UserId: 1, Segments: []segment.SegmentDto{{Slug: "AVITO_DISCOUNT_30"}}}, s)
+
+	days := 3
+	dto := user.SegmentsAddDelDto{
+		UserId:      1,
+		SegmentsAdd: []user.SegmentAdd{{Slug: "AVITO_VOICE_MESSAGES"}},
+		TtlDays:     &days,
+	}
+	cacheRepo.EXPECT().Exists(gomock.Any(), gomock.Any()).Return(int64(0), nil)
+	cacheRepo.EXPECT().Set(gomock.Any(), gomock.Any(), true, 60*time.Minute)
+	cacheRepo.EXPECT().AddToCache(gomock.Any(), gomock.Any(), gomock.Any(), 60*time.Minute)
+	userRepo.EXPECT().AddDelSegments(gomock.Any(), gomock.Any(), historyRepo).DoAndReturn(
+		func(_ context.Context, s *user.SegmentsAddDelDto, _ interface{}) error {
+			assert.Equal(t, dto.SegmentsAdd, s.SegmentsAdd)
+			assert.Equal(t, []string{}, s.SegmentsDel)
+			assert.Equal(t, &days, s.TtlDays)
+			return nil
+		})
+	require.NoError(t, c.AddDelSegments(ctx, dto))
+}
+
+func TestClientAdminToken(t *testing.T) {
+	var auth atomic.Value
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth.Store(r.Header.Get("Authorization"))
+		_, _ = w.Write([]byte("{}"))
+	}), client.WithAdminToken("0123456789abcdef"))
+	ctx := context.Background()
+
+	_, err := c.JobRuns(ctx, "", 0)
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer 0123456789abcdef", auth.Load())
+
+	// The token is not sent to the other routes
+	_, err = c.UserSegments(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "", auth.Load())
+}
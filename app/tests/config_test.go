@@ -0,0 +1,186 @@
+package tests
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"main/internal/config"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// env returns a lookup function over the given variables instead of the environment of the process.
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := vars[key]
+		return v, ok
+	}
+}
+
+func writeFile(t *testing.T, name, data string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(data), 0600))
+	return path
+}
+
+func TestLoadConfigLayers(t *testing.T) {
+	path := writeFile(t, "app.yaml", `
+app:
+  domain: "example.com"
+  port: "8080"
+  scheme: "http"
+db:
+  host: "db"
+  port: "5432"
+  name: "avito"
+  user: "postgres"
+redis:
+  host: "redis"
+  port: "6379"
+log:
+  level: "warn"
+`)
+
+	// Test defaults < YAML
+	cfg, err := config.Load([]string{"-config", path}, env(nil))
+	require.NoError(t, err)
+	assert.Equal(t, "8080", cfg.AppCfg.Port)
+	assert.Equal(t, "warn", cfg.LogCfg.Level)
+	assert.Equal(t, 30*time.Second, cfg.AppCfg.ShutdownTimeout)
+	assert.Equal(t, "", cfg.PostgresCfg.Password)
+
+	// Test YAML < env < flags
+	cfg, err = config.Load([]string{"-config", path, "-app-port", "9090"}, env(map[string]string{
+		"APP_PORT":             "8888",
+		"POSTGRES_PASSWORD":    "secret",
+		"POSTGRES_DB":          "segments",
+		"APP_SHUTDOWN_TIMEOUT": "1m",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, "9090", cfg.AppCfg.Port)
+	assert.Equal(t, "secret", cfg.PostgresCfg.Password)
+	assert.Equal(t, "segments", cfg.PostgresCfg.DbName)
+	assert.Equal(t, time.Minute, cfg.AppCfg.ShutdownTimeout)
+
+	// Test the password file takes precedence over the password
+	passwordFile := writeFile(t, "password", "from-file\n")
+	cfg, err = config.Load(nil, env(map[string]string{
+		"CONFIG_PATH":            path,
+		"POSTGRES_PASSWORD":      "secret",
+		"POSTGRES_PASSWORD_FILE": passwordFile,
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, "from-file", cfg.PostgresCfg.Password)
+
+	// Test the admin token file takes precedence over the token
+	tokenFile := writeFile(t, "token", "0123456789abcdef\n")
+	cfg, err = config.Load(nil, env(map[string]string{
+		"CONFIG_PATH":      path,
+		"ADMIN_TOKEN":      "fedcba9876543210",
+		"ADMIN_TOKEN_FILE": tokenFile,
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789abcdef", cfg.AdminCfg.Token)
+
+	// Test invalid values of env vars and flags
+	_, err = config.Load([]string{"-config", path}, env(map[string]string{"APP_SHUTDOWN_TIMEOUT": "soon"}))
+	assert.ErrorContains(t, err, "APP_SHUTDOWN_TIMEOUT")
+	_, err = config.Load([]string{"-config", path, "-unknown"}, env(nil))
+	assert.Error(t, err)
+	_, err = config.Load([]string{"-config", filepath.Join(t.TempDir(), "missing.yaml")}, env(nil))
+	assert.Error(t, err)
+}
+
+func TestValidateConfig(t *testing.T) {
+	cfg, err := config.LoadFile("../config/app.yaml")
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+
+	cfg.AppCfg.Port = "http"
+	cfg.PostgresCfg.Host = ""
+	cfg.JobsCfg.TtlCleanup.Cron = "every minute"
+	cfg.TracingCfg.Exporter = "otlp"
+	cfg.TracingCfg.Endpoint = ""
+	cfg.LogCfg.Format = "xml"
+	cfg.AdminCfg.Token = "secret"
+
+	err = cfg.Validate()
+	require.Error(t, err)
+	for _, msg := range []string{
+		`app.port: must be a port number, got "http"`,
+		"db.host: must not be empty",
+		`jobs.ttl_cleanup.cron: must be a five-field cron expression, got "every minute"`,
+		"tracing.endpoint: must not be empty for the otlp exporter",
+		`log.format: must be one of json, text, got "xml"`,
+		"admin.token: must be at least 16 characters",
+	} {
+		assert.Contains(t, err.Error(), msg)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	yaml := `
+app:
+  domain: "example.com"
+  port: "%s"
+  scheme: "http"
+db: {host: "db", port: "5432", name: "avito", user: "postgres"}
+redis: {host: "redis", port: "6379"}
+rate_limit: {rps: %d, burst: 10}
+log: {level: "%s"}
+`
+	path := writeFile(t, "app.yaml", fmt.Sprintf(yaml, "8080", 10, "info"))
+	load := func() (*config.Config, error) {
+		return config.Load([]string{"-config", path}, env(nil))
+	}
+	cfg, err := load()
+	require.NoError(t, err)
+
+	reloader := config.NewReloader(cfg, load)
+	var applied []*config.Config
+	reloader.Subscribe(func(cfg *config.Config) error {
+		applied = append(applied, cfg)
+		return nil
+	})
+
+	// Test the tunable settings are applied and the others are kept until restart
+	require.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf(yaml, "9090", 50, "debug")), 0600))
+	require.NoError(t, reloader.Reload())
+	require.Len(t, applied, 1)
+	assert.Equal(t, 50.0, applied[0].RateLimitCfg.Rps)
+	assert.Equal(t, "debug", applied[0].LogCfg.Level)
+	assert.Equal(t, "8080", applied[0].AppCfg.Port)
+	assert.Equal(t, 50.0, reloader.Current().RateLimitCfg.Rps)
+
+	// Test subscribers are not called if nothing tunable has changed
+	require.NoError(t, reloader.Reload())
+	assert.Len(t, applied, 1)
+
+	// Test an invalid config is rejected
+	require.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf(yaml, "9090", 0, "debug")), 0600))
+	err = reloader.Reload()
+	assert.ErrorContains(t, err, "rate_limit.rps: must be positive")
+	assert.Len(t, applied, 1)
+	assert.Equal(t, 50.0, reloader.Current().RateLimitCfg.Rps)
+
+	// Test a config which a subscriber failed to apply is not committed and is applied again on the next reload
+	failing := true
+	reloader.Subscribe(func(cfg *config.Config) error {
+		if failing {
+			return errors.New("limiter closed")
+		}
+		return nil
+	})
+	require.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf(yaml, "9090", 20, "debug")), 0600))
+	assert.ErrorContains(t, reloader.Reload(), "limiter closed")
+	assert.Len(t, applied, 2)
+	assert.Equal(t, 50.0, reloader.Current().RateLimitCfg.Rps)
+
+	failing = false
+	require.NoError(t, reloader.Reload())
+	assert.Len(t, applied, 3)
+	assert.Equal(t, 20.0, reloader.Current().RateLimitCfg.Rps)
+}
@@ -6,18 +6,22 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/alicebob/miniredis/v2"
 	"github.com/golang/mock/gomock"
+	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"main/cmd/web/handlers"
+	"main/internal/cache"
 	redisRepoMock "main/internal/cache/mocks"
+	"main/internal/config"
 	"main/internal/e"
+	"main/internal/history"
 	historyRepoMock "main/internal/history/mocks"
 	"main/internal/segment"
 	segmentRepoMock "main/internal/segment/mocks"
 	"main/internal/user"
 	userRepoMock "main/internal/user/mocks"
-	"main/pkg/utils"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -76,6 +80,7 @@ func TestCreateSegmentsEndpoint(t *testing.T) {
 		}
 		cacheRepo.EXPECT().Exists(ctx, key).Return(int64(0), nil)
 		cacheRepo.EXPECT().Set(ctx, key, true, 60*time.Minute)
+		cacheRepo.EXPECT().AddToCache(ctx, key, gomock.Any(), 60*time.Minute)
 
 		body := fmt.Sprintf(`{"slug": "%s"}`, tc.segmentName)
 		req := httptest.NewRequest("POST", "/segment", bytes.NewBuffer([]byte(body)))
@@ -93,14 +98,16 @@ func TestCreateSegmentsEndpoint(t *testing.T) {
 	)
 	cacheRepo.EXPECT().Exists(ctx, key).Return(int64(0), nil)
 	cacheRepo.EXPECT().Set(ctx, key, true, 60*time.Minute)
+	cacheRepo.EXPECT().AddToCache(ctx, key, gomock.Any(), 60*time.Minute)
 	req.Header.Add("Idempotency-Key", key)
 	rr := httptest.NewRecorder()
 	handlers.Segments(segmentRepo, cacheRepo)(rr, req)
 	assert.Equal(t, http.StatusBadRequest, rr.Code)
 
-	// Test idempotent key already exists
+	// Test idempotent key is being processed, the key holds a marker instead of the response
 	req = httptest.NewRequest("POST", "/segment", bytes.NewBuffer([]byte(`{"slug": "AVITO"}`)))
 	cacheRepo.EXPECT().Exists(ctx, key).Return(int64(1), nil)
+	cacheRepo.EXPECT().Get(ctx, key, gomock.Any()).Return(&json.UnmarshalTypeError{Value: "number"})
 	req.Header.Add("Idempotency-Key", key)
 	rr = httptest.NewRecorder()
 	handlers.Segments(segmentRepo, cacheRepo)(rr, req)
@@ -116,6 +123,7 @@ func TestCreateSegmentsEndpoint(t *testing.T) {
 	// Test segment already exists
 	cacheRepo.EXPECT().Exists(ctx, key).Return(int64(0), nil)
 	cacheRepo.EXPECT().Set(ctx, key, true, 60*time.Minute)
+	cacheRepo.EXPECT().AddToCache(ctx, key, gomock.Any(), 60*time.Minute)
 	segmentRepo.EXPECT().Create(
 		ctx,
 		&segment.Segment{Slug: "AVITO_DISCOUNT_50_test"},
@@ -134,6 +142,78 @@ func TestCreateSegmentsEndpoint(t *testing.T) {
 	assert.Equal(t, http.StatusConflict, rr.Code)
 }
 
+func TestCreateSegmentWithDefaultTtlEndpoint(t *testing.T) {
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+
+	segmentRepo := segmentRepoMock.NewMockRepository(ctl)
+	cacheRepo := redisRepoMock.NewMockRepository(ctl)
+
+	ctx := context.Background()
+	key := handlers.UniqueKey()
+
+	defaultTtl := "P7D"
+	cacheRepo.EXPECT().Exists(ctx, key).Return(int64(0), nil).Times(2)
+	cacheRepo.EXPECT().Set(ctx, key, true, 60*time.Minute).Times(2)
+	cacheRepo.EXPECT().AddToCache(ctx, key, gomock.Any(), 60*time.Minute).Times(2)
+	segmentRepo.EXPECT().Create(ctx, &segment.Segment{Slug: "AVITO_TRIAL_test", DefaultTtl: &defaultTtl})
+
+	req := httptest.NewRequest("POST", "/segment", bytes.NewBuffer([]byte(`{"slug": "AVITO_TRIAL_test", "default_ttl": "P7D"}`)))
+	req.Header.Add("Idempotency-Key", key)
+	rr := httptest.NewRecorder()
+	handlers.Segments(segmentRepo, cacheRepo)(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// Test default ttl is not an ISO-8601 duration
+	req = httptest.NewRequest("POST", "/segment", bytes.NewBuffer([]byte(`{"slug": "AVITO_TRIAL_test", "default_ttl": "7"}`)))
+	req.Header.Add("Idempotency-Key", key)
+	rr = httptest.NewRecorder()
+	handlers.Segments(segmentRepo, cacheRepo)(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestPatchSegmentDefaultTtlEndpoint(t *testing.T) {
+	ctx := context.Background()
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+
+	segmentRepo := segmentRepoMock.NewMockRepository(ctl)
+	cacheRepo := redisRepoMock.NewMockRepository(ctl)
+	patch := func(body string) int {
+		key := handlers.UniqueKey()
+		cacheRepo.EXPECT().Exists(ctx, key).Return(int64(0), nil)
+		cacheRepo.EXPECT().Set(ctx, key, true, 60*time.Minute)
+		cacheRepo.EXPECT().AddToCache(ctx, key, gomock.Any(), 60*time.Minute)
+		req := httptest.NewRequest("PATCH", "/segment", bytes.NewBufferString(body))
+		req.Header.Add("Idempotency-Key", key)
+		rr := httptest.NewRecorder()
+		handlers.Segments(segmentRepo, cacheRepo)(rr, req)
+		return rr.Code
+	}
+
+	defaultTtl := "P14D"
+	segmentRepo.EXPECT().Update(ctx, "AVITO_TRIAL_test", &segment.Patch{DefaultTtl: &defaultTtl}).
+		Return(&segment.Segment{Id: 1, Slug: "AVITO_TRIAL_test", DefaultTtl: &defaultTtl}, nil)
+	assert.Equal(t, http.StatusOK, patch(`{"slug": "AVITO_TRIAL_test", "default_ttl": "P14D"}`))
+	segmentRepo.EXPECT().Update(ctx, "AVITO_TRIAL_test", &segment.Patch{ClearDefaultTtl: true}).
+		Return(&segment.Segment{Id: 1, Slug: "AVITO_TRIAL_test"}, nil)
+	assert.Equal(t, http.StatusOK, patch(`{"slug": "AVITO_TRIAL_test", "clear_default_ttl": true}`))
+
+	// The members of a dynamic segment do not expire
+	rule := "AVITO_MOSCOW"
+	segmentRepo.EXPECT().Update(ctx, rule, &segment.Patch{DefaultTtl: &defaultTtl}).
+		Return(nil, &e.RuleSegmentError{Slugs: []string{rule}})
+	assert.Equal(t, http.StatusBadRequest, patch(`{"slug": "AVITO_MOSCOW", "default_ttl": "P14D"}`))
+
+	for _, body := range []string{
+		`{"slug": "AVITO_TRIAL_test", "default_ttl": "7"}`,
+		`{"slug": "AVITO_TRIAL_test", "default_ttl": "P0D"}`,
+		`{"slug": "AVITO_TRIAL_test", "default_ttl": "P14D", "clear_default_ttl": true}`,
+	} {
+		assert.Equal(t, http.StatusBadRequest, patch(body), body)
+	}
+}
+
 func TestDeleteSegmentsEndpoint(t *testing.T) {
 	ctx := context.Background()
 
@@ -179,6 +259,7 @@ func TestDeleteSegmentsEndpoint(t *testing.T) {
 	for _, tc := range testCases {
 		cacheRepo.EXPECT().Exists(ctx, key).Return(int64(0), nil)
 		cacheRepo.EXPECT().Set(ctx, key, true, 60*time.Minute)
+		cacheRepo.EXPECT().AddToCache(ctx, key, gomock.Any(), 60*time.Minute)
 		if tc.expectedStatus == http.StatusOK {
 			segmentRepo.EXPECT().Delete(ctx, tc.segmentName).Return(nil)
 		}
@@ -194,6 +275,7 @@ func TestDeleteSegmentsEndpoint(t *testing.T) {
 	// Test wrong body
 	cacheRepo.EXPECT().Exists(ctx, key).Return(int64(0), nil)
 	cacheRepo.EXPECT().Set(ctx, key, true, 60*time.Minute)
+	cacheRepo.EXPECT().AddToCache(ctx, key, gomock.Any(), 60*time.Minute)
 
 	req := httptest.NewRequest(
 		"DELETE",
@@ -205,8 +287,9 @@ func TestDeleteSegmentsEndpoint(t *testing.T) {
 	handlers.Segments(segmentRepo, cacheRepo)(rr, req)
 	assert.Equal(t, http.StatusBadRequest, rr.Code)
 
-	// Test Idempotency-Key already exists
+	// Test Idempotency-Key is being processed
 	cacheRepo.EXPECT().Exists(ctx, key).Return(int64(1), nil)
+	cacheRepo.EXPECT().Get(ctx, key, gomock.Any()).Return(&json.UnmarshalTypeError{Value: "number"})
 
 	req = httptest.NewRequest(
 		"DELETE",
@@ -322,6 +405,70 @@ func TestGetUserActiveSegmentsEndpoint(t *testing.T) {
 	assert.Equal(t, http.StatusNoContent, rr.Code)
 }
 
+func TestGetUserActiveSegmentsExpiryEndpoint(t *testing.T) {
+	ctx := context.Background()
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+
+	userRepo := userRepoMock.NewMockRepository(ctl)
+	historyRepo := historyRepoMock.NewMockRepository(ctl)
+	cacheRepo := redisRepoMock.NewMockRepository(ctl)
+
+	userId := 1
+	addedAt := time.Date(2023, 8, 30, 10, 0, 0, 0, time.UTC)
+	aliveUntil := time.Now().Add(72 * time.Hour).UTC().Truncate(time.Second)
+	expired := time.Now().Add(-time.Minute)
+
+	cacheRepo.EXPECT().Get(
+		ctx,
+		fmt.Sprintf("avito_user_%d", userId),
+		gomock.Any(),
+	).DoAndReturn(func(ctx context.Context, key string, result interface{}) error {
+		*result.(*user.Segments) = user.Segments{UserId: userId, Segments: []*segment.Segment{
+			{Id: 1, Slug: "AVITO_VOICE_MESSAGES", AddedAt: addedAt},
+			{Id: 2, Slug: "AVITO_DISCOUNT_30", AddedAt: addedAt, AliveUntil: &aliveUntil},
+			{Id: 3, Slug: "AVITO_DISCOUNT_50", AddedAt: addedAt, AliveUntil: &expired},
+		}}
+		return nil
+	})
+
+	req := httptest.NewRequest("GET", "/segment/user", nil)
+	req.URL.RawQuery = fmt.Sprintf("id=%d", userId)
+	rr := httptest.NewRecorder()
+	handlers.Users(userRepo, cacheRepo, historyRepo)(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var resp user.SegmentsDto
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	require.Len(t, resp.Segments, 2)
+
+	assert.Equal(t, "AVITO_VOICE_MESSAGES", resp.Segments[0].Slug)
+	assert.Equal(t, addedAt, resp.Segments[0].AddedAt.UTC())
+	assert.Nil(t, resp.Segments[0].AliveUntil)
+
+	assert.Equal(t, "AVITO_DISCOUNT_30", resp.Segments[1].Slug)
+	require.NotNil(t, resp.Segments[1].AliveUntil)
+	assert.Equal(t, aliveUntil, resp.Segments[1].AliveUntil.UTC())
+
+	// Test all cached memberships have expired
+	cacheRepo.EXPECT().Get(
+		ctx,
+		fmt.Sprintf("avito_user_%d", userId),
+		gomock.Any(),
+	).DoAndReturn(func(ctx context.Context, key string, result interface{}) error {
+		*result.(*user.Segments) = user.Segments{UserId: userId, Segments: []*segment.Segment{
+			{Id: 3, Slug: "AVITO_DISCOUNT_50", AddedAt: addedAt, AliveUntil: &expired},
+		}}
+		return nil
+	})
+
+	req = httptest.NewRequest("GET", "/segment/user", nil)
+	req.URL.RawQuery = fmt.Sprintf("id=%d", userId)
+	rr = httptest.NewRecorder()
+	handlers.Users(userRepo, cacheRepo, historyRepo)(rr, req)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+}
+
 func TestAddDelSegmentsEndpoint(t *testing.T) {
 	ctx := context.Background()
 	ctl := gomock.NewController(t)
@@ -376,12 +523,28 @@ func TestAddDelSegmentsEndpoint(t *testing.T) {
 			expectedStatus: http.StatusBadRequest,
 			body:           `{"user_id": -1, "add": ["AVITO_VOICE_MESSAGES_TEST"], "del": ["AVITO_DISCOUNT_50_TEST"]}`,
 		},
+		{
+			name:           "wrong_ttl",
+			expectedStatus: http.StatusBadRequest,
+			body:           `{"user_id": 4, "add": [{"slug": "AVITO_VOICE_MESSAGES_TEST", "ttl": "5 days"}], "del": []}`,
+		},
+		{
+			name:           "wrong_expires_at_in_past",
+			expectedStatus: http.StatusBadRequest,
+			body:           `{"user_id": 4, "add": [{"slug": "AVITO_VOICE_MESSAGES_TEST", "expires_at": "2020-01-01T00:00:00Z"}], "del": []}`,
+		},
+		{
+			name:           "wrong_ttl_and_ttl_days",
+			expectedStatus: http.StatusBadRequest,
+			body:           `{"user_id": 4, "add": ["AVITO_VOICE_MESSAGES_TEST"], "del": [], "ttl": "PT2H", "ttl_days": 1}`,
+		},
 	}
 
 	key := handlers.UniqueKey()
 	for _, tc := range testCasesErr {
 		cacheRepo.EXPECT().Exists(ctx, key).Return(int64(0), nil)
 		cacheRepo.EXPECT().Set(ctx, key, true, 60*time.Minute)
+		cacheRepo.EXPECT().AddToCache(ctx, key, gomock.Any(), 60*time.Minute)
 
 		req := httptest.NewRequest("POST", "/segment/user", bytes.NewBuffer([]byte(tc.body)))
 		req.Header.Add("Idempotency-Key", key)
@@ -390,30 +553,60 @@ func TestAddDelSegmentsEndpoint(t *testing.T) {
 		assert.Equal(t, tc.expectedStatus, rr.Code)
 	}
 
+	expiresAt := time.Date(2100, 1, 1, 12, 30, 0, 0, time.UTC)
+	ttl := "PT36H"
+	ttlDays := 3
 	testCasesOk := []struct {
 		name           string
 		expectedStatus int
-		add            []string
+		add            []user.SegmentAdd
 		del            []string
 	}{
 		{
 			name:           "add_1",
 			expectedStatus: http.StatusOK,
-			add:            []string{"AVITO_VOICE_MESSAGES_TEST"},
+			add:            []user.SegmentAdd{{Slug: "AVITO_VOICE_MESSAGES_TEST"}},
 			del:            []string{},
 		},
 		{
 			name:           "add_2",
 			expectedStatus: http.StatusOK,
-			add:            []string{"AVITO_VOICE_MESSAGES_TEST", "AVITO_DISCOUNT_50_TEST", "AVITO_DISCOUNT_30_TEST"},
+			add: []user.SegmentAdd{
+				{Slug: "AVITO_VOICE_MESSAGES_TEST"},
+				{Slug: "AVITO_DISCOUNT_50_TEST"},
+				{Slug: "AVITO_DISCOUNT_30_TEST"},
+			},
+			del: []string{},
+		},
+		{
+			name:           "add_with_expires_at",
+			expectedStatus: http.StatusOK,
+			add:            []user.SegmentAdd{{Slug: "AVITO_VOICE_MESSAGES_TEST", ExpiresAt: &expiresAt}},
 			del:            []string{},
 		},
+		{
+			name:           "add_with_ttl",
+			expectedStatus: http.StatusOK,
+			add:            []user.SegmentAdd{{Slug: "AVITO_VOICE_MESSAGES_TEST", Ttl: &ttl}},
+			del:            []string{},
+		},
+		{
+			name:           "add_with_ttl_per_slug",
+			expectedStatus: http.StatusOK,
+			add: []user.SegmentAdd{
+				{Slug: "AVITO_VOICE_MESSAGES_TEST", TtlDays: &ttlDays},
+				{Slug: "AVITO_DISCOUNT_50_TEST", Ttl: &ttl},
+				{Slug: "AVITO_DISCOUNT_30_TEST"},
+			},
+			del: []string{},
+		},
 	}
 
 	for _, tc := range testCasesOk {
 		userId := 1
 		cacheRepo.EXPECT().Exists(ctx, key).Return(int64(0), nil)
 		cacheRepo.EXPECT().Set(ctx, key, true, 60*time.Minute)
+		cacheRepo.EXPECT().AddToCache(ctx, key, gomock.Any(), 60*time.Minute)
 		s := user.SegmentsAddDelDto{
 			UserId:      userId,
 			SegmentsAdd: tc.add,
@@ -432,8 +625,9 @@ func TestAddDelSegmentsEndpoint(t *testing.T) {
 		assert.Equal(t, tc.expectedStatus, rr.Code)
 	}
 
-	// Test idempotent key already processed
+	// Test idempotent key is being processed
 	cacheRepo.EXPECT().Exists(ctx, key).Return(int64(1), nil)
+	cacheRepo.EXPECT().Get(ctx, key, gomock.Any()).Return(&json.UnmarshalTypeError{Value: "number"})
 	req := httptest.NewRequest("POST", "/segment/user", bytes.NewBuffer([]byte(`{}`)))
 	req.Header.Add("Idempotency-Key", key)
 	rr := httptest.NewRecorder()
@@ -441,6 +635,54 @@ func TestAddDelSegmentsEndpoint(t *testing.T) {
 	assert.Equal(t, http.StatusConflict, rr.Code)
 }
 
+func TestIdempotentKeyMiddlewareReplay(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	calls, status := 0, http.StatusInternalServerError
+	handler := handlers.IdempotentKeyMiddleware(cache.NewRepo(rdb, time.Minute),
+		func(w http.ResponseWriter, r *http.Request, _ interface{}, _ history.Repository) {
+			calls++
+			if status != http.StatusOK {
+				w.WriteHeader(status)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"slug":"AVITO_DISCOUNT_30"}`))
+		}, nil, nil)
+	do := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PATCH", "/segment", nil)
+		req.Header.Add("Idempotency-Key", key)
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	// The key of a failed request is released, so its retry is handled anew
+	key := handlers.UniqueKey()
+	assert.Equal(t, http.StatusInternalServerError, do(key).Code)
+	status = http.StatusOK
+	rr := do(key)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Header().Get("Idempotency-Replayed"))
+	assert.Equal(t, 2, calls)
+
+	// The repeated requests get the kept response without being handled again
+	rr = do(key)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "true", rr.Header().Get("Idempotency-Replayed"))
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"slug":"AVITO_DISCOUNT_30"}`, rr.Body.String())
+	assert.Equal(t, 2, calls)
+
+	// While the first request is being handled, the key holds a marker and the repeated requests get 409
+	key = handlers.UniqueKey()
+	require.NoError(t, mr.Set(key, "1"))
+	assert.Equal(t, http.StatusConflict, do(key).Code)
+	assert.Equal(t, 2, calls)
+}
+
 func TestRateLimiter(t *testing.T) {
 	handler := func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -448,7 +690,8 @@ func TestRateLimiter(t *testing.T) {
 
 	req := httptest.NewRequest("GET", "/test", nil)
 	rr := httptest.NewRecorder()
-	limiterMiddleware := handlers.RateLimiter(handler)
+	limits := handlers.NewRateLimits(10, 10)
+	limiterMiddleware := handlers.RateLimiter(limits, handler)
 
 	for i := 0; i < 10; i++ {
 		limiterMiddleware.ServeHTTP(rr, req)
@@ -459,6 +702,13 @@ func TestRateLimiter(t *testing.T) {
 
 	limiterMiddleware.ServeHTTP(rr, req)
 	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+
+	// Test the limits are changed at runtime
+	limits.Set(1000, 5)
+	time.Sleep(10 * time.Millisecond)
+	rr = httptest.NewRecorder()
+	limiterMiddleware.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
 }
 
 func TestReports(t *testing.T) {
@@ -468,7 +718,8 @@ func TestReports(t *testing.T) {
 	historyRepo := historyRepoMock.NewMockRepository(ctl)
 	cacheRepo := redisRepoMock.NewMockRepository(ctl)
 
-	cfg := utils.LoadConfig("../config/app.yaml")
+	cfg, err := config.LoadFile("../config/app.yaml")
+	require.NoError(t, err)
 
 	testCases := []struct {
 		name           string
@@ -635,3 +886,90 @@ func TestDownloadFile(t *testing.T) {
 		assert.Equal(t, tc.expectedStatus, rr.Code)
 	}
 }
+
+func TestUpdateSegmentTtlEndpoint(t *testing.T) {
+	ctx := context.Background()
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+
+	userRepo := userRepoMock.NewMockRepository(ctl)
+	cacheRepo := redisRepoMock.NewMockRepository(ctl)
+	historyRepo := historyRepoMock.NewMockRepository(ctl)
+
+	expiresAt := time.Date(2100, 1, 1, 12, 30, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name           string
+		expectedStatus int
+		body           string
+		aliveUntil     interface{}
+		err            error
+	}{
+		{
+			name:           "set_expires_at",
+			expectedStatus: http.StatusOK,
+			body:           `{"user_id": 1, "slug": "AVITO_VOICE_MESSAGES_TEST", "expires_at": "2100-01-01T12:30:00Z"}`,
+			aliveUntil:     &expiresAt,
+		},
+		{
+			name:           "set_ttl",
+			expectedStatus: http.StatusOK,
+			body:           `{"user_id": 1, "slug": "AVITO_VOICE_MESSAGES_TEST", "ttl": "P1D"}`,
+			aliveUntil:     gomock.Not(gomock.Nil()),
+		},
+		{
+			name:           "clear",
+			expectedStatus: http.StatusOK,
+			body:           `{"user_id": 1, "slug": "AVITO_VOICE_MESSAGES_TEST", "clear": true}`,
+			aliveUntil:     gomock.Nil(),
+		},
+		{
+			name:           "membership_not_found",
+			expectedStatus: http.StatusNotFound,
+			body:           `{"user_id": 1, "slug": "AVITO_VOICE_MESSAGES_TEST", "clear": true}`,
+			aliveUntil:     gomock.Nil(),
+			err:            &e.MembershipNotFoundError{UserId: 1, Slug: "AVITO_VOICE_MESSAGES_TEST"},
+		},
+		{
+			name:           "nothing_to_change",
+			expectedStatus: http.StatusBadRequest,
+			body:           `{"user_id": 1, "slug": "AVITO_VOICE_MESSAGES_TEST"}`,
+		},
+		{
+			name:           "clear_and_ttl",
+			expectedStatus: http.StatusBadRequest,
+			body:           `{"user_id": 1, "slug": "AVITO_VOICE_MESSAGES_TEST", "ttl": "P1D", "clear": true}`,
+		},
+		{
+			name:           "without_slug",
+			expectedStatus: http.StatusBadRequest,
+			body:           `{"user_id": 1, "ttl": "P1D"}`,
+		},
+	}
+
+	key := handlers.UniqueKey()
+	for _, tc := range testCases {
+		cacheRepo.EXPECT().Exists(ctx, key).Return(int64(0), nil)
+		cacheRepo.EXPECT().Set(ctx, key, true, 60*time.Minute)
+		cacheRepo.EXPECT().AddToCache(ctx, key, gomock.Any(), 60*time.Minute)
+		if tc.aliveUntil != nil {
+			userRepo.EXPECT().UpdateAliveUntil(ctx, 1, "AVITO_VOICE_MESSAGES_TEST", tc.aliveUntil).Return(tc.err)
+		}
+		if tc.expectedStatus == http.StatusOK {
+			cacheRepo.EXPECT().Del(ctx, "avito_user_1")
+		}
+
+		req := httptest.NewRequest("PATCH", "/segment/user", bytes.NewBuffer([]byte(tc.body)))
+		req.Header.Add("Idempotency-Key", key)
+		rr := httptest.NewRecorder()
+		handlers.Users(userRepo, cacheRepo, historyRepo)(rr, req)
+		assert.Equal(t, tc.expectedStatus, rr.Code, tc.name)
+	}
+}
+
+func TestWaitReports(t *testing.T) {
+	// No reports are being generated, so there is nothing to wait for
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, handlers.WaitReports(ctx))
+}
@@ -0,0 +1,124 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"main/cmd/web/handlers"
+	redisRepoMock "main/internal/cache/mocks"
+	"main/internal/e"
+	historyRepoMock "main/internal/history/mocks"
+	"main/internal/segment"
+	segmentRepoMock "main/internal/segment/mocks"
+	"main/internal/user"
+	userRepoMock "main/internal/user/mocks"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestExclusionGroupDto(t *testing.T) {
+	group := "discounts"
+	empty := ""
+	rule := `city == "Moscow"`
+
+	assert.True(t, (&segment.SegmentDto{Slug: "AVITO_DISCOUNT_30", ExclusionGroup: &group}).Valid())
+	assert.False(t, (&segment.SegmentDto{Slug: "AVITO_DISCOUNT_30", ExclusionGroup: &empty}).Valid())
+	// The members of a dynamic segment are defined by the rule only
+	assert.False(t, (&segment.SegmentDto{Slug: "AVITO_MOSCOW", ExclusionGroup: &group, Rule: &rule}).Valid())
+
+	assert.True(t, (&segment.SegmentPatchDto{Slug: "AVITO_DISCOUNT_30", ExclusionGroup: &group}).Valid())
+	assert.True(t, (&segment.SegmentPatchDto{Slug: "AVITO_DISCOUNT_30", ClearExclusionGroup: true}).Valid())
+	assert.False(t, (&segment.SegmentPatchDto{Slug: "AVITO_DISCOUNT_30"}).Valid())
+	assert.False(t, (&segment.SegmentPatchDto{Slug: "AVITO_DISCOUNT_30", ExclusionGroup: &group, ClearExclusionGroup: true}).Valid())
+	assert.False(t, (&segment.SegmentPatchDto{Slug: "AVITO_DISCOUNT_30", ExclusionGroup: &empty}).Valid())
+	assert.False(t, (&segment.SegmentPatchDto{ExclusionGroup: &group}).Valid())
+
+	dto := user.SegmentsAddDelDto{UserId: 1, SegmentsAdd: []user.SegmentAdd{{Slug: "AVITO_DISCOUNT_30"}}, SegmentsDel: []string{}}
+	for _, onConflict := range []string{"", user.OnConflictReject, user.OnConflictSwap} {
+		dto.OnConflict = onConflict
+		assert.True(t, dto.Valid(), onConflict)
+	}
+	dto.OnConflict = "replace"
+	assert.False(t, dto.Valid())
+}
+
+func TestPatchSegmentEndpoint(t *testing.T) {
+	ctx := context.Background()
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+
+	segmentRepo := segmentRepoMock.NewMockRepository(ctl)
+	cacheRepo := redisRepoMock.NewMockRepository(ctl)
+	handler := handlers.Segments(segmentRepo, cacheRepo)
+
+	patch := func(body string) int {
+		key := handlers.UniqueKey()
+		cacheRepo.EXPECT().Exists(ctx, key).Return(int64(0), nil)
+		cacheRepo.EXPECT().Set(ctx, key, true, 60*time.Minute)
+		cacheRepo.EXPECT().AddToCache(ctx, key, gomock.Any(), 60*time.Minute)
+		req := httptest.NewRequest("PATCH", "/segment", bytes.NewBufferString(body))
+		req.Header.Add("Idempotency-Key", key)
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr.Code
+	}
+
+	group := "discounts"
+	body := `{"slug": "AVITO_DISCOUNT_30", "exclusion_group": "discounts"}`
+	segmentRepo.EXPECT().Update(ctx, "AVITO_DISCOUNT_30", &segment.Patch{ExclusionGroup: &group}).
+		Return(&segment.Segment{Slug: "AVITO_DISCOUNT_30", ExclusionGroup: &group}, nil)
+	assert.Equal(t, http.StatusOK, patch(body))
+
+	segmentRepo.EXPECT().Update(ctx, "AVITO_DISCOUNT_30", &segment.Patch{ClearExclusionGroup: true}).
+		Return(&segment.Segment{Slug: "AVITO_DISCOUNT_30"}, nil)
+	assert.Equal(t, http.StatusOK, patch(`{"slug": "AVITO_DISCOUNT_30", "clear_exclusion_group": true}`))
+
+	for err, code := range map[error]int{
+		&e.SegmentsNotFoundError{Slugs: []string{"AVITO_DISCOUNT_30"}}:                                     http.StatusNotFound,
+		&e.RuleSegmentError{Slugs: []string{"AVITO_DISCOUNT_30"}}:                                          http.StatusBadRequest,
+		&e.SegmentInExperimentError{Slug: "AVITO_DISCOUNT_30", Experiment: "AVITO_CHECKOUT"}:               http.StatusConflict,
+		&e.ExclusionConflictError{Group: group, Slugs: []string{"AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"}}: http.StatusConflict,
+	} {
+		segmentRepo.EXPECT().Update(ctx, "AVITO_DISCOUNT_30", &segment.Patch{ExclusionGroup: &group}).Return(nil, err)
+		assert.Equal(t, code, patch(body), err.Error())
+	}
+
+	for _, body := range []string{
+		`{"slug": "AVITO_DISCOUNT_30"}`,
+		`{"slug": "AVITO_DISCOUNT_30", "exclusion_group": ""}`,
+		`{"slug": "AVITO_DISCOUNT_30", "exclusion_group": "discounts", "clear_exclusion_group": true}`,
+	} {
+		assert.Equal(t, http.StatusBadRequest, patch(body), body)
+	}
+}
+
+func TestAddDelExclusionConflictEndpoint(t *testing.T) {
+	ctx := context.Background()
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+
+	userRepo := userRepoMock.NewMockRepository(ctl)
+	cacheRepo := redisRepoMock.NewMockRepository(ctl)
+	historyRepo := historyRepoMock.NewMockRepository(ctl)
+
+	key := handlers.UniqueKey()
+	cacheRepo.EXPECT().Exists(ctx, key).Return(int64(0), nil)
+	cacheRepo.EXPECT().Set(ctx, key, true, 60*time.Minute)
+	cacheRepo.EXPECT().AddToCache(ctx, key, gomock.Any(), 60*time.Minute)
+	userRepo.EXPECT().AddDelSegments(ctx, &user.SegmentsAddDelDto{
+		UserId:      1,
+		SegmentsAdd: []user.SegmentAdd{{Slug: "AVITO_DISCOUNT_50"}},
+		SegmentsDel: []string{},
+		OnConflict:  user.OnConflictReject,
+	}, historyRepo).Return(&e.ExclusionConflictError{Group: "discounts", Slugs: []string{"AVITO_DISCOUNT_30"}})
+
+	req := httptest.NewRequest("POST", "/segment/user", bytes.NewBufferString(
+		`{"user_id": 1, "add": ["AVITO_DISCOUNT_50"], "del": [], "on_conflict": "reject"}`))
+	req.Header.Add("Idempotency-Key", key)
+	rr := httptest.NewRecorder()
+	handlers.Users(userRepo, cacheRepo, historyRepo)(rr, req)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+}
@@ -0,0 +1,300 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"main/cmd/web/handlers"
+	redisRepoMock "main/internal/cache/mocks"
+	"main/internal/e"
+	"main/internal/experiment"
+	experimentRepoMock "main/internal/experiment/mocks"
+	"main/internal/history"
+	historyRepoMock "main/internal/history/mocks"
+	"main/internal/migrate"
+	"main/internal/segment"
+	segmentRepoMock "main/internal/segment/mocks"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestExperimentAssign(t *testing.T) {
+	ex := &experiment.Experiment{
+		Slug: "AVITO_CHECKOUT",
+		Variants: []*experiment.Variant{
+			{Name: "control", Weight: 50},
+			{Name: "a", Weight: 30},
+			{Name: "b", Weight: 20},
+		},
+	}
+
+	counts := make(map[string]int)
+	for userId := 1; userId <= 10000; userId++ {
+		v := ex.Assign(userId)
+		require.NotNil(t, v)
+		// The assignment is sticky
+		assert.Same(t, v, ex.Assign(userId))
+		counts[v.Name]++
+	}
+	assert.InDelta(t, 5000, counts["control"], 300)
+	assert.InDelta(t, 3000, counts["a"], 300)
+	assert.InDelta(t, 2000, counts["b"], 300)
+
+	// Another experiment splits the users independently
+	other := &experiment.Experiment{Slug: "AVITO_SEARCH", Variants: ex.Variants}
+	same := 0
+	for userId := 1; userId <= 1000; userId++ {
+		if ex.Assign(userId) == other.Assign(userId) {
+			same++
+		}
+	}
+	assert.Less(t, same, 1000)
+
+	assert.Nil(t, (&experiment.Experiment{Slug: "AVITO_EMPTY"}).Assign(1))
+}
+
+func TestExperimentActive(t *testing.T) {
+	ex := &experiment.Experiment{
+		Slug: "AVITO_CHECKOUT",
+		Variants: []*experiment.Variant{
+			{Name: "control", Weight: 50, Status: segment.StatusActive},
+			{Name: "a", Weight: 30, Status: segment.StatusPaused},
+			{Name: "b", Weight: 20, Status: segment.StatusArchived},
+		},
+	}
+
+	// The users are assigned only to the variants with active segments
+	active := ex.Active()
+	assert.Equal(t, "AVITO_CHECKOUT", active.Slug)
+	require.Len(t, active.Variants, 1)
+	for userId := 1; userId <= 100; userId++ {
+		assert.Same(t, ex.Variants[0], active.Assign(userId))
+	}
+	assert.Len(t, ex.Variants, 3)
+}
+
+func TestExperimentDto(t *testing.T) {
+	dto := experiment.ExperimentDto{
+		Slug: "AVITO_CHECKOUT",
+		Variants: []experiment.VariantDto{
+			{Name: "control", Weight: 1},
+			{Name: "b", Segment: "AVITO_NEW_CHECKOUT", Weight: 1},
+		},
+	}
+	require.True(t, dto.Valid())
+	ex := experiment.NewExperiment(&dto)
+	assert.Equal(t, "AVITO_CHECKOUT_CONTROL", ex.Variants[0].Segment)
+	assert.Equal(t, "AVITO_NEW_CHECKOUT", ex.Variants[1].Segment)
+
+	for name, dto := range map[string]experiment.ExperimentDto{
+		"without_slug":      {Variants: dto.Variants},
+		"single_variant":    {Slug: "AVITO_CHECKOUT", Variants: dto.Variants[:1]},
+		"duplicate_name":    {Slug: "AVITO_CHECKOUT", Variants: []experiment.VariantDto{{Name: "a", Weight: 1}, {Name: "a", Segment: "X", Weight: 1}}},
+		"duplicate_segment": {Slug: "AVITO_CHECKOUT", Variants: []experiment.VariantDto{{Name: "a", Weight: 1}, {Name: "b", Segment: "AVITO_CHECKOUT_A", Weight: 1}}},
+		"zero_weight":       {Slug: "AVITO_CHECKOUT", Variants: []experiment.VariantDto{{Name: "a", Weight: 1}, {Name: "b"}}},
+		"without_name":      {Slug: "AVITO_CHECKOUT", Variants: []experiment.VariantDto{{Name: "a", Weight: 1}, {Weight: 1}}},
+	} {
+		assert.False(t, dto.Valid(), name)
+	}
+}
+
+func TestExperimentsEndpoint(t *testing.T) {
+	ctx := context.Background()
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+
+	experimentRepo := experimentRepoMock.NewMockRepository(ctl)
+	handler := handlers.Experiments(experimentRepo)
+
+	createdAt := time.Date(2023, 8, 30, 6, 31, 0, 0, time.UTC)
+	experimentRepo.EXPECT().Create(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, ex *experiment.Experiment) error {
+		assert.Equal(t, "AVITO_CHECKOUT", ex.Slug)
+		require.Len(t, ex.Variants, 2)
+		assert.Equal(t, experiment.Variant{Name: "control", Segment: "AVITO_CHECKOUT_CONTROL", Weight: 90}, *ex.Variants[0])
+		ex.Id, ex.CreatedAt = 1, createdAt
+		return nil
+	})
+	body := `{"slug": "AVITO_CHECKOUT", "variants": [{"name": "control", "weight": 90}, {"name": "b", "weight": 10}]}`
+	rr := httptest.NewRecorder()
+	handler(rr, httptest.NewRequest("POST", "/experiment", bytes.NewBufferString(body)))
+	require.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, "application/json", rr.Result().Header.Get("Content-Type"))
+	var dto experiment.ExperimentDto
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &dto))
+	assert.Equal(t, "AVITO_CHECKOUT_B", dto.Variants[1].Segment)
+	assert.Equal(t, createdAt, *dto.CreatedAt)
+
+	experimentRepo.EXPECT().Create(ctx, gomock.Any()).Return(&e.DuplicateSegmentError{SegmentName: "AVITO_CHECKOUT_B"})
+	rr = httptest.NewRecorder()
+	handler(rr, httptest.NewRequest("POST", "/experiment", bytes.NewBufferString(body)))
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	rr = httptest.NewRecorder()
+	handler(rr, httptest.NewRequest("POST", "/experiment", bytes.NewBufferString(`{"slug": "AVITO_CHECKOUT", "variants": []}`)))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	experimentRepo.EXPECT().FindAll(ctx).Return([]*experiment.Experiment{{
+		Id:        1,
+		Slug:      "AVITO_CHECKOUT",
+		Variants:  []*experiment.Variant{{Name: "control", Segment: "AVITO_CHECKOUT_CONTROL", Weight: 1}},
+		CreatedAt: createdAt,
+	}}, nil)
+	rr = httptest.NewRecorder()
+	handler(rr, httptest.NewRequest("GET", "/experiment", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var list experiment.ExperimentsDto
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &list))
+	require.Len(t, list.Experiments, 1)
+	assert.Equal(t, "AVITO_CHECKOUT", list.Experiments[0].Slug)
+
+	experimentRepo.EXPECT().Delete(ctx, "AVITO_CHECKOUT").Return(nil)
+	rr = httptest.NewRecorder()
+	handler(rr, httptest.NewRequest("DELETE", "/experiment?slug=AVITO_CHECKOUT", nil))
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+
+	experimentRepo.EXPECT().Delete(ctx, "AVITO_UNKNOWN").Return(&e.ExperimentNotFoundError{Slug: "AVITO_UNKNOWN"})
+	rr = httptest.NewRecorder()
+	handler(rr, httptest.NewRequest("DELETE", "/experiment?slug=AVITO_UNKNOWN", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestAllocateEndpoint(t *testing.T) {
+	ctx := context.Background()
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+
+	experimentRepo := experimentRepoMock.NewMockRepository(ctl)
+	cacheRepo := redisRepoMock.NewMockRepository(ctl)
+	historyRepo := historyRepoMock.NewMockRepository(ctl)
+	handler := handlers.Allocate(experimentRepo, cacheRepo, historyRepo)
+
+	// The first exposure adds the user to the segment, so the cached segments are dropped
+	allocation := &experiment.Allocation{
+		Experiment:    "AVITO_CHECKOUT",
+		UserId:        1,
+		Variant:       "b",
+		Segment:       "AVITO_CHECKOUT_B",
+		FirstExposure: true,
+	}
+	experimentRepo.EXPECT().Allocate(ctx, "AVITO_CHECKOUT", 1, historyRepo).Return(allocation, nil)
+	cacheRepo.EXPECT().Del(ctx, "avito_user_1")
+	rr := httptest.NewRecorder()
+	handler(rr, httptest.NewRequest("POST", "/experiment/allocate", bytes.NewBufferString(`{"experiment": "AVITO_CHECKOUT", "user_id": 1}`)))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var dto experiment.AllocationDto
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &dto))
+	assert.Equal(t, experiment.NewAllocationDto(allocation), dto)
+
+	// The next exposures return the same variant without changes
+	second := *allocation
+	second.FirstExposure = false
+	experimentRepo.EXPECT().Allocate(ctx, "AVITO_CHECKOUT", 1, historyRepo).Return(&second, nil)
+	rr = httptest.NewRecorder()
+	handler(rr, httptest.NewRequest("POST", "/experiment/allocate", bytes.NewBufferString(`{"experiment": "AVITO_CHECKOUT", "user_id": 1}`)))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &dto))
+	assert.False(t, dto.FirstExposure)
+
+	// An experiment without active variants takes no users
+	for _, err := range []error{
+		&e.InactiveExperimentError{Slug: "AVITO_CHECKOUT"},
+		&e.ArchivedSegmentError{Slugs: []string{"AVITO_CHECKOUT_A", "AVITO_CHECKOUT_B"}},
+	} {
+		experimentRepo.EXPECT().Allocate(ctx, "AVITO_CHECKOUT", 2, historyRepo).Return(nil, err)
+		rr = httptest.NewRecorder()
+		handler(rr, httptest.NewRequest("POST", "/experiment/allocate", bytes.NewBufferString(`{"experiment": "AVITO_CHECKOUT", "user_id": 2}`)))
+		assert.Equal(t, http.StatusConflict, rr.Code, err)
+	}
+
+	experimentRepo.EXPECT().Allocate(ctx, "AVITO_CHECKOUT", 1000, historyRepo).Return(nil, &e.UserNotFoundError{UserId: 1000})
+	rr = httptest.NewRecorder()
+	handler(rr, httptest.NewRequest("POST", "/experiment/allocate", bytes.NewBufferString(`{"experiment": "AVITO_CHECKOUT", "user_id": 1000}`)))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = httptest.NewRecorder()
+	handler(rr, httptest.NewRequest("POST", "/experiment/allocate", bytes.NewBufferString(`{"user_id": 1}`)))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestDeleteExperimentSegmentEndpoint(t *testing.T) {
+	ctx := context.Background()
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+
+	segmentRepo := segmentRepoMock.NewMockRepository(ctl)
+	cacheRepo := redisRepoMock.NewMockRepository(ctl)
+
+	key := handlers.UniqueKey()
+	cacheRepo.EXPECT().Exists(ctx, key).Return(int64(0), nil)
+	cacheRepo.EXPECT().Set(ctx, key, true, 60*time.Minute)
+	cacheRepo.EXPECT().AddToCache(ctx, key, gomock.Any(), 60*time.Minute)
+	segmentRepo.EXPECT().Delete(ctx, "AVITO_CHECKOUT_B").
+		Return(&e.SegmentInExperimentError{Slug: "AVITO_CHECKOUT_B", Experiment: "AVITO_CHECKOUT"})
+
+	req := httptest.NewRequest("DELETE", "/segment", bytes.NewBufferString(`{"slug": "AVITO_CHECKOUT_B"}`))
+	req.Header.Add("Idempotency-Key", key)
+	rr := httptest.NewRecorder()
+	handlers.Segments(segmentRepo, cacheRepo)(rr, req)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+}
+
+func TestAllocateWithDatabase(t *testing.T) {
+	pool, _ := newTestDatabase(t)
+	ctx := context.Background()
+
+	m, err := migrate.NewMigrator(pool)
+	require.NoError(t, err)
+	_, err = m.Up(ctx)
+	require.NoError(t, err)
+
+	repo := experiment.NewRepo(pool)
+	ex := &experiment.Experiment{
+		Slug:     "AVITO_CHECKOUT",
+		Variants: []*experiment.Variant{{Name: "a", Segment: "AVITO_CHECKOUT_A", Weight: 1}},
+	}
+	require.NoError(t, repo.Create(ctx, ex))
+	_, err = pool.Exec(ctx, `UPDATE segments SET default_ttl = 'P30D' WHERE slug = 'AVITO_CHECKOUT_A';`)
+	require.NoError(t, err)
+
+	// The membership created by the allocation lasts for the default TTL of the segment
+	allocation, err := repo.Allocate(ctx, "AVITO_CHECKOUT", 1, history.NewRepo(pool))
+	require.NoError(t, err)
+	assert.True(t, allocation.FirstExposure)
+	var aliveUntil *time.Time
+	require.NoError(t, pool.QueryRow(ctx, `SELECT alive_until FROM user_segments WHERE user_id = 1;`).Scan(&aliveUntil))
+	require.NotNil(t, aliveUntil)
+	assert.WithinDuration(t, time.Now().AddDate(0, 0, 30), *aliveUntil, time.Minute)
+
+	// A paused variant hides the membership, the user is assigned anew among the active variants
+	ex = &experiment.Experiment{
+		Slug: "AVITO_SEARCH",
+		Variants: []*experiment.Variant{
+			{Name: "a", Segment: "AVITO_SEARCH_A", Weight: 1},
+			{Name: "b", Segment: "AVITO_SEARCH_B", Weight: 1},
+		},
+	}
+	require.NoError(t, repo.Create(ctx, ex))
+	allocation, err = repo.Allocate(ctx, "AVITO_SEARCH", 1, history.NewRepo(pool))
+	require.NoError(t, err)
+	_, err = pool.Exec(ctx, `UPDATE segments SET status = 'paused' WHERE slug = $1;`, allocation.Segment)
+	require.NoError(t, err)
+	second, err := repo.Allocate(ctx, "AVITO_SEARCH", 1, history.NewRepo(pool))
+	require.NoError(t, err)
+	assert.True(t, second.FirstExposure)
+	assert.NotEqual(t, allocation.Segment, second.Segment)
+
+	// Without active variants the experiment takes no users, the archived variants are reported
+	_, err = pool.Exec(ctx, `UPDATE segments SET status = 'archived' WHERE slug = $1;`, second.Segment)
+	require.NoError(t, err)
+	_, err = repo.Allocate(ctx, "AVITO_SEARCH", 2, history.NewRepo(pool))
+	assert.Equal(t, &e.ArchivedSegmentError{Slugs: []string{second.Segment}}, err)
+	_, err = pool.Exec(ctx, `UPDATE segments SET status = 'draft' WHERE slug = $1;`, second.Segment)
+	require.NoError(t, err)
+	_, err = repo.Allocate(ctx, "AVITO_SEARCH", 2, history.NewRepo(pool))
+	assert.Equal(t, &e.InactiveExperimentError{Slug: "AVITO_SEARCH"}, err)
+}
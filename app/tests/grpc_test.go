@@ -0,0 +1,234 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/golang/mock/gomock"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"main/cmd/web/grpcapi"
+	"main/cmd/web/handlers"
+	"main/internal/cache"
+	redisRepoMock "main/internal/cache/mocks"
+	"main/internal/config"
+	"main/internal/e"
+	historyRepoMock "main/internal/history/mocks"
+	"main/internal/segment"
+	segmentRepoMock "main/internal/segment/mocks"
+	"main/internal/user"
+	userRepoMock "main/internal/user/mocks"
+	"main/pkg/pb"
+	"net"
+	"testing"
+	"time"
+)
+
+type grpcEnv struct {
+	segments *segmentRepoMock.MockRepository
+	users    *userRepoMock.MockRepository
+	history  *historyRepoMock.MockRepository
+	cache    *redisRepoMock.MockRepository
+	conn     *grpc.ClientConn
+	client   pb.SegmentServiceClient
+}
+
+func newGrpcEnv(t *testing.T) *grpcEnv {
+	ctl := gomock.NewController(t)
+	env := &grpcEnv{
+		segments: segmentRepoMock.NewMockRepository(ctl),
+		users:    userRepoMock.NewMockRepository(ctl),
+		history:  historyRepoMock.NewMockRepository(ctl),
+		cache:    redisRepoMock.NewMockRepository(ctl),
+	}
+
+	srv, _ := grpcapi.NewGrpcServer(
+		grpcapi.NewServer(env.segments, env.users, env.history, env.cache, config.NewConfig()),
+		handlers.NewRateLimits(1000, 1000),
+		true,
+	)
+	lis := bufconn.Listen(1 << 20)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	env.conn = conn
+	env.client = pb.NewSegmentServiceClient(conn)
+	return env
+}
+
+func TestGrpcSegments(t *testing.T) {
+	ctx := context.Background()
+	env := newGrpcEnv(t)
+
+	ttl := "P30D"
+	env.segments.EXPECT().Create(gomock.Any(), &segment.Segment{Slug: "AVITO_VOICE_MESSAGES", DefaultTtl: &ttl}).Return(nil)
+	_, err := env.client.CreateSegment(ctx, &pb.CreateSegmentRequest{Slug: "AVITO_VOICE_MESSAGES", DefaultTtl: "P30D"})
+	require.NoError(t, err)
+
+	env.segments.EXPECT().Create(gomock.Any(), &segment.Segment{Slug: "AVITO_VOICE_MESSAGES"}).
+		Return(&e.DuplicateSegmentError{SegmentName: "AVITO_VOICE_MESSAGES"})
+	_, err = env.client.CreateSegment(ctx, &pb.CreateSegmentRequest{Slug: "AVITO_VOICE_MESSAGES"})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	_, err = env.client.CreateSegment(ctx, &pb.CreateSegmentRequest{Slug: "AVITO_VOICE_MESSAGES", DefaultTtl: "month"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	owner := "growth"
+	env.segments.EXPECT().FindAll(gomock.Any(), segment.Filter{Tag: "promo"}).Return([]*segment.Segment{
+		{Id: 1, Slug: "AVITO_DISCOUNT_30", Owner: &owner, Tags: []string{"promo"}, Status: segment.StatusActive},
+		{Id: 2, Slug: "AVITO_VOICE_MESSAGES", DefaultTtl: &ttl, Tags: []string{"promo"}, Status: segment.StatusPaused},
+	}, nil)
+	list, err := env.client.ListSegments(ctx, &pb.ListSegmentsRequest{Tag: "promo"})
+	require.NoError(t, err)
+	require.Len(t, list.Segments, 2)
+	assert.Equal(t, "AVITO_DISCOUNT_30", list.Segments[0].Slug)
+	assert.Equal(t, "growth", list.Segments[0].Owner)
+	assert.Equal(t, "P30D", list.Segments[1].DefaultTtl)
+	assert.Equal(t, "paused", list.Segments[1].Status)
+
+	_, err = env.client.ListSegments(ctx, &pb.ListSegmentsRequest{Status: "stopped"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	env.segments.EXPECT().Delete(gomock.Any(), "AVITO_VOICE_MESSAGES").Return(errors.New("connection refused"))
+	_, err = env.client.DeleteSegment(ctx, &pb.DeleteSegmentRequest{Slug: "AVITO_VOICE_MESSAGES"})
+	assert.Equal(t, codes.Internal, status.Code(err))
+	assert.NotContains(t, err.Error(), "connection refused")
+}
+
+func TestGrpcUserSegments(t *testing.T) {
+	ctx := context.Background()
+	env := newGrpcEnv(t)
+
+	addedAt := time.Date(2023, 8, 1, 10, 0, 0, 0, time.UTC)
+	aliveUntil := time.Now().Add(time.Hour).UTC()
+	env.cache.EXPECT().Get(gomock.Any(), cache.UserSegmentsKey(1), gomock.Any()).Return(redis.Nil)
+	env.users.EXPECT().FindByUserId(gomock.Any(), 1).Return(&user.Segments{
+		UserId:   1,
+		Segments: []*segment.Segment{{Slug: "AVITO_DISCOUNT_30", AddedAt: addedAt, AliveUntil: &aliveUntil}},
+	}, nil)
+	us, err := env.client.GetUserSegments(ctx, &pb.GetUserSegmentsRequest{UserId: 1})
+	require.NoError(t, err)
+	require.Len(t, us.Segments, 1)
+	assert.Equal(t, "AVITO_DISCOUNT_30", us.Segments[0].Slug)
+	assert.Equal(t, addedAt, us.Segments[0].AddedAt.AsTime())
+	assert.Equal(t, aliveUntil, us.Segments[0].AliveUntil.AsTime())
+
+	// A user without segments has an empty list
+	env.cache.EXPECT().Get(gomock.Any(), cache.UserSegmentsKey(2), gomock.Any()).Return(redis.Nil)
+	env.users.EXPECT().FindByUserId(gomock.Any(), 2).Return(nil, &e.UserNotFoundError{UserId: 2})
+	us, err = env.client.GetUserSegments(ctx, &pb.GetUserSegmentsRequest{UserId: 2})
+	require.NoError(t, err)
+	assert.Empty(t, us.Segments)
+
+	_, err = env.client.GetUserSegments(ctx, &pb.GetUserSegmentsRequest{UserId: 0})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	days := 7
+	env.users.EXPECT().AddDelSegments(gomock.Any(), &user.SegmentsAddDelDto{
+		UserId: 1,
+		SegmentsAdd: []user.SegmentAdd{
+			{Slug: "AVITO_VOICE_MESSAGES"},
+			{Slug: "AVITO_DISCOUNT_50", Ttl: stringPtr("PT12H")},
+		},
+		SegmentsDel: []string{"AVITO_DISCOUNT_30"},
+		TtlDays:     &days,
+	}, env.history).Return(nil)
+	_, err = env.client.ModifyUserSegments(ctx, &pb.ModifyUserSegmentsRequest{
+		UserId: 1,
+		Add: []*pb.SegmentAdd{
+			{Slug: "AVITO_VOICE_MESSAGES"},
+			{Slug: "AVITO_DISCOUNT_50", Expiry: &pb.Expiry{Value: &pb.Expiry_Ttl{Ttl: "PT12H"}}},
+		},
+		Del:    []string{"AVITO_DISCOUNT_30"},
+		Expiry: &pb.Expiry{Value: &pb.Expiry_TtlDays{TtlDays: 7}},
+	})
+	require.NoError(t, err)
+
+	_, err = env.client.ModifyUserSegments(ctx, &pb.ModifyUserSegmentsRequest{
+		UserId: 1,
+		Add:    []*pb.SegmentAdd{{Slug: "AVITO_VOICE_MESSAGES"}},
+		Expiry: &pb.Expiry{Value: &pb.Expiry_ExpiresAt{ExpiresAt: timestamppb.New(time.Now().Add(-time.Hour))}},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func TestGrpcBulkModifyUserSegments(t *testing.T) {
+	ctx := context.Background()
+	env := newGrpcEnv(t)
+
+	env.users.EXPECT().AddDelSegments(gomock.Any(), gomock.Any(), env.history).DoAndReturn(
+		func(_ context.Context, s *user.SegmentsAddDelDto, _ interface{}) error {
+			if s.UserId == 3 {
+				return &e.SegmentsNotFoundError{Slugs: []string{"AVITO_UNKNOWN"}}
+			}
+			return nil
+		}).Times(3)
+
+	stream, err := env.client.BulkModifyUserSegments(ctx)
+	require.NoError(t, err)
+	for _, id := range []int64{1, 2, 0, 3} {
+		require.NoError(t, stream.Send(&pb.ModifyUserSegmentsRequest{UserId: id, Del: []string{"AVITO_DISCOUNT_30"}}))
+	}
+	resp, err := stream.CloseAndRecv()
+	require.NoError(t, err)
+
+	assert.EqualValues(t, 2, resp.Modified)
+	require.Len(t, resp.Failures, 2)
+	assert.EqualValues(t, 2, resp.Failures[0].Index)
+	assert.Equal(t, codes.InvalidArgument.String(), resp.Failures[0].Code)
+	assert.EqualValues(t, 3, resp.Failures[1].Index)
+	assert.EqualValues(t, 3, resp.Failures[1].UserId)
+	assert.Equal(t, codes.InvalidArgument.String(), resp.Failures[1].Code)
+}
+
+func TestGrpcReports(t *testing.T) {
+	ctx := context.Background()
+	env := newGrpcEnv(t)
+
+	env.cache.EXPECT().Get(gomock.Any(), handlers.TaskPrefix+"42", gomock.Any()).DoAndReturn(
+		func(_ context.Context, _ string, data interface{}) error {
+			return json.Unmarshal([]byte(`{"status": "success", "link_to_file": "http://localhost:8080/download?id=42"}`), data)
+		})
+	report, err := env.client.GetReport(ctx, &pb.GetReportRequest{TaskId: "42"})
+	require.NoError(t, err)
+	assert.Equal(t, pb.Report_STATUS_SUCCESS, report.Status)
+	assert.Equal(t, "http://localhost:8080/download?id=42", report.LinkToFile)
+
+	env.cache.EXPECT().Get(gomock.Any(), handlers.TaskPrefix+"43", gomock.Any()).Return(redis.Nil)
+	_, err = env.client.GetReport(ctx, &pb.GetReportRequest{TaskId: "43"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = env.client.StartReport(ctx, &pb.StartReportRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestGrpcHealth(t *testing.T) {
+	env := newGrpcEnv(t)
+
+	resp, err := healthpb.NewHealthClient(env.conn).Check(context.Background(), &healthpb.HealthCheckRequest{
+		Service: pb.SegmentService_ServiceDesc.ServiceName,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+}
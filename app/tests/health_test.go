@@ -0,0 +1,86 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"main/cmd/web/handlers"
+	"main/internal/health"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLivenessEndpoint(t *testing.T) {
+	req := httptest.NewRequest("GET", "/healthz", nil)
+	rr := httptest.NewRecorder()
+	handlers.Liveness()(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"status": "ok", "checks": {}}`, rr.Body.String())
+}
+
+func TestReadinessEndpoint(t *testing.T) {
+	checker := health.NewChecker()
+	redisErr := errors.New("dial tcp: connection refused")
+	var redisDown bool
+
+	checker.Add("postgres", func(ctx context.Context) error {
+		return nil
+	})
+	checker.Add("redis", func(ctx context.Context) error {
+		if redisDown {
+			return redisErr
+		}
+		return nil
+	})
+
+	check := func() (int, health.Report) {
+		req := httptest.NewRequest("GET", "/readyz", nil)
+		rr := httptest.NewRecorder()
+		handlers.Readiness(checker, time.Second)(rr, req)
+
+		var report health.Report
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &report))
+		return rr.Code, report
+	}
+
+	// Test application is starting
+	code, report := check()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, health.StatusStarting, report.Status)
+
+	// Test all dependencies are ok
+	checker.SetStarted()
+	code, report = check()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, health.StatusOk, report.Status)
+	assert.Equal(t, health.CheckResult{Status: health.StatusOk}, report.Checks["postgres"])
+	assert.Equal(t, health.CheckResult{Status: health.StatusOk}, report.Checks["redis"])
+
+	// Test one of the dependencies fails
+	redisDown = true
+	code, report = check()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, health.StatusFail, report.Status)
+	assert.Equal(t, health.CheckResult{Status: health.StatusOk}, report.Checks["postgres"])
+	assert.Equal(t, health.CheckResult{Status: health.StatusFail, Error: redisErr.Error()}, report.Checks["redis"])
+}
+
+func TestDeferredHandler(t *testing.T) {
+	api := &handlers.Deferred{}
+
+	req := httptest.NewRequest("GET", "/segment/user", nil)
+	rr := httptest.NewRecorder()
+	api.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+
+	api.Set(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	rr = httptest.NewRecorder()
+	api.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusTeapot, rr.Code)
+}
@@ -0,0 +1,220 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang/mock/gomock"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"main/cmd/web/handlers"
+	"main/internal/cache"
+	redisRepoMock "main/internal/cache/mocks"
+	"main/internal/e"
+	historyRepoMock "main/internal/history/mocks"
+	"main/internal/migrate"
+	"main/internal/segment"
+	segmentRepoMock "main/internal/segment/mocks"
+	"main/internal/user"
+	userRepoMock "main/internal/user/mocks"
+	"main/pkg/pb"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSegmentParentDto(t *testing.T) {
+	parent, empty, self := "AVITO_VAS", "", "AVITO_PERFORMANCE_VAS"
+
+	assert.True(t, (&segment.SegmentDto{Slug: "AVITO_PERFORMANCE_VAS", Parent: &parent}).Valid())
+	assert.False(t, (&segment.SegmentDto{Slug: "AVITO_PERFORMANCE_VAS", Parent: &empty}).Valid())
+	assert.False(t, (&segment.SegmentDto{Slug: "AVITO_PERFORMANCE_VAS", Parent: &self}).Valid())
+
+	// An empty parent makes the segment a root
+	assert.True(t, (&segment.SegmentPatchDto{Slug: "AVITO_PERFORMANCE_VAS", Parent: &parent}).Valid())
+	assert.True(t, (&segment.SegmentPatchDto{Slug: "AVITO_PERFORMANCE_VAS", Parent: &empty}).Valid())
+	assert.False(t, (&segment.SegmentPatchDto{Slug: "AVITO_PERFORMANCE_VAS", Parent: &self}).Valid())
+}
+
+func TestEffectiveSegmentsEndpoint(t *testing.T) {
+	ctx := context.Background()
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+
+	userRepo := userRepoMock.NewMockRepository(ctl)
+	cacheRepo := redisRepoMock.NewMockRepository(ctl)
+	historyRepo := historyRepoMock.NewMockRepository(ctl)
+	handler := handlers.Users(userRepo, cacheRepo, historyRepo)
+
+	addedAt := time.Date(2023, 8, 30, 10, 0, 0, 0, time.UTC)
+	soon := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	later := time.Now().Add(72 * time.Hour).UTC().Truncate(time.Second)
+	get := func(query string) *httptest.ResponseRecorder {
+		cacheRepo.EXPECT().Get(ctx, cache.UserSegmentsKey(1), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, key string, result interface{}) error {
+				*result.(*user.Segments) = user.Segments{UserId: 1, Segments: []*segment.Segment{
+					{Id: 1, Slug: "AVITO_PERFORMANCE_VAS", AddedAt: addedAt, AliveUntil: &soon},
+					{Id: 2, Slug: "AVITO_DISCOUNT_30", AddedAt: addedAt.Add(time.Hour), AliveUntil: &later},
+					{Id: 3, Slug: "AVITO_VOICE_MESSAGES", AddedAt: addedAt},
+				}}
+				return nil
+			})
+		req := httptest.NewRequest("GET", "/segment/user?id=1&"+query, nil)
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	// The inherited memberships follow the direct ones, the ones the user is a direct member of are not repeated
+	userRepo.EXPECT().FindAncestors(ctx, []string{"AVITO_PERFORMANCE_VAS", "AVITO_DISCOUNT_30", "AVITO_VOICE_MESSAGES"}).
+		Return(map[string][]string{
+			"AVITO_PERFORMANCE_VAS": {"AVITO_VAS", "AVITO_PAID"},
+			"AVITO_DISCOUNT_30":     {"AVITO_PAID"},
+			"AVITO_VOICE_MESSAGES":  {"AVITO_DISCOUNT_30"},
+		}, nil)
+	rr := get("effective=true")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var resp user.SegmentsDto
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	require.Len(t, resp.Segments, 5)
+	for _, s := range resp.Segments[:3] {
+		assert.Nil(t, s.InheritedFrom, s.Slug)
+	}
+
+	vas := resp.Segments[3]
+	assert.Equal(t, "AVITO_VAS", vas.Slug)
+	assert.Equal(t, "AVITO_PERFORMANCE_VAS", *vas.InheritedFrom)
+	assert.Equal(t, addedAt, vas.AddedAt.UTC())
+	assert.Equal(t, soon, vas.AliveUntil.UTC())
+
+	// A membership inherited from several segments lasts as long as the longest of them
+	paid := resp.Segments[4]
+	assert.Equal(t, "AVITO_PAID", paid.Slug)
+	assert.Equal(t, "AVITO_PERFORMANCE_VAS", *paid.InheritedFrom)
+	assert.Equal(t, later, paid.AliveUntil.UTC())
+
+	// Without effective only the direct memberships are returned
+	rr = get("effective=false")
+	require.Equal(t, http.StatusOK, rr.Code)
+	resp = user.SegmentsDto{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	assert.Len(t, resp.Segments, 3)
+
+	rr = httptest.NewRecorder()
+	handler(rr, httptest.NewRequest("GET", "/segment/user?id=1&effective=maybe", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestSegmentHierarchyEndpoints(t *testing.T) {
+	ctx := context.Background()
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+
+	segmentRepo := segmentRepoMock.NewMockRepository(ctl)
+	cacheRepo := redisRepoMock.NewMockRepository(ctl)
+	handler := handlers.Segments(segmentRepo, cacheRepo)
+
+	send := func(method, body string) int {
+		key := handlers.UniqueKey()
+		cacheRepo.EXPECT().Exists(ctx, key).Return(int64(0), nil)
+		cacheRepo.EXPECT().Set(ctx, key, true, 60*time.Minute)
+		cacheRepo.EXPECT().AddToCache(ctx, key, gomock.Any(), 60*time.Minute)
+		req := httptest.NewRequest(method, "/segment", bytes.NewBufferString(body))
+		req.Header.Add("Idempotency-Key", key)
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr.Code
+	}
+
+	parent := "AVITO_VAS"
+	body := `{"slug": "AVITO_PERFORMANCE_VAS", "parent": "AVITO_VAS"}`
+	segmentRepo.EXPECT().Create(ctx, &segment.Segment{Slug: "AVITO_PERFORMANCE_VAS", Parent: &parent}).Return(nil)
+	assert.Equal(t, http.StatusOK, send("POST", body))
+	segmentRepo.EXPECT().Create(ctx, gomock.Any()).Return(&e.ParentNotFoundError{Slug: parent})
+	assert.Equal(t, http.StatusBadRequest, send("POST", body))
+
+	segmentRepo.EXPECT().Update(ctx, "AVITO_PERFORMANCE_VAS", &segment.Patch{Parent: &parent}).
+		Return(&segment.Segment{Slug: "AVITO_PERFORMANCE_VAS", Parent: &parent}, nil)
+	assert.Equal(t, http.StatusOK, send("PATCH", body))
+	for err, code := range map[error]int{
+		&e.ParentNotFoundError{Slug: parent}:                                http.StatusBadRequest,
+		&e.SegmentCycleError{Slug: "AVITO_PERFORMANCE_VAS", Parent: parent}: http.StatusConflict,
+	} {
+		segmentRepo.EXPECT().Update(ctx, "AVITO_PERFORMANCE_VAS", &segment.Patch{Parent: &parent}).Return(nil, err)
+		assert.Equal(t, code, send("PATCH", body), err.Error())
+	}
+
+	segmentRepo.EXPECT().Delete(ctx, "AVITO_VAS").
+		Return(&e.SegmentHasChildrenError{Slug: "AVITO_VAS", Children: []string{"AVITO_PERFORMANCE_VAS"}})
+	assert.Equal(t, http.StatusConflict, send("DELETE", `{"slug": "AVITO_VAS"}`))
+}
+
+func TestGrpcEffectiveSegments(t *testing.T) {
+	ctx := context.Background()
+	env := newGrpcEnv(t)
+
+	addedAt := time.Date(2023, 8, 1, 10, 0, 0, 0, time.UTC)
+	env.cache.EXPECT().Get(gomock.Any(), cache.UserSegmentsKey(1), gomock.Any()).Return(redis.Nil)
+	env.users.EXPECT().FindByUserId(gomock.Any(), 1).Return(&user.Segments{
+		UserId:   1,
+		Segments: []*segment.Segment{{Slug: "AVITO_PERFORMANCE_VAS", AddedAt: addedAt}},
+	}, nil)
+	env.users.EXPECT().FindAncestors(gomock.Any(), []string{"AVITO_PERFORMANCE_VAS"}).
+		Return(map[string][]string{"AVITO_PERFORMANCE_VAS": {"AVITO_VAS"}}, nil)
+	us, err := env.client.GetUserSegments(ctx, &pb.GetUserSegmentsRequest{UserId: 1, Effective: true})
+	require.NoError(t, err)
+	require.Len(t, us.Segments, 2)
+	assert.Empty(t, us.Segments[0].InheritedFrom)
+	assert.Equal(t, "AVITO_VAS", us.Segments[1].Slug)
+	assert.Equal(t, "AVITO_PERFORMANCE_VAS", us.Segments[1].InheritedFrom)
+
+	env.segments.EXPECT().Delete(gomock.Any(), "AVITO_VAS").
+		Return(&e.SegmentHasChildrenError{Slug: "AVITO_VAS", Children: []string{"AVITO_PERFORMANCE_VAS"}})
+	_, err = env.client.DeleteSegment(ctx, &pb.DeleteSegmentRequest{Slug: "AVITO_VAS"})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestSetParentsConcurrently(t *testing.T) {
+	pool, _ := newTestDatabase(t)
+	ctx := context.Background()
+
+	m, err := migrate.NewMigrator(pool)
+	require.NoError(t, err)
+	_, err = m.Up(ctx)
+	require.NoError(t, err)
+
+	repo := segment.NewRepo(pool)
+	for i := 0; i < 20; i++ {
+		a, b := fmt.Sprintf("AVITO_A_%d", i), fmt.Sprintf("AVITO_B_%d", i)
+		require.NoError(t, repo.Create(ctx, &segment.Segment{Slug: a}))
+		require.NoError(t, repo.Create(ctx, &segment.Segment{Slug: b}))
+
+		// The segments are made the parents of each other at once: one of the changes makes a cycle,
+		// neither of them deadlocks
+		errs := make(chan error, 2)
+		setParent := func(slug, parent string) {
+			_, err := repo.Update(ctx, slug, &segment.Patch{Parent: &parent})
+			errs <- err
+		}
+		go setParent(a, b)
+		go setParent(b, a)
+
+		var cycles int
+		for j := 0; j < 2; j++ {
+			err := <-errs
+			var cycle *e.SegmentCycleError
+			if errors.As(err, &cycle) {
+				cycles++
+				continue
+			}
+			require.NoError(t, err)
+		}
+		assert.Equal(t, 1, cycles)
+	}
+}
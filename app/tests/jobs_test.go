@@ -0,0 +1,310 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-co-op/gocron"
+	"github.com/golang/mock/gomock"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"main/cmd/web/handlers"
+	"main/internal/e"
+	"main/internal/job"
+	jobRepoMock "main/internal/job/mocks"
+	"main/internal/user"
+	userRepoMock "main/internal/user/mocks"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestJobRunsEndpoint(t *testing.T) {
+	ctx := context.Background()
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+
+	jobRepo := jobRepoMock.NewMockRepository(ctl)
+
+	startedAt := time.Date(2023, 8, 30, 0, 0, 0, 0, time.UTC)
+	finishedAt := startedAt.Add(2 * time.Second)
+	rowsAffected := 3
+	runs := []*job.Run{
+		{
+			Id:           2,
+			Job:          "ttl_cleanup",
+			Instance:     "app-1",
+			StartedAt:    startedAt,
+			FinishedAt:   &finishedAt,
+			RowsAffected: &rowsAffected,
+		},
+		{
+			Id:        1,
+			Job:       "ttl_cleanup",
+			Instance:  "app-2",
+			StartedAt: startedAt.Add(-time.Minute),
+		},
+	}
+	jobRepo.EXPECT().FindRuns(ctx, "ttl_cleanup", 10).Return(runs, nil)
+
+	req := httptest.NewRequest("GET", "/admin/jobs", nil)
+	req.URL.RawQuery = "job=ttl_cleanup&limit=10"
+	rr := httptest.NewRecorder()
+	handlers.Jobs(jobRepo)(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var resp job.RunsDto
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	require.Len(t, resp.Runs, 2)
+	assert.Equal(t, 2, resp.Runs[0].Id)
+	assert.Equal(t, "app-1", resp.Runs[0].Instance)
+	assert.Equal(t, &rowsAffected, resp.Runs[0].RowsAffected)
+	assert.Nil(t, resp.Runs[1].FinishedAt)
+
+	// Test default limit
+	jobRepo.EXPECT().FindRuns(ctx, "", handlers.DefaultJobRunsLimit).Return(nil, nil)
+	req = httptest.NewRequest("GET", "/admin/jobs", nil)
+	rr = httptest.NewRecorder()
+	handlers.Jobs(jobRepo)(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"runs": []}`, rr.Body.String())
+
+	// Test repository error
+	jobRepo.EXPECT().FindRuns(ctx, "", handlers.DefaultJobRunsLimit).Return(nil, errors.New("some error"))
+	req = httptest.NewRequest("GET", "/admin/jobs", nil)
+	rr = httptest.NewRecorder()
+	handlers.Jobs(jobRepo)(rr, req)
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+
+	for _, rawQuery := range []string{"limit=0", "limit=-1", "limit=hello", "limit=100000", "limit=1&limit=2"} {
+		req = httptest.NewRequest("GET", "/admin/jobs", nil)
+		req.URL.RawQuery = rawQuery
+		rr = httptest.NewRecorder()
+		handlers.Jobs(jobRepo)(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, rawQuery)
+	}
+}
+
+// fakeLocker is a gocron.Locker of a single instance, which fails to lock while locked is set.
+type fakeLocker struct {
+	locked bool
+}
+
+func (l *fakeLocker) Lock(ctx context.Context, key string) (gocron.Lock, error) {
+	if l.locked {
+		return nil, gocron.ErrFailedToObtainLock
+	}
+	return l, nil
+}
+
+func (l *fakeLocker) Unlock(ctx context.Context) error {
+	return nil
+}
+
+func TestTriggerJobEndpoint(t *testing.T) {
+	ctx := context.Background()
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+
+	jobRepo := jobRepoMock.NewMockRepository(ctl)
+	locker := &fakeLocker{}
+	scheduler := job.NewScheduler(jobRepo, locker, "app-1")
+
+	calls := 0
+	err := scheduler.Cron(ctx, job.TtlCleanup, "0 0 * * *", func(ctx context.Context) (int, error) {
+		calls++
+		return 5, nil
+	})
+	require.NoError(t, err)
+
+	// The run is recorded within the span of the job
+	jobRepo.EXPECT().CreateRun(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, run *job.Run) error {
+		run.Id = 7
+		return nil
+	})
+	jobRepo.EXPECT().FinishRun(gomock.Any(), gomock.Any())
+
+	req := httptest.NewRequest("POST", "/admin/jobs/ttl_cleanup/run", nil)
+	req = mux.SetURLVars(req, map[string]string{"name": job.TtlCleanup})
+	rr := httptest.NewRecorder()
+	handlers.TriggerJob(scheduler)(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, 1, calls)
+
+	var run job.RunDto
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &run))
+	assert.Equal(t, 7, run.Id)
+	assert.Equal(t, "app-1", run.Instance)
+	require.NotNil(t, run.RowsAffected)
+	assert.Equal(t, 5, *run.RowsAffected)
+	assert.NotNil(t, run.FinishedAt)
+	assert.Nil(t, run.Error)
+
+	// Test job is being run by another instance
+	locker.locked = true
+	rr = httptest.NewRecorder()
+	handlers.TriggerJob(scheduler)(rr, req)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Equal(t, 1, calls)
+
+	// Test unknown job
+	req = mux.SetURLVars(req, map[string]string{"name": "unknown"})
+	rr = httptest.NewRecorder()
+	handlers.TriggerJob(scheduler)(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestPauseJobEndpoint(t *testing.T) {
+	ctx := context.Background()
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+
+	jobRepo := jobRepoMock.NewMockRepository(ctl)
+	scheduler := job.NewScheduler(jobRepo, &fakeLocker{}, "app-1")
+	err := scheduler.Cron(ctx, job.CacheRefresh, "* * * * *", func(ctx context.Context) (int, error) {
+		return 0, nil
+	})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("POST", "/admin/jobs/cache_refresh/pause", nil)
+	req = mux.SetURLVars(req, map[string]string{"name": job.CacheRefresh})
+	jobRepo.EXPECT().SetPaused(req.Context(), job.CacheRefresh, true)
+	rr := httptest.NewRecorder()
+	handlers.PauseJob(scheduler, true)(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	req = httptest.NewRequest("GET", "/admin/jobs/cache_refresh", nil)
+	req = mux.SetURLVars(req, map[string]string{"name": job.CacheRefresh})
+	jobRepo.EXPECT().IsPaused(req.Context(), job.CacheRefresh).Return(true, nil)
+	rr = httptest.NewRecorder()
+	handlers.JobInfo(scheduler)(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var info job.InfoDto
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &info))
+	assert.Equal(t, job.CacheRefresh, info.Name)
+	assert.Equal(t, "* * * * *", info.Cron)
+	assert.True(t, info.Paused)
+
+	req = httptest.NewRequest("POST", "/admin/jobs/cache_refresh/resume", nil)
+	req = mux.SetURLVars(req, map[string]string{"name": job.CacheRefresh})
+	jobRepo.EXPECT().SetPaused(req.Context(), job.CacheRefresh, false)
+	rr = httptest.NewRecorder()
+	handlers.PauseJob(scheduler, false)(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// Test unknown job
+	req = httptest.NewRequest("POST", "/admin/jobs/unknown/pause", nil)
+	req = mux.SetURLVars(req, map[string]string{"name": "unknown"})
+	rr = httptest.NewRecorder()
+	handlers.PauseJob(scheduler, true)(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestDryRunTtlCleanupEndpoint(t *testing.T) {
+	ctx := context.Background()
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+
+	userRepo := userRepoMock.NewMockRepository(ctl)
+
+	until := time.Date(2023, 9, 1, 0, 0, 0, 0, time.UTC)
+	addedAt := until.AddDate(0, 0, -3)
+	aliveUntil := until.Add(-time.Hour)
+	userRepo.EXPECT().FindExpired(ctx, until, handlers.DefaultDryRunLimit).Return([]*user.Membership{
+		{UserId: 1, Slug: "AVITO_DISCOUNT_30", AddedAt: addedAt, AliveUntil: &aliveUntil},
+	}, nil)
+
+	req := httptest.NewRequest("GET", "/admin/jobs/ttl_cleanup/dry_run", nil)
+	req.URL.RawQuery = "until=2023-09-01T03:00:00%2B03:00"
+	rr := httptest.NewRecorder()
+	handlers.DryRunTtlCleanup(userRepo)(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var resp user.ExpiringDto
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	assert.True(t, until.Equal(resp.Until))
+	require.Len(t, resp.Memberships, 1)
+	assert.Equal(t, 1, resp.Memberships[0].UserId)
+	assert.Equal(t, "AVITO_DISCOUNT_30", resp.Memberships[0].Slug)
+
+	for _, rawQuery := range []string{"until=2023-09-01", "until=hello", "limit=0"} {
+		req = httptest.NewRequest("GET", "/admin/jobs/ttl_cleanup/dry_run", nil)
+		req.URL.RawQuery = rawQuery
+		rr = httptest.NewRecorder()
+		handlers.DryRunTtlCleanup(userRepo)(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, rawQuery)
+	}
+}
+
+func TestRescheduleJob(t *testing.T) {
+	ctx := context.Background()
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+
+	jobRepo := jobRepoMock.NewMockRepository(ctl)
+	scheduler := job.NewScheduler(jobRepo, &fakeLocker{}, "app-1")
+	err := scheduler.Cron(ctx, job.TtlCleanup, "* * * * *", func(ctx context.Context) (int, error) {
+		return 0, nil
+	})
+	require.NoError(t, err)
+	scheduler.Start()
+	defer scheduler.Stop()
+
+	require.NoError(t, scheduler.Reschedule(job.TtlCleanup, "0 3 * * *"))
+	jobRepo.EXPECT().IsPaused(ctx, job.TtlCleanup).Return(false, nil).Times(2)
+	info, err := scheduler.Info(ctx, job.TtlCleanup)
+	require.NoError(t, err)
+	assert.Equal(t, "0 3 * * *", info.Cron)
+	assert.Equal(t, 3, info.NextRun.Hour())
+	assert.Equal(t, 0, info.NextRun.Minute())
+
+	// Test an invalid expression keeps the job scheduled
+	assert.Error(t, scheduler.Reschedule(job.TtlCleanup, "every day"))
+	info, err = scheduler.Info(ctx, job.TtlCleanup)
+	require.NoError(t, err)
+	assert.Equal(t, "0 3 * * *", info.Cron)
+
+	var notFound *e.JobNotFoundError
+	assert.ErrorAs(t, scheduler.Reschedule("unknown", "0 3 * * *"), &notFound)
+}
+
+func TestAdminToken(t *testing.T) {
+	newRouter := func(token string) *mux.Router {
+		r := mux.NewRouter()
+		admin := r.PathPrefix("/admin").Subrouter()
+		admin.Use(handlers.AdminToken(token))
+		admin.HandleFunc("/jobs", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET")
+		return r
+	}
+	token := "0123456789abcdef"
+
+	tests := []struct {
+		name          string
+		token         string
+		authorization string
+		code          int
+	}{
+		{"valid token", token, "Bearer " + token, http.StatusOK},
+		{"missing token", token, "", http.StatusUnauthorized},
+		{"wrong token", token, "Bearer fedcba9876543210", http.StatusUnauthorized},
+		{"wrong scheme", token, "Basic " + token, http.StatusUnauthorized},
+		{"disabled", "", "Bearer ", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/admin/jobs", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rr := httptest.NewRecorder()
+			newRouter(tt.token).ServeHTTP(rr, req)
+			require.Equal(t, tt.code, rr.Code)
+			if tt.code == http.StatusUnauthorized {
+				assert.Equal(t, `Bearer realm="admin"`, rr.Result().Header.Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"main/cmd/web/handlers"
+	"main/internal/config"
+	"main/internal/logger"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestIdMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := logger.New(config.LogConfig{Level: "info", Format: logger.FormatJson}, &slog.LevelVar{}, &buf)
+	require.NoError(t, err)
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(l)
+
+	var requestId string
+	h := handlers.RequestId(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId = logger.RequestId(r.Context())
+		slog.WarnContext(r.Context(), "something happened")
+		w.WriteHeader(http.StatusConflict)
+	}))
+
+	// Test the request ID of the client is propagated
+	req := httptest.NewRequest("POST", "/segment", nil)
+	req.Header.Set(handlers.RequestIdHeader, "req-42")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	assert.Equal(t, "req-42", requestId)
+	assert.Equal(t, "req-42", rr.Header().Get(handlers.RequestIdHeader))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	for _, line := range lines {
+		var record map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(line), &record))
+		assert.Equal(t, "req-42", record["request_id"])
+	}
+	var access map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &access))
+	assert.Equal(t, "request handled", access["msg"])
+	assert.Equal(t, float64(http.StatusConflict), access["status"])
+
+	// Test the request ID is generated if it is missing or can't be logged as is
+	for _, id := range []string{"", "bad\nid", strings.Repeat("a", 129)} {
+		req = httptest.NewRequest("POST", "/segment", nil)
+		req.Header.Set(handlers.RequestIdHeader, id)
+		rr = httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		assert.NotEmpty(t, requestId)
+		assert.NotEqual(t, id, requestId)
+		assert.Equal(t, requestId, rr.Header().Get(handlers.RequestIdHeader))
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	var level slog.LevelVar
+	l, err := logger.New(config.LogConfig{Level: "warn", Format: logger.FormatText}, &level, &buf)
+	require.NoError(t, err)
+	l.Info("skipped")
+	l.Warn("logged")
+	assert.NotContains(t, buf.String(), "skipped")
+	assert.Contains(t, buf.String(), "level=WARN msg=logged")
+
+	// Test the level is changed at runtime
+	require.NoError(t, logger.SetLevel(&level, "debug"))
+	l.Debug("debugging")
+	assert.Contains(t, buf.String(), "level=DEBUG msg=debugging")
+	assert.Error(t, logger.SetLevel(&level, "verbose"))
+	assert.Equal(t, slog.LevelDebug, level.Level())
+
+	_, err = logger.New(config.LogConfig{Level: "verbose", Format: logger.FormatJson}, &level, &buf)
+	assert.Error(t, err)
+	_, err = logger.New(config.LogConfig{Level: "info", Format: "xml"}, &level, &buf)
+	assert.Error(t, err)
+}
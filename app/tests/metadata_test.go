@@ -0,0 +1,217 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"main/cmd/web/handlers"
+	"main/internal/cache"
+	redisRepoMock "main/internal/cache/mocks"
+	"main/internal/e"
+	historyRepoMock "main/internal/history/mocks"
+	"main/internal/migrate"
+	"main/internal/segment"
+	segmentRepoMock "main/internal/segment/mocks"
+	"main/internal/user"
+	userRepoMock "main/internal/user/mocks"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSegmentMetadataDto(t *testing.T) {
+	for _, status := range []string{"", segment.StatusDraft, segment.StatusActive, segment.StatusPaused, segment.StatusArchived} {
+		assert.True(t, (&segment.SegmentDto{Slug: "AVITO_DISCOUNT_30", Status: status}).Valid(), status)
+	}
+	assert.False(t, (&segment.SegmentDto{Slug: "AVITO_DISCOUNT_30", Status: "deleted"}).Valid())
+	assert.True(t, (&segment.SegmentDto{Slug: "AVITO_DISCOUNT_30", Tags: []string{"pricing", "promo"}}).Valid())
+	assert.False(t, (&segment.SegmentDto{Slug: "AVITO_DISCOUNT_30", Tags: []string{"promo", ""}}).Valid())
+	assert.False(t, (&segment.SegmentDto{Slug: "AVITO_DISCOUNT_30", Tags: []string{"promo", "promo"}}).Valid())
+
+	paused, stopped, empty := segment.StatusPaused, "stopped", ""
+	assert.True(t, (&segment.SegmentPatchDto{Slug: "AVITO_DISCOUNT_30", Status: &paused}).Valid())
+	assert.True(t, (&segment.SegmentPatchDto{Slug: "AVITO_DISCOUNT_30", Owner: &empty}).Valid())
+	assert.True(t, (&segment.SegmentPatchDto{Slug: "AVITO_DISCOUNT_30", Tags: []string{}}).Valid())
+	assert.False(t, (&segment.SegmentPatchDto{Slug: "AVITO_DISCOUNT_30", Status: &stopped}).Valid())
+	assert.False(t, (&segment.SegmentPatchDto{Slug: "AVITO_DISCOUNT_30", Tags: []string{""}}).Valid())
+}
+
+func TestListSegmentsEndpoint(t *testing.T) {
+	ctx := context.Background()
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+
+	segmentRepo := segmentRepoMock.NewMockRepository(ctl)
+	cacheRepo := redisRepoMock.NewMockRepository(ctl)
+	handler := handlers.Segments(segmentRepo, cacheRepo)
+
+	owner := "growth"
+	createdAt := time.Date(2023, 8, 30, 6, 31, 0, 0, time.UTC)
+	segmentRepo.EXPECT().FindAll(ctx, segment.Filter{Tag: "promo", Owner: owner}).Return([]*segment.Segment{{
+		Id:        1,
+		Slug:      "AVITO_DISCOUNT_30",
+		Owner:     &owner,
+		Tags:      []string{"pricing", "promo"},
+		Status:    segment.StatusPaused,
+		CreatedAt: createdAt,
+		UpdatedAt: createdAt,
+	}}, nil)
+	rr := httptest.NewRecorder()
+	handler(rr, httptest.NewRequest("GET", "/segment?tag=promo&owner=growth", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var resp segment.SegmentsDto
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	require.Len(t, resp.Segments, 1)
+	assert.Equal(t, "AVITO_DISCOUNT_30", resp.Segments[0].Slug)
+	assert.Equal(t, segment.StatusPaused, resp.Segments[0].Status)
+	assert.Equal(t, []string{"pricing", "promo"}, resp.Segments[0].Tags)
+	assert.Equal(t, createdAt, *resp.Segments[0].CreatedAt)
+
+	segmentRepo.EXPECT().FindAll(ctx, segment.Filter{}).Return([]*segment.Segment{}, nil)
+	rr = httptest.NewRecorder()
+	handler(rr, httptest.NewRequest("GET", "/segment", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"segments": []}`, rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	handler(rr, httptest.NewRequest("GET", "/segment?status=stopped", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestPatchSegmentMetadataEndpoint(t *testing.T) {
+	ctx := context.Background()
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+
+	segmentRepo := segmentRepoMock.NewMockRepository(ctl)
+	cacheRepo := redisRepoMock.NewMockRepository(ctl)
+
+	key := handlers.UniqueKey()
+	cacheRepo.EXPECT().Exists(ctx, key).Return(int64(0), nil)
+	cacheRepo.EXPECT().Set(ctx, key, true, 60*time.Minute)
+	cacheRepo.EXPECT().AddToCache(ctx, key, gomock.Any(), 60*time.Minute)
+
+	description, empty, paused := "Discounts for the new users", "", segment.StatusPaused
+	segmentRepo.EXPECT().Update(ctx, "AVITO_DISCOUNT_30", &segment.Patch{
+		Description: &description,
+		Owner:       &empty,
+		Tags:        []string{},
+		Status:      &paused,
+	}).Return(&segment.Segment{Id: 3, Slug: "AVITO_DISCOUNT_30", Description: &description, Tags: []string{}, Status: paused}, nil)
+	// The change of the status drops the cached segments of the members
+	segmentRepo.EXPECT().FindMembers(ctx, 3).Return([]int{5, 7}, nil)
+	cacheRepo.EXPECT().Del(ctx, cache.UserSegmentsKey(5), cache.UserSegmentsKey(7)).Return(nil)
+
+	body := `{"slug": "AVITO_DISCOUNT_30", "description": "Discounts for the new users", "owner": "", "tags": [], "status": "paused"}`
+	req := httptest.NewRequest("PATCH", "/segment", bytes.NewBufferString(body))
+	req.Header.Add("Idempotency-Key", key)
+	rr := httptest.NewRecorder()
+	handlers.Segments(segmentRepo, cacheRepo)(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var resp segment.SegmentDto
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	assert.Equal(t, description, *resp.Description)
+	assert.Nil(t, resp.Owner)
+	assert.Equal(t, segment.StatusPaused, resp.Status)
+}
+
+func TestRefreshCacheDropsUsersWithoutActiveSegments(t *testing.T) {
+	ctx := context.Background()
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	userRepo := userRepoMock.NewMockRepository(ctl)
+	cacheRepo := cache.NewRepo(rdb, time.Hour)
+	require.NoError(t, mr.Set(cache.UserSegmentsKey(7), `{"user_id": 7, "segments": [{"slug": "AVITO_DISCOUNT_30"}]}`))
+
+	// The segments of user 7 have been paused after FindAll
+	userRepo.EXPECT().FindAll(ctx).Return([]*user.User{{Id: 5}, {Id: 7}}, nil)
+	userRepo.EXPECT().FindByUserId(ctx, 5).Return(&user.Segments{UserId: 5, Segments: []*segment.Segment{{Slug: "AVITO_VOICE_MESSAGES"}}}, nil)
+	userRepo.EXPECT().FindByUserId(ctx, 7).Return(nil, &e.UserNotFoundError{UserId: 7})
+
+	n, err := cacheRepo.RefreshCache(ctx, userRepo)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.True(t, mr.Exists(cache.UserSegmentsKey(5)))
+	assert.False(t, mr.Exists(cache.UserSegmentsKey(7)))
+}
+
+func TestAddDelArchivedSegmentEndpoint(t *testing.T) {
+	ctx := context.Background()
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+
+	userRepo := userRepoMock.NewMockRepository(ctl)
+	cacheRepo := redisRepoMock.NewMockRepository(ctl)
+	historyRepo := historyRepoMock.NewMockRepository(ctl)
+
+	key := handlers.UniqueKey()
+	cacheRepo.EXPECT().Exists(ctx, key).Return(int64(0), nil)
+	cacheRepo.EXPECT().Set(ctx, key, true, 60*time.Minute)
+	cacheRepo.EXPECT().AddToCache(ctx, key, gomock.Any(), 60*time.Minute)
+	userRepo.EXPECT().AddDelSegments(ctx, gomock.Any(), historyRepo).
+		Return(&e.ArchivedSegmentError{Slugs: []string{"AVITO_DISCOUNT_30"}})
+
+	req := httptest.NewRequest("POST", "/segment/user", bytes.NewBufferString(`{"user_id": 1, "add": ["AVITO_DISCOUNT_30"], "del": []}`))
+	req.Header.Add("Idempotency-Key", key)
+	rr := httptest.NewRecorder()
+	handlers.Users(userRepo, cacheRepo, historyRepo)(rr, req)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+}
+
+func TestStatusChangeWritesEvents(t *testing.T) {
+	pool, _ := newTestDatabase(t)
+	ctx := context.Background()
+
+	m, err := migrate.NewMigrator(pool)
+	require.NoError(t, err)
+	_, err = m.Up(ctx)
+	require.NoError(t, err)
+
+	repo := segment.NewRepo(pool)
+	require.NoError(t, repo.Create(ctx, &segment.Segment{Slug: "AVITO_DISCOUNT_30"}))
+	q := `
+		INSERT INTO user_segments (user_id, segment_id, alive_until)
+		SELECT u.user_id, s.segment_id, u.alive_until FROM segments s,
+		(VALUES (1, NULL), (2, now() + interval '1 day'), (3, now() - interval '1 hour')) AS u (user_id, alive_until)
+		WHERE s.slug = 'AVITO_DISCOUNT_30';
+	`
+	_, err = pool.Exec(ctx, q)
+	require.NoError(t, err)
+	events := func() []string {
+		rows, err := pool.Query(ctx, `SELECT user_id, event FROM outbox WHERE reason = 'status' ORDER BY id;`)
+		require.NoError(t, err)
+		defer rows.Close()
+		events := make([]string, 0)
+		for rows.Next() {
+			var userId int
+			var event string
+			require.NoError(t, rows.Scan(&userId, &event))
+			events = append(events, fmt.Sprintf("%d %s", userId, event))
+		}
+		require.NoError(t, rows.Err())
+		return events
+	}
+	update := func(status string) {
+		_, err := repo.Update(ctx, "AVITO_DISCOUNT_30", &segment.Patch{Status: &status})
+		require.NoError(t, err)
+	}
+
+	// The live members leave a hidden segment and enter it again when it is active, the expired ones have no events
+	update(segment.StatusPaused)
+	assert.Equal(t, []string{"1 left", "2 left"}, events())
+	update(segment.StatusDraft)
+	assert.Equal(t, []string{"1 left", "2 left"}, events())
+	update(segment.StatusActive)
+	assert.Equal(t, []string{"1 left", "2 left", "1 entered", "2 entered"}, events())
+}
@@ -0,0 +1,93 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/mock/gomock"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"main/cmd/web/handlers"
+	redisRepoMock "main/internal/cache/mocks"
+	historyRepoMock "main/internal/history/mocks"
+	"main/internal/metrics"
+	"main/internal/segment"
+	"main/internal/user"
+	userRepoMock "main/internal/user/mocks"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetricsMiddleware(t *testing.T) {
+	r := mux.NewRouter()
+	r.Use(handlers.Metrics)
+	r.HandleFunc("/admin/jobs/{name}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}).Methods("GET")
+	r.HandleFunc("/segment", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}).Methods("POST")
+
+	notFound := metrics.HttpRequests.WithLabelValues("/admin/jobs/{name}", "GET", "404")
+	ok := metrics.HttpRequests.WithLabelValues("/segment", "POST", "200")
+	notFoundBefore, okBefore := testutil.ToFloat64(notFound), testutil.ToFloat64(ok)
+
+	for _, name := range []string{"foo", "bar"} {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("GET", "/admin/jobs/"+name, nil))
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	}
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("POST", "/segment", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// Requests are grouped by the route template and not by the actual path
+	assert.Equal(t, notFoundBefore+2, testutil.ToFloat64(notFound))
+	assert.Equal(t, okBefore+1, testutil.ToFloat64(ok))
+}
+
+func TestCacheLookupMetrics(t *testing.T) {
+	ctx := context.Background()
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+
+	userRepo := userRepoMock.NewMockRepository(ctl)
+	historyRepo := historyRepoMock.NewMockRepository(ctl)
+	cacheRepo := redisRepoMock.NewMockRepository(ctl)
+
+	userId := 1
+	hits := metrics.CacheLookups.WithLabelValues("hit")
+	misses := metrics.CacheLookups.WithLabelValues("miss")
+	hitsBefore, missesBefore := testutil.ToFloat64(hits), testutil.ToFloat64(misses)
+
+	cacheRepo.EXPECT().Get(ctx, fmt.Sprintf("avito_user_%d", userId), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, key string, result interface{}) error {
+			*result.(*user.Segments) = user.Segments{UserId: userId, Segments: []*segment.Segment{
+				{Id: 1, Slug: "AVITO_VOICE_MESSAGES"},
+			}}
+			return nil
+		})
+
+	req := httptest.NewRequest("GET", "/segment/user", nil)
+	req.URL.RawQuery = fmt.Sprintf("id=%d", userId)
+	rr := httptest.NewRecorder()
+	handlers.Users(userRepo, cacheRepo, historyRepo)(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// Test the segments are read from the database on a cache miss
+	cacheRepo.EXPECT().Get(ctx, fmt.Sprintf("avito_user_%d", userId), gomock.Any()).
+		Return(fmt.Errorf("redis: nil"))
+	userRepo.EXPECT().FindByUserId(ctx, userId).Return(&user.Segments{UserId: userId, Segments: []*segment.Segment{
+		{Id: 1, Slug: "AVITO_VOICE_MESSAGES"},
+	}}, nil)
+
+	req = httptest.NewRequest("GET", "/segment/user", nil)
+	req.URL.RawQuery = fmt.Sprintf("id=%d", userId)
+	rr = httptest.NewRecorder()
+	handlers.Users(userRepo, cacheRepo, historyRepo)(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	assert.Equal(t, hitsBefore+1, testutil.ToFloat64(hits))
+	assert.Equal(t, missesBefore+1, testutil.ToFloat64(misses))
+}
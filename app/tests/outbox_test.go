@@ -0,0 +1,194 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"main/internal/migrate"
+	"main/internal/outbox"
+	"sync"
+	"testing"
+	"time"
+)
+
+var outboxEvents = func() []outbox.Event {
+	occurredAt := time.Date(2023, 8, 1, 10, 0, 0, 0, time.UTC)
+	aliveUntil := occurredAt.AddDate(0, 0, 7)
+	return []outbox.Event{
+		{Seq: 1, UserId: 5, Slug: "AVITO_DISCOUNT_30", Type: outbox.Entered, Reason: outbox.ReasonRequest, AliveUntil: &aliveUntil, OccurredAt: occurredAt},
+		{Seq: 2, UserId: 7, Slug: "AVITO_DISCOUNT_30", Type: outbox.Left, Reason: outbox.ReasonTtl, OccurredAt: occurredAt},
+	}
+}()
+
+func TestRedisStreamSink(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	sink := outbox.NewRedisStreamSink(rdb, "segment_events", 0)
+	require.NoError(t, sink.Publish(ctx, outboxEvents))
+
+	entries, err := rdb.XRange(ctx, "segment_events", "-", "+").Result()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, map[string]interface{}{
+		"seq":         "1",
+		"user_id":     "5",
+		"segment":     "AVITO_DISCOUNT_30",
+		"type":        "entered",
+		"reason":      "request",
+		"alive_until": "2023-08-08T10:00:00Z",
+		"occurred_at": "2023-08-01T10:00:00Z",
+	}, entries[0].Values)
+	assert.Equal(t, "2", entries[1].Values["seq"])
+	assert.NotContains(t, entries[1].Values, "alive_until")
+
+	mr.Close()
+	assert.Error(t, sink.Publish(ctx, outboxEvents))
+}
+
+// fakeKafka is a local Kafka producer which keeps the messages in memory and may fail the writes.
+type fakeKafka struct {
+	mu       sync.Mutex
+	messages []outbox.KafkaMessage
+	err      error
+}
+
+func (k *fakeKafka) WriteMessages(_ context.Context, msgs ...outbox.KafkaMessage) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.err != nil {
+		return k.err
+	}
+	k.messages = append(k.messages, msgs...)
+	return nil
+}
+
+func TestKafkaSink(t *testing.T) {
+	ctx := context.Background()
+	kafka := &fakeKafka{}
+	sink := outbox.NewKafkaSink(kafka, "segment-events")
+
+	require.NoError(t, sink.Publish(ctx, outboxEvents))
+	require.Len(t, kafka.messages, 2)
+
+	msg := kafka.messages[0]
+	assert.Equal(t, "segment-events", msg.Topic)
+	assert.Equal(t, "5", string(msg.Key))
+	assert.Equal(t, map[string]string{"seq": "1"}, msg.Headers)
+	var ev outbox.Event
+	require.NoError(t, json.Unmarshal(msg.Value, &ev))
+	assert.Equal(t, outboxEvents[0], ev)
+	assert.JSONEq(t, `{
+		"seq": 1,
+		"user_id": 5,
+		"segment": "AVITO_DISCOUNT_30",
+		"type": "entered",
+		"reason": "request",
+		"alive_until": "2023-08-08T10:00:00Z",
+		"occurred_at": "2023-08-01T10:00:00Z"
+	}`, string(msg.Value))
+
+	// A failed write is reported, so the relay publishes the events again
+	kafka.err = errors.New("leader not available")
+	assert.ErrorIs(t, sink.Publish(ctx, outboxEvents), kafka.err)
+}
+
+func TestSegmentEventsHaveNoUser(t *testing.T) {
+	ctx := context.Background()
+	ev := outbox.Event{Seq: 3, Slug: "AVITO_DISCOUNT_30", Type: outbox.SegmentCreated, Reason: outbox.ReasonRequest, OccurredAt: time.Now()}
+
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	require.NoError(t, outbox.NewRedisStreamSink(rdb, "segment_events", 0).Publish(ctx, []outbox.Event{ev}))
+	entries, err := rdb.XRange(ctx, "segment_events", "-", "+").Result()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.NotContains(t, entries[0].Values, "user_id")
+	assert.Equal(t, "segment_created", entries[0].Values["type"])
+
+	// The segment events are keyed by the slug
+	kafka := &fakeKafka{}
+	require.NoError(t, outbox.NewKafkaSink(kafka, "segment-events").Publish(ctx, []outbox.Event{ev}))
+	assert.Equal(t, "AVITO_DISCOUNT_30", string(kafka.messages[0].Key))
+	assert.NotContains(t, string(kafka.messages[0].Value), "user_id")
+}
+
+// flakySink fails as many publishes as failures and then succeeds, recording the seqs of every attempt.
+type flakySink struct {
+	failures int
+	attempts [][]int64
+}
+
+func (s *flakySink) Publish(_ context.Context, events []outbox.Event) error {
+	seqs := make([]int64, 0, len(events))
+	for _, ev := range events {
+		seqs = append(seqs, ev.Seq)
+	}
+	s.attempts = append(s.attempts, seqs)
+
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("sink is unavailable")
+	}
+	return nil
+}
+
+func TestRelayRepublishesAfterFailure(t *testing.T) {
+	pool, _ := newTestDatabase(t)
+	ctx := context.Background()
+
+	m, err := migrate.NewMigrator(pool)
+	require.NoError(t, err)
+	_, err = m.Up(ctx)
+	require.NoError(t, err)
+
+	write := func(events ...outbox.Event) {
+		tx, err := pool.Begin(ctx)
+		require.NoError(t, err)
+		require.NoError(t, outbox.Write(ctx, tx, events...))
+		require.NoError(t, tx.Commit(ctx))
+	}
+	outboxSeqs := func() []int64 {
+		rows, err := pool.Query(ctx, `SELECT seq FROM outbox ORDER BY seq;`)
+		require.NoError(t, err)
+		defer rows.Close()
+		seqs := make([]int64, 0)
+		for rows.Next() {
+			var seq int64
+			require.NoError(t, rows.Scan(&seq))
+			seqs = append(seqs, seq)
+		}
+		require.NoError(t, rows.Err())
+		return seqs
+	}
+	write(outboxEvents...)
+
+	// The failed batch stays in the outbox with the numbers it has got
+	sink := &flakySink{failures: 1}
+	relay := outbox.NewRelay(pool, sink, 10)
+	n, err := relay.RelayOnce(ctx)
+	require.Error(t, err)
+	assert.Zero(t, n)
+	assert.Equal(t, []int64{1, 2}, outboxSeqs())
+
+	// The events written in between are numbered after it, the failed batch is published again as it was
+	write(outbox.Event{UserId: 9, Slug: "AVITO_DISCOUNT_30", Type: outbox.Entered, Reason: outbox.ReasonRequest})
+	n, err = relay.RelayOnce(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, [][]int64{{1, 2}, {1, 2, 3}}, sink.attempts)
+	assert.Empty(t, outboxSeqs())
+
+	n, err = relay.RelayOnce(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+	assert.Len(t, sink.attempts, 2)
+}
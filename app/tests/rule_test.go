@@ -0,0 +1,193 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"main/cmd/web/handlers"
+	redisRepoMock "main/internal/cache/mocks"
+	"main/internal/e"
+	historyRepoMock "main/internal/history/mocks"
+	"main/internal/rule"
+	"main/internal/segment"
+	"main/internal/user"
+	userRepoMock "main/internal/user/mocks"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRuleMatch(t *testing.T) {
+	attrs := map[string]interface{}{
+		"city":          "Moscow",
+		"platform":      "ios",
+		"age":           float64(30),
+		"orders":        7,
+		"premium":       true,
+		"registered_at": "2023-05-01",
+		"device":        map[string]interface{}{"os": "ios", "version": float64(17)},
+	}
+
+	testCases := []struct {
+		rule  string
+		match bool
+	}{
+		{`city == "Moscow"`, true},
+		{`city == "Kazan"`, false},
+		{`city != "Kazan"`, true},
+		{`city == "Moscow" && platform in ["ios", "android"]`, true},
+		{`city == "Moscow" && platform in ["android"]`, false},
+		{`platform not in ["android", "web"]`, true},
+		{`city == "Kazan" || premium`, true},
+		{`!premium`, false},
+		{`!(city == "Kazan")`, true},
+		{`age >= 18 && age < 35`, true},
+		{`age > 30`, false},
+		{`orders == 7`, true},
+		{`orders in [1, 7]`, true},
+		{`registered_at >= "2023-01-01"`, true},
+		{`device.os == "ios" && device.version >= 16`, true},
+		{`device.model == null`, true},
+		{`missing == null`, true},
+		{`missing`, false},
+		{`age == "30"`, false},
+		{`age < "40"`, false},
+		{`city == "Moscow" || city == "Kazan" && premium == false`, true},
+		{`(city == "Moscow" || city == "Kazan") && premium == false`, false},
+		{`platform in []`, false},
+		{`city in "Moscow"`, false},
+		{`age == -1`, false},
+		{`"a \"b\"" == "a \"b\""`, true},
+	}
+
+	for _, tc := range testCases {
+		r, err := rule.Parse(tc.rule)
+		require.NoError(t, err, tc.rule)
+		assert.Equal(t, tc.match, r.Match(attrs), tc.rule)
+		assert.Equal(t, tc.rule, r.String())
+	}
+}
+
+func TestRuleParseErrors(t *testing.T) {
+	for _, src := range []string{
+		``,
+		`city ==`,
+		`city == "Moscow`,
+		`city = "Moscow"`,
+		`city == "Moscow" &&`,
+		`(city == "Moscow"`,
+		`platform in ["ios",]`,
+		`platform in ["ios"`,
+		`platform not ["ios"]`,
+		`city == "Moscow" premium`,
+		`1.2.3 == 1`,
+		`in == 1`,
+		`city @ 1`,
+	} {
+		_, err := rule.Parse(src)
+		assert.Error(t, err, src)
+	}
+}
+
+func TestRuleSegmentDto(t *testing.T) {
+	valid := `city == "Moscow"`
+	invalid := `city ==`
+	ttl := "P30D"
+
+	assert.True(t, (&segment.SegmentDto{Slug: "AVITO_MOSCOW", Rule: &valid}).Valid())
+	assert.False(t, (&segment.SegmentDto{Slug: "AVITO_MOSCOW", Rule: &invalid}).Valid())
+	// The members of a dynamic segment stay in it as long as they match the rule
+	assert.False(t, (&segment.SegmentDto{Slug: "AVITO_MOSCOW", Rule: &valid, DefaultTtl: &ttl}).Valid())
+}
+
+func TestAttributesDto(t *testing.T) {
+	assert.True(t, (&user.AttributesDto{UserId: 1, Attributes: map[string]interface{}{"city": "Moscow", "age": nil}}).Valid())
+	assert.True(t, (&user.AttributesDto{UserId: 1, Attributes: map[string]interface{}{}}).Valid())
+	assert.False(t, (&user.AttributesDto{UserId: 0, Attributes: map[string]interface{}{"city": "Moscow"}}).Valid())
+	assert.False(t, (&user.AttributesDto{UserId: 1}).Valid())
+	assert.False(t, (&user.AttributesDto{UserId: 1, Attributes: map[string]interface{}{"": "Moscow"}}).Valid())
+	assert.False(t, (&user.AttributesDto{UserId: 1, Attributes: map[string]interface{}{"device.os": "ios"}}).Valid())
+}
+
+func TestUserAttributesEndpoint(t *testing.T) {
+	ctx := context.Background()
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+
+	userRepo := userRepoMock.NewMockRepository(ctl)
+	cacheRepo := redisRepoMock.NewMockRepository(ctl)
+	historyRepo := historyRepoMock.NewMockRepository(ctl)
+	handler := handlers.UserAttributes(userRepo, cacheRepo, historyRepo)
+
+	// The attributes are merged and the cached segments are dropped, as the memberships may have changed
+	attrs := map[string]interface{}{"city": "Moscow", "platform": nil}
+	merged := map[string]interface{}{"city": "Moscow", "premium": true}
+	userRepo.EXPECT().UpsertAttributes(ctx, 1, attrs, historyRepo).Return(merged, nil)
+	cacheRepo.EXPECT().Del(ctx, "avito_user_1")
+
+	req := httptest.NewRequest("PATCH", "/user/attributes", bytes.NewBufferString(`{"user_id": 1, "attributes": {"city": "Moscow", "platform": null}}`))
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var resp user.AttributesDto
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	assert.Equal(t, user.AttributesDto{UserId: 1, Attributes: merged}, resp)
+
+	for _, body := range []string{
+		`{"user_id": 0, "attributes": {"city": "Moscow"}}`,
+		`{"user_id": 1}`,
+		`{"user_id": 1, "attributes": {"device.os": "ios"}}`,
+		`{"user_id": 1, "attributes": ["city"]}`,
+	} {
+		req = httptest.NewRequest("PATCH", "/user/attributes", bytes.NewBufferString(body))
+		rr = httptest.NewRecorder()
+		handler(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, body)
+	}
+
+	userRepo.EXPECT().FindAttributes(ctx, 1).Return(merged, nil)
+	req = httptest.NewRequest("GET", "/user/attributes?id=1", nil)
+	rr = httptest.NewRecorder()
+	handler(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	assert.Equal(t, user.AttributesDto{UserId: 1, Attributes: merged}, resp)
+
+	userRepo.EXPECT().FindAttributes(ctx, 2).Return(nil, &e.UserNotFoundError{UserId: 2})
+	req = httptest.NewRequest("GET", "/user/attributes?id=2", nil)
+	rr = httptest.NewRecorder()
+	handler(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	req = httptest.NewRequest("GET", "/user/attributes?id=x", nil)
+	rr = httptest.NewRecorder()
+	handler(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestAddDelRuleSegmentEndpoint(t *testing.T) {
+	ctx := context.Background()
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+
+	userRepo := userRepoMock.NewMockRepository(ctl)
+	cacheRepo := redisRepoMock.NewMockRepository(ctl)
+	historyRepo := historyRepoMock.NewMockRepository(ctl)
+
+	key := handlers.UniqueKey()
+	cacheRepo.EXPECT().Exists(ctx, key).Return(int64(0), nil)
+	cacheRepo.EXPECT().Set(ctx, key, true, 60*time.Minute)
+	cacheRepo.EXPECT().AddToCache(ctx, key, gomock.Any(), 60*time.Minute)
+	userRepo.EXPECT().AddDelSegments(ctx, gomock.Any(), historyRepo).
+		Return(&e.RuleSegmentError{Slugs: []string{"AVITO_MOSCOW"}})
+
+	req := httptest.NewRequest("POST", "/segment/user", bytes.NewBufferString(`{"user_id": 1, "add": ["AVITO_MOSCOW"], "del": []}`))
+	req.Header.Add("Idempotency-Key", key)
+	rr := httptest.NewRecorder()
+	handlers.Users(userRepo, cacheRepo, historyRepo)(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
@@ -0,0 +1,247 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"main/cmd/segctl/commands"
+	"main/internal/cache"
+	redisRepoMock "main/internal/cache/mocks"
+	"main/internal/history"
+	historyRepoMock "main/internal/history/mocks"
+	"main/internal/segment"
+	segmentRepoMock "main/internal/segment/mocks"
+	"main/internal/user"
+	userRepoMock "main/internal/user/mocks"
+	"os"
+	"testing"
+	"time"
+)
+
+type segctl struct {
+	users    *userRepoMock.MockRepository
+	segments *segmentRepoMock.MockRepository
+	history  *historyRepoMock.MockRepository
+	cache    *redisRepoMock.MockRepository
+	out      bytes.Buffer
+}
+
+func newSegctl(t *testing.T) *segctl {
+	ctl := gomock.NewController(t)
+	return &segctl{
+		users:    userRepoMock.NewMockRepository(ctl),
+		segments: segmentRepoMock.NewMockRepository(ctl),
+		history:  historyRepoMock.NewMockRepository(ctl),
+		cache:    redisRepoMock.NewMockRepository(ctl),
+	}
+}
+
+func (s *segctl) run(args ...string) error {
+	return commands.Run(context.Background(), &commands.Deps{
+		Users:    s.users,
+		Segments: s.segments,
+		History:  s.history,
+		Cache:    s.cache,
+		Out:      &s.out,
+	}, args)
+}
+
+func TestSegctlSegments(t *testing.T) {
+	ctx := context.Background()
+	s := newSegctl(t)
+
+	ttl := "P30D"
+	s.segments.EXPECT().Create(ctx, &segment.Segment{Slug: "AVITO_VOICE_MESSAGES", DefaultTtl: &ttl}).Return(nil)
+	require.NoError(t, s.run("segment", "create", "-ttl", "P30D", "AVITO_VOICE_MESSAGES"))
+
+	rule := `city == "Moscow"`
+	s.segments.EXPECT().Create(ctx, &segment.Segment{Slug: "AVITO_MOSCOW", Rule: &rule}).Return(nil)
+	require.NoError(t, s.run("segment", "create", "-rule", rule, "AVITO_MOSCOW"))
+
+	group := "discounts"
+	s.segments.EXPECT().Create(ctx, &segment.Segment{Slug: "AVITO_DISCOUNT_50", ExclusionGroup: &group}).Return(nil)
+	require.NoError(t, s.run("segment", "create", "-group", group, "AVITO_DISCOUNT_50"))
+
+	s.segments.EXPECT().Update(ctx, "AVITO_DISCOUNT_30", &segment.Patch{ExclusionGroup: &group}).
+		Return(&segment.Segment{Slug: "AVITO_DISCOUNT_30"}, nil)
+	require.NoError(t, s.run("segment", "group", "AVITO_DISCOUNT_30", group))
+	s.segments.EXPECT().Update(ctx, "AVITO_DISCOUNT_30", &segment.Patch{ClearExclusionGroup: true}).
+		Return(&segment.Segment{Slug: "AVITO_DISCOUNT_30"}, nil)
+	require.NoError(t, s.run("segment", "group", "-clear", "AVITO_DISCOUNT_30"))
+
+	owner, description := "growth", "Discounts for the new users"
+	s.segments.EXPECT().Create(ctx, &segment.Segment{
+		Slug:        "AVITO_DISCOUNT_10",
+		Description: &description,
+		Owner:       &owner,
+		Tags:        []string{"pricing", "promo"},
+		Status:      segment.StatusDraft,
+	}).Return(nil)
+	require.NoError(t, s.run("segment", "create", "-description", description, "-owner", owner,
+		"-tags", "pricing,promo", "-status", "draft", "AVITO_DISCOUNT_10"))
+
+	// Only the flags which are set change the segment, an empty value clears the field
+	paused, empty := segment.StatusPaused, ""
+	s.segments.EXPECT().Update(ctx, "AVITO_DISCOUNT_10", &segment.Patch{Owner: &empty, Tags: []string{}, Status: &paused}).
+		Return(&segment.Segment{Id: 10, Slug: "AVITO_DISCOUNT_10", Status: paused}, nil)
+	s.segments.EXPECT().FindMembers(ctx, 10).Return([]int{}, nil)
+	s.out.Reset()
+	require.NoError(t, s.run("segment", "update", "-owner", "", "-tags", "", "-status", "paused", "AVITO_DISCOUNT_10"))
+	assert.Equal(t, "updated segment AVITO_DISCOUNT_10, status paused\n", s.out.String())
+
+	// The default TTL applies to the new memberships, an empty value clears it
+	s.segments.EXPECT().Update(ctx, "AVITO_VOICE_MESSAGES", &segment.Patch{DefaultTtl: &ttl}).
+		Return(&segment.Segment{Slug: "AVITO_VOICE_MESSAGES", Status: segment.StatusActive}, nil)
+	require.NoError(t, s.run("segment", "update", "-ttl", ttl, "AVITO_VOICE_MESSAGES"))
+	s.segments.EXPECT().Update(ctx, "AVITO_VOICE_MESSAGES", &segment.Patch{ClearDefaultTtl: true}).
+		Return(&segment.Segment{Slug: "AVITO_VOICE_MESSAGES", Status: segment.StatusActive}, nil)
+	require.NoError(t, s.run("segment", "update", "-ttl", "", "AVITO_VOICE_MESSAGES"))
+	assert.ErrorIs(t, s.run("segment", "update", "-ttl", "month", "AVITO_VOICE_MESSAGES"), commands.ErrUsage)
+
+	// A segment is created as a child of its parent, an empty parent makes it a root again
+	discounts := "AVITO_DISCOUNTS"
+	s.segments.EXPECT().Create(ctx, &segment.Segment{Slug: "AVITO_DISCOUNT_70", Parent: &discounts}).Return(nil)
+	require.NoError(t, s.run("segment", "create", "-parent", discounts, "AVITO_DISCOUNT_70"))
+	s.segments.EXPECT().Update(ctx, "AVITO_DISCOUNT_70", &segment.Patch{Parent: &empty}).
+		Return(&segment.Segment{Slug: "AVITO_DISCOUNT_70", Status: segment.StatusActive}, nil)
+	require.NoError(t, s.run("segment", "update", "-parent", "", "AVITO_DISCOUNT_70"))
+
+	s.segments.EXPECT().Rename(ctx, "AVITO_VOICE_MESAGES", "AVITO_VOICE_MESSAGES").
+		Return(&segment.Segment{Id: 1, Slug: "AVITO_VOICE_MESSAGES"}, nil)
+	s.segments.EXPECT().FindMembers(ctx, 1).Return([]int{5}, nil)
+	s.cache.EXPECT().Del(ctx, cache.UserSegmentsKey(5)).Return(nil)
+	s.out.Reset()
+	require.NoError(t, s.run("segment", "rename", "AVITO_VOICE_MESAGES", "AVITO_VOICE_MESSAGES"))
+	assert.Equal(t, "renamed segment AVITO_VOICE_MESAGES to AVITO_VOICE_MESSAGES, the old slug stays as a deprecated alias\n", s.out.String())
+
+	s.segments.EXPECT().Delete(ctx, "AVITO_VOICE_MESSAGES").Return(nil)
+	require.NoError(t, s.run("segment", "delete", "AVITO_VOICE_MESSAGES"))
+
+	s.out.Reset()
+	s.segments.EXPECT().FindAll(ctx, segment.Filter{}).Return([]*segment.Segment{
+		{Id: 1, Slug: "AVITO_DISCOUNT_30", ExclusionGroup: &group, Parent: &discounts, Status: segment.StatusActive, Owner: &owner, Tags: []string{"pricing", "promo"}},
+		{Id: 2, Slug: "AVITO_VOICE_MESSAGES", DefaultTtl: &ttl, Status: segment.StatusPaused},
+		{Id: 3, Slug: "AVITO_MOSCOW", Rule: &rule, Status: segment.StatusActive},
+	}, nil)
+	require.NoError(t, s.run("segment", "list"))
+	assert.Equal(t, "ID  SLUG                  STATUS  OWNER   TAGS           DEFAULT TTL  GROUP      PARENT           RULE\n"+
+		"1   AVITO_DISCOUNT_30     active  growth  pricing,promo  -            discounts  AVITO_DISCOUNTS  -\n"+
+		"2   AVITO_VOICE_MESSAGES  paused  -       -              P30D         -          -                -\n"+
+		"3   AVITO_MOSCOW          active  -       -              -            -          -                city == \"Moscow\"\n", s.out.String())
+
+	s.segments.EXPECT().FindAll(ctx, segment.Filter{Tag: "promo", Owner: owner, Status: segment.StatusActive}).Return([]*segment.Segment{}, nil)
+	require.NoError(t, s.run("segment", "list", "-tag", "promo", "-owner", owner, "-status", "active"))
+
+	// Invalid arguments do not reach the repository
+	for _, args := range [][]string{
+		{},
+		{"segment"},
+		{"segment", "create"},
+		{"segment", "create", "-ttl", "P0D", "AVITO_VOICE_MESSAGES"},
+		{"segment", "create", "-rule", "city ==", "AVITO_MOSCOW"},
+		{"segment", "create", "-ttl", "P30D", "-rule", "premium", "AVITO_MOSCOW"},
+		{"segment", "create", "-group", "discounts", "-rule", "premium", "AVITO_MOSCOW"},
+		{"segment", "group", "AVITO_DISCOUNT_30"},
+		{"segment", "group", "-clear", "AVITO_DISCOUNT_30", "discounts"},
+		{"segment", "create", "-status", "deleted", "AVITO_DISCOUNT_10"},
+		{"segment", "create", "-tags", "promo,,pricing", "AVITO_DISCOUNT_10"},
+		{"segment", "update", "AVITO_DISCOUNT_10"},
+		{"segment", "update", "-status", "stopped", "AVITO_DISCOUNT_10"},
+		{"segment", "update", "-status", "paused"},
+		{"segment", "update", "-parent", "AVITO_DISCOUNT_10", "AVITO_DISCOUNT_10"},
+		{"segment", "create", "-parent", "AVITO_DISCOUNT_10", "AVITO_DISCOUNT_10"},
+		{"segment", "list", "-status", "stopped"},
+		{"segment", "list", "AVITO_DISCOUNT_10"},
+		{"segment", "delete"},
+		{"segment", "rename", "AVITO_VOICE_MESSAGES"},
+		{"segment", "rename", "AVITO_VOICE_MESAGES", ""},
+		{"unknown"},
+	} {
+		assert.ErrorIs(t, s.run(args...), commands.ErrUsage, args)
+	}
+}
+
+func TestSegctlUsers(t *testing.T) {
+	ctx := context.Background()
+	s := newSegctl(t)
+
+	days := 7
+	s.users.EXPECT().AddDelSegments(ctx, &user.SegmentsAddDelDto{
+		UserId:      5,
+		SegmentsAdd: []user.SegmentAdd{{Slug: "AVITO_DISCOUNT_30"}, {Slug: "AVITO_VOICE_MESSAGES"}},
+		SegmentsDel: []string{},
+		TtlDays:     &days,
+	}, s.history).Return(nil)
+	s.cache.EXPECT().Del(ctx, cache.UserSegmentsKey(5)).Return(nil)
+	require.NoError(t, s.run("user", "add", "-segments", "AVITO_DISCOUNT_30,AVITO_VOICE_MESSAGES", "-ttl-days", "7", "-id", "5"))
+
+	// The users from the csv file are removed one by one, a failure does not stop the others
+	path := writeFile(t, "users.csv", "user_id,comment\n1,first\n\n2,second\n3\n")
+	for _, id := range []int{1, 2, 3} {
+		dto := &user.SegmentsAddDelDto{UserId: id, SegmentsAdd: []user.SegmentAdd{}, SegmentsDel: []string{"AVITO_DISCOUNT_30"}}
+		if id == 2 {
+			s.users.EXPECT().AddDelSegments(ctx, dto, s.history).Return(errors.New("connection refused"))
+			continue
+		}
+		s.users.EXPECT().AddDelSegments(ctx, dto, s.history).Return(nil)
+		s.cache.EXPECT().Del(ctx, cache.UserSegmentsKey(id)).Return(nil)
+	}
+	s.out.Reset()
+	assert.EqualError(t, s.run("user", "remove", "-segments", "AVITO_DISCOUNT_30", "-csv", path), "failed to update 1 users")
+	assert.Equal(t, "user 2: connection refused\nupdated 2 of 3 users\n", s.out.String())
+
+	badIds := writeFile(t, "bad.csv", "1\nabc\n")
+	assert.EqualError(t, s.run("user", "add", "-segments", "AVITO_DISCOUNT_30", "-csv", badIds),
+		badIds+`:2: invalid user id "abc"`)
+
+	for _, args := range [][]string{
+		{"user", "add", "-id", "5"},
+		{"user", "add", "-segments", "AVITO_DISCOUNT_30"},
+		{"user", "add", "-segments", "AVITO_DISCOUNT_30", "-id", "5", "-csv", path},
+		{"user", "add", "-segments", "AVITO_DISCOUNT_30", "-id", "5", "-ttl", "P1D", "-ttl-days", "1"},
+		{"user", "remove", "-segments", "AVITO_DISCOUNT_30", "-id", "5", "-ttl", "P1D"},
+	} {
+		assert.ErrorIs(t, s.run(args...), commands.ErrUsage, args)
+	}
+}
+
+func TestSegctlJobs(t *testing.T) {
+	ctx := context.Background()
+	s := newSegctl(t)
+
+	s.users.EXPECT().DeleteExpired(ctx, s.history).Return(4, nil)
+	require.NoError(t, s.run("ttl-cleanup"))
+	assert.Equal(t, "deleted 4 expired memberships\n", s.out.String())
+
+	s.out.Reset()
+	s.cache.EXPECT().RefreshCache(ctx, s.users).Return(10, nil)
+	require.NoError(t, s.run("cache", "rebuild"))
+	assert.Equal(t, "cached segments of 10 users\n", s.out.String())
+}
+
+func TestSegctlReport(t *testing.T) {
+	ctx := context.Background()
+	s := newSegctl(t)
+
+	date := time.Date(2023, 8, 1, 10, 0, 0, 0, time.UTC)
+	story := []history.HistoryDto{
+		{UserId: 1, SegmentSlug: "AVITO_DISCOUNT_30", Operation: "add", Date: "2023-08-01 10:30:00"},
+	}
+	s.history.EXPECT().GetFromDate(ctx, date).Return(story, nil).Times(2)
+
+	require.NoError(t, s.run("report", "-date", "2023-08-01 10:00"))
+	assert.Contains(t, s.out.String(), "1,AVITO_DISCOUNT_30,add,2023-08-01 10:30:00")
+
+	path := t.TempDir() + "/report.csv"
+	s.out.Reset()
+	require.NoError(t, s.run("report", "-date", "2023-08-01 10:00", "-o", path))
+	assert.Equal(t, "written 1 records to "+path+"\n", s.out.String())
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "1,AVITO_DISCOUNT_30,add,2023-08-01 10:30:00")
+
+	assert.ErrorIs(t, s.run("report", "-date", "yesterday"), commands.ErrUsage)
+}
@@ -0,0 +1,183 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"main/cmd/web/handlers"
+	"main/internal/e"
+	"main/internal/outbox"
+	"main/internal/segment"
+	segmentRepoMock "main/internal/segment/mocks"
+	"main/internal/user"
+	userRepoMock "main/internal/user/mocks"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHub(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	// The entries added before the hub has started are not passed
+	sink := outbox.NewRedisStreamSink(rdb, "segment_events", 0)
+	old := outboxEvents[0]
+	old.Seq = 100
+	require.NoError(t, sink.Publish(ctx, []outbox.Event{old}))
+
+	hub := outbox.NewHub(rdb, "segment_events")
+	events, unsubscribe := hub.Subscribe(5)
+	defer unsubscribe()
+	go hub.Run(ctx)
+
+	// The hub reads only the entries added after it has started, so they are published until one arrives
+	var ev outbox.Event
+	require.Eventually(t, func() bool {
+		require.NoError(t, sink.Publish(ctx, outboxEvents))
+		select {
+		case ev = <-events:
+			return true
+		default:
+			return false
+		}
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Equal(t, outboxEvents[0], ev)
+
+	// The events of other users are not passed, the closed hub closes the subscriptions
+	hub.Close()
+	for ev = range events {
+		assert.Equal(t, 5, ev.UserId)
+	}
+	_, ok := <-events
+	assert.False(t, ok)
+}
+
+func TestHubDropsSlowSubscriber(t *testing.T) {
+	hub := outbox.NewHub(nil, "segment_events")
+	events, unsubscribe := hub.Subscribe(5)
+
+	for i := 0; i < 100; i++ {
+		hub.Dispatch(outbox.Event{Seq: int64(i + 1), UserId: 5})
+	}
+	n := 0
+	for range events {
+		n++
+	}
+	assert.Less(t, n, 100)
+
+	// Unsubscribing after the drop is safe
+	unsubscribe()
+}
+
+// readEvent reads the lines of the next Server-Sent Event, skipping the comments.
+func readEvent(t *testing.T, r *bufio.Reader) []string {
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			if len(lines) > 0 {
+				return lines
+			}
+			continue
+		}
+		if !strings.HasPrefix(line, ":") {
+			lines = append(lines, line)
+		}
+	}
+}
+
+func TestUserSegmentsStream(t *testing.T) {
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+	userRepo := userRepoMock.NewMockRepository(ctl)
+	segmentRepo := segmentRepoMock.NewMockRepository(ctl)
+	hub := outbox.NewHub(nil, "segment_events")
+
+	srv := httptest.NewServer(handlers.UserSegmentsStream(userRepo, segmentRepo, hub))
+	defer srv.Close()
+
+	expired := time.Now().Add(-time.Hour)
+	userRepo.EXPECT().FindByUserId(gomock.Any(), 5).Return(&user.Segments{
+		UserId: 5,
+		Segments: []*segment.Segment{
+			{Id: 1, Slug: "AVITO_VOICE_MESSAGES"},
+			{Id: 2, Slug: "AVITO_PERFORMANCE_VAS", AliveUntil: &expired},
+		},
+	}, nil)
+
+	resp, err := http.Get(srv.URL + "?id=5")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	r := bufio.NewReader(resp.Body)
+	assert.Equal(t, []string{
+		"event: segments",
+		`data: {"user_id":5,"segments":[{"slug":"AVITO_VOICE_MESSAGES"}]}`,
+	}, readEvent(t, r))
+
+	segmentRepo.EXPECT().FindStatus(gomock.Any(), "AVITO_DISCOUNT_30").Return(segment.StatusActive, nil)
+	hub.Dispatch(outbox.Event{Seq: 1, UserId: 6, Slug: "AVITO_DISCOUNT_30", Type: outbox.Entered})
+	hub.Dispatch(outboxEvents[0])
+	assert.Equal(t, []string{
+		"id: 1",
+		"event: change",
+		`data: {"seq":1,"user_id":5,"segment":"AVITO_DISCOUNT_30","type":"entered","reason":"request","alive_until":"2023-08-08T10:00:00Z","occurred_at":"2023-08-01T10:00:00Z"}`,
+	}, readEvent(t, r))
+
+	// The memberships of the segments which are not active are hidden until the status changes,
+	// the events of the deleted segments are passed
+	segmentRepo.EXPECT().FindStatus(gomock.Any(), "AVITO_DISCOUNT_50").Return(segment.StatusPaused, nil)
+	segmentRepo.EXPECT().FindStatus(gomock.Any(), "AVITO_DISCOUNT_70").Return("", &e.SegmentsNotFoundError{Slugs: []string{"AVITO_DISCOUNT_70"}})
+	hub.Dispatch(outbox.Event{Seq: 3, UserId: 5, Slug: "AVITO_DISCOUNT_50", Type: outbox.Entered, Reason: outbox.ReasonRequest})
+	hub.Dispatch(outbox.Event{Seq: 4, UserId: 5, Slug: "AVITO_DISCOUNT_50", Type: outbox.Entered, Reason: outbox.ReasonStatus})
+	hub.Dispatch(outbox.Event{Seq: 5, UserId: 5, Slug: "AVITO_DISCOUNT_70", Type: outbox.Left, Reason: outbox.ReasonSegmentDeleted})
+	assert.Equal(t, "id: 4", readEvent(t, r)[0])
+	assert.Equal(t, "id: 5", readEvent(t, r)[0])
+
+	// The stream ends on shutdown
+	hub.Close()
+	_, err = io.ReadAll(r)
+	assert.NoError(t, err)
+}
+
+func TestUserSegmentsStreamUnknownUser(t *testing.T) {
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+	userRepo := userRepoMock.NewMockRepository(ctl)
+	hub := outbox.NewHub(nil, "segment_events")
+
+	srv := httptest.NewServer(handlers.UserSegmentsStream(userRepo, segmentRepoMock.NewMockRepository(ctl), hub))
+	defer srv.Close()
+
+	userRepo.EXPECT().FindByUserId(gomock.Any(), 7).Return(nil, &e.UserNotFoundError{UserId: 7})
+	resp, err := http.Get(srv.URL + "?id=7")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, []string{
+		"event: segments",
+		`data: {"user_id":7,"segments":[]}`,
+	}, readEvent(t, bufio.NewReader(resp.Body)))
+	hub.Close()
+
+	for _, query := range []string{"", "?id=abc", "?id=0", "?id=1&id=2"} {
+		resp, err = http.Get(srv.URL + query)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, query)
+	}
+}
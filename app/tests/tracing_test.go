@@ -0,0 +1,65 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/mock/gomock"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"main/cmd/web/handlers"
+	redisRepoMock "main/internal/cache/mocks"
+	historyRepoMock "main/internal/history/mocks"
+	"main/internal/segment"
+	"main/internal/tracing"
+	"main/internal/user"
+	userRepoMock "main/internal/user/mocks"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestContextPropagation(t *testing.T) {
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	userRepo := userRepoMock.NewMockRepository(ctl)
+	historyRepo := historyRepoMock.NewMockRepository(ctl)
+	cacheRepo := redisRepoMock.NewMockRepository(ctl)
+
+	r := mux.NewRouter()
+	r.Use(otelmux.Middleware(tracing.ServiceName, otelmux.WithTracerProvider(tp)))
+	r.HandleFunc("/segment/user", handlers.Users(userRepo, cacheRepo, historyRepo)).Methods("GET")
+
+	userId := 1
+	var cacheSpan, dbSpan trace.SpanContext
+	cacheRepo.EXPECT().Get(gomock.Any(), fmt.Sprintf("avito_user_%d", userId), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, key string, result interface{}) error {
+			cacheSpan = trace.SpanContextFromContext(ctx)
+			return fmt.Errorf("redis: nil")
+		})
+	userRepo.EXPECT().FindByUserId(gomock.Any(), userId).
+		DoAndReturn(func(ctx context.Context, userId int) (*user.Segments, error) {
+			dbSpan = trace.SpanContextFromContext(ctx)
+			return &user.Segments{UserId: userId, Segments: []*segment.Segment{{Id: 1, Slug: "AVITO_VOICE_MESSAGES"}}}, nil
+		})
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/segment/user?id=%d", userId), nil)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	// Test the repositories get the context of the request span
+	spans := recorder.Ended()
+	require.Len(t, spans, 1)
+	assert.Equal(t, "/segment/user", spans[0].Name())
+	assert.Equal(t, spans[0].SpanContext(), cacheSpan)
+	assert.Equal(t, spans[0].SpanContext(), dbSpan)
+}
@@ -0,0 +1,65 @@
+package tests
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"main/pkg/utils"
+	"testing"
+	"time"
+)
+
+func TestParseISODuration(t *testing.T) {
+	start := time.Date(2023, 1, 31, 10, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name     string
+		value    string
+		expected time.Time
+	}{
+		{
+			name:     "hours",
+			value:    "PT36H",
+			expected: start.Add(36 * time.Hour),
+		},
+		{
+			name:     "minutes_and_seconds",
+			value:    "PT1M30.5S",
+			expected: start.Add(90*time.Second + 500*time.Millisecond),
+		},
+		{
+			name:     "days",
+			value:    "P3D",
+			expected: time.Date(2023, 2, 3, 10, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "weeks",
+			value:    "P2W",
+			expected: time.Date(2023, 2, 14, 10, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "full",
+			value:    "P1Y1M1DT1H1M1S",
+			expected: time.Date(2024, 3, 3, 11, 1, 1, 0, time.UTC),
+		},
+	}
+
+	for _, tc := range testCases {
+		d, err := utils.ParseISODuration(tc.value)
+		require.NoError(t, err, tc.name)
+		assert.Equal(t, tc.expected, d.AddTo(start), tc.name)
+	}
+
+	for _, value := range []string{"", "P", "PT", "5D", "P5", "PT5D", "P1H", "P-1D", "P1DT", "PT1H1H1"} {
+		_, err := utils.ParseISODuration(value)
+		assert.Error(t, err, value)
+	}
+
+	// The parts which do not fit are rejected instead of wrapping around
+	for _, value := range []string{"PT9999999H", "PT2562047H60M", "PT9999999999S", "P9223372036854775807W", "P9223372036854775807D1W"} {
+		_, err := utils.ParseISODuration(value)
+		assert.Error(t, err, value)
+	}
+	d, err := utils.ParseISODuration("PT2562047H")
+	require.NoError(t, err)
+	assert.Equal(t, 2562047*time.Hour, d.Clock)
+}
@@ -0,0 +1,331 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/golang/mock/gomock"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"main/cmd/web/handlers"
+	"main/internal/e"
+	"main/internal/outbox"
+	"main/internal/webhook"
+	webhookRepoMock "main/internal/webhook/mocks"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookEventName(t *testing.T) {
+	for _, tc := range []struct {
+		ev   outbox.Event
+		want string
+	}{
+		{outbox.Event{Type: outbox.SegmentCreated, Reason: outbox.ReasonRequest}, webhook.SegmentCreated},
+		{outbox.Event{Type: outbox.SegmentDeleted, Reason: outbox.ReasonRequest}, webhook.SegmentDeleted},
+		{outbox.Event{UserId: 5, Type: outbox.Entered, Reason: outbox.ReasonRequest}, webhook.UserAdded},
+		{outbox.Event{UserId: 5, Type: outbox.Left, Reason: outbox.ReasonRequest}, webhook.UserRemoved},
+		{outbox.Event{UserId: 5, Type: outbox.Left, Reason: outbox.ReasonSegmentDeleted}, webhook.UserRemoved},
+		{outbox.Event{UserId: 5, Type: outbox.Left, Reason: outbox.ReasonTtl}, webhook.UserExpired},
+	} {
+		assert.Equal(t, tc.want, webhook.EventName(tc.ev))
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	b := webhook.Backoff{MaxAttempts: 10, Min: 10 * time.Second, Max: time.Minute}
+	assert.Equal(t, 10*time.Second, b.Delay(1))
+	assert.Equal(t, 20*time.Second, b.Delay(2))
+	assert.Equal(t, 40*time.Second, b.Delay(3))
+	assert.Equal(t, time.Minute, b.Delay(4))
+	assert.Equal(t, time.Minute, b.Delay(50))
+}
+
+func TestSinks(t *testing.T) {
+	ctx := context.Background()
+	first, second := &fakeKafka{}, &fakeKafka{}
+	sinks := outbox.Sinks{outbox.NewKafkaSink(first, "a"), outbox.NewKafkaSink(second, "b")}
+
+	require.NoError(t, sinks.Publish(ctx, outboxEvents))
+	assert.Len(t, first.messages, 2)
+	assert.Len(t, second.messages, 2)
+
+	// The failure of a sink fails the whole batch
+	first.err = errors.New("leader not available")
+	assert.ErrorIs(t, sinks.Publish(ctx, outboxEvents), first.err)
+	assert.Len(t, second.messages, 2)
+}
+
+// webhookReceiver is a webhook endpoint which responds with the given status codes in turn.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (rcv *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+
+	body, _ := io.ReadAll(r.Body)
+	rcv.requests = append(rcv.requests, r)
+	rcv.bodies = append(rcv.bodies, body)
+	status := http.StatusOK
+	if len(rcv.statuses) > 0 {
+		status, rcv.statuses = rcv.statuses[0], rcv.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func TestWebhookDispatcher(t *testing.T) {
+	ctx := context.Background()
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+	repo := webhookRepoMock.NewMockRepository(ctl)
+
+	rcv := &webhookReceiver{statuses: []int{http.StatusOK, http.StatusServiceUnavailable, http.StatusInternalServerError}}
+	srv := httptest.NewServer(rcv)
+	defer srv.Close()
+
+	payload := []byte(`{"seq":1,"event":"user.added","segment":"AVITO_DISCOUNT_30","user_id":5}`)
+	delivery := func(id int64, attempts int) *webhook.Delivery {
+		return &webhook.Delivery{
+			Id:        id,
+			WebhookId: 1,
+			EventSeq:  id,
+			Event:     webhook.UserAdded,
+			Payload:   payload,
+			Status:    webhook.StatusPending,
+			Attempts:  attempts,
+			Url:       srv.URL,
+			Secret:    "s3cr3t",
+		}
+	}
+	backoff := webhook.Backoff{MaxAttempts: 3, Min: 10 * time.Second, Max: time.Minute}
+	dispatcher := webhook.NewDispatcher(repo, &http.Client{Timeout: time.Second}, backoff, 10)
+
+	// The deliveries are sent one at a time to get the responses in order
+	recorded := make(map[int64]*webhook.Delivery)
+	repo.EXPECT().Record(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, d *webhook.Delivery) error {
+		recorded[d.Id] = d
+		return nil
+	}).Times(3)
+	for _, d := range []*webhook.Delivery{delivery(1, 0), delivery(2, 0), delivery(3, 2)} {
+		repo.EXPECT().Claim(gomock.Any(), 10, time.Minute+time.Second).Return([]*webhook.Delivery{d}, nil)
+		n, err := dispatcher.DispatchOnce(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+	}
+
+	// The request is signed with the secret of the webhook
+	req := rcv.requests[0]
+	assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+	assert.Equal(t, "1", req.Header.Get(webhook.HeaderDelivery))
+	assert.Equal(t, webhook.UserAdded, req.Header.Get(webhook.HeaderEvent))
+	timestamp, err := strconv.ParseInt(req.Header.Get(webhook.HeaderTimestamp), 10, 64)
+	require.NoError(t, err)
+	assert.Equal(t, webhook.Sign("s3cr3t", timestamp, payload), req.Header.Get(webhook.HeaderSignature))
+	assert.Equal(t, payload, rcv.bodies[0])
+
+	ok := recorded[1]
+	assert.Equal(t, webhook.StatusDelivered, ok.Status)
+	assert.Equal(t, 1, ok.Attempts)
+	assert.Equal(t, http.StatusOK, *ok.LastStatusCode)
+	assert.NotNil(t, ok.FinishedAt)
+
+	retry := recorded[2]
+	assert.Equal(t, webhook.StatusPending, retry.Status)
+	assert.Equal(t, 1, retry.Attempts)
+	assert.Equal(t, http.StatusServiceUnavailable, *retry.LastStatusCode)
+	assert.Equal(t, "unexpected status 503", *retry.LastError)
+	assert.WithinDuration(t, time.Now().Add(10*time.Second), retry.NextAttemptAt, time.Second)
+	assert.Nil(t, retry.FinishedAt)
+
+	dead := recorded[3]
+	assert.Equal(t, webhook.StatusDead, dead.Status)
+	assert.Equal(t, 3, dead.Attempts)
+	assert.NotNil(t, dead.FinishedAt)
+}
+
+func TestWebhookDispatcherUnreachable(t *testing.T) {
+	ctx := context.Background()
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+	repo := webhookRepoMock.NewMockRepository(ctl)
+
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := srv.URL
+	srv.Close()
+
+	dispatcher := webhook.NewDispatcher(repo, &http.Client{Timeout: time.Second}, webhook.Backoff{MaxAttempts: 3, Min: time.Second, Max: time.Second}, 10)
+	repo.EXPECT().Claim(gomock.Any(), 10, gomock.Any()).Return([]*webhook.Delivery{
+		{Id: 1, Event: webhook.SegmentCreated, Status: webhook.StatusPending, Url: url, Secret: "s"},
+	}, nil)
+	repo.EXPECT().Record(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, d *webhook.Delivery) error {
+		assert.Equal(t, webhook.StatusPending, d.Status)
+		assert.Nil(t, d.LastStatusCode)
+		assert.NotNil(t, d.LastError)
+		return nil
+	})
+	_, err := dispatcher.DispatchOnce(ctx)
+	require.NoError(t, err)
+
+	repo.EXPECT().Claim(gomock.Any(), 10, gomock.Any()).Return(nil, errors.New("db is down"))
+	_, err = dispatcher.DispatchOnce(ctx)
+	assert.Error(t, err)
+}
+
+func TestWebhookSink(t *testing.T) {
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+	repo := webhookRepoMock.NewMockRepository(ctl)
+
+	repo.EXPECT().Enqueue(gomock.Any(), outboxEvents).Return(1, nil)
+	assert.NoError(t, webhook.NewSink(repo).Publish(context.Background(), outboxEvents))
+}
+
+const testAdminToken = "0123456789abcdef"
+
+func newWebhookRouter(repo webhook.Repository) *mux.Router {
+	r := mux.NewRouter()
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(handlers.AdminToken(testAdminToken))
+	admin.HandleFunc("/webhooks", handlers.Webhooks(repo)).Methods("POST", "GET")
+	admin.HandleFunc("/webhooks/{id:[0-9]+}", handlers.DeleteWebhook(repo)).Methods("DELETE")
+	admin.HandleFunc("/webhooks/{id:[0-9]+}/deliveries", handlers.WebhookDeliveries(repo)).Methods("GET")
+	admin.HandleFunc("/webhooks/dead_letters", handlers.DeadLetters(repo)).Methods("GET")
+	admin.HandleFunc("/webhooks/dead_letters/{id:[0-9]+}/retry", handlers.RetryDeadLetter(repo)).Methods("POST")
+	return r
+}
+
+// newAdminRequest is httptest.NewRequest carrying the admin token.
+func newAdminRequest(method, target string, body io.Reader) *http.Request {
+	req := httptest.NewRequest(method, target, body)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	return req
+}
+
+func TestCreateWebhook(t *testing.T) {
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+	repo := webhookRepoMock.NewMockRepository(ctl)
+	router := newWebhookRouter(repo)
+
+	for _, body := range []string{
+		`{"url": "ftp://example.com", "secret": "s"}`,
+		`{"url": "https://example.com/hook"}`,
+		`{"url": "https://example.com/hook", "secret": "s", "events": ["user.moved"]}`,
+		`{"url": "https://example.com/hook", "secret": "s", "segments": [""]}`,
+		`not json`,
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, newAdminRequest("POST", "/admin/webhooks", bytes.NewBufferString(body)))
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+
+	createdAt := time.Date(2023, 8, 1, 10, 0, 0, 0, time.UTC)
+	repo.EXPECT().Create(gomock.Any(), &webhook.Webhook{
+		Url:      "https://example.com/hook",
+		Secret:   "s3cr3t",
+		Segments: []string{"AVITO_DISCOUNT_30"},
+		Events:   []string{},
+	}).DoAndReturn(func(_ context.Context, wh *webhook.Webhook) error {
+		wh.Id, wh.CreatedAt = 1, createdAt
+		return nil
+	})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newAdminRequest("POST", "/admin/webhooks", bytes.NewBufferString(
+		`{"url": "https://example.com/hook", "secret": "s3cr3t", "segments": ["AVITO_DISCOUNT_30"]}`,
+	)))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	// The headers are sent together with the status
+	assert.Equal(t, "application/json", w.Result().Header.Get("Content-Type"))
+	assert.JSONEq(t, `{
+		"id": 1,
+		"url": "https://example.com/hook",
+		"segments": ["AVITO_DISCOUNT_30"],
+		"events": [],
+		"created_at": "2023-08-01T10:00:00Z"
+	}`, w.Body.String())
+}
+
+func TestWebhookAdminEndpoints(t *testing.T) {
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+	repo := webhookRepoMock.NewMockRepository(ctl)
+	router := newWebhookRouter(repo)
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, newAdminRequest(method, target, nil))
+		return w
+	}
+
+	// The webhooks are available only with the admin token
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/webhooks", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	repo.EXPECT().FindAll(gomock.Any()).Return([]*webhook.Webhook{
+		{Id: 1, Url: "https://example.com/hook", Secret: "s3cr3t", Segments: []string{}, Events: []string{webhook.UserExpired}},
+	}, nil)
+	w = serve("GET", "/admin/webhooks")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "s3cr3t")
+
+	repo.EXPECT().Delete(gomock.Any(), 1).Return(nil)
+	assert.Equal(t, http.StatusNoContent, serve("DELETE", "/admin/webhooks/1").Code)
+	repo.EXPECT().Delete(gomock.Any(), 2).Return(&e.WebhookNotFoundError{Id: 2})
+	assert.Equal(t, http.StatusNotFound, serve("DELETE", "/admin/webhooks/2").Code)
+
+	code := 503
+	msg := "unexpected status 503"
+	next := time.Date(2023, 8, 1, 10, 0, 10, 0, time.UTC)
+	repo.EXPECT().FindDeliveries(gomock.Any(), 1, webhook.StatusPending, 20).Return([]*webhook.Delivery{{
+		Id:             7,
+		WebhookId:      1,
+		EventSeq:       3,
+		Event:          webhook.UserAdded,
+		Payload:        []byte(`{"seq":3}`),
+		Status:         webhook.StatusPending,
+		Attempts:       1,
+		NextAttemptAt:  next,
+		LastStatusCode: &code,
+		LastError:      &msg,
+		CreatedAt:      next.Add(-10 * time.Second),
+	}}, nil)
+	w = serve("GET", "/admin/webhooks/1/deliveries?status=pending&limit=20")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"deliveries": [{
+		"delivery_id": 7,
+		"webhook_id": 1,
+		"event": "user.added",
+		"payload": {"seq": 3},
+		"status": "pending",
+		"attempts": 1,
+		"next_attempt_at": "2023-08-01T10:00:10Z",
+		"last_status_code": 503,
+		"last_error": "unexpected status 503",
+		"created_at": "2023-08-01T10:00:00Z",
+		"finished_at": null
+	}]}`, w.Body.String())
+	assert.Equal(t, http.StatusBadRequest, serve("GET", "/admin/webhooks/1/deliveries?status=lost").Code)
+	repo.EXPECT().FindDeliveries(gomock.Any(), 2, "", handlers.DefaultDeliveriesLimit).Return(nil, &e.WebhookNotFoundError{Id: 2})
+	assert.Equal(t, http.StatusNotFound, serve("GET", "/admin/webhooks/2/deliveries").Code)
+
+	repo.EXPECT().FindDeadLetters(gomock.Any(), handlers.DefaultDeliveriesLimit).Return([]*webhook.DeadLetter{}, nil)
+	w = serve("GET", "/admin/webhooks/dead_letters")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"dead_letters": []}`, w.Body.String())
+
+	repo.EXPECT().RetryDeadLetter(gomock.Any(), int64(7)).Return(nil)
+	assert.Equal(t, http.StatusNoContent, serve("POST", "/admin/webhooks/dead_letters/7/retry").Code)
+	repo.EXPECT().RetryDeadLetter(gomock.Any(), int64(8)).Return(&e.DeadLetterNotFoundError{DeliveryId: 8})
+	assert.Equal(t, http.StatusNotFound, serve("POST", "/admin/webhooks/dead_letters/8/retry").Code)
+}